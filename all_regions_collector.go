@@ -0,0 +1,224 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// RegionAll is the region expanding a collector to all regions enabled for the
+// account.
+const RegionAll = "all"
+
+// AllRegionsCollector runs a sub-collector per region enabled for the account.
+// Regions are discovered once when the collector starts.
+type AllRegionsCollector struct {
+	config CollectorConfig
+	// base is the collector for the default region. It is used to discover
+	// regions, record telemetry, and validate the configuration.
+	base *BaseCollector
+}
+
+func NewAllRegionsCollector(c CollectorConfig) (MetricCollector, error) {
+	tmpl := c
+	tmpl.Region = ""
+	if _, err := CollectorFromConfig(tmpl); err != nil {
+		return nil, err
+	}
+
+	return &AllRegionsCollector{
+		config: c,
+		base:   &BaseCollector{config: tmpl},
+	}, nil
+}
+
+// Valid validates the configuration of the sub-collectors.
+func (a *AllRegionsCollector) Valid() bool {
+	c, err := CollectorFromConfig(a.base.config)
+	if err != nil {
+		_ = a.base.HandleError(err)
+		return false
+	}
+
+	return c.Valid()
+}
+
+// regions returns the names of all regions enabled for the account in order.
+func (a *AllRegionsCollector) regions(ctx context.Context) ([]string, error) {
+	client, err := a.base.client()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.DescribeRegions(ctx, &ec2.DescribeRegionsInput{}, a.base.Telemetry())
+	if err != nil {
+		return nil, err
+	}
+
+	regions := []string{}
+	for _, r := range *res {
+		regions = append(regions, aws.StringValue(r.RegionName))
+	}
+	sort.Strings(regions)
+
+	return regions, nil
+}
+
+// expand creates a collector for every region enabled for the account.
+func (a *AllRegionsCollector) expand(ctx context.Context) ([]MetricCollector, error) {
+	regions, err := a.regions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	collectors := []MetricCollector{}
+	for _, r := range regions {
+		c := a.config
+		c.Region = r
+		collector, err := CollectorFromConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		collectors = append(collectors, collector)
+	}
+
+	return collectors, nil
+}
+
+// Run discovers the enabled regions, retrying every interval until successful,
+// and starts the sub-collectors. The store of the returned CollectorProc
+// combines the stores of all sub-collectors. Stopping the collector stops all
+// sub-collectors.
+func (a *AllRegionsCollector) Run() *CollectorProc {
+	store := &multiStore{}
+	proc := newCollectorProc(a.base.ID(), store)
+	proc.Name, proc.Expose = a.config.Name, a.config.Expose
+	proc.Registry = exposition != nil
+	proc.Overrides = &Overrides{}
+
+	// The collector is ready once the regions were discovered and all
+	// sub-collectors are ready.
+	var mu sync.Mutex
+	var procs []*CollectorProc
+	proc.ready = func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if procs == nil {
+			return false
+		}
+		for _, p := range procs {
+			if !p.Ready() {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	// ctx is cancelled as soon as the collector is signaled to stop, see
+	// BaseCollector.run.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-proc.Stop
+		cancel()
+	}()
+
+	go func() {
+		defer close(proc.exited)
+
+		// procs is only written by this goroutine, reading it needs no
+		// lock.
+		defer func() {
+			for _, p := range procs {
+				_ = a.base.HandleError(p.Close())
+			}
+		}()
+
+		for {
+			collectors, err := a.expand(ctx)
+			if err == nil {
+				started := []*CollectorProc{}
+				for _, c := range collectors {
+					p := c.Run()
+					started = append(started, p)
+					store.add(p.Store)
+					if p.Overrides != nil {
+						proc.Overrides.link(p.Overrides)
+					}
+				}
+				mu.Lock()
+				procs = started
+				mu.Unlock()
+				a.base.logger().Infow("started collectors for all regions", "id", a.base.ID(), "name", a.config.Name, "collectors", len(started))
+				break
+			}
+
+			_ = a.base.HandleError(err)
+			select {
+			case <-time.After(time.Duration(a.config.Interval) * time.Second):
+			case <-ctx.Done():
+				proc.Done <- a
+				return
+			}
+		}
+
+		<-ctx.Done()
+		proc.Done <- a
+	}()
+
+	return proc
+}
+
+// multiStore is a read only Store combining the content of multiple stores.
+type multiStore struct {
+	sync.Mutex
+
+	stores []Store
+}
+
+func (s *multiStore) add(store Store) {
+	s.Lock()
+	defer s.Unlock()
+	s.stores = append(s.stores, store)
+}
+
+// Add is a no-op, the combined stores are written by their collectors.
+func (s *multiStore) Add(str string) {}
+
+// Commit is a no-op, the combined stores are committed by their collectors.
+func (s *multiStore) Commit() {}
+
+// String returns the content of all combined stores. Families are declared by
+// the first store only.
+func (s *multiStore) String() string {
+	s.Lock()
+	defer s.Unlock()
+
+	b := strings.Builder{}
+	declared := map[string]struct{}{}
+	for _, store := range s.stores {
+		writeDeclared(&b, store.String(), declared)
+	}
+
+	return b.String()
+}
+
+// Generation returns the sum of the generations of the combined stores plus
+// their number, so it changes with every commit and every store added.
+func (s *multiStore) Generation() uint64 {
+	s.Lock()
+	defer s.Unlock()
+
+	g := uint64(len(s.stores))
+	for _, store := range s.stores {
+		g += store.Generation()
+	}
+
+	return g
+}
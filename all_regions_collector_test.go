@@ -0,0 +1,122 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+// collectorRegion returns the region a collector is configured for.
+func collectorRegion(c MetricCollector) string {
+	switch c := c.(type) {
+	case *BaseCollector:
+		return c.config.Region
+	case *ASGCollector:
+		return c.base.config.Region
+	case *ECHostCollector:
+		return c.base.config.Region
+	case *MSKBrokerCollector:
+		return c.base.config.Region
+	}
+
+	return ""
+}
+
+func TestAllRegionsExpand(t *testing.T) {
+	regions := []*ec2.Region{
+		{RegionName: aws.String("us-east-1")},
+		{RegionName: aws.String("eu-central-1")},
+	}
+
+	cases := []struct {
+		typ     string
+		client  *FakeClient
+		regions []string
+		err     bool
+		message string
+	}{
+		{"ebs", &FakeClient{Regions: regions}, []string{"eu-central-1", "us-east-1"}, false,
+			"Collector should expand to all discovered regions"},
+		{"asg", &FakeClient{Regions: regions}, []string{"eu-central-1", "us-east-1"}, false,
+			"ASG collector should expand to all discovered regions"},
+		{"ebs", &FakeClient{}, []string{}, false,
+			"No discovered regions should expand to no collectors"},
+		{"ebs", withError(MethodDescribeRegions, &FakeClient{Regions: regions}), nil, true,
+			"Failing region discovery should return an error"},
+	}
+
+	for _, c := range cases {
+		collector, err := CollectorFromConfig(CollectorConfig{
+			Type:        c.typ,
+			Region:      "All",
+			Offset:      300,
+			Interval:    300,
+			Period:      300,
+			MetricStats: []MetricStat{{MetricName: "VolumeReadOps", Stat: "Sum"}},
+		})
+		assert.Nil(t, err, c.message)
+		a, ok := collector.(*AllRegionsCollector)
+		assert.True(t, ok, c.message)
+		assert.True(t, a.Valid(), c.message)
+		a.base._client = c.client
+
+		collectors, err := a.expand(context.Background())
+		assert.Equal(t, c.err, err != nil, c.message)
+		if c.err {
+			continue
+		}
+
+		got := []string{}
+		for _, sub := range collectors {
+			got = append(got, collectorRegion(sub))
+			assert.True(t, sub.Valid(), c.message)
+		}
+		assert.Equal(t, c.regions, got, c.message)
+		assert.Equal(t, MethodDescribeRegions, c.client.Calls()[0].Method, c.message)
+	}
+}
+
+func TestAllRegionsValid(t *testing.T) {
+	c, err := CollectorFromConfig(CollectorConfig{Type: "ebs", Region: RegionAll, Offset: 1, Interval: 2})
+	assert.Nil(t, err)
+	assert.False(t, c.Valid(), "Invalid sub-collector configuration should be invalid")
+
+	_, err = CollectorFromConfig(CollectorConfig{Type: "unknown", Region: RegionAll})
+	assert.ErrorIs(t, err, ErrNoSuchCollectorType, "Unknown collector types should be rejected")
+}
+
+func TestAllRegionsRunClose(t *testing.T) {
+	c, err := CollectorFromConfig(CollectorConfig{Type: "ebs", Region: RegionAll, Offset: 1, Interval: 1})
+	assert.Nil(t, err)
+	a := c.(*AllRegionsCollector)
+	client := withError(MethodDescribeRegions, &FakeClient{})
+	a.base._client = client
+
+	proc := a.Run()
+	assert.Eventually(t, func() bool { return len(client.Calls()) > 0 }, time.Second, time.Millisecond)
+	assert.Nil(t, proc.Close(), "Collector retrying region discovery should stop")
+	assert.Equal(t, "", proc.Store.String())
+}
+
+func TestMultiStore(t *testing.T) {
+	first, second := NewStore(0), NewStore(0)
+	s := &multiStore{}
+	assert.Equal(t, uint64(0), s.Generation())
+
+	s.add(first)
+	s.add(second)
+	generation := s.Generation()
+
+	first.Add("first\n")
+	first.Commit()
+	second.Add("second\n")
+	second.Commit()
+
+	assert.Equal(t, "first\nsecond\n", s.String(), "Content of all stores should be combined")
+	assert.Greater(t, s.Generation(), generation, "Generation should change with commits of any store")
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+)
+
+// DefaultARNCacheSize is the number of parsed ARNs kept in memory. It bounds
+// the memory used by the cache while covering the resources of most fleets.
+const DefaultARNCacheSize = 50000
+
+// arns caches the ARNs parsed by collectors. The same ARNs are parsed for
+// dimensions and labels on every run.
+var arns = newARNCache(DefaultARNCacheSize)
+
+// arnCache is a least recently used cache of parsed ARNs keyed by the ARN
+// string.
+type arnCache struct {
+	sync.Mutex
+
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+	// hits and misses are counted for tests.
+	hits   uint64
+	misses uint64
+}
+
+type arnCacheEntry struct {
+	key string
+	arn arn.ARN
+}
+
+func newARNCache(size int) *arnCache {
+	return &arnCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// parse returns the parsed ARN s, from the cache if possible. ARNs that fail
+// to parse are not cached.
+func (c *arnCache) parse(s string) (arn.ARN, error) {
+	c.Lock()
+	if e, ok := c.entries[s]; ok {
+		c.order.MoveToFront(e)
+		c.hits++
+		c.Unlock()
+		return e.Value.(*arnCacheEntry).arn, nil
+	}
+	c.misses++
+	c.Unlock()
+
+	a, err := arn.Parse(s)
+	if err != nil {
+		return a, err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.entries[s]; !ok {
+		c.entries[s] = c.order.PushFront(&arnCacheEntry{key: s, arn: a})
+		for c.order.Len() > c.size {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*arnCacheEntry).key)
+		}
+	}
+
+	return a, nil
+}
+
+// parseARN parses s using the shared ARN cache.
+func parseARN(s string) (arn.ARN, error) {
+	return arns.parse(s)
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/stretchr/testify/assert"
+)
+
+const testARN = "arn:aws:ec2:us-east-1:123456789012:volume/vol-0123456789abcdef0"
+
+func TestARNCache(t *testing.T) {
+	c := newARNCache(2)
+
+	expected, err := arn.Parse(testARN)
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		a, err := c.parse(testARN)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, a, "Cached ARNs should match parsed ARNs")
+	}
+	assert.Equal(t, uint64(1), c.misses, "Only the first parse should miss the cache")
+	assert.Equal(t, uint64(2), c.hits, "Repeated parses should hit the cache")
+
+	_, err = c.parse("invalid")
+	assert.NotNil(t, err, "Invalid ARNs should return an error")
+	assert.NotContains(t, c.entries, "invalid", "Invalid ARNs should not be cached")
+
+	_, _ = c.parse(testARN + "1")
+	_, _ = c.parse(testARN)
+	_, _ = c.parse(testARN + "2")
+	assert.Equal(t, 2, c.order.Len(), "The cache should be bounded")
+	assert.Contains(t, c.entries, testARN, "Recently used ARNs should be kept")
+	assert.NotContains(t, c.entries, testARN+"1", "Least recently used ARNs should be evicted")
+}
+
+func BenchmarkParseARN(b *testing.B) {
+	resources := make([]string, 1000)
+	for i := range resources {
+		resources[i] = fmt.Sprintf("%s%d", testARN, i)
+	}
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = arn.Parse(resources[i%len(resources)])
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		c := newARNCache(len(resources))
+		for i := 0; i < b.N; i++ {
+			_, _ = c.parse(resources[i%len(resources)])
+		}
+	})
+}
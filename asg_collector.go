@@ -2,8 +2,8 @@
 package main
 
 import (
+	"context"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
@@ -29,12 +29,12 @@ func (a *ASGCollector) Valid() bool {
 	return a.base.Valid()
 }
 
-func (a *ASGCollector) getGroups() (*ResourceIndex, error) {
-	client, err := DefaultAWSClient(a.base.config.Region)
+func (a *ASGCollector) getGroups(ctx context.Context) (*ResourceIndex, error) {
+	client, err := a.base.client()
 	if err != nil {
 		return nil, err
 	}
-	res, err := client.DescribeAutoScalingGroups(&autoscaling.DescribeAutoScalingGroupsInput{}, a.base.Telemetry())
+	res, err := client.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{}, a.base.Telemetry())
 	if err != nil {
 		return nil, err
 	}
@@ -51,10 +51,10 @@ func (a *ASGCollector) getGroups() (*ResourceIndex, error) {
 			ResourceARN: group.AutoScalingGroupARN,
 			Tags:        tags,
 		})
-		Logger.Debugf("ASG ARN: %s", aws.StringValue(group.AutoScalingGroupARN))
+		a.base.logger().Debugf("ASG ARN: %s", aws.StringValue(group.AutoScalingGroupARN))
 	}
 
-	return NewResourceIndexFromTagMapping(&mapping, id), nil
+	return NewResourceIndexFromTagMapping(&mapping, a.base.resourceID()), nil
 }
 
 func filter(groups *[]*autoscaling.Group, tf []TagFilter) *[]*autoscaling.Group {
@@ -79,8 +79,9 @@ outer:
 					continue outer
 				}
 
-				// Value does not match, go to next group
-				if v != filterTag.Value {
+				// Value matches none of the filter values, go to next
+				// group
+				if !filterTag.matches(v) {
 					continue outer
 				}
 			}
@@ -100,7 +101,7 @@ func (a *ASGCollector) Run() *CollectorProc {
 
 // asgMetricDimension sets the name of the autoscaling group as dimension for CloudWatch.
 func asgMetricDimension(resource *tagging.ResourceTagMapping) ([]*cloudwatch.Dimension, error) {
-	arn, err := arn.Parse(*resource.ResourceARN)
+	arn, err := parseARN(*resource.ResourceARN)
 	if err != nil {
 		return []*cloudwatch.Dimension{}, ErrCanNotParseARN
 	}
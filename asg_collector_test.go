@@ -2,6 +2,7 @@
 package main
 
 import (
+	"context"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -151,6 +152,34 @@ func TestFilter(t *testing.T) {
 			expected: []*autoscaling.Group{},
 			message:  "No match should return empty result",
 		},
+		{
+			groups: []*autoscaling.Group{
+				{Tags: []*autoscaling.TagDescription{{Key: aws.String("env"), Value: aws.String("prod")}}},
+				{Tags: []*autoscaling.TagDescription{{Key: aws.String("env"), Value: aws.String("staging")}}},
+				{Tags: []*autoscaling.TagDescription{{Key: aws.String("env"), Value: aws.String("dev")}}},
+			},
+			tagfilters: []TagFilter{
+				{Key: "env", Values: []string{"prod", "staging"}},
+			},
+			expected: []*autoscaling.Group{
+				{Tags: []*autoscaling.TagDescription{{Key: aws.String("env"), Value: aws.String("prod")}}},
+				{Tags: []*autoscaling.TagDescription{{Key: aws.String("env"), Value: aws.String("staging")}}},
+			},
+			message: "Groups matching any of the filter values should be returned",
+		},
+		{
+			groups: []*autoscaling.Group{
+				{Tags: []*autoscaling.TagDescription{{Key: aws.String("env"), Value: aws.String("prod")}}},
+				{Tags: []*autoscaling.TagDescription{{Key: aws.String("env"), Value: aws.String("dev")}}},
+			},
+			tagfilters: []TagFilter{
+				{Key: "env", Value: "dev", Values: []string{"staging"}},
+			},
+			expected: []*autoscaling.Group{
+				{Tags: []*autoscaling.TagDescription{{Key: aws.String("env"), Value: aws.String("dev")}}},
+			},
+			message: "Value should be matched along with the values",
+		},
 	}
 
 	for _, c := range cases {
@@ -158,3 +187,36 @@ func TestFilter(t *testing.T) {
 		assert.Equal(t, &c.expected, got, c.message)
 	}
 }
+
+func TestGetGroups(t *testing.T) {
+	client := &FakeClient{AutoScalingGroupPages: [][]*autoscaling.Group{
+		{
+			{
+				AutoScalingGroupARN: aws.String("arn:aws:autoscaling:us-east-1:000000000000:autoScalingGroup:aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee:autoScalingGroupName/first"),
+				Tags:                []*autoscaling.TagDescription{{Key: aws.String("team"), Value: aws.String("metrics")}},
+			},
+		},
+		{
+			{
+				AutoScalingGroupARN: aws.String("arn:aws:autoscaling:us-east-1:000000000000:autoScalingGroup:aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee:autoScalingGroupName/second"),
+				Tags:                []*autoscaling.TagDescription{{Key: aws.String("team"), Value: aws.String("other")}},
+			},
+		},
+	}}
+
+	c, _ := NewASGCollector(CollectorConfig{
+		Type:       "asg",
+		TagFilters: []TagFilter{{Key: "team", Value: "metrics"}},
+	})
+	a := c.(*ASGCollector)
+	a.base._client = client
+
+	index, err := a.getGroups(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(index.Resources), "Only groups matching the tag filters should be indexed")
+	for _, r := range index.Resources {
+		assert.Equal(t, "team", *r.Tags[0].Key)
+		assert.Equal(t, "metrics", *r.Tags[0].Value)
+	}
+	assert.Equal(t, MethodDescribeAutoScalingGroups, client.Calls()[0].Method)
+}
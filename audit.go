@@ -0,0 +1,278 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/configservice"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/kafka"
+	"github.com/aws/aws-sdk-go/service/rds"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// AuditLogStdout as audit log path writes the audit log to stdout.
+	AuditLogStdout = "stdout"
+	// DefaultAuditMaxSizeBytes is the size the audit log file is rotated
+	// at if not configured.
+	DefaultAuditMaxSizeBytes = 100 << 20
+)
+
+var ErrInvalidAuditLog = errors.New("Invalid audit log configuration")
+
+// AuditLogConfig enables the audit log of the AWS API calls of all collectors
+// if a path is set.
+type AuditLogConfig struct {
+	// Path is the file the audit log is written to, AuditLogStdout for
+	// stdout.
+	Path string `yaml:"path"`
+	// SampleRate is the share of calls logged, all calls if 0.
+	SampleRate float64 `yaml:"sample_rate"`
+	// IncludeARNs logs the ARNs in request parameters, only their number is
+	// logged by default.
+	IncludeARNs bool `yaml:"include_arns"`
+	// MaxSizeBytes is the size the audit log file is rotated at.
+	MaxSizeBytes int64 `yaml:"max_size_bytes"`
+}
+
+// withDefaults returns the configuration with the defaults of unset values, or
+// an error if a value is out of range.
+func (c AuditLogConfig) withDefaults() (AuditLogConfig, error) {
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return c, fmt.Errorf("%w: sample_rate has to be between 0 and 1: %v", ErrInvalidAuditLog, c.SampleRate)
+	}
+	if c.MaxSizeBytes < 0 {
+		return c, fmt.Errorf("%w: max_size_bytes must not be negative: %d", ErrInvalidAuditLog, c.MaxSizeBytes)
+	}
+	if c.SampleRate == 0 {
+		c.SampleRate = 1
+	}
+	if c.MaxSizeBytes == 0 {
+		c.MaxSizeBytes = DefaultAuditMaxSizeBytes
+	}
+
+	return c, nil
+}
+
+// auditLog logs the AWS API calls of all collectors if the audit log is
+// configured. It is set on start and read only after, calls are not logged if
+// nil.
+var auditLog *AuditLogger
+
+// AuditLogger writes a JSON line for every sampled AWS API call. It has its own
+// core so the audit log does not mix with the operational logs.
+type AuditLogger struct {
+	log         *zap.Logger
+	sampleRate  float64
+	includeARNs bool
+	// sample returns a number in [0, 1) a call is logged below the sample
+	// rate, replaced in tests.
+	sample func() float64
+}
+
+// NewAuditLogger returns an audit logger writing to the file or stdout
+// configured in conf.
+func NewAuditLogger(conf AuditLogConfig) (*AuditLogger, error) {
+	if conf.Path == AuditLogStdout {
+		return newAuditLogger(zapcore.Lock(os.Stdout), conf), nil
+	}
+	f, err := openRotatingFile(conf.Path, conf.MaxSizeBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAuditLog, err)
+	}
+
+	return newAuditLogger(f, conf), nil
+}
+
+func newAuditLogger(w zapcore.WriteSyncer, conf AuditLogConfig) *AuditLogger {
+	encoder := zap.NewProductionEncoderConfig()
+	encoder.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+	// The level carries no information, every call is logged at info.
+	encoder.LevelKey = ""
+
+	return &AuditLogger{
+		log:         zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(encoder), w, zapcore.InfoLevel)),
+		sampleRate:  conf.SampleRate,
+		includeARNs: conf.IncludeARNs,
+		sample:      rand.Float64,
+	}
+}
+
+// attach adds the audit handler attributing calls to collector b to the session
+// of client. The handler runs on completion of every request, i.e. every page
+// after all of its retries. Clients other than AWSClient, e.g. fakes in tests,
+// are not audited. Calls on a nil audit logger are ignored.
+func (a *AuditLogger) attach(client Client, b *BaseCollector) {
+	c, ok := client.(*AWSClient)
+	if a == nil || !ok {
+		return
+	}
+	c.sess.Handlers.Complete.PushBackNamed(a.handler(b.ID(), b.config.Name, b.config.Type))
+}
+
+// handler returns an SDK request handler logging the completed requests of the
+// collector.
+func (a *AuditLogger) handler(id CollectorID, name, typ string) request.NamedHandler {
+	return request.NamedHandler{
+		Name: "promwatch.AuditLog",
+		Fn: func(r *request.Request) {
+			if a.sample() >= a.sampleRate {
+				return
+			}
+			operation := ""
+			if r.Operation != nil {
+				operation = r.Operation.Name
+			}
+			a.log.Info("aws api call",
+				zap.String(LabelCollectorID, string(id)),
+				zap.String(LabelCollectorName, name),
+				zap.String(LabelCollectorType, typ),
+				zap.String("service", r.ClientInfo.ServiceName),
+				zap.String("operation", operation),
+				zap.String("region", aws.StringValue(r.Config.Region)),
+				zap.Any("params", a.summarize(r.Params)),
+				zap.Float64("duration_seconds", time.Since(r.Time).Seconds()),
+				zap.String("outcome", auditOutcome(r.Error)),
+			)
+		},
+	}
+}
+
+// auditOutcome returns success, or the AWS error code of err.
+func auditOutcome(err error) string {
+	if err == nil {
+		return "success"
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code()
+	}
+
+	return "error"
+}
+
+// summarize returns the parameters of the requests issued by the collectors
+// worth auditing. Lists are reduced to their number, except for the resource
+// types, and ARNs are only included if enabled.
+func (a *AuditLogger) summarize(params interface{}) map[string]interface{} {
+	s := map[string]interface{}{}
+	switch p := params.(type) {
+	case *tagging.GetResourcesInput:
+		s["resource_types"] = aws.StringValueSlice(p.ResourceTypeFilters)
+		s["tag_filters"] = len(p.TagFilters)
+		s["arns"] = len(p.ResourceARNList)
+		if a.includeARNs {
+			s["arns"] = aws.StringValueSlice(p.ResourceARNList)
+		}
+	case *cloudwatch.GetMetricDataInput:
+		s["queries"] = len(p.MetricDataQueries)
+		s["start_time"] = aws.TimeValue(p.StartTime)
+		s["end_time"] = aws.TimeValue(p.EndTime)
+	case *autoscaling.DescribeAutoScalingGroupsInput:
+		s["groups"] = len(p.AutoScalingGroupNames)
+	case *elasticache.DescribeCacheClustersInput:
+		s["show_node_info"] = aws.BoolValue(p.ShowCacheNodeInfo)
+	case *configservice.SelectResourceConfigInput:
+		s["limit"] = aws.Int64Value(p.Limit)
+	case *ec2.DescribeRegionsInput:
+		s["all_regions"] = aws.BoolValue(p.AllRegions)
+	case *rds.DescribeDBInstancesInput:
+		s["filters"] = len(p.Filters)
+		if a.includeARNs && p.DBInstanceIdentifier != nil {
+			s["db_instance_identifier"] = aws.StringValue(p.DBInstanceIdentifier)
+		}
+	case *kafka.ListNodesInput:
+		if a.includeARNs {
+			s["cluster_arn"] = aws.StringValue(p.ClusterArn)
+		}
+	}
+
+	return s
+}
+
+// rotatingFile is a file that is moved to <path>.1, replacing a previous one,
+// once a write would grow it beyond its maximum size.
+type rotatingFile struct {
+	sync.Mutex
+
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// open opens the file for appending.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+
+	return nil
+}
+
+// Write writes p rotating the file first if p would grow it beyond its maximum
+// size. A single write larger than the maximum size goes to an empty file.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// rotate moves the file to <path>.1 and opens a new one.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+// Sync commits the content of the file to storage.
+func (f *rotatingFile) Sync() error {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.file.Sync()
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v2"
+)
+
+// auditedClient returns a client with the audit handler of b attached that
+// answers requests with the canned responses by service without calling AWS.
+func auditedClient(t *testing.T, a *AuditLogger, b *BaseCollector, responses map[string]*http.Response) *AWSClient {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	assert.Nil(t, err)
+	sess.Handlers.Send.Clear()
+	sess.Handlers.Send.PushBack(func(r *request.Request) {
+		res := *responses[r.ClientInfo.ServiceName]
+		res.Body = io.NopCloser(res.Body)
+		r.HTTPResponse = &res
+	})
+	client := &AWSClient{Region: "us-east-1", sess: sess}
+	a.attach(client, b)
+
+	return client
+}
+
+func response(status int, body string) *http.Response {
+	return &http.Response{StatusCode: status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}
+}
+
+// auditLines returns the JSON lines of the audit log.
+func auditLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	lines := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		l := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &l), line)
+		lines = append(lines, l)
+	}
+
+	return lines
+}
+
+func TestAuditLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	a := newAuditLogger(zapcore.AddSync(buf), AuditLogConfig{SampleRate: 1})
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs", Name: "volumes"}))
+	client := auditedClient(t, a, b, map[string]*http.Response{
+		"tagging":    response(http.StatusOK, `{"ResourceTagMappingList": []}`),
+		"monitoring": response(http.StatusOK, `<GetMetricDataResponse><GetMetricDataResult><MetricDataResults/></GetMetricDataResult></GetMetricDataResponse>`),
+	})
+
+	arns := []*string{aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-a"), aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-b")}
+	_, err := client.GetResources(context.Background(), &tagging.GetResourcesInput{
+		ResourceTypeFilters: []*string{aws.String("ec2:volume")},
+		ResourceARNList:     arns,
+	}, b.Telemetry())
+	assert.Nil(t, err)
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err = client.GetMetricData(context.Background(), []*cloudwatch.GetMetricDataInput{{
+		StartTime:         aws.Time(now.Add(-time.Minute)),
+		EndTime:           aws.Time(now),
+		MetricDataQueries: []*cloudwatch.MetricDataQuery{{Id: aws.String("a")}, {Id: aws.String("b")}, {Id: aws.String("c")}},
+	}}, b.Telemetry())
+	assert.Nil(t, err)
+
+	lines := auditLines(t, buf)
+	if assert.Len(t, lines, 2) {
+		for _, l := range lines {
+			assert.Equal(t, string(b.ID()), l[LabelCollectorID])
+			assert.Equal(t, "volumes", l[LabelCollectorName])
+			assert.Equal(t, "ebs", l[LabelCollectorType])
+			assert.Equal(t, "us-east-1", l["region"])
+			assert.Equal(t, "success", l["outcome"])
+			assert.Contains(t, l, "ts")
+			assert.GreaterOrEqual(t, l["duration_seconds"], float64(0))
+		}
+		assert.Equal(t, "tagging", lines[0]["service"])
+		assert.Equal(t, "GetResources", lines[0]["operation"])
+		assert.Equal(t, map[string]interface{}{
+			"resource_types": []interface{}{"ec2:volume"},
+			"tag_filters":    float64(0),
+			"arns":           float64(2),
+		}, lines[0]["params"], "ARNs should only be counted by default")
+		assert.Equal(t, "monitoring", lines[1]["service"])
+		assert.Equal(t, "GetMetricData", lines[1]["operation"])
+		assert.Equal(t, float64(3), lines[1]["params"].(map[string]interface{})["queries"])
+	}
+
+	// ARNs are logged if enabled and errors by their code.
+	buf.Reset()
+	a.includeARNs = true
+	client = auditedClient(t, a, b, map[string]*http.Response{
+		"tagging": response(http.StatusBadRequest, `{"__type": "AccessDeniedException", "message": "denied"}`),
+	})
+	_, err = client.GetResources(context.Background(), &tagging.GetResourcesInput{ResourceARNList: arns}, b.Telemetry())
+	assert.NotNil(t, err)
+	lines = auditLines(t, buf)
+	if assert.Len(t, lines, 1) {
+		assert.Equal(t, "AccessDeniedException", lines[0]["outcome"])
+		assert.Equal(t, []interface{}{*arns[0], *arns[1]}, lines[0]["params"].(map[string]interface{})["arns"])
+	}
+}
+
+func TestAuditLogSampling(t *testing.T) {
+	buf := &bytes.Buffer{}
+	a := newAuditLogger(zapcore.AddSync(buf), AuditLogConfig{SampleRate: 0.5})
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"}))
+	client := auditedClient(t, a, b, map[string]*http.Response{
+		"tagging": response(http.StatusOK, `{}`),
+	})
+
+	for _, sample := range []float64{0.7, 0.2, 0.5, 0.1} {
+		sample := sample
+		a.sample = func() float64 { return sample }
+		_, err := client.GetResources(context.Background(), &tagging.GetResourcesInput{}, b.Telemetry())
+		assert.Nil(t, err)
+	}
+	assert.Len(t, auditLines(t, buf), 2, "Only calls sampled below the sample rate should be logged")
+}
+
+func TestAuditLogNil(t *testing.T) {
+	var a *AuditLogger
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"}))
+	client := &AWSClient{sess: session.Must(session.NewSession())}
+	n := client.sess.Handlers.Complete.Len()
+	a.attach(client, b)
+	assert.Equal(t, n, client.sess.Handlers.Complete.Len(), "No handler should be attached without audit log")
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f, err := openRotatingFile(path, 10)
+	assert.Nil(t, err)
+
+	for _, w := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddddddddddd\n"} {
+		_, err := f.Write([]byte(w))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, f.Sync())
+
+	current, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "dddddddddddd\n", string(current), "A write larger than the maximum size should go to an empty file")
+	rotated, err := os.ReadFile(path + ".1")
+	assert.Nil(t, err)
+	assert.Equal(t, "cccc\n", string(rotated), "Only the last rotated file should be kept")
+}
+
+func TestConfigAuditLog(t *testing.T) {
+	var got PromWatchConfig
+	assert.Nil(t, yaml.Unmarshal([]byte("audit_log: {path: stdout}"), &got))
+	assert.Equal(t, AuditLogConfig{Path: AuditLogStdout, SampleRate: 1, MaxSizeBytes: DefaultAuditMaxSizeBytes}, got.AuditLog)
+
+	assert.ErrorIs(t, yaml.Unmarshal([]byte("audit_log: {sample_rate: 1.5}"), &PromWatchConfig{}), ErrInvalidAuditLog)
+	assert.ErrorIs(t, yaml.Unmarshal([]byte("audit_log: {max_size_bytes: -1}"), &PromWatchConfig{}), ErrInvalidAuditLog)
+}
@@ -3,30 +3,110 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	awsrequest "github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/configservice"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/kafka"
+	"github.com/aws/aws-sdk-go/service/rds"
 	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const MaxMetricDataQueryItems = 500
 
+// MaxQueryIDLength is the maximum length of GetMetricData query IDs.
+const MaxQueryIDLength = 255
+
+var ErrInvalidQueryID = errors.New("Invalid query ID")
+var ErrInvalidRoleARN = errors.New("Invalid ARN of the role to assume")
+var ErrConflictingRoleARN = errors.New("Conflicting role_arn and assume_role_arn")
+
+// matchQueryID matches valid GetMetricData query IDs, which have to start with
+// a lower case letter.
+var matchQueryID = regexp.MustCompile(`^[a-z][a-zA-Z0-9_]*$`)
+
+// validQueryID returns an error if the query ID would be rejected by
+// GetMetricData, failing the whole request it is part of.
+func validQueryID(id string) error {
+	if len(id) > MaxQueryIDLength {
+		return fmt.Errorf("%w: longer than %d characters: %s", ErrInvalidQueryID, MaxQueryIDLength, id)
+	}
+	if !matchQueryID.MatchString(id) {
+		return fmt.Errorf("%w: %s", ErrInvalidQueryID, id)
+	}
+
+	return nil
+}
+
 // Client implements the set of AWS service methods used in the collectors. We
 // use a small subset of what the AWS SDK provides accross a multitude of
 // service packages, this interface helps us to easily keep track of that usage
 // and implement testing clients.
+//
+// Methods aggregate all pages of a request and increment the request counter
+// in the passed in telemetry for every page received. Requests are aborted once
+// the passed in context is cancelled. In case of errors the
+// results received up to that point are returned alongside the error. Logging
+// and counting errors is left to the caller.
 type Client interface {
-	DescribeAutoScalingGroups(*autoscaling.DescribeAutoScalingGroupsInput, *CollectorTelemetry) (*[]*autoscaling.Group, error)
-	DescribeCacheClusters(*elasticache.DescribeCacheClustersInput, *CollectorTelemetry) (*[]*elasticache.CacheCluster, error)
-	GetResources(*tagging.GetResourcesInput, *CollectorTelemetry) (*[]*tagging.ResourceTagMapping, error)
-	GetMetricData([]*cloudwatch.GetMetricDataInput, *CollectorTelemetry) (*[]*cloudwatch.MetricDataResult, error)
+	DescribeAutoScalingGroups(context.Context, *autoscaling.DescribeAutoScalingGroupsInput, *CollectorTelemetry) (*[]*autoscaling.Group, error)
+	DescribeCacheClusters(context.Context, *elasticache.DescribeCacheClustersInput, *CollectorTelemetry) (*[]*elasticache.CacheCluster, error)
+	GetResources(context.Context, *tagging.GetResourcesInput, *CollectorTelemetry) (*[]*tagging.ResourceTagMapping, error)
+	GetMetricData(context.Context, []*cloudwatch.GetMetricDataInput, *CollectorTelemetry) (*[]*cloudwatch.MetricDataResult, error)
+	ListConfigResources(context.Context, *configservice.SelectResourceConfigInput, *CollectorTelemetry) (*[]*string, error)
+	DescribeRegions(context.Context, *ec2.DescribeRegionsInput, *CollectorTelemetry) (*[]*ec2.Region, error)
+	ListAccountAliases(context.Context, *iam.ListAccountAliasesInput, *CollectorTelemetry) (*[]*string, error)
+	DescribeDBInstances(context.Context, *rds.DescribeDBInstancesInput, *CollectorTelemetry) (*[]*rds.DBInstance, error)
+	ListNodes(context.Context, *kafka.ListNodesInput, *CollectorTelemetry) (*[]*kafka.NodeInfo, error)
+	GetCallerIdentity(context.Context, *sts.GetCallerIdentityInput, *CollectorTelemetry) (*sts.GetCallerIdentityOutput, error)
+}
+
+// Method names of the Client interface. They identify failed methods in
+// MethodError and are used to script errors and record calls of the
+// FakeClient.
+const (
+	MethodDescribeAutoScalingGroups = "DescribeAutoScalingGroups"
+	MethodDescribeCacheClusters     = "DescribeCacheClusters"
+	MethodGetResources              = "GetResources"
+	MethodGetMetricData             = "GetMetricData"
+	MethodListConfigResources       = "ListConfigResources"
+	MethodDescribeRegions           = "DescribeRegions"
+	MethodListAccountAliases        = "ListAccountAliases"
+	MethodDescribeDBInstances       = "DescribeDBInstances"
+	MethodListNodes                 = "ListNodes"
+	MethodGetCallerIdentity         = "GetCallerIdentity"
+)
+
+// MethodError is returned by Client methods and identifies the failed method,
+// see the Method constants.
+type MethodError struct {
+	Method string
+	Err    error
+}
+
+func (e *MethodError) Error() string {
+	return e.Method + ": " + e.Err.Error()
+}
+
+func (e *MethodError) Unwrap() error {
+	return e.Err
 }
 
 // AWSClient implements the Client interface and provides the AWS requests we
@@ -39,9 +119,40 @@ type AWSClient struct {
 	cloudwatch  *cloudwatch.CloudWatch
 	autoscaling *autoscaling.AutoScaling
 	elasticache *elasticache.ElastiCache
+	config      *configservice.ConfigService
+	ec2         *ec2.EC2
+	iam         *iam.IAM
+	rds         *rds.RDS
+	kafka       *kafka.Kafka
+	sts         *sts.STS
+}
+
+// AWSOptions are custom options of the AWS SDK config of a collector, e.g. to
+// collect from LocalStack or through a proxy for testing. Options not set keep
+// the defaults of the SDK.
+type AWSOptions struct {
+	// Endpoint replaces the endpoint of all services.
+	Endpoint         string `yaml:"endpoint"`
+	DisableSSL       bool   `yaml:"disable_ssl"`
+	S3ForcePathStyle bool   `yaml:"s3_force_path_style"`
 }
 
-func defaultSession(region string) (*session.Session, error) {
+// apply sets the options that are set on config.
+func (o AWSOptions) apply(config *aws.Config) *aws.Config {
+	if o.Endpoint != "" {
+		config.Endpoint = aws.String(o.Endpoint)
+	}
+	if o.DisableSSL {
+		config.DisableSSL = aws.Bool(true)
+	}
+	if o.S3ForcePathStyle {
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	return config
+}
+
+func defaultSession(region string, opts AWSOptions) (*session.Session, error) {
 	retryer := client.DefaultRetryer{
 		NumMaxRetries:    5,
 		MinThrottleDelay: 500 * time.Millisecond,
@@ -50,22 +161,73 @@ func defaultSession(region string) (*session.Session, error) {
 		MaxRetryDelay:    3 * time.Second,
 	}
 	// level := aws.LogDebugWithHTTPBody
-	return session.NewSession(&aws.Config{
+	return session.NewSession(opts.apply(&aws.Config{
 		Region:     aws.String(region),
 		MaxRetries: aws.Int(5),
 		Retryer:    retryer,
 		// LogLevel:   &level,
-	})
+	}))
+}
+
+// validRoleARN returns an error if roleARN is set but not the ARN of an IAM
+// role.
+func validRoleARN(roleARN string) error {
+	if roleARN == "" {
+		return nil
+	}
+
+	parsed, err := arn.Parse(roleARN)
+	if err != nil || parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+		return fmt.Errorf("%w: %s", ErrInvalidRoleARN, roleARN)
+	}
+
+	return nil
+}
+
+// collectorRoleARN returns the validated role ARN of a collector configuring
+// it as roleARN, its alias assumeRoleARN, or both with the same value.
+func collectorRoleARN(roleARN, assumeRoleARN string) (string, error) {
+	if roleARN != "" && assumeRoleARN != "" && roleARN != assumeRoleARN {
+		return "", fmt.Errorf("%w: %s and %s", ErrConflictingRoleARN, roleARN, assumeRoleARN)
+	}
+	if roleARN == "" {
+		roleARN = assumeRoleARN
+	}
+
+	return roleARN, validRoleARN(roleARN)
+}
+
+// roleSession returns a copy of sess using the temporary credentials of the
+// role roleARN, which is assumed with the credentials of sess. The credentials
+// are renewed before they expire.
+func roleSession(sess *session.Session, roleARN string) (*session.Session, error) {
+	creds := stscreds.NewCredentials(sess, roleARN)
+	// Assume the role right away so a role that can not be assumed fails the
+	// client instead of every request.
+	if _, err := creds.Get(); err != nil {
+		return nil, fmt.Errorf("Can not assume role %s: %w", roleARN, err)
+	}
+
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
 }
 
 // DefaultAWSClient returns a default AWSClient for the provided region with max
-// retries set to 5 and all other values being set as in a stock aws.Config.
-func DefaultAWSClient(region string) (Client, error) {
-	sess, err := defaultSession(region)
+// retries set to 5, the options in opts applied, and all other values being set
+// as in a stock aws.Config. If roleARN is set, the client uses the temporary
+// credentials of the role.
+func DefaultAWSClient(region string, opts AWSOptions, roleARN string) (Client, error) {
+	sess, err := defaultSession(region, opts)
 	if err != nil {
 		return nil, err
 	}
 
+	if roleARN != "" {
+		sess, err = roleSession(sess, roleARN)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &AWSClient{
 		Region: *sess.Config.Region,
 		sess:   sess,
@@ -93,40 +255,158 @@ func (client *AWSClient) getCloudwatch() *cloudwatch.CloudWatch {
 }
 
 func (client *AWSClient) getAutoscaling() *autoscaling.AutoScaling {
+	if client.autoscaling != nil {
+		return client.autoscaling
+	}
+
 	client.autoscaling = autoscaling.New(client.sess)
 
 	return client.autoscaling
 }
 
 func (client *AWSClient) getElasticache() *elasticache.ElastiCache {
+	if client.elasticache != nil {
+		return client.elasticache
+	}
+
 	client.elasticache = elasticache.New(client.sess)
 
 	return client.elasticache
 }
 
+func (client *AWSClient) getConfigService() *configservice.ConfigService {
+	if client.config != nil {
+		return client.config
+	}
+
+	client.config = configservice.New(client.sess)
+
+	return client.config
+}
+
+func (client *AWSClient) getEC2() *ec2.EC2 {
+	if client.ec2 != nil {
+		return client.ec2
+	}
+
+	client.ec2 = ec2.New(client.sess)
+
+	return client.ec2
+}
+
+func (client *AWSClient) getIAM() *iam.IAM {
+	if client.iam != nil {
+		return client.iam
+	}
+
+	client.iam = iam.New(client.sess)
+
+	return client.iam
+}
+
+func (client *AWSClient) getRDS() *rds.RDS {
+	if client.rds != nil {
+		return client.rds
+	}
+
+	client.rds = rds.New(client.sess)
+
+	return client.rds
+}
+
+func (client *AWSClient) getKafka() *kafka.Kafka {
+	if client.kafka != nil {
+		return client.kafka
+	}
+
+	client.kafka = kafka.New(client.sess)
+
+	return client.kafka
+}
+
+func (client *AWSClient) getSTS() *sts.STS {
+	if client.sts != nil {
+		return client.sts
+	}
+
+	client.sts = sts.New(client.sess)
+
+	return client.sts
+}
+
+// maxPagesKey is the context key of the page limit of GetResources, see
+// withMaxPages.
+type maxPagesKey struct{}
+
+// withMaxPages returns a copy of ctx limiting GetResources to its first max
+// pages, e.g. to bound the discovery of doctor. Resources on further pages are
+// left out.
+func withMaxPages(ctx context.Context, max int) context.Context {
+	return context.WithValue(ctx, maxPagesKey{}, max)
+}
+
+// maxPages returns the page limit of ctx, 0 if not limited.
+func maxPages(ctx context.Context) int {
+	max, _ := ctx.Value(maxPagesKey{}).(int)
+
+	return max
+}
+
+// retryExpired calls request and, in case it fails due to expired credentials,
+// expires the session credentials to force a refresh and calls request once
+// more. request has to reset any results it aggregates as it might be called
+// twice.
+func (client *AWSClient) retryExpired(tele *CollectorTelemetry, request func() error) error {
+	err := request()
+	if !awsrequest.IsErrorExpiredCreds(err) {
+		return err
+	}
+
+	Logger.Warnw("AWS credentials expired, refreshing", "region", client.Region)
+	tele.CredentialRefreshCount.Inc()
+	if client.sess.Config.Credentials != nil {
+		client.sess.Config.Credentials.Expire()
+	}
+
+	return request()
+}
+
 // GetResources proxies to
 // resourcegroupstaggingapi.GetGetResourcesPagesWithContext and handles
-// aggregation of the paged results.
-func (client *AWSClient) GetResources(input *tagging.GetResourcesInput, tele *CollectorTelemetry) (*[]*tagging.ResourceTagMapping, error) {
+// aggregation of the paged results up to the page limit of ctx, see
+// withMaxPages.
+func (client *AWSClient) GetResources(ctx context.Context, input *tagging.GetResourcesInput, tele *CollectorTelemetry) (*[]*tagging.ResourceTagMapping, error) {
 	res := []*tagging.ResourceTagMapping{}
-	ctx := context.Background()
 	api := client.getTaggingAPI()
 
-	err := api.GetResourcesPagesWithContext(ctx, input, callback(&res, tele.GetResourcesCount))
+	err := client.retryExpired(tele, func() error {
+		res = res[:0]
+		return api.GetResourcesPagesWithContext(ctx, input, callback(&res, tele.GetResourcesCount, maxPages(ctx)))
+	})
+	if err != nil {
+		err = &MethodError{Method: MethodGetResources, Err: err}
+	}
+
 	return &res, err
 }
 
-func callback(res *[]*tagging.ResourceTagMapping, counter prometheus.Counter) func(page *tagging.GetResourcesOutput, lastPage bool) bool {
+// callback aggregates the pages of GetResources into res and stops paging after
+// max pages if max is larger than 0. The SDK marks pages with an empty or
+// missing token as last page.
+func callback(res *[]*tagging.ResourceTagMapping, counter prometheus.Counter, max int) func(page *tagging.GetResourcesOutput, lastPage bool) bool {
+	pages := 0
 	return func(page *tagging.GetResourcesOutput, lastPage bool) bool {
 		defer counter.Inc()
 		*res = append(*res, page.ResourceTagMappingList...)
-		return page.PaginationToken != nil
+		pages++
+		return !lastPage && (max <= 0 || pages < max)
 	}
 }
 
-// GetResources proxies to cloudwatch.GetMetricDataPage and handles aggregation
-// of the paged results. The requests are issued concurrently.
-func (client *AWSClient) GetMetricData(in []*cloudwatch.GetMetricDataInput, tele *CollectorTelemetry) (*[]*cloudwatch.MetricDataResult, error) {
+// GetMetricData proxies to cloudwatch.GetMetricDataPagesWithContext and
+// handles aggregation of the paged results. The requests are issued
+// concurrently, errors of all requests are joined.
+func (client *AWSClient) GetMetricData(ctx context.Context, in []*cloudwatch.GetMetricDataInput, tele *CollectorTelemetry) (*[]*cloudwatch.MetricDataResult, error) {
 	type lock struct {
 		sync.Mutex
 		r []*cloudwatch.MetricDataResult
@@ -134,31 +414,36 @@ func (client *AWSClient) GetMetricData(in []*cloudwatch.GetMetricDataInput, tele
 	res := lock{
 		r: []*cloudwatch.MetricDataResult{},
 	}
+	errs := []error{}
 	wg := sync.WaitGroup{}
 	for _, input := range in {
 		wg.Add(1)
 		go func(w *sync.WaitGroup, ip *cloudwatch.GetMetricDataInput) {
 			defer wg.Done()
-			err := client.getCloudwatch().GetMetricDataPages(ip, func(page *cloudwatch.GetMetricDataOutput, last bool) bool {
-				defer tele.GetMetricDataCount.Inc()
-				res.Lock()
-				res.r = append(res.r, page.MetricDataResults...)
-				res.Unlock()
-				return !last
+			r := []*cloudwatch.MetricDataResult{}
+			err := client.retryExpired(tele, func() error {
+				r = r[:0]
+				return client.getCloudwatch().GetMetricDataPagesWithContext(ctx, ip, func(page *cloudwatch.GetMetricDataOutput, last bool) bool {
+					defer tele.GetMetricDataCount.Inc()
+					r = append(r, page.MetricDataResults...)
+					return !last
+				})
 			})
 
+			res.Lock()
+			defer res.Unlock()
+			res.r = append(res.r, r...)
 			if err != nil {
-				Logger.Error("GetMetricData:", err.Error())
-				tele.ErrorCount.Inc()
+				errs = append(errs, &MethodError{Method: MethodGetMetricData, Err: err})
 			}
 		}(&wg, input)
 	}
 	wg.Wait()
 
-	return &res.r, nil
+	return &res.r, errors.Join(errs...)
 }
 
-func (client *AWSClient) DescribeAutoScalingGroups(input *autoscaling.DescribeAutoScalingGroupsInput, tele *CollectorTelemetry) (*[]*autoscaling.Group, error) {
+func (client *AWSClient) DescribeAutoScalingGroups(ctx context.Context, input *autoscaling.DescribeAutoScalingGroupsInput, tele *CollectorTelemetry) (*[]*autoscaling.Group, error) {
 	type lock struct {
 		sync.Mutex
 		r []*autoscaling.Group
@@ -167,23 +452,25 @@ func (client *AWSClient) DescribeAutoScalingGroups(input *autoscaling.DescribeAu
 		r: []*autoscaling.Group{},
 	}
 
-	err := client.getAutoscaling().DescribeAutoScalingGroupsPages(input, func(page *autoscaling.DescribeAutoScalingGroupsOutput, last bool) bool {
-		tele.DescribeAutoScalingGroupsCount.Inc()
-		res.Lock()
-		res.r = append(res.r, page.AutoScalingGroups...)
-		res.Unlock()
-		return !last
+	err := client.retryExpired(tele, func() error {
+		res.r = res.r[:0]
+		return client.getAutoscaling().DescribeAutoScalingGroupsPagesWithContext(ctx, input, func(page *autoscaling.DescribeAutoScalingGroupsOutput, last bool) bool {
+			tele.DescribeAutoScalingGroupsCount.Inc()
+			res.Lock()
+			res.r = append(res.r, page.AutoScalingGroups...)
+			res.Unlock()
+			return !last
+		})
 	})
 
 	if err != nil {
-		Logger.Error("DescribeAutoScalingGroups:", err.Error())
-		tele.ErrorCount.Inc()
+		err = &MethodError{Method: MethodDescribeAutoScalingGroups, Err: err}
 	}
 
 	return &res.r, err
 }
 
-func (client *AWSClient) DescribeCacheClusters(input *elasticache.DescribeCacheClustersInput, tele *CollectorTelemetry) (*[]*elasticache.CacheCluster, error) {
+func (client *AWSClient) DescribeCacheClusters(ctx context.Context, input *elasticache.DescribeCacheClustersInput, tele *CollectorTelemetry) (*[]*elasticache.CacheCluster, error) {
 	type lock struct {
 		sync.Mutex
 		r []*elasticache.CacheCluster
@@ -192,18 +479,152 @@ func (client *AWSClient) DescribeCacheClusters(input *elasticache.DescribeCacheC
 		r: []*elasticache.CacheCluster{},
 	}
 
-	err := client.getElasticache().DescribeCacheClustersPages(input, func(page *elasticache.DescribeCacheClustersOutput, last bool) bool {
-		tele.DescribeElasticacheCacheClustersCount.Inc()
-		res.Lock()
-		res.r = append(res.r, page.CacheClusters...)
-		res.Unlock()
-		return !last
+	err := client.retryExpired(tele, func() error {
+		res.r = res.r[:0]
+		return client.getElasticache().DescribeCacheClustersPagesWithContext(ctx, input, func(page *elasticache.DescribeCacheClustersOutput, last bool) bool {
+			tele.DescribeElasticacheCacheClustersCount.Inc()
+			res.Lock()
+			res.r = append(res.r, page.CacheClusters...)
+			res.Unlock()
+			return !last
+		})
 	})
 
 	if err != nil {
-		Logger.Error("DescribeElasticacheCacheClusters]:", err.Error())
-		tele.ErrorCount.Inc()
+		err = &MethodError{Method: MethodDescribeCacheClusters, Err: err}
 	}
 
 	return &res.r, err
 }
+
+// ListConfigResources proxies to
+// configservice.SelectResourceConfigPagesWithContext and handles aggregation of
+// the paged results. Each result is a JSON document with the properties
+// selected by the query expression.
+func (client *AWSClient) ListConfigResources(ctx context.Context, input *configservice.SelectResourceConfigInput, tele *CollectorTelemetry) (*[]*string, error) {
+	res := []*string{}
+
+	err := client.retryExpired(tele, func() error {
+		res = res[:0]
+		return client.getConfigService().SelectResourceConfigPagesWithContext(ctx, input, func(page *configservice.SelectResourceConfigOutput, last bool) bool {
+			tele.SelectResourceConfigCount.Inc()
+			res = append(res, page.Results...)
+			return !last
+		})
+	})
+
+	if err != nil {
+		err = &MethodError{Method: MethodListConfigResources, Err: err}
+	}
+
+	return &res, err
+}
+
+// DescribeRegions proxies to ec2.DescribeRegionsWithContext. The response is
+// not paged, a successful request counts as a single page.
+func (client *AWSClient) DescribeRegions(ctx context.Context, input *ec2.DescribeRegionsInput, tele *CollectorTelemetry) (*[]*ec2.Region, error) {
+	res := []*ec2.Region{}
+
+	err := client.retryExpired(tele, func() error {
+		out, err := client.getEC2().DescribeRegionsWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		tele.DescribeRegionsCount.Inc()
+		res = out.Regions
+
+		return nil
+	})
+
+	if err != nil {
+		err = &MethodError{Method: MethodDescribeRegions, Err: err}
+	}
+
+	return &res, err
+}
+
+// ListAccountAliases proxies to iam.ListAccountAliasesPagesWithContext and
+// handles aggregation of the paged results. An account has at most one alias.
+func (client *AWSClient) ListAccountAliases(ctx context.Context, input *iam.ListAccountAliasesInput, tele *CollectorTelemetry) (*[]*string, error) {
+	res := []*string{}
+
+	err := client.retryExpired(tele, func() error {
+		res = res[:0]
+		return client.getIAM().ListAccountAliasesPagesWithContext(ctx, input, func(page *iam.ListAccountAliasesOutput, last bool) bool {
+			tele.ListAccountAliasesCount.Inc()
+			res = append(res, page.AccountAliases...)
+			return !last
+		})
+	})
+
+	if err != nil {
+		err = &MethodError{Method: MethodListAccountAliases, Err: err}
+	}
+
+	return &res, err
+}
+
+// DescribeDBInstances proxies to rds.DescribeDBInstancesPagesWithContext and
+// handles aggregation of the paged results.
+func (client *AWSClient) DescribeDBInstances(ctx context.Context, input *rds.DescribeDBInstancesInput, tele *CollectorTelemetry) (*[]*rds.DBInstance, error) {
+	res := []*rds.DBInstance{}
+
+	err := client.retryExpired(tele, func() error {
+		res = res[:0]
+		return client.getRDS().DescribeDBInstancesPagesWithContext(ctx, input, func(page *rds.DescribeDBInstancesOutput, last bool) bool {
+			tele.DescribeDBInstancesCount.Inc()
+			res = append(res, page.DBInstances...)
+			return !last
+		})
+	})
+
+	if err != nil {
+		err = &MethodError{Method: MethodDescribeDBInstances, Err: err}
+	}
+
+	return &res, err
+}
+
+// ListNodes proxies to kafka.ListNodesPagesWithContext and handles aggregation
+// of the paged results.
+func (client *AWSClient) ListNodes(ctx context.Context, input *kafka.ListNodesInput, tele *CollectorTelemetry) (*[]*kafka.NodeInfo, error) {
+	res := []*kafka.NodeInfo{}
+
+	err := client.retryExpired(tele, func() error {
+		res = res[:0]
+		return client.getKafka().ListNodesPagesWithContext(ctx, input, func(page *kafka.ListNodesOutput, last bool) bool {
+			tele.ListNodesCount.Inc()
+			res = append(res, page.NodeInfoList...)
+			return !last
+		})
+	})
+
+	if err != nil {
+		err = &MethodError{Method: MethodListNodes, Err: err}
+	}
+
+	return &res, err
+}
+
+// GetCallerIdentity proxies to sts.GetCallerIdentityWithContext. The response
+// is not paged, a successful request counts as a single page.
+func (client *AWSClient) GetCallerIdentity(ctx context.Context, input *sts.GetCallerIdentityInput, tele *CollectorTelemetry) (*sts.GetCallerIdentityOutput, error) {
+	res := &sts.GetCallerIdentityOutput{}
+
+	err := client.retryExpired(tele, func() error {
+		out, err := client.getSTS().GetCallerIdentityWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		tele.GetCallerIdentityCount.Inc()
+		res = out
+
+		return nil
+	})
+
+	if err != nil {
+		err = &MethodError{Method: MethodGetCallerIdentity, Err: err}
+	}
+
+	return res, err
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/configservice"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+)
+
+// configResource is the subset of an AWS Config configuration item PromWatch
+// uses. Queries have to select at least the arn, tags are optional.
+type configResource struct {
+	ARN  string `json:"arn"`
+	Tags []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"tags"`
+}
+
+// getConfigResources is a resourceGetter listing resources using the AWS
+// Config advanced query configured for the collector.
+func (b *BaseCollector) getConfigResources(ctx context.Context) (*ResourceIndex, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := client.ListConfigResources(ctx, &configservice.SelectResourceConfigInput{
+		Expression: aws.String(b.config.ResourceQuery),
+	}, b.Telemetry())
+	if err != nil {
+		return nil, err
+	}
+
+	mapping, err := configResultsToTagMapping(results)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewResourceIndexFromTagMapping(&mapping, b.resourceID()), nil
+}
+
+// configResultsToTagMapping converts the JSON documents returned by AWS Config
+// advanced queries to resource tag mappings. Results without an ARN can not be
+// correlated with CloudWatch metrics and are skipped.
+func configResultsToTagMapping(results *[]*string) ([]*tagging.ResourceTagMapping, error) {
+	mapping := []*tagging.ResourceTagMapping{}
+	for _, r := range *results {
+		var res configResource
+		if err := json.Unmarshal([]byte(aws.StringValue(r)), &res); err != nil {
+			return nil, fmt.Errorf("Can not parse AWS Config query result: %w", err)
+		}
+
+		if res.ARN == "" {
+			Logger.Warn("AWS Config query result without arn, make sure the query selects arn")
+			continue
+		}
+
+		tags := []*tagging.Tag{}
+		for _, t := range res.Tags {
+			tags = append(tags, &tagging.Tag{Key: aws.String(t.Key), Value: aws.String(t.Value)})
+		}
+
+		mapping = append(mapping, &tagging.ResourceTagMapping{
+			ResourceARN: aws.String(res.ARN),
+			Tags:        tags,
+		})
+	}
+
+	return mapping, nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigResultsToTagMapping(t *testing.T) {
+	cases := []struct {
+		results     []*string
+		expected    []*tagging.ResourceTagMapping
+		expectError bool
+		message     string
+	}{
+		{
+			results:  []*string{},
+			expected: []*tagging.ResourceTagMapping{},
+			message:  "Empty results should produce an empty mapping",
+		},
+		{
+			results: []*string{
+				aws.String(`{"arn":"arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff","tags":[{"key":"team","value":"metrics"}]}`),
+				aws.String(`{"arn":"arn:aws:ec2:us-east-1:000000000000:volume/vol-00000000000000000"}`),
+			},
+			expected: []*tagging.ResourceTagMapping{
+				{
+					ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff"),
+					Tags: []*tagging.Tag{
+						{Key: aws.String("team"), Value: aws.String("metrics")},
+					},
+				},
+				{
+					ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-00000000000000000"),
+					Tags:        []*tagging.Tag{},
+				},
+			},
+			message: "Results should be mapped with their tags",
+		},
+		{
+			results: []*string{
+				aws.String(`{"resourceId":"vol-fffffffffffffffff"}`),
+			},
+			expected: []*tagging.ResourceTagMapping{},
+			message:  "Results without arn should be skipped",
+		},
+		{
+			results:     []*string{aws.String(`not json`)},
+			expectError: true,
+			message:     "Invalid JSON should produce an error",
+		},
+	}
+
+	for _, c := range cases {
+		got, err := configResultsToTagMapping(&c.results)
+		if c.expectError {
+			assert.NotNil(t, err, c.message)
+			continue
+		}
+		assert.Nil(t, err, c.message)
+		assert.Equal(t, c.expected, got, c.message)
+
+		index := NewResourceIndexFromTagMapping(&got, id)
+		assert.Equal(t, len(c.expected), len(index.Resources), c.message)
+	}
+}
@@ -0,0 +1,955 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/configservice"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/iam"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+var errScripted = errors.New("scripted error")
+
+// stubAWSClient returns an AWSClient that sends its requests to a local HTTP
+// server answering them with the pages and errors scripted in script.
+func stubAWSClient(t *testing.T, script *FakeClient) Client {
+	return newStubAWSClient(t, &awsStub{script: script}, credentials.NewStaticCredentials("AKID", "SECRET", ""))
+}
+
+func newStubAWSClient(t *testing.T, stub *awsStub, creds *credentials.Credentials) *AWSClient {
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(srv.URL),
+		Credentials: creds,
+		MaxRetries:  aws.Int(0),
+	})
+	assert.Nil(t, err)
+
+	return &AWSClient{Region: "us-east-1", sess: sess}
+}
+
+// awsStub speaks just enough of the AWS JSON and query protocols to serve the
+// requests issued by the AWSClient.
+type awsStub struct {
+	sync.Mutex
+	script *FakeClient
+	// expired is the number of requests answered with an expired token
+	// error before serving the script.
+	expired int
+}
+
+func (s *awsStub) expire() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.expired > 0 {
+		s.expired--
+		return true
+	}
+
+	return false
+}
+
+var queryIDPattern = regexp.MustCompile(`^MetricDataQueries\.member\.\d+\.Id$`)
+
+func (s *awsStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	if s.expire() {
+		if r.Header.Get("X-Amz-Target") != "" {
+			w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"ExpiredTokenException","message":"expired"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "<ErrorResponse><Error><Type>Sender</Type><Code>ExpiredToken</Code><Message>expired</Message></Error><RequestId>stub</RequestId></ErrorResponse>")
+		return
+	}
+
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		var in struct {
+			PaginationToken string
+			NextToken       string
+		}
+		_ = json.Unmarshal(body, &in)
+
+		switch target[strings.Index(target, ".")+1:] {
+		case "GetResources":
+			i, next, ok := s.page(in.PaginationToken, len(s.script.ResourceTagMappingPages), MethodGetResources)
+			if !ok {
+				s.jsonError(w)
+				return
+			}
+			page := []*tagging.ResourceTagMapping{}
+			if i < len(s.script.ResourceTagMappingPages) {
+				page = s.script.ResourceTagMappingPages[i]
+			}
+			s.json(w, &tagging.GetResourcesOutput{PaginationToken: aws.String(next), ResourceTagMappingList: page})
+		case "SelectResourceConfig":
+			i, next, ok := s.page(in.NextToken, len(s.script.ConfigResultPages), MethodListConfigResources)
+			if !ok {
+				s.jsonError(w)
+				return
+			}
+			page := []*string{}
+			if i < len(s.script.ConfigResultPages) {
+				page = s.script.ConfigResultPages[i]
+			}
+			out := &configservice.SelectResourceConfigOutput{Results: page}
+			if next != "" {
+				out.NextToken = aws.String(next)
+			}
+			s.json(w, out)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+		return
+	}
+
+	form, _ := url.ParseQuery(string(body))
+	buf := &strings.Builder{}
+	switch action := form.Get("Action"); action {
+	case "GetMetricData":
+		i, next, ok := s.page(form.Get("NextToken"), len(s.script.MetricDataResultPages), MethodGetMetricData)
+		if !ok {
+			s.queryError(w)
+			return
+		}
+		ids := map[string]struct{}{}
+		for k, v := range form {
+			if queryIDPattern.MatchString(k) {
+				ids[v[0]] = struct{}{}
+			}
+		}
+		buf.WriteString("<MetricDataResults>")
+		if i < len(s.script.MetricDataResultPages) {
+			for _, res := range s.script.MetricDataResultPages[i] {
+				if _, ok := ids[aws.StringValue(res.Id)]; !ok {
+					continue
+				}
+				fmt.Fprintf(buf, "<member><Id>%s</Id><StatusCode>Complete</StatusCode><Timestamps>", aws.StringValue(res.Id))
+				for _, ts := range res.Timestamps {
+					fmt.Fprintf(buf, "<member>%s</member>", ts.UTC().Format(time.RFC3339))
+				}
+				buf.WriteString("</Timestamps><Values>")
+				for _, v := range res.Values {
+					fmt.Fprintf(buf, "<member>%s</member>", strconv.FormatFloat(*v, 'f', -1, 64))
+				}
+				buf.WriteString("</Values></member>")
+			}
+		}
+		buf.WriteString("</MetricDataResults>")
+		s.query(w, action, buf.String(), "NextToken", next)
+	case "DescribeAutoScalingGroups":
+		i, next, ok := s.page(form.Get("NextToken"), len(s.script.AutoScalingGroupPages), MethodDescribeAutoScalingGroups)
+		if !ok {
+			s.queryError(w)
+			return
+		}
+		buf.WriteString("<AutoScalingGroups>")
+		if i < len(s.script.AutoScalingGroupPages) {
+			for _, g := range s.script.AutoScalingGroupPages[i] {
+				fmt.Fprintf(buf, "<member><AutoScalingGroupARN>%s</AutoScalingGroupARN><AutoScalingGroupName>%s</AutoScalingGroupName></member>",
+					aws.StringValue(g.AutoScalingGroupARN), aws.StringValue(g.AutoScalingGroupName))
+			}
+		}
+		buf.WriteString("</AutoScalingGroups>")
+		s.query(w, action, buf.String(), "NextToken", next)
+	case "DescribeCacheClusters":
+		i, next, ok := s.page(form.Get("Marker"), len(s.script.CacheClusterPages), MethodDescribeCacheClusters)
+		if !ok {
+			s.queryError(w)
+			return
+		}
+		buf.WriteString("<CacheClusters>")
+		if i < len(s.script.CacheClusterPages) {
+			for _, c := range s.script.CacheClusterPages[i] {
+				fmt.Fprintf(buf, "<CacheCluster><ARN>%s</ARN><CacheClusterId>%s</CacheClusterId><Engine>%s</Engine></CacheCluster>",
+					aws.StringValue(c.ARN), aws.StringValue(c.CacheClusterId), aws.StringValue(c.Engine))
+			}
+		}
+		buf.WriteString("</CacheClusters>")
+		s.query(w, action, buf.String(), "Marker", next)
+	case "ListAccountAliases":
+		i, next, ok := s.page(form.Get("Marker"), len(s.script.AccountAliasPages), MethodListAccountAliases)
+		if !ok {
+			s.queryError(w)
+			return
+		}
+		buf.WriteString("<AccountAliases>")
+		if i < len(s.script.AccountAliasPages) {
+			for _, a := range s.script.AccountAliasPages[i] {
+				fmt.Fprintf(buf, "<member>%s</member>", aws.StringValue(a))
+			}
+		}
+		buf.WriteString("</AccountAliases>")
+		// IAM only follows the marker of truncated responses
+		if next != "" {
+			buf.WriteString("<IsTruncated>true</IsTruncated>")
+		}
+		s.query(w, action, buf.String(), "Marker", next)
+	case "DescribeRegions":
+		// EC2 uses its own flavor of the query protocol
+		w.Header().Set("Content-Type", "text/xml")
+		if s.script.Errors[MethodDescribeRegions] != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "<Response><Errors><Error><Code>InvalidParameterValue</Code><Message>scripted error</Message></Error></Errors><RequestID>stub</RequestID></Response>")
+			return
+		}
+		buf.WriteString("<DescribeRegionsResponse><requestId>stub</requestId><regionInfo>")
+		for _, r := range s.script.Regions {
+			fmt.Fprintf(buf, "<item><regionName>%s</regionName></item>", aws.StringValue(r.RegionName))
+		}
+		buf.WriteString("</regionInfo></DescribeRegionsResponse>")
+		fmt.Fprint(w, buf.String())
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// page resolves the pagination token to the index of the page to serve and
+// the token of the next page. Tokens are only handed out for pages that exist
+// or for the failing request following the last page in case an error is
+// scripted for the method. ok is false if the request has to fail.
+func (s *awsStub) page(token string, pages int, method string) (i int, next string, ok bool) {
+	if token != "" {
+		i, _ = strconv.Atoi(strings.TrimPrefix(token, "page-"))
+	}
+
+	failing := s.script.Errors[method] != nil
+	if failing && i >= pages {
+		return i, "", false
+	}
+
+	if i+1 < pages || failing {
+		next = fmt.Sprintf("page-%d", i+1)
+	}
+
+	return i, next, true
+}
+
+func (s *awsStub) json(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *awsStub) jsonError(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(w, `{"__type":"ValidationException","message":"scripted error"}`)
+}
+
+func (s *awsStub) query(w http.ResponseWriter, action, result, tokenName, token string) {
+	if token != "" {
+		result += fmt.Sprintf("<%s>%s</%s>", tokenName, token, tokenName)
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, "<%sResponse><%sResult>%s</%sResult><ResponseMetadata><RequestId>stub</RequestId></ResponseMetadata></%sResponse>",
+		action, action, result, action, action)
+}
+
+func (s *awsStub) queryError(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprint(w, "<ErrorResponse><Error><Type>Sender</Type><Code>ValidationError</Code><Message>scripted error</Message></Error><RequestId>stub</RequestId></ErrorResponse>")
+}
+
+// conformanceCase describes a behaviour every Client implementation has to
+// show. call returns identifiers of the results to compare implementations.
+type conformanceCase struct {
+	message       string
+	script        func() *FakeClient
+	call          func(Client, *CollectorTelemetry) ([]string, error)
+	counter       func(*CollectorTelemetry) prometheus.Counter
+	expected      []string
+	expectedPages float64
+	expectError   bool
+}
+
+func callGetResources(c Client, tele *CollectorTelemetry) ([]string, error) {
+	res, err := c.GetResources(context.Background(), &tagging.GetResourcesInput{}, tele)
+	ids := []string{}
+	for _, r := range *res {
+		ids = append(ids, aws.StringValue(r.ResourceARN))
+	}
+	return ids, err
+}
+
+func callGetMetricData(c Client, tele *CollectorTelemetry) ([]string, error) {
+	res, err := c.GetMetricData(context.Background(), []*cloudwatch.GetMetricDataInput{
+		{
+			StartTime: aws.Time(time.Unix(0, 0)),
+			EndTime:   aws.Time(time.Unix(300, 0)),
+			MetricDataQueries: []*cloudwatch.MetricDataQuery{
+				{Id: aws.String("id_a")},
+				{Id: aws.String("id_b")},
+			},
+		},
+	}, tele)
+	ids := []string{}
+	for _, r := range *res {
+		ids = append(ids, fmt.Sprintf("%s=%v", aws.StringValue(r.Id), aws.Float64ValueSlice(r.Values)))
+	}
+	return ids, err
+}
+
+func callDescribeAutoScalingGroups(c Client, tele *CollectorTelemetry) ([]string, error) {
+	res, err := c.DescribeAutoScalingGroups(context.Background(), &autoscaling.DescribeAutoScalingGroupsInput{}, tele)
+	ids := []string{}
+	for _, g := range *res {
+		ids = append(ids, aws.StringValue(g.AutoScalingGroupARN))
+	}
+	return ids, err
+}
+
+func callDescribeCacheClusters(c Client, tele *CollectorTelemetry) ([]string, error) {
+	res, err := c.DescribeCacheClusters(context.Background(), &elasticache.DescribeCacheClustersInput{}, tele)
+	ids := []string{}
+	for _, cl := range *res {
+		ids = append(ids, aws.StringValue(cl.ARN))
+	}
+	return ids, err
+}
+
+func callListConfigResources(c Client, tele *CollectorTelemetry) ([]string, error) {
+	res, err := c.ListConfigResources(context.Background(), &configservice.SelectResourceConfigInput{Expression: aws.String("SELECT arn")}, tele)
+	return aws.StringValueSlice(*res), err
+}
+
+func callDescribeRegions(c Client, tele *CollectorTelemetry) ([]string, error) {
+	res, err := c.DescribeRegions(context.Background(), &ec2.DescribeRegionsInput{}, tele)
+	ids := []string{}
+	for _, r := range *res {
+		ids = append(ids, aws.StringValue(r.RegionName))
+	}
+	return ids, err
+}
+
+func callListAccountAliases(c Client, tele *CollectorTelemetry) ([]string, error) {
+	res, err := c.ListAccountAliases(context.Background(), &iam.ListAccountAliasesInput{}, tele)
+	return aws.StringValueSlice(*res), err
+}
+
+func withError(method string, f *FakeClient) *FakeClient {
+	f.Errors = map[string]error{method: errScripted}
+	return f
+}
+
+func resourcePages() *FakeClient {
+	return &FakeClient{ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{
+		{{ResourceARN: aws.String("arn:1")}, {ResourceARN: aws.String("arn:2")}},
+		{{ResourceARN: aws.String("arn:3")}},
+	}}
+}
+
+func metricDataPages() *FakeClient {
+	ts := []*time.Time{aws.Time(time.Unix(60, 0))}
+	return &FakeClient{MetricDataResultPages: [][]*cloudwatch.MetricDataResult{
+		{{Id: aws.String("id_a"), Timestamps: ts, Values: []*float64{aws.Float64(1.5)}}},
+		{
+			{Id: aws.String("id_b"), Timestamps: ts, Values: []*float64{aws.Float64(2)}},
+			{Id: aws.String("id_unknown"), Timestamps: ts, Values: []*float64{aws.Float64(3)}},
+		},
+	}}
+}
+
+func groupPages() *FakeClient {
+	return &FakeClient{AutoScalingGroupPages: [][]*autoscaling.Group{
+		{{AutoScalingGroupARN: aws.String("arn:asg:1"), AutoScalingGroupName: aws.String("1")}},
+		{{AutoScalingGroupARN: aws.String("arn:asg:2"), AutoScalingGroupName: aws.String("2")}},
+	}}
+}
+
+func clusterPages() *FakeClient {
+	return &FakeClient{CacheClusterPages: [][]*elasticache.CacheCluster{
+		{{ARN: aws.String("arn:ec:1"), CacheClusterId: aws.String("1"), Engine: aws.String("memcached")}},
+		{{ARN: aws.String("arn:ec:2"), CacheClusterId: aws.String("2"), Engine: aws.String("redis")}},
+	}}
+}
+
+func configPages() *FakeClient {
+	return &FakeClient{ConfigResultPages: [][]*string{
+		{aws.String(`{"arn":"arn:1"}`)},
+		{aws.String(`{"arn":"arn:2"}`)},
+	}}
+}
+
+func aliasPages() *FakeClient {
+	return &FakeClient{AccountAliasPages: [][]*string{
+		{aws.String("production")},
+		{aws.String("legacy")},
+	}}
+}
+
+func regions() *FakeClient {
+	return &FakeClient{Regions: []*ec2.Region{
+		{RegionName: aws.String("us-east-1")},
+		{RegionName: aws.String("eu-central-1")},
+	}}
+}
+
+var conformanceCases = []conformanceCase{
+	{
+		message:       "GetResources aggregates all pages and counts every page",
+		script:        resourcePages,
+		call:          callGetResources,
+		counter:       func(t *CollectorTelemetry) prometheus.Counter { return t.GetResourcesCount },
+		expected:      []string{"arn:1", "arn:2", "arn:3"},
+		expectedPages: 2,
+	},
+	{
+		message:       "GetResources returns partial results alongside error",
+		script:        func() *FakeClient { return withError(MethodGetResources, resourcePages()) },
+		call:          callGetResources,
+		counter:       func(t *CollectorTelemetry) prometheus.Counter { return t.GetResourcesCount },
+		expected:      []string{"arn:1", "arn:2", "arn:3"},
+		expectedPages: 2,
+		expectError:   true,
+	},
+	{
+		message:       "GetMetricData aggregates all pages, filters results by query, and counts every page",
+		script:        metricDataPages,
+		call:          callGetMetricData,
+		counter:       func(t *CollectorTelemetry) prometheus.Counter { return t.GetMetricDataCount },
+		expected:      []string{"id_a=[1.5]", "id_b=[2]"},
+		expectedPages: 2,
+	},
+	{
+		message:       "GetMetricData returns partial results alongside error",
+		script:        func() *FakeClient { return withError(MethodGetMetricData, metricDataPages()) },
+		call:          callGetMetricData,
+		counter:       func(t *CollectorTelemetry) prometheus.Counter { return t.GetMetricDataCount },
+		expected:      []string{"id_a=[1.5]", "id_b=[2]"},
+		expectedPages: 2,
+		expectError:   true,
+	},
+	{
+		message:       "DescribeAutoScalingGroups aggregates all pages and counts every page",
+		script:        groupPages,
+		call:          callDescribeAutoScalingGroups,
+		counter:       func(t *CollectorTelemetry) prometheus.Counter { return t.DescribeAutoScalingGroupsCount },
+		expected:      []string{"arn:asg:1", "arn:asg:2"},
+		expectedPages: 2,
+	},
+	{
+		message:       "DescribeAutoScalingGroups returns partial results alongside error",
+		script:        func() *FakeClient { return withError(MethodDescribeAutoScalingGroups, groupPages()) },
+		call:          callDescribeAutoScalingGroups,
+		counter:       func(t *CollectorTelemetry) prometheus.Counter { return t.DescribeAutoScalingGroupsCount },
+		expected:      []string{"arn:asg:1", "arn:asg:2"},
+		expectedPages: 2,
+		expectError:   true,
+	},
+	{
+		message:       "DescribeCacheClusters aggregates all pages and counts every page",
+		script:        clusterPages,
+		call:          callDescribeCacheClusters,
+		counter:       func(t *CollectorTelemetry) prometheus.Counter { return t.DescribeElasticacheCacheClustersCount },
+		expected:      []string{"arn:ec:1", "arn:ec:2"},
+		expectedPages: 2,
+	},
+	{
+		message:       "DescribeCacheClusters returns partial results alongside error",
+		script:        func() *FakeClient { return withError(MethodDescribeCacheClusters, clusterPages()) },
+		call:          callDescribeCacheClusters,
+		counter:       func(t *CollectorTelemetry) prometheus.Counter { return t.DescribeElasticacheCacheClustersCount },
+		expected:      []string{"arn:ec:1", "arn:ec:2"},
+		expectedPages: 2,
+		expectError:   true,
+	},
+	{
+		message:       "ListConfigResources aggregates all pages and counts every page",
+		script:        configPages,
+		call:          callListConfigResources,
+		counter:       func(t *CollectorTelemetry) prometheus.Counter { return t.SelectResourceConfigCount },
+		expected:      []string{`{"arn":"arn:1"}`, `{"arn":"arn:2"}`},
+		expectedPages: 2,
+	},
+	{
+		message:       "ListConfigResources returns partial results alongside error",
+		script:        func() *FakeClient { return withError(MethodListConfigResources, configPages()) },
+		call:          callListConfigResources,
+		counter:       func(t *CollectorTelemetry) prometheus.Counter { return t.SelectResourceConfigCount },
+		expected:      []string{`{"arn":"arn:1"}`, `{"arn":"arn:2"}`},
+		expectedPages: 2,
+		expectError:   true,
+	},
+	{
+		message:       "DescribeRegions returns all regions and counts the request",
+		script:        regions,
+		call:          callDescribeRegions,
+		counter:       func(t *CollectorTelemetry) prometheus.Counter { return t.DescribeRegionsCount },
+		expected:      []string{"us-east-1", "eu-central-1"},
+		expectedPages: 1,
+	},
+	{
+		message:     "DescribeRegions returns no regions alongside error",
+		script:      func() *FakeClient { return withError(MethodDescribeRegions, regions()) },
+		call:        callDescribeRegions,
+		counter:     func(t *CollectorTelemetry) prometheus.Counter { return t.DescribeRegionsCount },
+		expected:    []string{},
+		expectError: true,
+	},
+	{
+		message:       "ListAccountAliases aggregates all pages and counts every page",
+		script:        aliasPages,
+		call:          callListAccountAliases,
+		counter:       func(t *CollectorTelemetry) prometheus.Counter { return t.ListAccountAliasesCount },
+		expected:      []string{"production", "legacy"},
+		expectedPages: 2,
+	},
+	{
+		message:       "ListAccountAliases returns partial results alongside error",
+		script:        func() *FakeClient { return withError(MethodListAccountAliases, aliasPages()) },
+		call:          callListAccountAliases,
+		counter:       func(t *CollectorTelemetry) prometheus.Counter { return t.ListAccountAliasesCount },
+		expected:      []string{"production", "legacy"},
+		expectedPages: 2,
+		expectError:   true,
+	},
+	{
+		message:     "Errors without any pages return empty results",
+		script:      func() *FakeClient { return withError(MethodGetResources, &FakeClient{}) },
+		call:        callGetResources,
+		counter:     func(t *CollectorTelemetry) prometheus.Counter { return t.GetResourcesCount },
+		expected:    []string{},
+		expectError: true,
+	},
+}
+
+func TestClientConformance(t *testing.T) {
+	implementations := map[string]func(*testing.T, *FakeClient) Client{
+		"FakeClient": func(_ *testing.T, script *FakeClient) Client { return script },
+		"AWSClient":  stubAWSClient,
+	}
+
+	for name, impl := range implementations {
+		for _, c := range conformanceCases {
+			tele := newTelemetryVecs(DefaultTelemetryLabels).collectorTelemetry(prometheus.Labels{})
+			client := impl(t, c.script())
+
+			got, err := c.call(client, tele)
+			message := fmt.Sprintf("%s: %s", name, c.message)
+			assert.Equal(t, c.expected, got, message)
+			assert.Equal(t, c.expectError, err != nil, message)
+			if err != nil {
+				var merr *MethodError
+				assert.ErrorAs(t, err, &merr, message+": errors identify the failed method")
+				assert.Contains(t, iamActions, merr.Method, message)
+			}
+			assert.Equal(t, c.expectedPages, testutil.ToFloat64(c.counter(tele)), message)
+			assert.Equal(t, 0.0, testutil.ToFloat64(tele.ErrorCount), message+": errors are counted by the caller")
+		}
+	}
+}
+
+func TestGetResourcesCallbackLastPage(t *testing.T) {
+	mapping := func(arn string) []*tagging.ResourceTagMapping {
+		return []*tagging.ResourceTagMapping{{ResourceARN: aws.String(arn)}}
+	}
+	type page struct {
+		output *tagging.GetResourcesOutput
+		last   bool
+	}
+	cases := []struct {
+		pages    []page
+		max      int
+		expected int
+		message  string
+	}{
+		{
+			pages: []page{
+				{&tagging.GetResourcesOutput{PaginationToken: aws.String("page-2"), ResourceTagMappingList: mapping("arn:1")}, false},
+				{&tagging.GetResourcesOutput{PaginationToken: aws.String("page-3"), ResourceTagMappingList: mapping("arn:2")}, false},
+				{&tagging.GetResourcesOutput{PaginationToken: aws.String(""), ResourceTagMappingList: mapping("arn:3")}, true},
+			},
+			expected: 3,
+			message:  "Paging should continue until the last page",
+		},
+		{
+			pages: []page{
+				{&tagging.GetResourcesOutput{PaginationToken: aws.String("page-2"), ResourceTagMappingList: mapping("arn:1")}, true},
+				{&tagging.GetResourcesOutput{PaginationToken: aws.String("page-3"), ResourceTagMappingList: mapping("arn:2")}, false},
+			},
+			expected: 1,
+			message:  "Paging should stop at the last page even if it has a token",
+		},
+		{
+			pages: []page{
+				{&tagging.GetResourcesOutput{PaginationToken: aws.String("page-2"), ResourceTagMappingList: mapping("arn:1")}, false},
+				{&tagging.GetResourcesOutput{PaginationToken: aws.String("page-3"), ResourceTagMappingList: mapping("arn:2")}, false},
+				{&tagging.GetResourcesOutput{PaginationToken: aws.String(""), ResourceTagMappingList: mapping("arn:3")}, true},
+			},
+			max:      2,
+			expected: 2,
+			message:  "Paging should stop at the page limit",
+		},
+	}
+
+	for _, c := range cases {
+		res := []*tagging.ResourceTagMapping{}
+		counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test"})
+		cb := callback(&res, counter, c.max)
+
+		// A paginator relying on the callback alone to stop.
+		for _, p := range c.pages {
+			if !cb(p.output, p.last) {
+				break
+			}
+		}
+		assert.Len(t, res, c.expected, c.message)
+		assert.Equal(t, float64(c.expected), testutil.ToFloat64(counter), c.message)
+	}
+}
+
+func TestGetResourcesPaginatorLastPage(t *testing.T) {
+	cases := []struct {
+		tokens   []string
+		expected []string
+		message  string
+	}{
+		{
+			tokens:   []string{"page-2", "page-3", ""},
+			expected: []string{"arn:1", "arn:2", "arn:3"},
+			message:  "Paging should continue until a page with an empty token",
+		},
+		{
+			tokens:   []string{"page-2", "", "page-4"},
+			expected: []string{"arn:1", "arn:2"},
+			message:  "A page with an empty token should be the last page",
+		},
+	}
+
+	for _, c := range cases {
+		requests := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests > len(c.tokens) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, `{"PaginationToken":%q,"ResourceTagMappingList":[{"ResourceARN":"arn:%d"}]}`, c.tokens[requests-1], requests)
+		}))
+
+		sess, err := session.NewSession(&aws.Config{
+			Region:      aws.String("us-east-1"),
+			Endpoint:    aws.String(srv.URL),
+			Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+			MaxRetries:  aws.Int(0),
+		})
+		assert.Nil(t, err)
+		tele := newTelemetryVecs(DefaultTelemetryLabels).collectorTelemetry(prometheus.Labels{})
+
+		got, err := callGetResources(&AWSClient{Region: "us-east-1", sess: sess}, tele)
+		assert.Nil(t, err, c.message)
+		assert.Equal(t, c.expected, got, c.message)
+		assert.Equal(t, float64(len(c.expected)), testutil.ToFloat64(tele.GetResourcesCount), c.message)
+		srv.Close()
+	}
+}
+
+func TestFakeClientCalls(t *testing.T) {
+	f := &FakeClient{}
+	tele := newTelemetryVecs(DefaultTelemetryLabels).collectorTelemetry(prometheus.Labels{})
+	input := &tagging.GetResourcesInput{}
+
+	_, _ = f.GetResources(context.Background(), input, tele)
+	_, _ = f.DescribeAutoScalingGroups(context.Background(), &autoscaling.DescribeAutoScalingGroupsInput{}, tele)
+
+	calls := f.Calls()
+	assert.Equal(t, 2, len(calls))
+	assert.Equal(t, MethodGetResources, calls[0].Method)
+	assert.Same(t, input, calls[0].Input)
+	assert.Equal(t, MethodDescribeAutoScalingGroups, calls[1].Method)
+}
+
+// countingProvider counts how often credentials are retrieved.
+type countingProvider struct {
+	retrieved int
+}
+
+func (p *countingProvider) Retrieve() (credentials.Value, error) {
+	p.retrieved++
+	return credentials.Value{AccessKeyID: "AKID", SecretAccessKey: "SECRET"}, nil
+}
+
+func (p *countingProvider) IsExpired() bool {
+	return false
+}
+
+func TestExpiredCredentialsRefresh(t *testing.T) {
+	cases := []struct {
+		message     string
+		expired     int
+		call        func(Client, *CollectorTelemetry) ([]string, error)
+		script      func() *FakeClient
+		expected    []string
+		expectError bool
+		refreshes   float64
+	}{
+		{
+			message:   "Expired credentials should be refreshed and the request retried",
+			expired:   1,
+			call:      callGetResources,
+			script:    resourcePages,
+			expected:  []string{"arn:1", "arn:2", "arn:3"},
+			refreshes: 1,
+		},
+		{
+			message:   "Expired credentials should be refreshed for query protocol requests",
+			expired:   1,
+			call:      callGetMetricData,
+			script:    metricDataPages,
+			expected:  []string{"id_a=[1.5]", "id_b=[2]"},
+			refreshes: 1,
+		},
+		{
+			message:     "Requests should only be retried once",
+			expired:     2,
+			call:        callDescribeAutoScalingGroups,
+			script:      groupPages,
+			expected:    []string{},
+			expectError: true,
+			refreshes:   1,
+		},
+		{
+			message:  "Valid credentials should not be refreshed",
+			call:     callListConfigResources,
+			script:   configPages,
+			expected: []string{`{"arn":"arn:1"}`, `{"arn":"arn:2"}`},
+		},
+	}
+
+	for _, c := range cases {
+		provider := &countingProvider{}
+		client := newStubAWSClient(t, &awsStub{script: c.script(), expired: c.expired}, credentials.NewCredentials(provider))
+		tele := newTelemetryVecs(DefaultTelemetryLabels).collectorTelemetry(prometheus.Labels{})
+
+		got, err := c.call(client, tele)
+		assert.Equal(t, c.expected, got, c.message)
+		assert.Equal(t, c.expectError, err != nil, c.message)
+		assert.Equal(t, c.refreshes, testutil.ToFloat64(tele.CredentialRefreshCount), c.message)
+		assert.Equal(t, int(c.refreshes)+1, provider.retrieved, c.message)
+	}
+}
+
+func TestValidRoleARN(t *testing.T) {
+	for _, roleARN := range []string{"", "arn:aws:iam::123456789012:role/promwatch", "arn:aws:iam::123456789012:role/path/promwatch"} {
+		assert.Nil(t, validRoleARN(roleARN), roleARN)
+	}
+	for _, roleARN := range []string{"promwatch", "arn:aws:iam::123456789012:user/promwatch", "arn:aws:sts::123456789012:assumed-role/promwatch/session"} {
+		assert.ErrorIs(t, validRoleARN(roleARN), ErrInvalidRoleARN, roleARN)
+	}
+}
+
+func TestRoleSession(t *testing.T) {
+	var assumed []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		assumed = append(assumed, r.Form.Get("RoleArn"))
+		if r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/promwatch" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>denied</Message></Error></ErrorResponse>`)
+			return
+		}
+		// The first credentials are expired right away to force a renewal.
+		expiration := time.Now().Add(time.Hour)
+		if len(assumed) == 1 {
+			expiration = time.Now().Add(-time.Minute)
+		}
+		fmt.Fprintf(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials>
+<AccessKeyId>ASSUMED%d</AccessKeyId><SecretAccessKey>ASSUMEDSECRET</SecretAccessKey><SessionToken>TOKEN</SessionToken>
+<Expiration>%s</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`, len(assumed), expiration.UTC().Format(time.RFC3339))
+	}))
+	defer srv.Close()
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(srv.URL),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	}))
+
+	roleSess, err := roleSession(sess, "arn:aws:iam::123456789012:role/promwatch")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"arn:aws:iam::123456789012:role/promwatch"}, assumed, "The role should be assumed when the session is created")
+
+	creds, err := roleSess.Config.Credentials.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "ASSUMED2", creds.AccessKeyID, "Expired credentials of the role should be renewed")
+	assert.Equal(t, "TOKEN", creds.SessionToken, "The credentials of the assumed role should be used")
+	creds, err = roleSess.Config.Credentials.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "ASSUMED2", creds.AccessKeyID, "Valid credentials of the role should be reused")
+	assert.Len(t, assumed, 2, "Valid credentials of the role should be reused")
+
+	creds, err = sess.Config.Credentials.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, "AKID", creds.AccessKeyID, "The credentials of the original session should not change")
+
+	_, err = roleSession(sess, "arn:aws:iam::123456789012:role/denied")
+	assert.NotNil(t, err, "Roles that can not be assumed should fail the session")
+}
+
+func TestServiceClientsReused(t *testing.T) {
+	c, err := DefaultAWSClient("us-east-1", AWSOptions{}, "")
+	assert.Nil(t, err)
+	client := c.(*AWSClient)
+
+	assert.Same(t, client.getAutoscaling(), client.getAutoscaling(), "Autoscaling clients should be created once")
+	assert.Same(t, client.getElasticache(), client.getElasticache(), "Elasticache clients should be created once")
+
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs", Region: "us-east-1"}))
+	first, err := b.client()
+	assert.Nil(t, err)
+	second, err := b.client()
+	assert.Nil(t, err)
+	assert.Same(t, first, second, "Collectors should reuse their client across runs")
+}
+
+func TestAWSOptions(t *testing.T) {
+	cases := []struct {
+		opts     AWSOptions
+		expected aws.Config
+		message  string
+	}{
+		{AWSOptions{}, aws.Config{}, "Defaults should be kept without options"},
+		{
+			AWSOptions{Endpoint: "http://localhost:4566", DisableSSL: true, S3ForcePathStyle: true},
+			aws.Config{Endpoint: aws.String("http://localhost:4566"), DisableSSL: aws.Bool(true), S3ForcePathStyle: aws.Bool(true)},
+			"Options should be set",
+		},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, &c.expected, c.opts.apply(&aws.Config{}), c.message)
+	}
+
+	var config CollectorConfig
+	assert.Nil(t, yaml.Unmarshal([]byte("{type: sqs, aws_options: {endpoint: 'http://localhost:4566', disable_ssl: true, s3_force_path_style: true}}"), &config))
+	b := stripInterface(CollectorFromConfig(config))
+	client, err := b.client()
+	assert.Nil(t, err)
+	sess := client.(*AWSClient).sess
+	assert.Equal(t, "http://localhost:4566", aws.StringValue(sess.Config.Endpoint), "The endpoint should be set on the session of the collector")
+	assert.True(t, aws.BoolValue(sess.Config.DisableSSL), "SSL should be disabled on the session of the collector")
+	assert.True(t, aws.BoolValue(sess.Config.S3ForcePathStyle), "Path style should be forced on the session of the collector")
+	assert.Equal(t, 5, aws.IntValue(sess.Config.MaxRetries), "Defaults should be kept")
+}
+
+func TestValidQueryID(t *testing.T) {
+	for _, id := range []string{"id_0a1b_0", "e_x_1", "a", "id_" + strings.Repeat("f", MaxQueryIDLength-3)} {
+		assert.Nil(t, validQueryID(id), id)
+	}
+	for _, id := range []string{"", "0a1b", "Id_0a1b_0", "id-0a1b", "id_arn:aws", "id_" + strings.Repeat("f", MaxQueryIDLength-2)} {
+		assert.ErrorIs(t, validQueryID(id), ErrInvalidQueryID, id)
+	}
+}
+
+func TestEC2GetMetricDataInputChunks(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:     "ec2",
+		Offset:   300,
+		Interval: 300,
+		Period:   300,
+		MetricStats: []MetricStat{
+			{MetricName: "CPUUtilization", Stat: "Average"},
+			{MetricName: "NetworkIn", Stat: "Sum"},
+			{MetricName: "StatusCheckFailed", Stat: "Maximum"},
+		},
+	}))
+
+	resources := []*tagging.ResourceTagMapping{}
+	for i := 0; i < 600; i++ {
+		resources = append(resources, &tagging.ResourceTagMapping{
+			ResourceARN: aws.String(fmt.Sprintf("arn:aws:ec2:us-east-1:000000000000:instance/i-%017x", i)),
+		})
+	}
+	index := NewResourceIndexFromTagMapping(&resources, b.resourceID())
+
+	in := b.getMetricDataInput(index, b.metricDimensions())
+	assert.Len(t, in, 4, "1800 queries should be split into 4 requests")
+	total := 0
+	for _, i := range in {
+		assert.LessOrEqual(t, len(i.MetricDataQueries), MaxMetricDataQueryItems)
+		total += len(i.MetricDataQueries)
+	}
+	assert.Equal(t, 600*3, total, "Every instance should be queried for every metric stat")
+
+	q := in[0].MetricDataQueries[0].MetricStat.Metric
+	assert.Equal(t, "AWS/EC2", aws.StringValue(q.Namespace))
+	assert.Equal(t, "InstanceId", aws.StringValue(q.Dimensions[0].Name))
+	assert.Regexp(t, `^i-[0-9a-f]{17}$`, aws.StringValue(q.Dimensions[0].Value), "Instances should be queried by their ID")
+}
+
+func TestGetMetricDataInputLimits(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:     "lambda",
+		Offset:   300,
+		Interval: 300,
+		Period:   300,
+		MetricStats: []MetricStat{
+			{MetricName: "Errors", Stat: "Sum"},
+			{MetricName: "Invocations", Stat: "Sum"},
+			{MetricName: "Duration", Stat: "Average"},
+		},
+		Expressions: []Expression{{Expression: "m1/m2*100", Label: "ErrorRate"}},
+	}))
+
+	resources := []*tagging.ResourceTagMapping{}
+	for i := 0; i < 1000; i++ {
+		// Every third function name is long enough to exceed the query ID
+		// length limit.
+		name := fmt.Sprintf("f-%d", i)
+		if i%3 == 0 {
+			name += strings.Repeat("x", 140)
+		}
+		resources = append(resources, &tagging.ResourceTagMapping{
+			ResourceARN: aws.String("arn:aws:lambda:us-east-1:000000000000:function:" + name),
+		})
+	}
+	// Hex encoded ARNs as IDs to make the query IDs grow with the ARN.
+	index := NewResourceIndexFromTagMapping(&resources, func(r *tagging.ResourceTagMapping) string {
+		return fmt.Sprintf("%x", *r.ResourceARN)
+	})
+
+	in := b.getMetricDataInput(index, b.metricDimensions())
+	total := 0
+	for _, i := range in {
+		assert.LessOrEqual(t, len(i.MetricDataQueries), MaxMetricDataQueryItems)
+		for _, q := range i.MetricDataQueries {
+			assert.Nil(t, validQueryID(*q.Id))
+		}
+		total += len(i.MetricDataQueries)
+	}
+	assert.Equal(t, 666*4, total, "Queries of resources with too long IDs should be left out")
+	assert.Equal(t, float64(334*3), testutil.ToFloat64(b.Telemetry().ErrorCount),
+		"Left out metric stat queries should be counted as errors, expressions referencing them are skipped")
+}
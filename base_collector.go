@@ -2,15 +2,21 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/iam"
 	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 )
 
 // BaseCollector implements common functionality for most collectors.
@@ -18,6 +24,7 @@ type BaseCollector struct {
 	config    CollectorConfig
 	_client   Client
 	store     Store
+	seriesMap *SeriesMap
 	time      Time
 	telemetry *CollectorTelemetry
 	id        uuid.UUID
@@ -26,6 +33,91 @@ type BaseCollector struct {
 	namespace      string
 	dimension      string
 	resourcePrefix string
+	// dimensionLabels derives the labels of resources queried by several
+	// dimensions from those instead of the dimension, e.g. MSK brokers.
+	dimensionLabels metricDimensions
+
+	// seen keeps resources of previous runs to apply the resource grace
+	// period, see applyGrace.
+	seen map[string]*graceEntry
+	// runs counts the collection runs to determine which metric stats are
+	// due, see MetricStat.CollectEvery.
+	runs uint64
+	// scheduler is only set explicitly for testing, see chunkScheduler().
+	scheduler *ChunkScheduler
+	// pusher is only set explicitly for testing, see samplePusher().
+	pusher *Pusher
+	// cadenceRuns holds the last queried boundary of every cadence. It is
+	// kept across restarts of the collector, see dueCadences.
+	cadenceRuns map[string]time.Time
+	// storeSize is the size of the last output of storeResults, used to
+	// size the buffer of the next one. It is accessed atomically as
+	// storeResults runs asynchronously.
+	storeSize int64
+	// dualWriteWarned is the time the dual write expiry warning was logged
+	// last, see warnDualWriteExpiry.
+	dualWriteWarned time.Time
+	// phases tracks the health of the collection phases, see recordPhase.
+	phases phaseHealth
+	// accountAlias replaces the account ID in labels if set, see
+	// resolveAccountAlias.
+	accountAlias string
+	// pending holds the content of the last commit if it failed, see
+	// commit.
+	pending pendingCommit
+	// storing is held while the results of a collection are stored, so the
+	// next collection waits for the previous commit, see getMetrics.
+	storing sync.Mutex
+	// overrides holds the runtime overrides set through the control
+	// endpoint. It is kept across restarts of the collector.
+	overrides *Overrides
+	// override is the override applied at the start of the current tick,
+	// see applyOverride. Only the run goroutine accesses it.
+	override *Override
+	// queries counts the queries of the current run to enforce
+	// Override.MaxQueriesPerRun.
+	queries int
+	// panicked is set atomically by recoverPanic and consumed by
+	// countPanics, consecutivePanics is only accessed by the run
+	// goroutine.
+	panicked          int32
+	consecutivePanics int
+	// collected is set atomically once the results of a successful query
+	// phase are committed, see
+	// CollectorProc.Ready. It is kept across restarts of the collector.
+	collected int32
+	// history retains the last commits if enabled, see
+	// CollectorConfig.HistoryCommits. It is kept across restarts of the
+	// collector.
+	history *History
+	// stale tracks the series of the last commit to emit stale markers,
+	// see CollectorConfig.StaleMarkers.
+	stale staleSeries
+	// carried holds the output of the last query of the metric stats not
+	// queried in every run by statKey, see carry. Only storeResults
+	// accesses it.
+	carried map[string]*carriedStat
+	// negative holds the negative cache state by resource ID, see
+	// CollectorConfig.NegativeCache. Only the run goroutine accesses it.
+	negative map[string]*negativeEntry
+	// endpoints holds the endpoint addresses of the resources, see
+	// CollectorConfig.EndpointLabel.
+	endpoints endpointCache
+	// log is the logger at the log level of the collector if configured,
+	// see logger.
+	logOnce sync.Once
+	log     *zap.SugaredLogger
+}
+
+// maxGraceResources limits the number of missing resources held back during
+// the grace period to bound memory usage.
+const maxGraceResources = 10000
+
+// graceEntry is a previously discovered resource and the number of
+// consecutive runs it was missing from discovery.
+type graceEntry struct {
+	resource *tagging.ResourceTagMapping
+	misses   int
 }
 
 // Valid checks BaseCollector and returns true in case of valid internal state.
@@ -38,6 +130,203 @@ func (b *BaseCollector) Valid() bool {
 		return false
 	}
 
+	if len(b.config.MetricStats) == 0 {
+		_ = b.HandleError(errors.New("At least one metric stat must be configured"))
+		return false
+	}
+
+	// CloudWatch rejects periods of standard resolution metrics that are
+	// not a multiple of 60.
+	if b.config.Period <= 0 || b.config.Period%60 != 0 {
+		_ = b.HandleError(fmt.Errorf("Period must be a positive multiple of 60: %d", b.config.Period))
+		return false
+	}
+
+	if err := validateRegion(b.config.Region, b.config.AllowUnknownRegion); err != nil {
+		_ = b.HandleError(err)
+		return false
+	}
+
+	minCadence := time.Duration(0)
+	for _, s := range b.config.MetricStats {
+		if s.MetricName == "" || s.Stat == "" {
+			_ = b.HandleError(fmt.Errorf("Metric stats need a name and stat: %q %q", s.MetricName, s.Stat))
+			return false
+		}
+
+		if s.CollectEvery < 0 {
+			_ = b.HandleError(fmt.Errorf("Collect every must not be negative: %s %s %d", s.MetricName, s.Stat, s.CollectEvery))
+			return false
+		}
+
+		if err := s.Bounds.valid(s.BoundsAction); err != nil {
+			_ = b.HandleError(fmt.Errorf("Invalid bounds: %s %s: %w", s.MetricName, s.Stat, err))
+			return false
+		}
+
+		if err := b.validDimensionSets(s); err != nil {
+			_ = b.HandleError(err)
+			return false
+		}
+
+		if s.Cadence == "" {
+			continue
+		}
+		d, ok := cadences[s.Cadence]
+		if !ok {
+			_ = b.HandleError(fmt.Errorf("Unknown cadence: %s %s %s", s.MetricName, s.Stat, s.Cadence))
+			return false
+		}
+		if s.CollectEvery > 1 {
+			_ = b.HandleError(fmt.Errorf("Cadence and collect every are mutually exclusive: %s %s", s.MetricName, s.Stat))
+			return false
+		}
+		if minCadence == 0 || d < minCadence {
+			minCadence = d
+		}
+	}
+
+	if b.config.CadenceOffset < 0 || (minCadence > 0 && b.cadenceOffset() >= minCadence) {
+		_ = b.HandleError(fmt.Errorf("Cadence offset must be between 0 and the shortest cadence: %d", b.config.CadenceOffset))
+		return false
+	}
+
+	switch b.config.ResourceSource {
+	case "":
+	case ResourceSourceAWSConfig:
+		if b.config.ResourceQuery == "" {
+			_ = b.HandleError(fmt.Errorf("Resource source %s requires a resource query", ResourceSourceAWSConfig))
+			return false
+		}
+	default:
+		_ = b.HandleError(fmt.Errorf("Unknown resource source: %s", b.config.ResourceSource))
+		return false
+	}
+
+	if err := b.validExpressions(); err != nil {
+		_ = b.HandleError(err)
+		return false
+	}
+
+	if b.config.MetricNameSuffix != "" && !matchFamilySuffix.MatchString(b.config.MetricNameSuffix) {
+		_ = b.HandleError(fmt.Errorf("Invalid metric name suffix: %s", b.config.MetricNameSuffix))
+		return false
+	}
+
+	if b.config.MetricPrefix != "" && !matchMetricPrefix.MatchString(b.config.MetricPrefix) {
+		_ = b.HandleError(fmt.Errorf("Invalid metric prefix: %s", b.config.MetricPrefix))
+		return false
+	}
+
+	switch b.config.QueryID {
+	case "", QueryIDSHA1, QueryIDShort:
+	default:
+		_ = b.HandleError(fmt.Errorf("Unknown query ID: %s", b.config.QueryID))
+		return false
+	}
+
+	if b.config.ResourceGraceCycles < 0 {
+		err := fmt.Errorf("Resource grace cycles must not be negative: %d", b.config.ResourceGraceCycles)
+		_ = b.HandleError(err)
+		return false
+	}
+
+	if b.config.MaxConsecutivePanics < 0 {
+		_ = b.HandleError(fmt.Errorf("Max consecutive panics must not be negative: %d", b.config.MaxConsecutivePanics))
+		return false
+	}
+	for _, f := range b.config.DimensionFilters {
+		if err := f.valid(); err != nil {
+			_ = b.HandleError(err)
+			return false
+		}
+	}
+
+	reserved := []string{"arn", dimensionLabel(b.dimension)}
+	for _, l := range arnLabels {
+		reserved = append(reserved, l.label)
+	}
+	if err := validClassification(b.config.ClassificationLabel, b.config.ClassificationRules, reserved...); err != nil {
+		_ = b.HandleError(err)
+		return false
+	}
+
+	if _, ok := Levels[b.config.LogLevel]; b.config.LogLevel != "" && !ok {
+		_ = b.HandleError(fmt.Errorf("Unknown log level: %s", b.config.LogLevel))
+		return false
+	}
+
+	if n := b.config.NegativeCache; n.EmptyRuns < 0 || n.Every < 0 {
+		_ = b.HandleError(fmt.Errorf("Negative cache empty runs and every must not be negative: %d, %d", n.EmptyRuns, n.Every))
+		return false
+	}
+
+	if err := validEndpointLabel(b.config.Type, b.config.EndpointLabel, b.config.EndpointLabelOnSeries); err != nil {
+		_ = b.HandleError(err)
+		return false
+	}
+
+	if b.config.StoreHintBytes < 0 {
+		_ = b.HandleError(fmt.Errorf("Store hint bytes must not be negative: %d", b.config.StoreHintBytes))
+		return false
+	}
+
+	if b.config.HistoryCommits < 0 {
+		_ = b.HandleError(fmt.Errorf("History commits must not be negative: %d", b.config.HistoryCommits))
+		return false
+	}
+
+	staticKeys := make([]string, 0, len(b.config.StaticLabels))
+	for k := range b.config.StaticLabels {
+		staticKeys = append(staticKeys, k)
+	}
+	sort.Strings(staticKeys)
+	staticNames := map[string]string{}
+	for _, k := range staticKeys {
+		name := toSnakeCase(sanitize(k))
+		if name == "" {
+			_ = b.HandleError(fmt.Errorf("Invalid static label: %q", k))
+			return false
+		}
+		// Keys mapping to the same label name would randomly overwrite
+		// each other.
+		if other, ok := staticNames[name]; ok {
+			_ = b.HandleError(fmt.Errorf("Static labels %q and %q are both named %s", other, k, name))
+			return false
+		}
+		staticNames[name] = k
+	}
+
+	accountID := false
+	for _, l := range b.config.ARNLabels {
+		if _, ok := arnLabels[l]; !ok {
+			_ = b.HandleError(fmt.Errorf("Unknown ARN label: %s", l))
+			return false
+		}
+		accountID = accountID || l == "account_id"
+	}
+	if b.config.AccountAlias && !accountID {
+		_ = b.HandleError(errors.New("Account alias requires the account_id ARN label"))
+		return false
+	}
+
+	if _, err := b.config.DualWrite.expiry(); err != nil {
+		_ = b.HandleError(err)
+		return false
+	}
+
+	if err := validExpose(b.config.Expose, b.config.Name); err != nil {
+		_ = b.HandleError(err)
+		return false
+	}
+
+	for _, h := range b.config.ActiveHours {
+		if _, err := parseActiveWindow(h); err != nil {
+			_ = b.HandleError(err)
+			return false
+		}
+	}
+
 	return true
 }
 
@@ -45,7 +334,7 @@ func (b *BaseCollector) Valid() bool {
 // unchanged.
 func (b *BaseCollector) HandleError(err error) error {
 	if err != nil {
-		Logger.Error(err)
+		b.logger().Error(err)
 		b.Telemetry().ErrorCount.Inc()
 	}
 
@@ -67,9 +356,9 @@ func (b *BaseCollector) Time() Time {
 func (b *BaseCollector) Telemetry() *CollectorTelemetry {
 	if b.telemetry == nil {
 		b.telemetry = NewCollectorTelemetry(prometheus.Labels{
-			"collector_id":   string(b.ID()),
-			"collector_name": b.config.Name,
-			"collector_type": b.config.Type,
+			LabelCollectorID:   string(b.ID()),
+			LabelCollectorName: b.config.Name,
+			LabelCollectorType: b.config.Type,
 		})
 	}
 
@@ -97,7 +386,7 @@ func (b *BaseCollector) getResourcesInput(resourceType string) *tagging.GetResou
 	for _, f := range b.config.TagFilters {
 		in.TagFilters = append(in.TagFilters, &tagging.TagFilter{
 			Key:    aws.String(f.Key),
-			Values: []*string{aws.String(f.Value)},
+			Values: aws.StringSlice(f.values()),
 		})
 	}
 
@@ -106,95 +395,437 @@ func (b *BaseCollector) getResourcesInput(resourceType string) *tagging.GetResou
 
 // storeResults takes a *ResourceIndex and transforms the query results stored
 // in it into prometheus compatible metrics and stores them in a buffer that
-// gets used when the metrics get requested.
-func (b *BaseCollector) storeResults(index *ResourceIndex) {
-	buf := bytes.Buffer{}
+// gets used when the metrics get requested. It returns the error of the
+// commit.
+func (b *BaseCollector) storeResults(index *ResourceIndex) error {
+	bounds := b.statBounds()
+	// Samples are only kept for pushing, the history and the registry
+	// exposition, the store gets the formatted lines.
+	pusher := b.samplePusher()
+	exposed := exposition != nil && b.config.Expose != ExposeNamedOnly
+	keepSamples := pusher != nil || b.history != nil || exposed
+	samples := []Sample{}
+	series := []seriesEntry{}
+	names := map[string][]string{}
+	current := map[string]Sample{}
+	carriedKeys := b.carriedStats()
+	queried := map[string]struct{}{}
+	fresh := map[string]*carriedStat{}
+	size := atomic.LoadInt64(&b.storeSize)
+	if size == 0 {
+		size = int64(b.config.StoreHintBytes)
+	}
+	buf := make([]byte, 0, size)
+	// Families are checked once per commit against the telemetry served
+	// alongside.
+	taken := familyGuard.families()
+	static := staticLabels(b.config.StaticLabels)
+	infoName := ""
+	if b.config.EndpointLabel && !b.config.EndpointLabelOnSeries {
+		if guarded := b.guardFamilies(taken, []string{b.endpointInfoName()}); len(guarded) > 0 {
+			infoName = guarded[0]
+		}
+	}
 	for id, r := range index.Resources {
-		Logger.Debugw(*r.ResourceARN, "id", b.ID(), "name", b.config.Name, "type", b.config.Type)
-		tags, err := defaultExtraTags(b.dimension, b.resourcePrefix)(r)
+		b.logger().Debugw(*r.ResourceARN, "id", b.ID(), "name", b.config.Name, "type", b.config.Type)
+		tags, err := b.extraTags(r)
 		_ = b.HandleError(err)
-		t := convertTags(r, b.config.MergeTags, tags...)
+		if class := b.classify(r); class != nil {
+			tags = append(tags, class)
+		}
+		endpoint := ""
+		if b.config.EndpointLabel {
+			endpoint = b.endpoints.get(aws.StringValue(r.ResourceARN))
+		}
+		if endpoint != "" && b.config.EndpointLabelOnSeries {
+			tags = append(tags, &tagging.Tag{Key: aws.String(LabelEndpoint), Value: aws.String(endpoint)})
+		}
+		labels := withInstanceLabels(withStaticLabels(convertLabels(r, b.config.MergeTags, tags...), static))
+		formatted := labelsToString(labels)
+		if endpoint != "" && infoName != "" {
+			info := Sample{
+				Name:      infoName,
+				Labels:    append(labels[:len(labels):len(labels)], Label{LabelEndpoint, endpoint}),
+				Value:     1,
+				Timestamp: b.Time().Now().UnixMilli(),
+			}
+			buf = appendSample(buf, info.Name, labelsToString(info.Labels), info.Value, info.Timestamp)
+			if keepSamples {
+				samples = append(samples, info)
+			}
+		}
+		fp := fingerprint(labels)
+		var resource *SeriesResource
 		for _, query := range index.Queries[id] {
 			res, ok := index.Results[*query.Id]
+			// Observed before zero filling to reflect the datapoints
+			// returned by CloudWatch.
+			datapoints := 0
+			if ok {
+				datapoints = len(res.Values)
+			}
+			b.Telemetry().DatapointsPerSeries.Observe(float64(datapoints))
+			if w, zeroFill := index.ZeroFill[*query.Id]; zeroFill {
+				res, ok = w.zeroFill(query, res), true
+			}
+			if !ok {
+				b.logger().Warn(*query.Id, " not found in results")
+				continue
+			}
+			queryLabels, queryFormatted, queryFP := labels, formatted, fp
+			if set, ok := index.DimensionSets[*query.Id]; ok {
+				queryLabels = withInstanceLabels(withStaticLabels(convertLabels(r, b.config.MergeTags, append(tags[:len(tags):len(tags)], set.tags()...)...), static))
+				queryFormatted = labelsToString(queryLabels)
+				queryFP = fingerprint(queryLabels)
+			}
+			var key string
+			if query.MetricStat != nil {
+				key = statKey(*query.MetricStat.Metric.MetricName, *query.MetricStat.Stat)
+			} else {
+				// Expressions have no metric stat and are named by
+				// their label.
+				key = statKey(aws.StringValue(query.Label), "")
+			}
+			_, carried := carriedKeys[key]
+			if carried {
+				queried[key] = struct{}{}
+				if fresh[key] == nil {
+					fresh[key] = &carriedStat{}
+				}
+			}
+			statNames, ok := names[key]
 			if !ok {
-				Logger.Warn(*query.Id, " not found in results")
+				if query.MetricStat != nil {
+					statNames = b.metricNames(*query.MetricStat.Metric.MetricName, *query.MetricStat.Stat)
+				} else {
+					statNames = []string{b.expressionName(aws.StringValue(query.Label))}
+				}
+				statNames = b.guardFamilies(taken, statNames)
+				names[key] = statNames
+			}
+			if len(statNames) == 0 {
 				continue
 			}
+			bound := bounds[key]
 			for i, v := range res.Values {
-				fmt.Fprintf(
-					&buf,
-					"promwatch_aws_%s_%s_%s{%s} %f %d\n",
-					b.config.Type,
-					toSnakeCase(sanitize(*query.MetricStat.Metric.MetricName)),
-					toSnakeCase(sanitize(*query.MetricStat.Stat)),
-					t,
-					*v,
-					index.Results[*query.Id].Timestamps[i].Unix()*1000)
+				value, keep, out := bound.bounds.apply(*v, bound.action)
+				if out {
+					b.Telemetry().OutOfBoundsCount.WithLabelValues(statNames[0]).Inc()
+				}
+				if !keep {
+					continue
+				}
+				timestamp := res.Timestamps[i].Unix() * 1000
+				for _, name := range statNames {
+					buf = appendSample(buf, name, queryFormatted, value, timestamp)
+					if b.config.StaleMarkers {
+						current[seriesKey(name, queryFormatted)] = Sample{Name: name, Labels: queryLabels}
+					}
+					sample := Sample{
+						Name:      name,
+						Labels:    queryLabels,
+						Value:     value,
+						Timestamp: timestamp,
+					}
+					if keepSamples {
+						samples = append(samples, sample)
+					}
+					if carried {
+						fresh[key].samples = append(fresh[key].samples, sample)
+					}
+				}
+			}
+
+			if len(res.Values) == 0 {
+				continue
+			}
+			if resource == nil {
+				resource = newSeriesResource(r, b.config.Type, queryDimension(query, b.dimension), b.config.MergeTags)
 			}
+			for _, name := range statNames {
+				entry := seriesEntry{metric: name, fingerprint: queryFP, resource: resource}
+				series = append(series, entry)
+				if carried {
+					fresh[key].series = append(fresh[key].series, entry)
+				}
+			}
+		}
+	}
+
+	// Metric stats not due in this run are committed with the output of
+	// their last query.
+	for _, c := range b.carry(carriedKeys, queried, fresh) {
+		for _, s := range c.samples {
+			formatted := labelsToString(s.Labels)
+			buf = appendSample(buf, s.Name, formatted, s.Value, s.Timestamp)
+			if b.config.StaleMarkers {
+				current[seriesKey(s.Name, formatted)] = Sample{Name: s.Name, Labels: s.Labels}
+			}
+			if keepSamples {
+				samples = append(samples, s)
+			}
+		}
+		series = append(series, c.series...)
+	}
+
+	for _, s := range b.orphanSamples(index, taken) {
+		buf = appendSample(buf, s.Name, labelsToString(s.Labels), s.Value, s.Timestamp)
+		if keepSamples {
+			samples = append(samples, s)
+		}
+	}
+
+	// Stale markers are only pushed, the text format of the store can not
+	// tell the staleness NaN apart from other NaN values.
+	pushed := samples
+	if b.config.StaleMarkers && pusher != nil {
+		pushed = append(samples[:len(samples):len(samples)], b.stale.markers(current, b.Time().Now().UnixMilli())...)
+	}
+
+	atomic.StoreInt64(&b.storeSize, int64(len(buf)))
+	// The samples are exposed first so /metrics never serves the store of a
+	// collector whose samples are exposed through the registry.
+	if exposed {
+		exposition.set(b.ID(), samples)
+	}
+	err := b.commit(buf)
+	b.recordPhase(PhaseStore, err)
+	if err == nil && b.history != nil {
+		b.Telemetry().HistoryBytes.Set(float64(b.history.add(b.Time().Now(), samples)))
+	}
+	if b.seriesMap != nil {
+		b.seriesMap.set(series)
+	}
+
+	if pusher != nil {
+		pusher.Enqueue(pushed)
+	}
+
+	return err
+}
+
+// extraTags returns the labels derived from the resource, see defaultExtraTags.
+// The dimension label is replaced by the labels of dimensionLabels if set.
+func (b *BaseCollector) extraTags(r *tagging.ResourceTagMapping) ([]*tagging.Tag, error) {
+	if b.dimensionLabels == nil {
+		return defaultExtraTags(b.dimension, b.resourcePrefix, b.accountAlias, b.config.ARNLabels...)(r)
+	}
+
+	tags, err := defaultExtraTags("", b.resourcePrefix, b.accountAlias, b.config.ARNLabels...)(r)
+	if err != nil {
+		return tags, err
+	}
+	dims, err := b.dimensionLabels(r)
+	for _, d := range dims {
+		tags = append(tags, &tagging.Tag{Key: aws.String(dimensionLabel(*d.Name)), Value: d.Value})
+	}
+
+	return tags, err
+}
+
+// statBound is the bounds applied to the values of a metric stat.
+type statBound struct {
+	bounds *Bounds
+	action string
+}
+
+func statKey(metric, stat string) string {
+	return metric + "\xff" + stat
+}
+
+// validDimensionSets returns an error if a dimension set of s has empty names
+// or values, or a dimension whose label would collide with the labels derived
+// from the resource, which would make the series of the sets indistinguishable.
+func (b *BaseCollector) validDimensionSets(s MetricStat) error {
+	taken := map[string]struct{}{
+		"arn":                       {},
+		dimensionLabel(b.dimension): {},
+	}
+	for _, c := range b.config.ARNLabels {
+		taken[arnLabels[c].label] = struct{}{}
+	}
+
+	for _, set := range s.DimensionSets {
+		for name, value := range set {
+			if name == "" || value == "" {
+				return fmt.Errorf("Dimension sets must not contain empty names or values: %s %s", s.MetricName, s.Stat)
+			}
+			if _, ok := taken[dimensionLabel(name)]; ok {
+				return fmt.Errorf("Dimension set collides with resource label: %s %s %s", s.MetricName, s.Stat, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// statBounds returns the bounds of the configured metric stats keyed by
+// statKey. Metric stats without bounds get the default bounds of their
+// metric unless disabled.
+func (b *BaseCollector) statBounds() map[string]statBound {
+	bounds := map[string]statBound{}
+	for _, s := range b.config.MetricStats {
+		bound := statBound{bounds: s.Bounds, action: s.BoundsAction}
+		if bound.bounds == nil && !b.config.DisableDefaultBounds {
+			bound.bounds = defaultBounds(b.namespace, s.MetricName, s.Stat)
+		}
+		if bound.bounds != nil {
+			bounds[statKey(s.MetricName, s.Stat)] = bound
 		}
 	}
-	b.store.Add(buf.String())
-	b.store.Commit()
+
+	return bounds
 }
 
 // makeQueries produces a list of CloudWatch metrics data queries from the
 // resources in the passed in ResourceIndex and the collector config that
-// defines the metrics that are supposed to be queried.
+// defines the metrics that are supposed to be queried. Metric stats with a
+// cadence are left out, see cadenceInputs. The queries of the expressions
+// follow the queries of the metric stats.
 func (b *BaseCollector) makeQueries(index *ResourceIndex, namespace string, dimensions metricDimensions) []*cloudwatch.MetricDataQuery {
+	dataQuery := b.makeStatQueries(index, namespace, dimensions, int64(b.config.Period), func(s MetricStat) bool {
+		return s.Cadence == "" && s.due(b.runs)
+	})
+
+	return append(dataQuery, b.makeExpressionQueries(index)...)
+}
+
+// makeStatQueries produces the queries of the metric stats matching include
+// with the given period.
+func (b *BaseCollector) makeStatQueries(index *ResourceIndex, namespace string, dimensions metricDimensions, period int64, include func(MetricStat) bool) []*cloudwatch.MetricDataQuery {
 	dataQuery := []*cloudwatch.MetricDataQuery{}
-	for id, r := range index.Resources {
+	for _, id := range b.queryOrder(index) {
+		r := index.Resources[id]
 		for i, s := range b.config.MetricStats {
+			if !include(s) || b.override.disables(s.MetricName) {
+				continue
+			}
 			d, err := dimensions(r)
 			if err != nil {
 				_ = b.HandleError(err)
 				continue
 			}
-			query := cloudwatch.MetricDataQuery{
-				Id: aws.String(fmt.Sprintf("%s_%s_%d", "id", id, i)),
-				MetricStat: &cloudwatch.MetricStat{
-					Metric: &cloudwatch.Metric{
-						Dimensions: d,
-						MetricName: aws.String(s.MetricName),
-						Namespace:  aws.String(namespace),
+			sets := s.dimensionSets(namespace)
+			for j, set := range sets {
+				if b.queryBudgetExhausted() {
+					return dataQuery
+				}
+				dims := append(append([]*cloudwatch.Dimension{}, d...), set.dimensions()...)
+				if !allowedDimensions(b.config.DimensionFilters, dims) {
+					b.Telemetry().FilteredDimensionsCount.Inc()
+					continue
+				}
+				queryID := fmt.Sprintf("%s_%s_%d", "id", id, i)
+				if len(sets) > 1 || len(set) > 0 {
+					queryID = fmt.Sprintf("%s_%d", queryID, j)
+				}
+				// Invalid IDs are left out as they would fail all
+				// queries of the request.
+				if err := validQueryID(queryID); err != nil {
+					_ = b.HandleError(fmt.Errorf("%w, resource %s", err, aws.StringValue(r.ResourceARN)))
+					continue
+				}
+				query := cloudwatch.MetricDataQuery{
+					Id: aws.String(queryID),
+					MetricStat: &cloudwatch.MetricStat{
+						Metric: &cloudwatch.Metric{
+							Dimensions: dims,
+							MetricName: aws.String(s.MetricName),
+							Namespace:  aws.String(namespace),
+						},
+						Period: aws.Int64(period),
+						Stat:   aws.String(s.Stat),
 					},
-					Period: aws.Int64(int64(b.config.Period)),
-					Stat:   aws.String(s.Stat),
-				},
+				}
+				dataQuery = append(dataQuery, &query)
+				index.Queries[id] = append(index.Queries[id], &query)
+				if len(set) > 0 {
+					index.DimensionSets[queryID] = set
+				}
+				if s.ZeroFill {
+					index.ZeroFill[queryID] = queryWindow{}
+				}
+				b.queries++
 			}
-			dataQuery = append(dataQuery, &query)
-			index.Queries[id] = append(index.Queries[id], &query)
 		}
 	}
 
 	return dataQuery
 }
 
+// queryOrder returns the IDs of the resources in index not skipped by the
+// negative cache. They are sorted if the number of queries is limited by an
+// override, so the same resources are queried in every run.
+func (b *BaseCollector) queryOrder(index *ResourceIndex) []string {
+	ids := make([]string, 0, len(index.Resources))
+	for id := range index.Resources {
+		if _, skipped := index.Skipped[id]; skipped {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if b.override != nil && b.override.MaxQueriesPerRun > 0 {
+		sort.Strings(ids)
+	}
+
+	return ids
+}
+
+// queryBudgetExhausted returns true if the queries of the current run reached
+// the limit of the active override.
+func (b *BaseCollector) queryBudgetExhausted() bool {
+	return b.override != nil && b.override.MaxQueriesPerRun > 0 && b.queries >= b.override.MaxQueriesPerRun
+}
+
 // getMetricDataInput prepares the request payloads to query CloudWatch based on
 // listed resources and the collector configuration. It will ensure each request
 // only contains the allowed number of query items.
 func (b *BaseCollector) getMetricDataInput(index *ResourceIndex, dim metricDimensions) []*cloudwatch.GetMetricDataInput {
 	dataQuery := b.makeQueries(index, b.namespace, dim)
-	ins := []*cloudwatch.GetMetricDataInput{}
 
 	endTime := b.Time().Now().UTC().Add(time.Duration(-b.config.Offset) * time.Second)
-	startTime := endTime.Add(time.Duration(-b.config.Interval) * time.Second)
+	startTime := endTime.Add(-b.interval())
 
-	// Create a new getMetricDataInput for every MaxMetricDataQueryItems.
-	for i := 0; i < len(dataQuery); i += MaxMetricDataQueryItems {
-		end := i + MaxMetricDataQueryItems
+	return chunkQueries(dataQuery, startTime, endTime)
+}
 
-		if end > len(dataQuery) {
-			end = len(dataQuery)
+// cadenceInputs prepares the request payloads for the metric stats of the due
+// cadences. Every cadence is queried with its duration as period over the last
+// two full periods aligned to UTC, so datapoints published late are picked up
+// as well.
+func (b *BaseCollector) cadenceInputs(index *ResourceIndex, dim metricDimensions, due map[string]time.Time) []*cloudwatch.GetMetricDataInput {
+	ins := []*cloudwatch.GetMetricDataInput{}
+	for _, c := range []string{CadenceHourly, CadenceDaily} {
+		if _, ok := due[c]; !ok {
+			continue
 		}
 
+		d := cadences[c]
+		dataQuery := b.makeStatQueries(index, b.namespace, dim, int64(d.Seconds()), func(s MetricStat) bool {
+			return s.Cadence == c
+		})
+
+		endTime := b.Time().Now().UTC().Add(-b.cadenceOffset()).Truncate(d)
+		startTime := endTime.Add(-2 * d)
+		ins = append(ins, chunkQueries(dataQuery, startTime, endTime)...)
+	}
+
+	return ins
+}
+
+// chunkQueries creates a new GetMetricDataInput for every
+// MaxMetricDataQueryItems queries, see splitQueries.
+func chunkQueries(dataQuery []*cloudwatch.MetricDataQuery, startTime, endTime time.Time) []*cloudwatch.GetMetricDataInput {
+	ins := []*cloudwatch.GetMetricDataInput{}
+	for _, chunk := range splitQueries(dataQuery) {
 		in := &cloudwatch.GetMetricDataInput{
-			EndTime:   &endTime,
-			StartTime: &startTime,
+			EndTime:   aws.Time(endTime),
+			StartTime: aws.Time(startTime),
 			// Order matters later in the Prometheus metrics output where
 			// timestamps have to be ordered as Prometheus will only ingest
 			// ascending timestamps for the same time series.
 			ScanBy:            &TimestampAscending,
-			MetricDataQueries: dataQuery[i:end],
+			MetricDataQueries: chunk,
 		}
 
 		ins = append(ins, in)
@@ -203,12 +834,39 @@ func (b *BaseCollector) getMetricDataInput(index *ResourceIndex, dim metricDimen
 	return ins
 }
 
+// cadenceOffset returns the configured offset of cadence boundaries.
+func (b *BaseCollector) cadenceOffset() time.Duration {
+	return time.Duration(b.config.CadenceOffset) * time.Second
+}
+
+// dueCadences returns the cadences of the configured metric stats whose
+// current boundary was not queried yet, mapped to that boundary. Boundaries
+// are aligned to UTC hours and days shifted by the cadence offset.
+func (b *BaseCollector) dueCadences(now time.Time) map[string]time.Time {
+	due := map[string]time.Time{}
+	for _, s := range b.config.MetricStats {
+		d, ok := cadences[s.Cadence]
+		if !ok {
+			continue
+		}
+
+		boundary := now.UTC().Add(-b.cadenceOffset()).Truncate(d).Add(b.cadenceOffset())
+		if last, ok := b.cadenceRuns[s.Cadence]; ok && !boundary.After(last) {
+			continue
+		}
+		due[s.Cadence] = boundary
+	}
+
+	return due
+}
+
 // collect issues the requests to CloudWatch and transforms and stores the
 // results.
-func (b *BaseCollector) collect(getResources resourceGetter, dim metricDimensions) error {
+func (b *BaseCollector) collect(ctx context.Context, getResources resourceGetter, dim metricDimensions) error {
 	start := time.Now()
-	Logger.Debugw("starting to collect", "id", b.ID(), "name", b.config.Name, "type", b.config.Type)
+	b.logger().Debugw("starting to collect", "id", b.ID(), "name", b.config.Name, "type", b.config.Type)
 	defer func() {
+		b.runs++
 		b.Telemetry().RunCount.Inc()
 		b.Telemetry().RunDuration.Set(time.Since(start).Seconds())
 	}()
@@ -217,62 +875,332 @@ func (b *BaseCollector) collect(getResources resourceGetter, dim metricDimension
 		getResources = b.getResources
 	}
 
-	index, err := getResources()
+	index, err := getResources(ctx)
+	b.recordPhase(PhaseDiscovery, err)
 	if err != nil {
 		return err
 	}
+	b.refreshEndpoints(ctx)
+	// Stopping the collector is not an error, there is just nothing left
+	// to do.
+	if ctx.Err() != nil {
+		return nil
+	}
 	b.Telemetry().MatchingResources.Set(float64(len(index.Resources)))
+	b.Telemetry().GraceResources.Set(float64(b.applyGrace(index)))
+	b.Telemetry().EstimatedSeries.Set(float64(len(index.Resources) * b.seriesPerResource()))
 
-	b.getMetrics(index, dim)
+	b.getMetrics(ctx, index, dim)
 	duration := time.Since(start)
 
-	Logger.Debugw(fmt.Sprintf("Finished after %.2fs", duration.Seconds()), "id", b.ID(), "name", b.config.Name, "type", b.config.Type)
+	b.logger().Debugw(fmt.Sprintf("Finished after %.2fs", duration.Seconds()), "id", b.ID(), "name", b.config.Name, "type", b.config.Type, "override", b.override)
 	return nil
 }
 
-func (b *BaseCollector) client() (Client, error) {
-	// Check if a client is set explicitly (usually for testing) and create a
-	// new one otherwise.
-	client := b._client
-	if client == nil {
-		return DefaultAWSClient(b.config.Region)
+// active returns true if now is within any of the configured active hours or
+// no active hours are configured. Invalid windows are ignored as they are
+// rejected by Valid.
+func (b *BaseCollector) active(now time.Time) bool {
+	if len(b.config.ActiveHours) == 0 {
+		return true
+	}
+
+	for _, h := range b.config.ActiveHours {
+		w, err := parseActiveWindow(h)
+		if err == nil && w.contains(now) {
+			return true
+		}
 	}
 
-	return client, nil
+	return false
+}
+
+// collectIfActive runs collect unless the collector is outside of its active
+// hours or the replica is not the leader, in which case no AWS calls are issued
+// until the next interval. The dual write expiry warning is checked on every
+// run regardless.
+func (b *BaseCollector) collectIfActive(ctx context.Context, getResources resourceGetter, dim metricDimensions) error {
+	b.warnDualWriteExpiry(b.Time().Now())
+	if !b.active(b.Time().Now()) {
+		b.logger().Debugw("outside of active hours, skipping collection", "id", b.ID(), "name", b.config.Name, "type", b.config.Type)
+		return nil
+	}
+	if !isLeader() {
+		b.logger().Debugw("not the leader, skipping collection", "id", b.ID(), "name", b.config.Name, "type", b.config.Type)
+		return nil
+	}
+
+	return b.collect(ctx, getResources, dim)
+}
+
+// tick runs a collection of the run loop. The next tick is scheduled an
+// interval after the collection finished, so a collection taking longer than
+// the interval delays all following ones. Such overruns are logged and
+// counted. Panics of the collection are recovered, see recoverPanic.
+func (b *BaseCollector) tick(ctx context.Context, getResources resourceGetter, dim metricDimensions) time.Duration {
+	b.applyOverride()
+
+	start := b.Time().Now()
+	err := b.safeCollect(ctx, getResources, dim)
+	_ = b.HandleError(err)
+	b.countPanics()
+
+	took := b.Time().Now().Sub(start)
+	interval := b.interval()
+	if interval > 0 && took > interval {
+		b.logger().Warnw("collection overran its interval, ticks are delayed", "id", b.ID(), "name", b.config.Name, "type", b.config.Type, "took", took, "interval", interval)
+		b.Telemetry().IntervalOverrunsCount.Inc()
+	}
+
+	return b.untilNextTick(interval)
+}
+
+// untilNextTick returns the time until the next tick. An interval stretched by
+// the active override is capped at its expiry, but not below the configured
+// interval, so the configured interval applies again once the override expired
+// instead of only after the stretched interval.
+func (b *BaseCollector) untilNextTick(interval time.Duration) time.Duration {
+	if b.override == nil {
+		return interval
+	}
+
+	left := b.override.Expires.Sub(b.Time().Now())
+	if configured := time.Duration(b.config.Interval) * time.Second; left < configured {
+		left = configured
+	}
+	if left < interval {
+		return left
+	}
 
+	return interval
 }
 
-func (b *BaseCollector) getResources() (*ResourceIndex, error) {
+// interval returns the configured interval stretched by the active override.
+func (b *BaseCollector) interval() time.Duration {
+	return b.override.interval(time.Duration(b.config.Interval) * time.Second)
+}
+
+// applyOverride activates the pending override and drops the active one once
+// expired. It is called at the start of every tick, so overrides never change
+// a collection in flight.
+func (b *BaseCollector) applyOverride() {
+	if b.overrides == nil {
+		return
+	}
+
+	o := b.overrides.apply(b.Time().Now())
+	if o != b.override {
+		if o == nil {
+			b.logger().Infow("override expired", "id", b.ID(), "name", b.config.Name, "type", b.config.Type)
+		} else {
+			b.logger().Infow("override applied", "id", b.ID(), "name", b.config.Name, "type", b.config.Type, "override", o)
+		}
+	}
+	b.override = o
+	b.Telemetry().OverrideActive.Set(boolFloat(o != nil))
+}
+
+// applyGrace adds resources to index that were discovered in previous runs but
+// are missing from the current discovery result for at most the configured
+// number of resource grace cycles. This smooths over resources transiently
+// missing from eventually consistent discovery APIs. It returns the number of
+// resources held in the index that way.
+func (b *BaseCollector) applyGrace(index *ResourceIndex) int {
+	if b.config.ResourceGraceCycles <= 0 {
+		return 0
+	}
+
+	if b.seen == nil {
+		b.seen = map[string]*graceEntry{}
+	}
+
+	for id, r := range index.Resources {
+		b.seen[id] = &graceEntry{resource: r}
+	}
+
+	held := 0
+	for id, e := range b.seen {
+		if _, ok := index.Resources[id]; ok {
+			continue
+		}
+
+		e.misses++
+		if e.misses > b.config.ResourceGraceCycles || held >= maxGraceResources {
+			delete(b.seen, id)
+			continue
+		}
+
+		b.logger().Debugw("holding missing resource", "arn", aws.StringValue(e.resource.ResourceARN), "misses", e.misses, "id", b.ID())
+		index.Resources[id] = e.resource
+		held++
+	}
+
+	return held
+}
+
+func (b *BaseCollector) client() (Client, error) {
+	// Use the client set explicitly (usually for testing) or created by a
+	// previous run, so sessions and connections are reused across runs.
+	if b._client == nil {
+		client, err := DefaultAWSClient(b.config.Region, b.config.AWSOptions, b.config.RoleARN)
+		if err != nil {
+			return nil, err
+		}
+		auditLog.attach(client, b)
+		b._client = client
+	}
+
+	return b._client, nil
+}
+
+func (b *BaseCollector) getResources(ctx context.Context) (*ResourceIndex, error) {
+	if b.config.ResourceSource == ResourceSourceAWSConfig {
+		return b.getConfigResources(ctx)
+	}
+
 	client, err := b.client()
 	if err != nil {
 		return nil, err
 	}
 
 	input := b.getResourcesInput(b.resourceName)
-	resources, err := client.GetResources(input, b.Telemetry())
+	resources, err := client.GetResources(ctx, input, b.Telemetry())
 	if err != nil {
 		return nil, err
 	}
 
-	return NewResourceIndexFromTagMapping(resources, id), nil
+	return NewResourceIndexFromTagMapping(resources, b.resourceID()), nil
+}
+
+// resourceID returns the function creating the IDs of resources, see
+// CollectorConfig.QueryID.
+func (b *BaseCollector) resourceID() func(*tagging.ResourceTagMapping) string {
+	if b.config.QueryID == QueryIDShort {
+		return shortID
+	}
+
+	return id
 }
 
-func (b *BaseCollector) getMetrics(index *ResourceIndex, dim metricDimensions) {
-	in := b.getMetricDataInput(index, dim)
+func (b *BaseCollector) getMetrics(ctx context.Context, index *ResourceIndex, dim metricDimensions) {
+	b.queries = 0
+	if skip := b.probation(index); skip != nil {
+		index.Skipped = skip
+	}
+	due := b.dueCadences(b.Time().Now())
+	in := append(b.getMetricDataInput(index, dim), b.cadenceInputs(index, dim, due)...)
+	index.setZeroFillWindows(in)
 
 	client, err := b.client()
 	if err != nil {
+		b.recordPhase(PhaseQuery, err)
 		_ = b.HandleError(err)
 		return
 	}
 
-	res, err := client.GetMetricData(in, b.Telemetry())
+	res, err := b.getMetricData(ctx, client, in)
+	// Results of a cancelled collection are incomplete and not stored.
+	if ctx.Err() != nil {
+		return
+	}
+	b.recordPhase(PhaseQuery, err)
 	if err != nil {
 		_ = b.HandleError(err)
+		// Results missing due to failed requests must not be zero filled.
+		index.ZeroFill = map[string]queryWindow{}
+	} else {
+		// Boundaries are only recorded once queried successfully so they
+		// are retried in the next run otherwise.
+		if b.cadenceRuns == nil {
+			b.cadenceRuns = map[string]time.Time{}
+		}
+		for c, boundary := range due {
+			b.cadenceRuns[c] = boundary
+		}
 	}
 	index.AddResults(res)
+	// Resources are only judged by complete results.
+	if err == nil {
+		b.updateNegativeCache(index)
+	}
+
+	// Results are stored asynchronously, but one collection at a time so
+	// overlapping collections commit in order. The lock is released by the
+	// storing goroutine.
+	// The collector is ready once the results of a run that queried all
+	// metrics successfully are committed.
+	complete := err == nil
+	b.storing.Lock()
+	go func() {
+		defer b.storing.Unlock()
+		if b.safeStoreResults(index) == nil && complete {
+			atomic.StoreInt32(&b.collected, 1)
+		}
+	}()
+}
+
+// samplePusher returns the Pusher committed samples are pushed to or nil if
+// pushing is not configured.
+func (b *BaseCollector) samplePusher() *Pusher {
+	if b.pusher != nil {
+		return b.pusher
+	}
+
+	return pusher
+}
 
-	go b.storeResults(index)
+// chunkScheduler returns the scheduler GetMetricData requests have to wait for
+// or nil if requests are not rate limited.
+func (b *BaseCollector) chunkScheduler() *ChunkScheduler {
+	if b.scheduler != nil {
+		return b.scheduler
+	}
+
+	return chunkScheduler
+}
+
+// getMetricData requests the metric data for all inputs. In case a scheduler is
+// configured every input is requested on its own once the scheduler dispatches
+// it, unless ctx is cancelled by then.
+func (b *BaseCollector) getMetricData(ctx context.Context, client Client, in []*cloudwatch.GetMetricDataInput) (*[]*cloudwatch.MetricDataResult, error) {
+	scheduler := b.chunkScheduler()
+	if scheduler == nil {
+		return client.GetMetricData(ctx, in, b.Telemetry())
+	}
+
+	// ID and telemetry are initialized lazily and have to be resolved before
+	// being used concurrently.
+	collectorID, tele := b.ID(), b.Telemetry()
+
+	type lock struct {
+		sync.Mutex
+		r    []*cloudwatch.MetricDataResult
+		errs []error
+	}
+	res := lock{
+		r: []*cloudwatch.MetricDataResult{},
+	}
+	wg := sync.WaitGroup{}
+	for _, input := range in {
+		wg.Add(1)
+		go func(ip *cloudwatch.GetMetricDataInput) {
+			defer wg.Done()
+			if scheduler.Wait(ctx, collectorID, tele) != nil {
+				return
+			}
+			r, err := client.GetMetricData(ctx, []*cloudwatch.GetMetricDataInput{ip}, tele)
+
+			res.Lock()
+			defer res.Unlock()
+			res.r = append(res.r, *r...)
+			if err != nil {
+				res.errs = append(res.errs, err)
+			}
+		}(input)
+	}
+	wg.Wait()
+
+	return &res.r, errors.Join(res.errs...)
 }
 
 // run starts the collection job that periodically queries CloudWatch for
@@ -280,34 +1208,111 @@ func (b *BaseCollector) getMetrics(index *ResourceIndex, dim metricDimensions) {
 // collector as the parameters define the source of resources and what dimension
 // to use for the metrics queries.
 func (b *BaseCollector) run(getResources resourceGetter, dim metricDimensions) *CollectorProc {
-	b.store = NewStore()
-	proc := CollectorProc{
-		ID:    b.ID(),
-		Store: b.store,
-		Done:  make(chan MetricCollector),
-		Stop:  make(chan string),
+	// A restarted collector keeps serving its previous results until the
+	// next commit.
+	if b.store == nil {
+		b.store = b.newStore()
+	}
+	if b.seriesMap == nil {
+		b.seriesMap = NewSeriesMap()
+	}
+	proc := newCollectorProc(b.ID(), b.store)
+	proc.Name, proc.Expose = b.config.Name, b.config.Expose
+	proc.Registry = exposition != nil
+	proc.SeriesMap = b.seriesMap
+	if b.overrides == nil {
+		b.overrides = &Overrides{}
 	}
+	proc.Overrides = b.overrides
+	if b.history == nil && b.config.HistoryCommits > 0 {
+		b.history = NewHistory(b.config.HistoryCommits)
+	}
+	proc.History = b.history
+	proc.ready = func() bool { return atomic.LoadInt32(&b.collected) == 1 }
+
+	// ctx is cancelled as soon as the collector is signaled to stop, which
+	// is either a message sent on or closing of the Stop channel.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-proc.Stop
+		cancel()
+	}()
 
 	go func() {
+		defer close(proc.exited)
+
+		b.resolveAccountAlias(ctx)
+
 		// run once before starting the loop ticker
-		_ = b.HandleError(b.collect(getResources, dim))
+		timer := time.NewTimer(b.tick(ctx, getResources, dim))
+		defer timer.Stop()
 		for {
+			if b.panicLoop() {
+				b.logger().Errorw("stopping collector", "id", b.ID(), "name", b.config.Name, "type", b.config.Type, "reason", "panic loop", "panics", b.consecutivePanics)
+				proc.Done <- b
+				return
+			}
+
 			select {
-			case <-time.After(time.Duration(b.config.Interval) * time.Second):
-				_ = b.HandleError(b.collect(getResources, dim))
-			case <-proc.Stop:
+			case <-timer.C:
+				timer.Reset(b.tick(ctx, getResources, dim))
+			case <-ctx.Done():
 				proc.Done <- b
 				return
 			}
 		}
 	}()
 
-	return &proc
+	return proc
+}
+
+// resolveAccountAlias looks up the alias of the account once if enabled. The
+// resources of a collector always belong to the account of its credentials, so
+// the alias of that account applies to all of them. Without an alias, or if the
+// lookup fails, the account ID is used.
+func (b *BaseCollector) resolveAccountAlias(ctx context.Context) {
+	if !b.config.AccountAlias {
+		return
+	}
+
+	client, err := b.client()
+	if err != nil {
+		_ = b.HandleError(err)
+		return
+	}
+
+	aliases, err := client.ListAccountAliases(ctx, &iam.ListAccountAliasesInput{}, b.Telemetry())
+	if b.HandleError(err) != nil || len(*aliases) == 0 {
+		return
+	}
+
+	b.accountAlias = aws.StringValue((*aliases)[0])
+	b.logger().Infow("using account alias", "id", b.ID(), "name", b.config.Name, "alias", b.accountAlias)
+}
+
+// newStore returns a store of the configured store backend. Redis keys are
+// derived from the collector configuration so they are the same on all
+// replicas. The in memory store is pre-grown by the store hint.
+func (b *BaseCollector) newStore() Store {
+	if redisBackend != nil {
+		return redisBackend.Store(fmt.Sprintf("%s:%s:%s", b.config.Type, b.config.Name, b.config.Region))
+	}
+
+	return NewStore(b.config.StoreHintBytes)
 }
 
 // Run starts the base collector
 func (b *BaseCollector) Run() *CollectorProc {
-	return b.run(nil, defaultMetricDimension(b.dimension, b.resourcePrefix))
+	return b.run(nil, b.metricDimensions())
+}
+
+// metricDimensions returns the metricDimensions of the collector type.
+func (b *BaseCollector) metricDimensions() metricDimensions {
+	if t, ok := collectorTypes[b.config.Type]; ok && t.MetricDimensions != nil {
+		return t.MetricDimensions
+	}
+
+	return defaultMetricDimension(b.dimension, b.resourcePrefix)
 }
 
 // withTime is only required for testing to have static deterministic time
@@ -2,239 +2,1286 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
 )
 
 func TestValid(t *testing.T) {
+	stats := []MetricStat{{MetricName: "VolumeReadOps", Stat: "Sum"}}
 	cases := []struct {
 		collector *BaseCollector
 		expected  bool
 		message   string
 	}{
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      1,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+				},
+			},
+			expected: false,
+			message:  "Offset smaller than Interval should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+				},
+			},
+			expected: true,
+			message:  "Offset equal to Interval should be valid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      3,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+				},
+			},
+			expected: true,
+			message:  "Offset larger than Interval should be valid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "s3",
+					Offset:      86400,
+					Interval:    86400,
+					Period:      86400,
+					MetricStats: []MetricStat{{MetricName: "BucketSizeBytes", Stat: "Average"}},
+				},
+			},
+			expected: true,
+			message:  "Daily intervals and periods should be valid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:                "ebs",
+					Offset:              2,
+					Interval:            2,
+					Period:              60,
+					MetricStats:         stats,
+					ResourceGraceCycles: -1,
+				},
+			},
+			expected: false,
+			message:  "Negative resource grace cycles should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+					ActiveHours: []string{"08:00-18:00", "22:00-24:00"},
+				},
+			},
+			expected: true,
+			message:  "Valid active hours should be valid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+					ActiveHours: []string{"8-18"},
+				},
+			},
+			expected: false,
+			message:  "Malformed active hours should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+					ARNLabels:   []string{"region", "resource"},
+				},
+			},
+			expected: false,
+			message:  "Unknown ARN labels should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: []MetricStat{{MetricName: "BucketSizeBytes", Stat: "Average", Cadence: "weekly"}},
+				},
+			},
+			expected: false,
+			message:  "Unknown cadences should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:          "ebs",
+					Offset:        2,
+					Interval:      2,
+					Period:        60,
+					CadenceOffset: 3600,
+					MetricStats:   []MetricStat{{MetricName: "BucketSizeBytes", Stat: "Average", Cadence: CadenceHourly}},
+				},
+			},
+			expected: false,
+			message:  "Cadence offset of the shortest cadence or more should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:          "ebs",
+					Offset:        2,
+					Interval:      2,
+					Period:        60,
+					CadenceOffset: 3600,
+					MetricStats:   []MetricStat{{MetricName: "BucketSizeBytes", Stat: "Average", Cadence: CadenceDaily}},
+				},
+			},
+			expected: true,
+			message:  "Cadence offset shorter than the cadence should be valid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+					Region:      "eu-central-1",
+				},
+			},
+			expected: true,
+			message:  "Known region should be valid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+					Region:      "us-east1",
+				},
+			},
+			expected: false,
+			message:  "Malformed region should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:               "ebs",
+					Offset:             2,
+					Interval:           2,
+					Period:             60,
+					MetricStats:        stats,
+					Region:             "us-east1",
+					AllowUnknownRegion: true,
+				},
+			},
+			expected: false,
+			message:  "Malformed region should be invalid even if unknown regions are allowed",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+					Region:      "xx-future-9",
+				},
+			},
+			expected: false,
+			message:  "Unknown region should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:               "ebs",
+					Offset:             2,
+					Interval:           2,
+					Period:             60,
+					MetricStats:        stats,
+					Region:             "xx-future-9",
+					AllowUnknownRegion: true,
+				},
+			},
+			expected: true,
+			message:  "Unknown well formed region should be valid if unknown regions are allowed",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:           "ebs",
+					Offset:         2,
+					Interval:       2,
+					Period:         60,
+					MetricStats:    stats,
+					ResourceSource: ResourceSourceAWSConfig,
+				},
+			},
+			expected: false,
+			message:  "AWS Config resource source without query should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:           "ebs",
+					Offset:         2,
+					Interval:       2,
+					Period:         60,
+					MetricStats:    stats,
+					ResourceSource: "unknown",
+				},
+			},
+			expected: false,
+			message:  "Unknown resource source should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+					QueryID:     "md5",
+				},
+			},
+			expected: false,
+			message:  "Unknown query ID should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:     "ebs",
+					Offset:   2,
+					Interval: 2,
+					Period:   60,
+					MetricStats: []MetricStat{
+						{MetricName: "VolumeReadOps", Stat: "Sum", BoundsAction: "ignore"},
+					},
+				},
+			},
+			expected: false,
+			message:  "Unknown bounds action should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+					DualWrite:   DualWrite{Enabled: true, Expires: "01/02/2021"},
+				},
+			},
+			expected: false,
+			message:  "Malformed dual write expiry should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+					Expose:      "hidden",
+				},
+			},
+			expected: false,
+			message:  "Unknown exposure modes should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:         "ebs",
+					Offset:       2,
+					Interval:     2,
+					Period:       60,
+					MetricStats:  stats,
+					AccountAlias: true,
+				},
+			},
+			expected: false,
+			message:  "Account alias without the account_id ARN label should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+					Expose:      ExposeNamedOnly,
+				},
+			},
+			expected: false,
+			message:  "Named exposure without a name should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Name:        "billing",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: stats,
+					Expose:      ExposeNamedOnly,
+				},
+			},
+			expected: true,
+			message:  "Named exposure with a name should be valid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:     "ebs",
+					Offset:   2,
+					Interval: 2,
+					Period:   60,
+					MetricStats: []MetricStat{
+						{MetricName: "VolumeReadOps", Stat: "Sum", Bounds: &Bounds{Min: aws.Float64(1), Max: aws.Float64(0)}},
+					},
+				},
+			},
+			expected: false,
+			message:  "Bounds with min greater than max should be invalid",
+		},
 		{
 			collector: &BaseCollector{
 				config: CollectorConfig{
 					Type:     "ebs",
-					Offset:   1,
+					Offset:   2,
+					Interval: 2,
+					Period:   60,
+					MetricStats: []MetricStat{
+						{MetricName: "VolumeReadOps", Stat: "Sum", Bounds: &Bounds{Max: aws.Float64(10)}, BoundsAction: BoundsActionClamp},
+					},
+				},
+			},
+			expected: true,
+			message:  "Bounds with clamp action should be valid",
+		},
+		{
+			collector: &BaseCollector{
+				dimension: "LoadBalancer",
+				config: CollectorConfig{
+					Type:     "alb",
+					Offset:   2,
+					Interval: 2,
+					Period:   60,
+					MetricStats: []MetricStat{
+						{MetricName: "RequestCount", Stat: "Sum", DimensionSets: []DimensionSet{{}, {"AvailabilityZone": "us-east-1a"}}},
+					},
+				},
+			},
+			expected: true,
+			message:  "Dimension sets should be valid",
+		},
+		{
+			collector: &BaseCollector{
+				dimension: "LoadBalancer",
+				config: CollectorConfig{
+					Type:     "alb",
+					Offset:   2,
+					Interval: 2,
+					Period:   60,
+					MetricStats: []MetricStat{
+						{MetricName: "RequestCount", Stat: "Sum", DimensionSets: []DimensionSet{{"AvailabilityZone": ""}}},
+					},
+				},
+			},
+			expected: false,
+			message:  "Dimension sets with empty values should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				dimension: "LoadBalancer",
+				config: CollectorConfig{
+					Type:     "alb",
+					Offset:   2,
 					Interval: 2,
+					Period:   60,
+					MetricStats: []MetricStat{
+						{MetricName: "RequestCount", Stat: "Sum", DimensionSets: []DimensionSet{{"LoadBalancer": "app/other/1"}}},
+					},
+				},
+			},
+			expected: false,
+			message:  "Dimension sets colliding with the resource dimension should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:             "sqs",
+					Offset:           2,
+					Interval:         2,
+					Period:           60,
+					MetricStats:      stats,
+					MetricNameSuffix: "_fifo",
+				},
+			},
+			expected: true,
+			message:  "Metric name suffix should be valid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:             "sqs",
+					Offset:           2,
+					Interval:         2,
+					Period:           60,
+					MetricStats:      stats,
+					MetricNameSuffix: ".fifo",
+				},
+			},
+			expected: false,
+			message:  "Metric name suffix producing invalid metric names should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:         "sqs",
+					Offset:       2,
+					Interval:     2,
+					Period:       60,
+					MetricStats:  stats,
+					MetricPrefix: "cloudwatch_",
+				},
+			},
+			expected: true,
+			message:  "Metric prefix should be valid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:         "sqs",
+					Offset:       2,
+					Interval:     2,
+					Period:       60,
+					MetricStats:  stats,
+					MetricPrefix: "1cloudwatch_",
+				},
+			},
+			expected: false,
+			message:  "Metric prefix starting with a digit should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:         "sqs",
+					Offset:       2,
+					Interval:     2,
+					Period:       60,
+					MetricStats:  stats,
+					MetricPrefix: "cloud-watch_",
+				},
+			},
+			expected: false,
+			message:  "Metric prefix with invalid characters should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      60,
+					MetricStats: []MetricStat{{MetricName: "VolumeReadOps"}},
+				},
+			},
+			expected: false,
+			message:  "Metric stats without stat should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:     "ebs",
+					Offset:   2,
+					Interval: 2,
+					Period:   60,
+				},
+			},
+			expected: false,
+			message:  "Missing metric stats should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					MetricStats: stats,
+				},
+			},
+			expected: false,
+			message:  "Missing period should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      -60,
+					MetricStats: stats,
+				},
+			},
+			expected: false,
+			message:  "Negative period should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      90,
+					MetricStats: stats,
+				},
+			},
+			expected: false,
+			message:  "Period not a multiple of 60 should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:        "ebs",
+					Offset:      2,
+					Interval:    2,
+					Period:      300,
+					MetricStats: stats,
+				},
+			},
+			expected: true,
+			message:  "Period multiple of 60 should be valid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:         "ebs",
+					Offset:       2,
+					Interval:     2,
+					Period:       60,
+					MetricStats:  stats,
+					StaticLabels: map[string]string{"Team": "platform", "team": "storage"},
+				},
+			},
+			expected: false,
+			message:  "Static labels with the same label name should be invalid",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					Type:         "ebs",
+					Offset:       2,
+					Interval:     2,
+					Period:       60,
+					MetricStats:  stats,
+					StaticLabels: map[string]string{"Team": "platform", "Environment": "production"},
+				},
+			},
+			expected: true,
+			message:  "Static labels with distinct label names should be valid",
+		},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, c.collector.Valid(), c.message)
+	}
+}
+
+func TestGetResourcesInput(t *testing.T) {
+	testType := "some:type"
+	cases := []struct {
+		collector *BaseCollector
+		expected  *tagging.GetResourcesInput
+		message   string
+	}{
+		{
+			collector: &BaseCollector{config: CollectorConfig{}},
+			expected: &tagging.GetResourcesInput{
+				ResourceTypeFilters: []*string{aws.String(testType)},
+				TagFilters:          []*tagging.TagFilter{},
+			},
+			message: "Empty EBS collector config should produce query for all volumes",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					TagFilters: []TagFilter{
+						{
+							Key:   "tagKey",
+							Value: "tagValue",
+						},
+						{
+							Key:   "anotherTagKey",
+							Value: "anotherTagValue",
+						},
+					},
+				},
+			},
+			expected: &tagging.GetResourcesInput{
+				ResourceTypeFilters: []*string{aws.String(testType)},
+				TagFilters: []*tagging.TagFilter{
+					{
+						Key:    aws.String("tagKey"),
+						Values: []*string{aws.String("tagValue")},
+					},
+					{
+						Key:    aws.String("anotherTagKey"),
+						Values: []*string{aws.String("anotherTagValue")},
+					},
+				},
+			},
+			message: "Empty EBS collector config should produce query for all volumes",
+		},
+		{
+			collector: &BaseCollector{
+				config: CollectorConfig{
+					TagFilters: []TagFilter{
+						{Key: "env", Values: []string{"prod", "staging"}},
+						{Key: "team", Value: "a", Values: []string{"b"}},
+					},
+				},
+			},
+			expected: &tagging.GetResourcesInput{
+				ResourceTypeFilters: []*string{aws.String(testType)},
+				TagFilters: []*tagging.TagFilter{
+					{
+						Key:    aws.String("env"),
+						Values: []*string{aws.String("prod"), aws.String("staging")},
+					},
+					{
+						Key:    aws.String("team"),
+						Values: []*string{aws.String("a"), aws.String("b")},
+					},
+				},
+			},
+			message: "All values of tag filters should be requested",
+		},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, c.collector.getResourcesInput(testType), c.message)
+	}
+}
+
+func TestMakeQueries(t *testing.T) {
+	cases := []struct {
+		collector      *BaseCollector
+		resources      []*tagging.ResourceTagMapping
+		expected       []*cloudwatch.MetricDataQuery
+		expectedErrors []error
+		// expectedSamples are stored if every query returns a single
+		// datapoint of 1.
+		expectedSamples []string
+		message         string
+	}{
+		{
+			message:   "Empty entities should produce empty results",
+			collector: stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"})),
+			resources: []*tagging.ResourceTagMapping{},
+			expected:  []*cloudwatch.MetricDataQuery{},
+		},
+		{
+			message: "Invalid ARNs should produce errors",
+			collector: stripInterface(CollectorFromConfig(CollectorConfig{
+				Type:        "ebs",
+				MetricStats: []MetricStat{{MetricName: "MyMetricName", Stat: "Sum"}},
+			})),
+			resources: []*tagging.ResourceTagMapping{
+				{
+					ResourceARN: aws.String("broken"),
+				},
+			},
+			expected: []*cloudwatch.MetricDataQuery{},
+			expectedErrors: []error{
+				ErrCanNotParseARN,
+			},
+		},
+		{
+			message:   "Empty metric stats should produce empty results",
+			collector: stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"})),
+			resources: []*tagging.ResourceTagMapping{
+				{
+					ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff"),
+				},
+			},
+			expected: []*cloudwatch.MetricDataQuery{},
+		},
+		{
+			message: "Resources should be properly zipped into metric data queries",
+			collector: stripInterface(CollectorFromConfig(CollectorConfig{
+				Type:   "ebs",
+				Period: 300,
+				MetricStats: []MetricStat{
+					{
+						MetricName: "MyMetricName",
+						Stat:       "Sum",
+					},
+					{
+						MetricName: "MyOtherMetricName",
+						Stat:       "Average",
+					},
+				},
+			})),
+			resources: []*tagging.ResourceTagMapping{
+				{
+					ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff"),
+				},
+				{
+					ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-00000000000000000"),
+				},
+			},
+			expected: []*cloudwatch.MetricDataQuery{
+				{
+					Id: aws.String("id_43c1360ea31ff82de65453d44cabeb5307b8a1f5_0"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Sum"),
+						Period: aws.Int64(300),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("MyMetricName"),
+							Namespace:  aws.String("AWS/EBS"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("VolumeId"),
+									Value: aws.String("vol-00000000000000000"),
+								},
+							},
+						},
+					},
+				},
+				{
+					Id: aws.String("id_43c1360ea31ff82de65453d44cabeb5307b8a1f5_1"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Average"),
+						Period: aws.Int64(300),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("MyOtherMetricName"),
+							Namespace:  aws.String("AWS/EBS"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("VolumeId"),
+									Value: aws.String("vol-00000000000000000"),
+								},
+							},
+						},
+					},
+				},
+				{
+					Id: aws.String("id_d714b664b1f99367e6962cabb2463495ce4aa395_0"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Sum"),
+						Period: aws.Int64(300),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("MyMetricName"),
+							Namespace:  aws.String("AWS/EBS"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("VolumeId"),
+									Value: aws.String("vol-fffffffffffffffff"),
+								},
+							},
+						},
+					},
+				},
+				{
+					Id: aws.String("id_d714b664b1f99367e6962cabb2463495ce4aa395_1"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Average"),
+						Period: aws.Int64(300),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("MyOtherMetricName"),
+							Namespace:  aws.String("AWS/EBS"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("VolumeId"),
+									Value: aws.String("vol-fffffffffffffffff"),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			message: "Redshift clusters should be queried by their identifier",
+			collector: stripInterface(CollectorFromConfig(CollectorConfig{
+				Type:   "redshift",
+				Period: 60,
+				MetricStats: []MetricStat{
+					{
+						MetricName: "CPUUtilization",
+						Stat:       "Average",
+					},
+					{
+						MetricName: "DatabaseConnections",
+						Stat:       "Maximum",
+					},
+					{
+						MetricName: "HealthStatus",
+						Stat:       "Minimum",
+					},
+					{
+						MetricName: "ReadIOPS",
+						Stat:       "Average",
+					},
+					{
+						MetricName: "WriteIOPS",
+						Stat:       "Average",
+					},
+				},
+			})),
+			resources: []*tagging.ResourceTagMapping{
+				{
+					ResourceARN: aws.String("arn:aws:redshift:us-east-1:123456789012:cluster:my-cluster"),
+				},
+			},
+			expected: []*cloudwatch.MetricDataQuery{
+				{
+					Id: aws.String("id_5cbd43580fed06b1799a69f55e72825d193024d7_0"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Average"),
+						Period: aws.Int64(60),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("CPUUtilization"),
+							Namespace:  aws.String("AWS/Redshift"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("ClusterIdentifier"),
+									Value: aws.String("my-cluster"),
+								},
+							},
+						},
+					},
+				},
+				{
+					Id: aws.String("id_5cbd43580fed06b1799a69f55e72825d193024d7_1"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Maximum"),
+						Period: aws.Int64(60),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("DatabaseConnections"),
+							Namespace:  aws.String("AWS/Redshift"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("ClusterIdentifier"),
+									Value: aws.String("my-cluster"),
+								},
+							},
+						},
+					},
+				},
+				{
+					Id: aws.String("id_5cbd43580fed06b1799a69f55e72825d193024d7_2"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Minimum"),
+						Period: aws.Int64(60),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("HealthStatus"),
+							Namespace:  aws.String("AWS/Redshift"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("ClusterIdentifier"),
+									Value: aws.String("my-cluster"),
+								},
+							},
+						},
+					},
+				},
+				{
+					Id: aws.String("id_5cbd43580fed06b1799a69f55e72825d193024d7_3"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Average"),
+						Period: aws.Int64(60),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("ReadIOPS"),
+							Namespace:  aws.String("AWS/Redshift"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("ClusterIdentifier"),
+									Value: aws.String("my-cluster"),
+								},
+							},
+						},
+					},
+				},
+				{
+					Id: aws.String("id_5cbd43580fed06b1799a69f55e72825d193024d7_4"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Average"),
+						Period: aws.Int64(60),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("WriteIOPS"),
+							Namespace:  aws.String("AWS/Redshift"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("ClusterIdentifier"),
+									Value: aws.String("my-cluster"),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			message: "Tables should be queried by name without the table/ prefix",
+			collector: stripInterface(CollectorFromConfig(CollectorConfig{
+				Type:   "dynamodb",
+				Period: 60,
+				MetricStats: []MetricStat{
+					{MetricName: "ConsumedReadCapacityUnits", Stat: "Sum"},
+					{MetricName: "ThrottledRequests", Stat: "Sum"},
+				},
+			})),
+			resources: []*tagging.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:dynamodb:us-east-1:000000000000:table/my-table")},
+			},
+			expected: []*cloudwatch.MetricDataQuery{
+				{
+					Id: aws.String("id_f9253e9565fd21cda3ccde9c1c48a2cc334bb08c_0"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Sum"),
+						Period: aws.Int64(60),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("ConsumedReadCapacityUnits"),
+							Namespace:  aws.String("AWS/DynamoDB"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("TableName"),
+									Value: aws.String("my-table"),
+								},
+							},
+						},
+					},
+				},
+				{
+					Id: aws.String("id_f9253e9565fd21cda3ccde9c1c48a2cc334bb08c_1"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Sum"),
+						Period: aws.Int64(60),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("ThrottledRequests"),
+							Namespace:  aws.String("AWS/DynamoDB"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("TableName"),
+									Value: aws.String("my-table"),
+								},
+							},
+						},
+					},
 				},
 			},
-			expected: false,
-			message:  "Offset smaller than Interval should be invalid",
-		},
-		{
-			collector: &BaseCollector{
-				config: CollectorConfig{
-					Type:     "ebs",
-					Offset:   2,
-					Interval: 2,
-				},
+			expectedSamples: []string{
+				`promwatch_aws_dynamodb_consumed_read_capacity_units_sum{arn="arn:aws:dynamodb:us-east-1:000000000000:table/my-table",table_name="my-table"} 1.000000 1609459200000`,
 			},
-			expected: true,
-			message:  "Offset equal to Interval should be valid",
 		},
 		{
-			collector: &BaseCollector{
-				config: CollectorConfig{
-					Type:     "ebs",
-					Offset:   3,
-					Interval: 2,
+			message: "Streams should be queried by name without the stream/ prefix and dotted metric names should not produce double underscores",
+			collector: stripInterface(CollectorFromConfig(CollectorConfig{
+				Type:   "kinesis",
+				Period: 60,
+				MetricStats: []MetricStat{
+					{MetricName: "GetRecords.IteratorAgeMilliseconds", Stat: "Maximum"},
+					{MetricName: "IncomingBytes", Stat: "Sum"},
 				},
+			})),
+			resources: []*tagging.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:kinesis:us-east-1:000000000000:stream/my-stream")},
 			},
-			expected: true,
-			message:  "Offset larger than Interval should be valid",
-		},
-	}
-
-	for _, c := range cases {
-		assert.Equal(t, c.expected, c.collector.Valid(), c.message)
-	}
-}
-
-func TestGetResourcesInput(t *testing.T) {
-	testType := "some:type"
-	cases := []struct {
-		collector *BaseCollector
-		expected  *tagging.GetResourcesInput
-		message   string
-	}{
-		{
-			collector: &BaseCollector{config: CollectorConfig{}},
-			expected: &tagging.GetResourcesInput{
-				ResourceTypeFilters: []*string{aws.String(testType)},
-				TagFilters:          []*tagging.TagFilter{},
-			},
-			message: "Empty EBS collector config should produce query for all volumes",
-		},
-		{
-			collector: &BaseCollector{
-				config: CollectorConfig{
-					TagFilters: []TagFilter{
-						{
-							Key:   "tagKey",
-							Value: "tagValue",
-						},
-						{
-							Key:   "anotherTagKey",
-							Value: "anotherTagValue",
+			expected: []*cloudwatch.MetricDataQuery{
+				{
+					Id: aws.String("id_e70c9cbe0d64c42079ed1aec7ede95ca91c706b6_0"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Maximum"),
+						Period: aws.Int64(60),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("GetRecords.IteratorAgeMilliseconds"),
+							Namespace:  aws.String("AWS/Kinesis"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("StreamName"),
+									Value: aws.String("my-stream"),
+								},
+							},
 						},
 					},
 				},
-			},
-			expected: &tagging.GetResourcesInput{
-				ResourceTypeFilters: []*string{aws.String(testType)},
-				TagFilters: []*tagging.TagFilter{
-					{
-						Key:    aws.String("tagKey"),
-						Values: []*string{aws.String("tagValue")},
-					},
-					{
-						Key:    aws.String("anotherTagKey"),
-						Values: []*string{aws.String("anotherTagValue")},
+				{
+					Id: aws.String("id_e70c9cbe0d64c42079ed1aec7ede95ca91c706b6_1"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Sum"),
+						Period: aws.Int64(60),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("IncomingBytes"),
+							Namespace:  aws.String("AWS/Kinesis"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("StreamName"),
+									Value: aws.String("my-stream"),
+								},
+							},
+						},
 					},
 				},
 			},
-			message: "Empty EBS collector config should produce query for all volumes",
-		},
-	}
-
-	for _, c := range cases {
-		assert.Equal(t, c.expected, c.collector.getResourcesInput(testType), c.message)
-	}
-}
-
-func TestMakeQueries(t *testing.T) {
-	cases := []struct {
-		collector      *BaseCollector
-		resources      []*tagging.ResourceTagMapping
-		expected       []*cloudwatch.MetricDataQuery
-		expectedErrors []error
-		message        string
-	}{
-		{
-			message:   "Empty entities should produce empty results",
-			collector: stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"})),
-			resources: []*tagging.ResourceTagMapping{},
-			expected:  []*cloudwatch.MetricDataQuery{},
+			expectedSamples: []string{
+				`promwatch_aws_kinesis_get_records_iterator_age_milliseconds_maximum{arn="arn:aws:kinesis:us-east-1:000000000000:stream/my-stream",stream_name="my-stream"} 1.000000 1609459200000`,
+			},
 		},
 		{
-			message:   "Invalid ARNs should produce errors",
-			collector: stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"})),
+			message: "REST APIs should be queried by the last segment of their ARN",
+			collector: stripInterface(CollectorFromConfig(CollectorConfig{
+				Type:   "apigw",
+				Period: 60,
+				MetricStats: []MetricStat{
+					{MetricName: "5XXError", Stat: "Sum"},
+					{MetricName: "Latency", Stat: "Average"},
+				},
+			})),
 			resources: []*tagging.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:apigateway:us-east-1::/restapis/abc123def")},
+			},
+			expected: []*cloudwatch.MetricDataQuery{
 				{
-					ResourceARN: aws.String("broken"),
+					Id: aws.String("id_a0905320f4a61e4913da7eb64e31154c059ab24b_0"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Sum"),
+						Period: aws.Int64(60),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("5XXError"),
+							Namespace:  aws.String("AWS/ApiGateway"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("ApiId"),
+									Value: aws.String("abc123def"),
+								},
+							},
+						},
+					},
+				},
+				{
+					Id: aws.String("id_a0905320f4a61e4913da7eb64e31154c059ab24b_1"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Average"),
+						Period: aws.Int64(60),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("Latency"),
+							Namespace:  aws.String("AWS/ApiGateway"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("ApiId"),
+									Value: aws.String("abc123def"),
+								},
+							},
+						},
+					},
 				},
 			},
-			expected: []*cloudwatch.MetricDataQuery{},
-			expectedErrors: []error{
-				ErrCanNotParseARN,
+			expectedSamples: []string{
+				`promwatch_aws_apigw_5_xx_error_sum{arn="arn:aws:apigateway:us-east-1::/restapis/abc123def",api_id="abc123def"} 1.000000 1609459200000`,
 			},
 		},
 		{
-			message:   "Empty metric stats should produce empty results",
-			collector: stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"})),
+			message: "Services should be queried by cluster and service name, services without cluster name in their ARN should not be queried",
+			collector: stripInterface(CollectorFromConfig(CollectorConfig{
+				Type:   "ecs",
+				Period: 60,
+				MetricStats: []MetricStat{
+					{MetricName: "CPUUtilization", Stat: "Average"},
+				},
+			})),
 			resources: []*tagging.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:ecs:us-east-1:123456789012:service/my-cluster/my-service")},
+				{ResourceARN: aws.String("arn:aws:ecs:us-east-1:123456789012:service/legacy-service")},
+			},
+			expected: []*cloudwatch.MetricDataQuery{
 				{
-					ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff"),
+					Id: aws.String("id_8ba8fdc2604446cfbb554b4a0abbe35a92d4d1df_0"),
+					MetricStat: &cloudwatch.MetricStat{
+						Stat:   aws.String("Average"),
+						Period: aws.Int64(60),
+						Metric: &cloudwatch.Metric{
+							MetricName: aws.String("CPUUtilization"),
+							Namespace:  aws.String("AWS/ECS"),
+							Dimensions: []*cloudwatch.Dimension{
+								{
+									Name:  aws.String("ClusterName"),
+									Value: aws.String("my-cluster"),
+								},
+								{
+									Name:  aws.String("ServiceName"),
+									Value: aws.String("my-service"),
+								},
+							},
+						},
+					},
 				},
 			},
-			expected: []*cloudwatch.MetricDataQuery{},
+			expectedErrors: []error{ErrNotECSService},
+			expectedSamples: []string{
+				`promwatch_aws_ecs_cpu_utilization_average{arn="arn:aws:ecs:us-east-1:123456789012:service/my-cluster/my-service",cluster_name="my-cluster",service_name="my-service"} 1.000000 1609459200000`,
+			},
 		},
 		{
-			message: "Resources should be properly zipped into metric data queries",
+			message: "Dimension names should be queried as is and sanitized for labels",
 			collector: stripInterface(CollectorFromConfig(CollectorConfig{
-				Type:   "ebs",
-				Period: 300,
+				Type:   "msk",
+				Period: 60,
 				MetricStats: []MetricStat{
-					{
-						MetricName: "MyMetricName",
-						Stat:       "Sum",
-					},
-					{
-						MetricName: "MyOtherMetricName",
-						Stat:       "Average",
-					},
+					{MetricName: "CpuUser", Stat: "Average", DimensionSets: []DimensionSet{{"Broker ID": "1"}}},
 				},
 			})),
 			resources: []*tagging.ResourceTagMapping{
-				{
-					ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff"),
-				},
-				{
-					ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-00000000000000000"),
-				},
+				{ResourceARN: aws.String("arn:aws:kafka:us-east-1:123456789012:cluster/my-cluster/abcd1234-1")},
 			},
 			expected: []*cloudwatch.MetricDataQuery{
 				{
-					Id: aws.String("id_43c1360ea31ff82de65453d44cabeb5307b8a1f5_0"),
+					Id: aws.String("id_bfd77b3efc67faa48c20d3982074219e14f25ee3_0_0"),
 					MetricStat: &cloudwatch.MetricStat{
-						Stat:   aws.String("Sum"),
-						Period: aws.Int64(300),
+						Stat:   aws.String("Average"),
+						Period: aws.Int64(60),
 						Metric: &cloudwatch.Metric{
-							MetricName: aws.String("MyMetricName"),
-							Namespace:  aws.String("AWS/EBS"),
+							MetricName: aws.String("CpuUser"),
+							Namespace:  aws.String("AWS/Kafka"),
 							Dimensions: []*cloudwatch.Dimension{
 								{
-									Name:  aws.String("VolumeId"),
-									Value: aws.String("vol-00000000000000000"),
+									Name:  aws.String("Cluster Name"),
+									Value: aws.String("my-cluster"),
+								},
+								{
+									Name:  aws.String("Broker ID"),
+									Value: aws.String("1"),
 								},
 							},
 						},
 					},
 				},
+			},
+			expectedSamples: []string{
+				`promwatch_aws_msk_cpu_user_average{arn="arn:aws:kafka:us-east-1:123456789012:cluster/my-cluster/abcd1234-1",cluster_name="my-cluster",broker_id="1"} 1.000000 1609459200000`,
+			},
+		},
+		{
+			message: "Buckets should be queried with the default or configured storage type",
+			collector: stripInterface(CollectorFromConfig(CollectorConfig{
+				Type:   "s3",
+				Period: 86400,
+				MetricStats: []MetricStat{
+					{MetricName: "BucketSizeBytes", Stat: "Average"},
+					{MetricName: "NumberOfObjects", Stat: "Average"},
+					{MetricName: "BucketSizeBytes", Stat: "Maximum", DimensionSets: []DimensionSet{{"StorageType": "StandardIAStorage"}}},
+				},
+			})),
+			resources: []*tagging.ResourceTagMapping{
+				{ResourceARN: aws.String("arn:aws:s3:::my-bucket")},
+			},
+			expected: []*cloudwatch.MetricDataQuery{
 				{
-					Id: aws.String("id_43c1360ea31ff82de65453d44cabeb5307b8a1f5_1"),
+					Id: aws.String("id_55dc43886aa4db7af1bf28c94a0dad66828e4177_0_0"),
 					MetricStat: &cloudwatch.MetricStat{
 						Stat:   aws.String("Average"),
-						Period: aws.Int64(300),
+						Period: aws.Int64(86400),
 						Metric: &cloudwatch.Metric{
-							MetricName: aws.String("MyOtherMetricName"),
-							Namespace:  aws.String("AWS/EBS"),
+							MetricName: aws.String("BucketSizeBytes"),
+							Namespace:  aws.String("AWS/S3"),
 							Dimensions: []*cloudwatch.Dimension{
 								{
-									Name:  aws.String("VolumeId"),
-									Value: aws.String("vol-00000000000000000"),
+									Name:  aws.String("BucketName"),
+									Value: aws.String("my-bucket"),
+								},
+								{
+									Name:  aws.String("StorageType"),
+									Value: aws.String("StandardStorage"),
 								},
 							},
 						},
 					},
 				},
 				{
-					Id: aws.String("id_d714b664b1f99367e6962cabb2463495ce4aa395_0"),
+					Id: aws.String("id_55dc43886aa4db7af1bf28c94a0dad66828e4177_1_0"),
 					MetricStat: &cloudwatch.MetricStat{
-						Stat:   aws.String("Sum"),
-						Period: aws.Int64(300),
+						Stat:   aws.String("Average"),
+						Period: aws.Int64(86400),
 						Metric: &cloudwatch.Metric{
-							MetricName: aws.String("MyMetricName"),
-							Namespace:  aws.String("AWS/EBS"),
+							MetricName: aws.String("NumberOfObjects"),
+							Namespace:  aws.String("AWS/S3"),
 							Dimensions: []*cloudwatch.Dimension{
 								{
-									Name:  aws.String("VolumeId"),
-									Value: aws.String("vol-fffffffffffffffff"),
+									Name:  aws.String("BucketName"),
+									Value: aws.String("my-bucket"),
+								},
+								{
+									Name:  aws.String("StorageType"),
+									Value: aws.String("AllStorageTypes"),
 								},
 							},
 						},
 					},
 				},
 				{
-					Id: aws.String("id_d714b664b1f99367e6962cabb2463495ce4aa395_1"),
+					Id: aws.String("id_55dc43886aa4db7af1bf28c94a0dad66828e4177_2_0"),
 					MetricStat: &cloudwatch.MetricStat{
-						Stat:   aws.String("Average"),
-						Period: aws.Int64(300),
+						Stat:   aws.String("Maximum"),
+						Period: aws.Int64(86400),
 						Metric: &cloudwatch.Metric{
-							MetricName: aws.String("MyOtherMetricName"),
-							Namespace:  aws.String("AWS/EBS"),
+							MetricName: aws.String("BucketSizeBytes"),
+							Namespace:  aws.String("AWS/S3"),
 							Dimensions: []*cloudwatch.Dimension{
 								{
-									Name:  aws.String("VolumeId"),
-									Value: aws.String("vol-fffffffffffffffff"),
+									Name:  aws.String("BucketName"),
+									Value: aws.String("my-bucket"),
+								},
+								{
+									Name:  aws.String("StorageType"),
+									Value: aws.String("StandardIAStorage"),
 								},
 							},
 						},
@@ -245,16 +1292,165 @@ func TestMakeQueries(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		typ := collectorTypes["ebs"]
 		index := NewResourceIndexFromTagMapping(&c.resources, id)
-		zipped := c.collector.makeQueries(index, typ.Namespace, defaultMetricDimension(typ.Dimension, typ.ResourcePrefix))
+		zipped := c.collector.makeQueries(index, c.collector.namespace, c.collector.metricDimensions())
 		// we have to sort zipped as the order is not guaranteed
 		sort.Slice(zipped, func(x, y int) bool {
 			return *zipped[x].Id < *zipped[y].Id
 		})
 
-		assert.Equal(t, zipped, c.expected, c.message)
+		assert.Equal(t, zipped, c.expected, c.message)
+		assert.Equal(t, float64(len(c.expectedErrors)), testutil.ToFloat64(c.collector.Telemetry().ErrorCount), c.message)
+
+		if c.expectedSamples == nil {
+			continue
+		}
+		results := []*cloudwatch.MetricDataResult{}
+		for _, q := range zipped {
+			results = append(results, &cloudwatch.MetricDataResult{
+				Id:         q.Id,
+				Values:     []*float64{aws.Float64(1)},
+				Timestamps: []*time.Time{aws.Time(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))},
+			})
+		}
+		index.AddResults(&results)
+		c.collector.store = NewStore(0)
+		c.collector.storeResults(index)
+		for _, sample := range c.expectedSamples {
+			assert.Contains(t, storeSamples(c.collector.store), sample, c.message)
+		}
+	}
+}
+
+func TestMakeQueriesLambda(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:   "lambda",
+		Period: 60,
+		MetricStats: []MetricStat{
+			{MetricName: "Invocations", Stat: "Sum"},
+			{MetricName: "Errors", Stat: "Sum"},
+			{MetricName: "Duration", Stat: "p99"},
+		},
+	}))
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:lambda:us-east-1:000000000000:function:plain")},
+		{ResourceARN: aws.String("arn:aws:lambda:us-east-1:000000000000:function:versioned:7")},
+		{ResourceARN: aws.String("arn:aws:lambda:us-east-1:000000000000:function:aliased:prod")},
+	}
+
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	queries := b.makeQueries(index, b.namespace, defaultMetricDimension(b.dimension, b.resourcePrefix))
+
+	got := []string{}
+	for _, q := range queries {
+		assert.Equal(t, "AWS/Lambda", aws.StringValue(q.MetricStat.Metric.Namespace))
+		assert.Equal(t, int64(60), aws.Int64Value(q.MetricStat.Period))
+		assert.Len(t, q.MetricStat.Metric.Dimensions, 1)
+		d := q.MetricStat.Metric.Dimensions[0]
+		assert.Equal(t, "FunctionName", aws.StringValue(d.Name))
+		got = append(got, fmt.Sprintf("%s %s %s", aws.StringValue(d.Value), aws.StringValue(q.MetricStat.Metric.MetricName), aws.StringValue(q.MetricStat.Stat)))
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{
+		"aliased Duration p99", "aliased Errors Sum", "aliased Invocations Sum",
+		"plain Duration p99", "plain Errors Sum", "plain Invocations Sum",
+		"versioned Duration p99", "versioned Errors Sum", "versioned Invocations Sum",
+	}, got, "Every metric stat should be queried by function name without qualifier")
+
+	assert.Equal(t, []string{"promwatch_aws_lambda_invocations_sum"}, b.metricNames("Invocations", "Sum"))
+	assert.Equal(t, []string{"promwatch_aws_lambda_errors_sum"}, b.metricNames("Errors", "Sum"))
+	assert.Equal(t, []string{"promwatch_aws_lambda_duration_p99"}, b.metricNames("Duration", "p99"))
+}
+
+func TestMakeQueriesMultipleStats(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:   "ebs",
+		Period: 60,
+		MetricStats: []MetricStat{
+			{MetricName: "VolumeReadBytes", Stats: []string{"Average", "Sum", "Maximum"}},
+		},
+	}))
+	b.store = NewStore(0)
+	index := syntheticIndex(b, 2, 1)
+
+	got := map[string]int{}
+	for _, queries := range index.Queries {
+		for _, q := range queries {
+			got[aws.StringValue(q.MetricStat.Stat)]++
+		}
+	}
+	assert.Equal(t, map[string]int{"Average": 2, "Sum": 2, "Maximum": 2}, got, "Every stat should be queried once per resource")
+
+	b.storeResults(index)
+	names := map[string]struct{}{}
+	for _, l := range strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n") {
+		name, _, _ := strings.Cut(l, "{")
+		names[name] = struct{}{}
+	}
+	assert.Equal(t, map[string]struct{}{
+		"promwatch_aws_ebs_volume_read_bytes_average": {},
+		"promwatch_aws_ebs_volume_read_bytes_sum":     {},
+		"promwatch_aws_ebs_volume_read_bytes_maximum": {},
+	}, names, "Every stat should be emitted with its own suffix")
+}
+
+func TestMakeQueriesDimensionSets(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:   "alb",
+		Period: 60,
+		MetricStats: []MetricStat{
+			{MetricName: "RequestCount", Stat: "Sum", DimensionSets: []DimensionSet{
+				{},
+				{"AvailabilityZone": "us-east-1a"},
+				{"TargetGroup": "targetgroup/tg/1", "AvailabilityZone": "us-east-1b"},
+			}},
+			{MetricName: "ActiveConnectionCount", Stat: "Sum"},
+		},
+	}))
+	b.store = NewStore(0)
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:elasticloadbalancing:us-east-1:000000000000:loadbalancer/app/lb/1")},
+	}
+
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	queries := b.makeQueries(index, b.namespace, defaultMetricDimension(b.dimension, b.resourcePrefix))
+
+	got := []string{}
+	ids := map[string]struct{}{}
+	for _, q := range queries {
+		ids[aws.StringValue(q.Id)] = struct{}{}
+		dims := []string{}
+		for _, d := range q.MetricStat.Metric.Dimensions {
+			dims = append(dims, aws.StringValue(d.Name)+"="+aws.StringValue(d.Value))
+		}
+		got = append(got, aws.StringValue(q.MetricStat.Metric.MetricName)+" "+strings.Join(dims, ","))
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{
+		"ActiveConnectionCount LoadBalancer=app/lb/1",
+		"RequestCount LoadBalancer=app/lb/1",
+		"RequestCount LoadBalancer=app/lb/1,AvailabilityZone=us-east-1a",
+		"RequestCount LoadBalancer=app/lb/1,AvailabilityZone=us-east-1b,TargetGroup=targetgroup/tg/1",
+	}, got, "Every dimension set should yield a query with exactly the dimensions of the set added")
+	assert.Len(t, ids, len(queries), "Query IDs should be unique")
+
+	results := []*cloudwatch.MetricDataResult{}
+	for _, q := range queries {
+		results = append(results, &cloudwatch.MetricDataResult{
+			Id:         q.Id,
+			Values:     []*float64{aws.Float64(1)},
+			Timestamps: []*time.Time{aws.Time(time.Unix(1, 0))},
+		})
 	}
+	index.AddResults(&results)
+	b.storeResults(index)
+
+	out := storeSamples(b.store)
+	assert.Equal(t, 4, strings.Count(out, "\n"))
+	assert.Contains(t, out, `promwatch_aws_alb_request_count_sum{arn="arn:aws:elasticloadbalancing:us-east-1:000000000000:loadbalancer/app/lb/1",load_balancer="app/lb/1"} `)
+	assert.Contains(t, out, `load_balancer="app/lb/1",availability_zone="us-east-1a"} `, "Series of dimension sets should be labeled with the dimensions")
+	assert.Contains(t, out, `load_balancer="app/lb/1",availability_zone="us-east-1b",target_group="targetgroup/tg/1"} `)
+	assert.Equal(t, 4, b.seriesPerResource(), "Every dimension set should be counted as series")
 }
 
 func TestGetMetricDataInput(t *testing.T) {
@@ -413,6 +1609,278 @@ func TestGetMetricDataInput(t *testing.T) {
 	}
 }
 
+func TestApplyGrace(t *testing.T) {
+	first := &tagging.ResourceTagMapping{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff")}
+	second := &tagging.ResourceTagMapping{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-00000000000000000")}
+	discover := func(r ...*tagging.ResourceTagMapping) *ResourceIndex {
+		return NewResourceIndexFromTagMapping(&r, id)
+	}
+
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs", ResourceGraceCycles: 2}))
+
+	index := discover(first, second)
+	assert.Equal(t, 0, b.applyGrace(index))
+	assert.Equal(t, 2, len(index.Resources))
+
+	// transient disappearance for one cycle is smoothed over
+	index = discover(first)
+	assert.Equal(t, 1, b.applyGrace(index), "Missing resource should be held")
+	assert.Equal(t, 2, len(index.Resources))
+
+	index = discover(first, second)
+	assert.Equal(t, 0, b.applyGrace(index))
+	assert.Equal(t, 2, len(index.Resources))
+
+	// real deletion ages out after the configured number of cycles
+	for i := 0; i < 2; i++ {
+		index = discover(first)
+		assert.Equal(t, 1, b.applyGrace(index), "Missing resource should be held during grace period")
+		assert.Equal(t, 2, len(index.Resources))
+	}
+	index = discover(first)
+	assert.Equal(t, 0, b.applyGrace(index), "Missing resource should be dropped after grace period")
+	assert.Equal(t, 1, len(index.Resources))
+	assert.Equal(t, 1, len(b.seen))
+
+	// default config keeps current behaviour
+	b = stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"}))
+	_ = b.applyGrace(discover(first, second))
+	index = discover(first)
+	assert.Equal(t, 0, b.applyGrace(index))
+	assert.Equal(t, 1, len(index.Resources))
+}
+
+func TestStoreResultsControlCharacters(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:      "ebs",
+		MergeTags: []string{"team"},
+	}))
+	b.store = NewStore(0)
+
+	resources := []*tagging.ResourceTagMapping{
+		{
+			ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff"),
+			Tags: []*tagging.Tag{
+				{Key: aws.String("team"), Value: aws.String("first\nsecond\r")},
+			},
+		},
+	}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	for rid := range index.Resources {
+		query := &cloudwatch.MetricDataQuery{
+			Id: aws.String("query"),
+			MetricStat: &cloudwatch.MetricStat{
+				Metric: &cloudwatch.Metric{MetricName: aws.String("VolumeReadBytes")},
+				Stat:   aws.String("Sum"),
+			},
+		}
+		index.Queries[rid] = []*cloudwatch.MetricDataQuery{query}
+	}
+	index.AddResults(&[]*cloudwatch.MetricDataResult{
+		{
+			Id:         aws.String("query"),
+			Values:     []*float64{aws.Float64(1)},
+			Timestamps: []*time.Time{aws.Time(time.Unix(1, 0))},
+		},
+	})
+
+	b.storeResults(index)
+	out := storeSamples(b.store)
+	assert.Equal(t, 1, strings.Count(out, "\n"), "Output should stay on a single line")
+	assert.Contains(t, out, `team="first\nsecond"`)
+}
+
+func TestStoreResultsBounds(t *testing.T) {
+	cases := []struct {
+		stat                 MetricStat
+		disableDefaultBounds bool
+		expected             []string
+		outOfBounds          float64
+		message              string
+	}{
+		{
+			stat:        MetricStat{MetricName: "VolumeIdleTime", Stat: "Sum", Bounds: &Bounds{Min: aws.Float64(0), Max: aws.Float64(5)}},
+			expected:    []string{"} 1.000000 "},
+			outOfBounds: 2,
+			message:     "Values out of bounds should be dropped by default",
+		},
+		{
+			stat:        MetricStat{MetricName: "VolumeIdleTime", Stat: "Sum", Bounds: &Bounds{Min: aws.Float64(0), Max: aws.Float64(5)}, BoundsAction: BoundsActionClamp},
+			expected:    []string{"} 0.000000 ", "} 1.000000 ", "} 5.000000 "},
+			outOfBounds: 2,
+			message:     "Values out of bounds should be clamped with the clamp action",
+		},
+		{
+			stat:        MetricStat{MetricName: "VolumeReadOps", Stat: "Sum"},
+			expected:    []string{"} 1.000000 ", "} 10.000000 "},
+			outOfBounds: 1,
+			message:     "Count-like metrics should have a default lower bound of 0",
+		},
+		{
+			stat:        MetricStat{MetricName: "VolumeReadOps", Stat: "Sum", Bounds: &Bounds{Max: aws.Float64(5)}},
+			expected:    []string{"} -1.000000 ", "} 1.000000 "},
+			outOfBounds: 1,
+			message:     "Configured bounds should override the default bounds",
+		},
+		{
+			stat:                 MetricStat{MetricName: "VolumeReadOps", Stat: "Sum"},
+			disableDefaultBounds: true,
+			expected:             []string{"} -1.000000 ", "} 1.000000 ", "} 10.000000 "},
+			message:              "Default bounds should be disabled per collector",
+		},
+		{
+			stat:     MetricStat{MetricName: "VolumeIdleTime", Stat: "Sum"},
+			expected: []string{"} -1.000000 ", "} 1.000000 ", "} 10.000000 "},
+			message:  "Metrics missing from the catalog should not be bounded",
+		},
+	}
+
+	for _, c := range cases {
+		b := stripInterface(CollectorFromConfig(CollectorConfig{
+			Type:                 "ebs",
+			MetricStats:          []MetricStat{c.stat},
+			DisableDefaultBounds: c.disableDefaultBounds,
+		}))
+		b.store = NewStore(0)
+
+		resources := []*tagging.ResourceTagMapping{
+			{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff")},
+		}
+		index := NewResourceIndexFromTagMapping(&resources, id)
+		b.makeQueries(index, b.namespace, defaultMetricDimension(b.dimension, b.resourcePrefix))
+		results := []*cloudwatch.MetricDataResult{}
+		for _, queries := range index.Queries {
+			results = append(results, &cloudwatch.MetricDataResult{
+				Id:     queries[0].Id,
+				Values: []*float64{aws.Float64(-1), aws.Float64(1), aws.Float64(10)},
+				Timestamps: []*time.Time{
+					aws.Time(time.Unix(1, 0)), aws.Time(time.Unix(2, 0)), aws.Time(time.Unix(3, 0)),
+				},
+			})
+		}
+		index.AddResults(&results)
+
+		b.storeResults(index)
+		out := storeSamples(b.store)
+		assert.Equal(t, len(c.expected), strings.Count(out, "\n"), c.message)
+		for _, e := range c.expected {
+			assert.Contains(t, out, e, c.message)
+		}
+
+		name := fmt.Sprintf("promwatch_aws_ebs_%s_sum", toSnakeCase(c.stat.MetricName))
+		assert.Equal(t, c.outOfBounds, testutil.ToFloat64(b.Telemetry().OutOfBoundsCount.WithLabelValues(name)), c.message)
+	}
+}
+
+func TestDatapointsPerSeries(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type: "ebs",
+		MetricStats: []MetricStat{
+			{MetricName: "VolumeReadOps", Stat: "Sum"},
+			{MetricName: "VolumeWriteOps", Stat: "Sum"},
+			{MetricName: "VolumeIdleTime", Stat: "Sum"},
+		},
+	}))
+	b.store = NewStore(0)
+	b.telemetry = newTelemetryVecs(DefaultTelemetryLabels).collectorTelemetry(prometheus.Labels{})
+
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff")},
+	}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	b.makeQueries(index, b.namespace, defaultMetricDimension(b.dimension, b.resourcePrefix))
+	datapoints := map[string]int{"VolumeReadOps": 3, "VolumeWriteOps": 1}
+	results := []*cloudwatch.MetricDataResult{}
+	for _, queries := range index.Queries {
+		for _, q := range queries {
+			n, ok := datapoints[*q.MetricStat.Metric.MetricName]
+			if !ok {
+				// VolumeIdleTime is missing from the results
+				continue
+			}
+			r := &cloudwatch.MetricDataResult{Id: q.Id}
+			for i := 0; i < n; i++ {
+				r.Values = append(r.Values, aws.Float64(1))
+				r.Timestamps = append(r.Timestamps, aws.Time(time.Unix(int64(i), 0)))
+			}
+			results = append(results, r)
+		}
+	}
+	index.AddResults(&results)
+
+	b.storeResults(index)
+
+	m := &dto.Metric{}
+	assert.Nil(t, b.telemetry.DatapointsPerSeries.(prometheus.Metric).Write(m))
+	assert.Equal(t, uint64(3), m.GetHistogram().GetSampleCount(), "Every series should be observed once")
+	assert.Equal(t, 4.0, m.GetHistogram().GetSampleSum(), "Observations should match the datapoints of the results")
+	buckets := map[float64]uint64{}
+	for _, bucket := range m.GetHistogram().GetBucket() {
+		buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+	}
+	assert.Equal(t, uint64(1), buckets[0], "Series missing from the results should be observed as empty")
+	assert.Equal(t, uint64(2), buckets[1])
+	assert.Equal(t, uint64(3), buckets[3])
+}
+
+func TestCollectEvery(t *testing.T) {
+	client := &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{
+			{{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff")}},
+		},
+	}
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type: "ebs",
+		MetricStats: []MetricStat{
+			{MetricName: "VolumeReadBytes", Stat: "Sum"},
+			{MetricName: "VolumeWriteBytes", Stat: "Sum", CollectEvery: 3},
+		},
+	}))
+	b._client = client
+	b.store = NewStore(0)
+
+	queried := []int{}
+	for run := 0; run < 7; run++ {
+		assert.Nil(t, b.collect(context.Background(), nil, defaultMetricDimension(b.dimension, b.resourcePrefix)))
+
+		calls := client.Calls()
+		in := calls[len(calls)-1].Input.([]*cloudwatch.GetMetricDataInput)
+		assert.Equal(t, MethodGetMetricData, calls[len(calls)-1].Method)
+		for _, q := range in[0].MetricDataQueries {
+			if *q.MetricStat.Metric.MetricName == "VolumeWriteBytes" {
+				queried = append(queried, run)
+			}
+		}
+		assert.NotEmpty(t, in[0].MetricDataQueries, "Stats without collect_every should be queried every run")
+	}
+
+	assert.Equal(t, []int{0, 3, 6}, queried, "Stat with collect_every 3 should only be queried every third run")
+}
+
+func TestEstimatedSeries(t *testing.T) {
+	client := &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{
+			{
+				{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff")},
+				{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-00000000000000000")},
+			},
+		},
+	}
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type: "ebs",
+		MetricStats: []MetricStat{
+			{MetricName: "VolumeReadBytes", Stat: "Sum"},
+			{MetricName: "VolumeWriteBytes", Stat: "Sum"},
+			{MetricName: "VolumeIdleTime", Stat: "Average"},
+		},
+	}))
+	b._client = client
+	b.store = NewStore(0)
+
+	assert.Nil(t, b.collect(context.Background(), nil, defaultMetricDimension(b.dimension, b.resourcePrefix)))
+	assert.Equal(t, 6.0, testutil.ToFloat64(b.Telemetry().EstimatedSeries), "Estimate should be resources times metric stats")
+}
+
 // stripInterface is used for easier access to internal data during testing
 func stripInterface(i MetricCollector, e error) *BaseCollector {
 	if c, ok := i.(*BaseCollector); ok {
@@ -421,3 +1889,655 @@ func stripInterface(i MetricCollector, e error) *BaseCollector {
 
 	return nil
 }
+
+func TestCollectorProcClose(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	resources := [][]*tagging.ResourceTagMapping{
+		{{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff")}},
+	}
+	newCollector := func(typ string, client *FakeClient) MetricCollector {
+		c, err := CollectorFromConfig(CollectorConfig{
+			Type:        typ,
+			Interval:    1,
+			MetricStats: []MetricStat{{MetricName: "VolumeReadBytes", Stat: "Sum"}},
+		})
+		assert.Nil(t, err)
+		switch c := c.(type) {
+		case *BaseCollector:
+			c._client = client
+		case *ASGCollector:
+			c.base._client = client
+		case *ECHostCollector:
+			c.base._client = client
+		case *MSKBrokerCollector:
+			c.base._client = client
+		}
+
+		return c
+	}
+
+	cases := []struct {
+		typ     string
+		client  *FakeClient
+		wait    time.Duration
+		message string
+	}{
+		{"ebs", &FakeClient{ResourceTagMappingPages: resources}, 50 * time.Millisecond,
+			"Idle collector should stop"},
+		{"ebs", &FakeClient{ResourceTagMappingPages: resources, Delay: 200 * time.Millisecond}, 50 * time.Millisecond,
+			"Collector closed mid collect should stop"},
+		{"asg", &FakeClient{Delay: 200 * time.Millisecond}, 50 * time.Millisecond,
+			"ASG collector closed mid collect should stop"},
+		{"ec_host", &FakeClient{Delay: 200 * time.Millisecond}, 50 * time.Millisecond,
+			"ElastiCache host collector closed mid collect should stop"},
+		{"msk_broker", &FakeClient{Delay: 200 * time.Millisecond}, 50 * time.Millisecond,
+			"MSK broker collector closed mid collect should stop"},
+	}
+
+	for _, c := range cases {
+		proc := newCollector(c.typ, c.client).Run()
+		time.Sleep(c.wait)
+
+		assert.Nil(t, proc.Close(), c.message)
+		assert.Nil(t, proc.Close(), "Closing twice should be a no-op")
+		assert.NotNil(t, <-proc.Done, c.message)
+	}
+}
+
+func TestCollectorProcCloseCancelsCollect(t *testing.T) {
+	client := &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{
+			{{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff")}},
+		},
+		Delay: 100 * time.Millisecond,
+	}
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:        "ebs",
+		Interval:    1,
+		MetricStats: []MetricStat{{MetricName: "VolumeReadBytes", Stat: "Sum"}},
+	}))
+	b._client = client
+
+	proc := b.Run()
+	time.Sleep(20 * time.Millisecond)
+	assert.Nil(t, proc.Close())
+
+	for _, c := range client.Calls() {
+		assert.NotEqual(t, MethodGetMetricData, c.Method, "Metrics should not be queried after the collector was closed")
+	}
+	assert.Equal(t, uint64(0), proc.Store.Generation(), "Results of a cancelled collect should not be stored")
+}
+
+// blockingClient blocks in GetMetricData until the passed in context is
+// cancelled.
+type blockingClient struct {
+	*FakeClient
+	blocked chan struct{}
+}
+
+func (c *blockingClient) GetMetricData(ctx context.Context, in []*cloudwatch.GetMetricDataInput, tele *CollectorTelemetry) (*[]*cloudwatch.MetricDataResult, error) {
+	close(c.blocked)
+	<-ctx.Done()
+	return &[]*cloudwatch.MetricDataResult{}, &MethodError{Method: MethodGetMetricData, Err: ctx.Err()}
+}
+
+func TestCollectorProcCloseCancelsRequests(t *testing.T) {
+	defer func(d time.Duration) { CloseTimeout = d }(CloseTimeout)
+	CloseTimeout = 100 * time.Millisecond
+
+	client := &blockingClient{
+		FakeClient: &FakeClient{
+			ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{
+				{{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff")}},
+			},
+		},
+		blocked: make(chan struct{}),
+	}
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:        "ebs",
+		Interval:    60,
+		MetricStats: []MetricStat{{MetricName: "VolumeReadBytes", Stat: "Sum"}},
+	}))
+	b._client = client
+
+	proc := b.Run()
+	select {
+	case <-client.blocked:
+	case <-time.After(time.Second):
+		assert.FailNow(t, "Collector did not query metrics")
+	}
+
+	assert.Nil(t, proc.Close(), "Closing should abort requests in flight")
+	assert.Equal(t, uint64(0), proc.Store.Generation(), "Results of an aborted request should not be stored")
+}
+
+func TestCollectorProcCloseTimeout(t *testing.T) {
+	defer func(d time.Duration) { CloseTimeout = d }(CloseTimeout)
+	CloseTimeout = 10 * time.Millisecond
+
+	client := &FakeClient{Delay: 200 * time.Millisecond}
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs", Interval: 1}))
+	b._client = client
+
+	proc := b.Run()
+	time.Sleep(20 * time.Millisecond)
+	assert.ErrorIs(t, proc.Close(), ErrCloseTimeout, "Close should give up after the timeout")
+
+	CloseTimeout = time.Second
+	assert.Nil(t, proc.Close(), "Close should succeed once the collector stopped")
+}
+
+func TestActive(t *testing.T) {
+	at := func(str string) time.Time {
+		ts, err := time.Parse(time.RFC3339, str)
+		assert.Nil(t, err)
+
+		return ts
+	}
+
+	cases := []struct {
+		activeHours []string
+		now         time.Time
+		expected    bool
+		message     string
+	}{
+		{nil, at("2021-01-01T03:00:00Z"), true,
+			"Collector without active hours should always be active"},
+		{[]string{"08:00-18:00"}, at("2021-01-01T08:00:00Z"), true,
+			"Start of the window should be active"},
+		{[]string{"08:00-18:00"}, at("2021-01-01T17:59:59Z"), true,
+			"End of the window should be active"},
+		{[]string{"08:00-18:00"}, at("2021-01-01T18:00:00Z"), false,
+			"Window end should be exclusive"},
+		{[]string{"08:00-18:00"}, at("2021-01-01T07:59:59Z"), false,
+			"Before the window should be inactive"},
+		{[]string{"08:00-18:00"}, at("2021-01-01T09:00:00+02:00"), false,
+			"Windows should be in UTC"},
+		{[]string{"22:00-06:00"}, at("2021-01-01T23:30:00Z"), true,
+			"Window spanning midnight should be active before midnight"},
+		{[]string{"22:00-06:00"}, at("2021-01-01T05:30:00Z"), true,
+			"Window spanning midnight should be active after midnight"},
+		{[]string{"22:00-06:00"}, at("2021-01-01T12:00:00Z"), false,
+			"Window spanning midnight should be inactive during the day"},
+		{[]string{"01:00-02:00", "12:00-24:00"}, at("2021-01-01T23:59:00Z"), true,
+			"Any matching window should make the collector active"},
+	}
+
+	for _, c := range cases {
+		b := &BaseCollector{config: CollectorConfig{ActiveHours: c.activeHours}}
+		assert.Equal(t, c.expected, b.active(c.now), c.message)
+	}
+}
+
+func TestCollectIfActive(t *testing.T) {
+	client := &FakeClient{}
+	now := time.Date(2021, 1, 1, 20, 0, 0, 0, time.UTC)
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:        "ebs",
+		ActiveHours: []string{"08:00-18:00"},
+	}))
+	b._client = client
+	b.store = NewStore(0)
+	b.withTime(&testTime{now: &now})
+	dim := defaultMetricDimension(b.dimension, b.resourcePrefix)
+
+	assert.Nil(t, b.collectIfActive(context.Background(), nil, dim))
+	assert.Empty(t, client.Calls(), "No AWS calls should be issued outside of active hours")
+
+	now = time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	assert.Nil(t, b.collectIfActive(context.Background(), nil, dim))
+	assert.NotEmpty(t, client.Calls(), "AWS calls should be issued within active hours")
+}
+
+func TestResolveAccountAlias(t *testing.T) {
+	resource := &tagging.ResourceTagMapping{ResourceARN: aws.String("arn:aws:ec2:us-east-1:123456789012:volume/vol-1")}
+	cases := []struct {
+		enabled  bool
+		client   *FakeClient
+		expected string
+		calls    int
+		message  string
+	}{
+		{true, &FakeClient{AccountAliasPages: [][]*string{{aws.String("production")}}}, "production", 1,
+			"Account ID should be mapped to the alias"},
+		{true, &FakeClient{}, "123456789012", 1,
+			"Accounts without alias should keep the ID"},
+		{true, &FakeClient{Errors: map[string]error{MethodListAccountAliases: errAccessDenied}}, "123456789012", 1,
+			"Failed lookups should fall back to the ID"},
+		{false, &FakeClient{AccountAliasPages: [][]*string{{aws.String("production")}}}, "123456789012", 0,
+			"Alias should not be looked up unless enabled"},
+	}
+
+	for _, c := range cases {
+		b := stripInterface(CollectorFromConfig(CollectorConfig{
+			Type:         "ebs",
+			ARNLabels:    []string{"account_id"},
+			AccountAlias: c.enabled,
+		}))
+		b._client = c.client
+
+		b.resolveAccountAlias(context.Background())
+		assert.Len(t, c.client.Calls(), c.calls, c.message)
+
+		tags, err := defaultExtraTags(b.dimension, b.resourcePrefix, b.accountAlias, b.config.ARNLabels...)(resource)
+		assert.Nil(t, err, c.message)
+		assert.Equal(t, c.expected, aws.StringValue(tags[len(tags)-1].Value), c.message)
+	}
+}
+
+// advancingClient advances the clock of a test by the given duration on every
+// discovery to simulate a slow collection.
+type advancingClient struct {
+	*FakeClient
+	now *time.Time
+	by  time.Duration
+}
+
+func (c *advancingClient) GetResources(ctx context.Context, input *tagging.GetResourcesInput, tele *CollectorTelemetry) (*[]*tagging.ResourceTagMapping, error) {
+	*c.now = c.now.Add(c.by)
+	return c.FakeClient.GetResources(ctx, input, tele)
+}
+
+func TestTickOverrun(t *testing.T) {
+	cases := []struct {
+		took     time.Duration
+		expected float64
+		message  string
+	}{
+		{30 * time.Second, 0, "Collections within the interval should not be counted"},
+		{60 * time.Second, 0, "Collections taking exactly the interval should not be counted"},
+		{61 * time.Second, 1, "Collections taking longer than the interval should be counted"},
+	}
+
+	for _, c := range cases {
+		now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs", Interval: 60}))
+		b._client = &advancingClient{FakeClient: &FakeClient{}, now: &now, by: c.took}
+		b.store = NewStore(0)
+		b.withTime(&testTime{now: &now})
+
+		b.tick(context.Background(), nil, defaultMetricDimension(b.dimension, b.resourcePrefix))
+		assert.Equal(t, c.expected, testutil.ToFloat64(b.Telemetry().IntervalOverrunsCount), c.message)
+	}
+}
+
+func TestCadence(t *testing.T) {
+	client := &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{
+			{{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff")}},
+		},
+	}
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:          "ebs",
+		Offset:        300,
+		Interval:      300,
+		Period:        300,
+		CadenceOffset: 3600,
+		MetricStats: []MetricStat{
+			{MetricName: "VolumeReadBytes", Stat: "Sum"},
+			{MetricName: "VolumeIdleTime", Stat: "Sum", Cadence: CadenceDaily},
+		},
+	}))
+	b._client = client
+	// Set up front as Run would otherwise set them while results of the
+	// direct collect calls below are still being stored.
+	b.store = NewStore(0)
+	b.seriesMap = NewSeriesMap()
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	b.withTime(&testTime{now: &now})
+	dim := defaultMetricDimension(b.dimension, b.resourcePrefix)
+
+	// dailyInputs returns the inputs of the last GetMetricData call querying
+	// the daily metric stat.
+	dailyInputs := func() []*cloudwatch.GetMetricDataInput {
+		calls := client.Calls()
+		res := []*cloudwatch.GetMetricDataInput{}
+		for _, in := range calls[len(calls)-1].Input.([]*cloudwatch.GetMetricDataInput) {
+			if *in.MetricDataQueries[0].MetricStat.Period == 86400 {
+				assert.Equal(t, "VolumeIdleTime", *in.MetricDataQueries[0].MetricStat.Metric.MetricName)
+				res = append(res, in)
+			}
+		}
+
+		return res
+	}
+
+	assert.Nil(t, b.collect(context.Background(), nil, dim))
+	in := dailyInputs()
+	assert.Equal(t, 1, len(in), "Daily stat should be queried on the first run")
+	assert.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), *in[0].EndTime, "Query should end at the last UTC day boundary")
+	assert.Equal(t, time.Date(2020, 12, 30, 0, 0, 0, 0, time.UTC), *in[0].StartTime, "Query should cover two days")
+
+	now = time.Date(2021, 1, 1, 23, 0, 0, 0, time.UTC)
+	assert.Nil(t, b.collect(context.Background(), nil, dim))
+	assert.Empty(t, dailyInputs(), "Daily stat should not be queried again before the next boundary")
+
+	now = time.Date(2021, 1, 2, 0, 30, 0, 0, time.UTC)
+	assert.Nil(t, b.collect(context.Background(), nil, dim))
+	assert.Empty(t, dailyInputs(), "Boundary should be shifted by the cadence offset")
+
+	now = time.Date(2021, 1, 2, 1, 0, 0, 0, time.UTC)
+	client.Errors = map[string]error{MethodGetMetricData: errScripted}
+	assert.Nil(t, b.collect(context.Background(), nil, dim))
+	assert.Equal(t, 1, len(dailyInputs()), "Daily stat should be queried at the shifted boundary")
+
+	client.Errors = nil
+	now = time.Date(2021, 1, 2, 1, 5, 0, 0, time.UTC)
+	assert.Nil(t, b.collect(context.Background(), nil, dim))
+	in = dailyInputs()
+	assert.Equal(t, 1, len(in), "Failed boundary should be retried in the next run")
+	assert.Equal(t, time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC), *in[0].EndTime)
+
+	// restart returns once the restarted collector queried metrics
+	restart := func() {
+		calls := len(client.Calls())
+		proc := b.Run()
+		assert.Eventually(t, func() bool {
+			c := client.Calls()
+			return len(c) > calls && c[len(c)-1].Method == MethodGetMetricData
+		}, time.Second, time.Millisecond)
+		assert.Nil(t, proc.Close())
+	}
+
+	now = time.Date(2021, 1, 2, 6, 0, 0, 0, time.UTC)
+	restart()
+	assert.Empty(t, dailyInputs(), "Restarted collector should not query a boundary again")
+
+	now = time.Date(2021, 1, 3, 2, 0, 0, 0, time.UTC)
+	restart()
+	assert.Equal(t, 1, len(dailyInputs()), "Restarted collector should not skip a boundary passed while stopped")
+}
+
+// syntheticIndex returns an index of n resources with results for every metric
+// stat of b with points datapoints each.
+func syntheticIndex(b *BaseCollector, n, points int) *ResourceIndex {
+	resources := make([]*tagging.ResourceTagMapping, 0, n)
+	for i := 0; i < n; i++ {
+		resources = append(resources, &tagging.ResourceTagMapping{
+			ResourceARN: aws.String(fmt.Sprintf("arn:aws:ec2:us-east-1:000000000000:volume/vol-%017d", i)),
+			Tags: []*tagging.Tag{
+				{Key: aws.String("team"), Value: aws.String("storage")},
+				{Key: aws.String("env"), Value: aws.String("prod")},
+			},
+		})
+	}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	b.makeQueries(index, b.namespace, defaultMetricDimension(b.dimension, b.resourcePrefix))
+
+	results := []*cloudwatch.MetricDataResult{}
+	for _, queries := range index.Queries {
+		for _, q := range queries {
+			res := &cloudwatch.MetricDataResult{Id: q.Id}
+			for p := 0; p < points; p++ {
+				res.Values = append(res.Values, aws.Float64(float64(p)*1.5))
+				res.Timestamps = append(res.Timestamps, aws.Time(time.Unix(int64(1611929698+p*60), 0)))
+			}
+			results = append(results, res)
+		}
+	}
+	index.AddResults(&results)
+
+	return index
+}
+
+func syntheticCollector() *BaseCollector {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:      "ebs",
+		MergeTags: []string{"team", "env"},
+		MetricStats: []MetricStat{
+			{MetricName: "VolumeReadBytes", Stat: "Sum"},
+			{MetricName: "VolumeWriteBytes", Stat: "Sum"},
+			{MetricName: "VolumeIdleTime", Stat: "Average"},
+		},
+	}))
+	b.store = NewStore(0)
+
+	return b
+}
+
+func TestStoreResultsOutput(t *testing.T) {
+	b := syntheticCollector()
+	index := syntheticIndex(b, 3, 2)
+	b.storeResults(index)
+
+	expected := []string{}
+	for id, r := range index.Resources {
+		tags, _ := defaultExtraTags(b.dimension, b.resourcePrefix, "")(r)
+		labels := convertLabels(r, b.config.MergeTags, tags...)
+		for _, q := range index.Queries[id] {
+			res := index.Results[*q.Id]
+			for i, v := range res.Values {
+				expected = append(expected, Sample{
+					Name: fmt.Sprintf("promwatch_aws_ebs_%s_%s",
+						toSnakeCase(*q.MetricStat.Metric.MetricName),
+						toSnakeCase(*q.MetricStat.Stat)),
+					Labels:    labels,
+					Value:     *v,
+					Timestamp: res.Timestamps[i].Unix() * 1000,
+				}.String())
+			}
+		}
+	}
+
+	got := strings.SplitAfter(storeSamples(b.store), "\n")
+	got = got[:len(got)-1]
+	sort.Strings(expected)
+	sort.Strings(got)
+	assert.Equal(t, expected, got, "Output should match the samples formatted one by one")
+}
+
+func TestStoreResultsMetricNameSuffix(t *testing.T) {
+	b := syntheticCollector()
+	b.config.MetricNameSuffix = "_fifo"
+	b.config.DualWrite = DualWrite{Enabled: true}
+	index := syntheticIndex(b, 1, 1)
+	b.storeResults(index)
+
+	names := map[string]struct{}{}
+	for _, l := range strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n") {
+		name, _, _ := strings.Cut(l, "{")
+		names[name] = struct{}{}
+	}
+	assert.Contains(t, names, "promwatch_aws_ebs_volume_read_bytes_sum_fifo", "The suffix should be appended to metric names")
+	assert.Contains(t, names, "promwatch_aws_ebs_volume_read_bytes_sum", "Dual write should emit the names without suffix")
+}
+
+func TestStoreResultsStaticLabels(t *testing.T) {
+	b := syntheticCollector()
+	b.config.StaticLabels = map[string]string{
+		"Environment": `prod "eu"`,
+		"team":        "platform",
+	}
+	index := syntheticIndex(b, 1, 1)
+	for _, r := range index.Resources {
+		r.Tags = nil
+	}
+	b.storeResults(index)
+
+	lines := strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n")
+	assert.NotEmpty(t, lines)
+	for _, l := range lines {
+		assert.Contains(t, l, `environment="prod \"eu\""`, "Static labels should be added to resources without tags")
+		assert.Contains(t, l, `team="platform"`, "Static labels should be added to resources without tags")
+	}
+
+	b = syntheticCollector()
+	b.config.StaticLabels = map[string]string{"team": "platform"}
+	b.storeResults(syntheticIndex(b, 1, 1))
+	for _, l := range strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n") {
+		assert.Contains(t, l, `team="storage"`, "Merge tags should take precedence over static labels")
+		assert.NotContains(t, l, `team="platform"`, "Static labels colliding with merge tags should be dropped")
+	}
+}
+
+func TestStoreResultsMetricPrefix(t *testing.T) {
+	b := syntheticCollector()
+	b.config.MetricPrefix = "cloudwatch_"
+	index := syntheticIndex(b, 1, 1)
+	b.storeResults(index)
+
+	for _, l := range strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n") {
+		assert.True(t, strings.HasPrefix(l, "cloudwatch_ebs_"), "The prefix should replace the default prefix: %s", l)
+	}
+	assert.Equal(t, "cloudwatch_ebs_doubled", b.expressionName("Doubled"), "Expressions should use the prefix")
+	assert.Equal(t, "cloudwatch_ebs_endpoint_info", b.endpointInfoName(), "Endpoint info series should use the prefix")
+}
+
+func TestCollectorReady(t *testing.T) {
+	now := time.Date(2021, 1, 1, 20, 0, 0, 0, time.UTC)
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:        "ebs",
+		Interval:    60,
+		ActiveHours: []string{"08:00-18:00"},
+		MetricStats: []MetricStat{{MetricName: "VolumeReadOps", Stat: "Sum"}},
+	}))
+	b.withTime(&testTime{now: &now})
+	client := &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{{{ResourceARN: aws.String(testARN)}}},
+	}
+	b._client = client
+	b.store = NewStore(0)
+	dim := defaultMetricDimension(b.dimension, b.resourcePrefix)
+	proc := &CollectorProc{ready: func() bool { return atomic.LoadInt32(&b.collected) == 1 }}
+	tick := func(ctx context.Context, getResources resourceGetter) {
+		b.tick(ctx, getResources, dim)
+		b.storing.Lock()
+		b.storing.Unlock()
+	}
+
+	tick(context.Background(), nil)
+	assert.False(t, proc.Ready(), "Runs outside of active hours should not make the collector ready")
+
+	now = time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	tick(context.Background(), panickingGetter)
+	assert.False(t, proc.Ready(), "Failed collections should not make the collector ready")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tick(ctx, nil)
+	assert.False(t, proc.Ready(), "Cancelled collections should not make the collector ready")
+
+	client.Errors = map[string]error{MethodGetMetricData: errScripted}
+	tick(context.Background(), nil)
+	assert.False(t, proc.Ready(), "Collections with failed queries should not make the collector ready")
+
+	client.Errors = nil
+	tick(context.Background(), nil)
+	assert.True(t, proc.Ready(), "Successful collections should make the collector ready")
+}
+
+func BenchmarkStoreResults(b *testing.B) {
+	for _, n := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("resources=%d", n), func(b *testing.B) {
+			c := syntheticCollector()
+			index := syntheticIndex(c, n, 5)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.storeResults(index)
+			}
+		})
+	}
+}
+
+// valueClient answers every query with a single datapoint of value.
+type valueClient struct {
+	*FakeClient
+	value float64
+}
+
+func (c *valueClient) GetMetricData(ctx context.Context, in []*cloudwatch.GetMetricDataInput, tele *CollectorTelemetry) (*[]*cloudwatch.MetricDataResult, error) {
+	res := []*cloudwatch.MetricDataResult{}
+	for _, input := range in {
+		for _, q := range input.MetricDataQueries {
+			res = append(res, &cloudwatch.MetricDataResult{
+				Id:         q.Id,
+				Values:     []*float64{aws.Float64(c.value)},
+				Timestamps: []*time.Time{aws.Time(time.Unix(1611929698, 0))},
+			})
+		}
+	}
+
+	return &res, nil
+}
+
+// interleavedStore detects content of different commits being added to the
+// store before either is committed.
+type interleavedStore struct {
+	Store
+
+	open        int32
+	interleaved int32
+}
+
+func (s *interleavedStore) Add(str string) {
+	if !atomic.CompareAndSwapInt32(&s.open, 0, 1) {
+		atomic.StoreInt32(&s.interleaved, 1)
+	}
+	// Widen the window for overlapping commits.
+	time.Sleep(time.Millisecond)
+	s.Store.Add(str)
+}
+
+func (s *interleavedStore) Commit() {
+	s.Store.Commit()
+	atomic.StoreInt32(&s.open, 0)
+}
+
+func TestGetMetricsSerializesCommits(t *testing.T) {
+	const resources, collections = 20, 10
+	b := syntheticCollector()
+	store := &interleavedStore{Store: NewStore(0)}
+	b.store = store
+	arns := make([]*tagging.ResourceTagMapping, 0, resources)
+	for i := 0; i < resources; i++ {
+		arns = append(arns, &tagging.ResourceTagMapping{
+			ResourceARN: aws.String(fmt.Sprintf("arn:aws:ec2:us-east-1:000000000000:volume/vol-%017d", i)),
+		})
+	}
+	dim := defaultMetricDimension(b.dimension, b.resourcePrefix)
+
+	// values returns the distinct values of the samples in the store and
+	// their number.
+	values := func() (map[string]struct{}, int) {
+		lines := strings.Fields(storeSamples(store))
+		distinct := map[string]struct{}{}
+		// Lines are name, value, and timestamp.
+		for i := 1; i < len(lines); i += 3 {
+			distinct[lines[i]] = struct{}{}
+		}
+		return distinct, len(lines) / 3
+	}
+
+	done := make(chan struct{})
+	torn := make(chan string, 1)
+	go func() {
+		defer close(torn)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if distinct, n := values(); len(distinct) > 1 || (n != 0 && n != resources*len(b.config.MetricStats)) {
+				torn <- storeSamples(store)
+				return
+			}
+		}
+	}()
+
+	for v := 1; v <= collections; v++ {
+		b._client = &valueClient{FakeClient: &FakeClient{}, value: float64(v)}
+		b.getMetrics(context.Background(), NewResourceIndexFromTagMapping(&arns, id), dim)
+	}
+	b.storing.Lock()
+	b.storing.Unlock()
+	close(done)
+
+	assert.Empty(t, <-torn, "The store should never serve a torn buffer")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&store.interleaved), "Commits should not interleave")
+	distinct, _ := values()
+	assert.Equal(t, map[string]struct{}{fmt.Sprintf("%f", float64(collections)): {}}, distinct,
+		"The store should hold the results of the last collection")
+}
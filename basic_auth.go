@@ -0,0 +1,86 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var ErrInvalidBasicAuth = errors.New("Invalid basic auth configuration")
+
+// BasicAuthConfig protects the metrics, control, and debug endpoints with HTTP
+// basic auth if a username is set. The password is either set directly or read
+// from PasswordFile when the configuration is loaded.
+type BasicAuthConfig struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// enabled returns true if basic auth is configured.
+func (c BasicAuthConfig) enabled() bool {
+	return c.Username != ""
+}
+
+// resolve returns the configuration with the password read from the password
+// file, if set. It returns an error if a password is set without username, or
+// not exactly one of password and password file is set for a username.
+func (c BasicAuthConfig) resolve() (BasicAuthConfig, error) {
+	if !c.enabled() {
+		if c.Password != "" || c.PasswordFile != "" {
+			return c, fmt.Errorf("%w: password without username", ErrInvalidBasicAuth)
+		}
+		return c, nil
+	}
+	if (c.Password == "") == (c.PasswordFile == "") {
+		return c, fmt.Errorf("%w: either password or password_file has to be set", ErrInvalidBasicAuth)
+	}
+	if c.PasswordFile != "" {
+		content, err := os.ReadFile(c.PasswordFile)
+		if err != nil {
+			return c, fmt.Errorf("%w: %s", ErrInvalidBasicAuth, err)
+		}
+		// Files usually end with a newline that is not part of the
+		// password.
+		c.Password = strings.TrimRight(string(content), "\r\n")
+		if c.Password == "" {
+			return c, fmt.Errorf("%w: empty password file: %s", ErrInvalidBasicAuth, c.PasswordFile)
+		}
+	}
+
+	return c, nil
+}
+
+// basicAuthHandler wraps h to require the credentials of conf. Unauthenticated
+// requests are answered with 401 Unauthorized. The credentials are compared in
+// constant time, hashed first so their length is not revealed either. h is
+// returned as is if basic auth is not configured.
+func basicAuthHandler(h http.Handler, conf BasicAuthConfig) http.Handler {
+	if !conf.enabled() {
+		return h
+	}
+
+	username := sha256.Sum256([]byte(conf.Username))
+	password := sha256.Sum256([]byte(conf.Password))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		gotUsername := sha256.Sum256([]byte(u))
+		gotPassword := sha256.Sum256([]byte(p))
+		// Both are compared regardless of the outcome of the first.
+		valid := subtle.ConstantTimeCompare(username[:], gotUsername[:]) &
+			subtle.ConstantTimeCompare(password[:], gotPassword[:])
+		if !ok || valid != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="PromWatch", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,69 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestBasicAuthHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("metrics"))
+	})
+	h := basicAuthHandler(ok, BasicAuthConfig{Username: "prometheus", Password: "secret"})
+
+	get := func(username, password string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody)
+		if auth {
+			req.SetBasicAuth(username, password)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("prometheus", "secret", true)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "metrics", rec.Body.String())
+
+	for message, rec := range map[string]*httptest.ResponseRecorder{
+		"Requests without credentials should be rejected": get("", "", false),
+		"Wrong passwords should be rejected":              get("prometheus", "wrong", true),
+		"Wrong usernames should be rejected":              get("grafana", "secret", true),
+		"Longer passwords should be rejected":             get("prometheus", "secret2", true),
+	} {
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, message)
+		assert.Contains(t, rec.Header().Get("WWW-Authenticate"), "Basic", message)
+		assert.NotContains(t, rec.Body.String(), "metrics", message)
+	}
+
+	rec = httptest.NewRecorder()
+	basicAuthHandler(ok, BasicAuthConfig{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+	assert.Equal(t, http.StatusOK, rec.Code, "Requests should not be checked without basic auth")
+}
+
+func TestConfigBasicAuth(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	assert.Nil(t, os.WriteFile(passwordFile, []byte("from-file\n"), 0o600))
+
+	var got PromWatchConfig
+	assert.Nil(t, yaml.Unmarshal([]byte("basic_auth: {username: prometheus, password_file: "+passwordFile+"}"), &got))
+	assert.Equal(t, "from-file", got.BasicAuth.Password, "Passwords should be read from the file without trailing newline")
+
+	cases := map[string]string{
+		"Passwords without username should fail": "basic_auth: {password: secret}",
+		"Usernames without password should fail": "basic_auth: {username: prometheus}",
+		"Password and password file should fail": "basic_auth: {username: prometheus, password: secret, password_file: " + passwordFile + "}",
+		"Missing password files should fail":     "basic_auth: {username: prometheus, password_file: " + passwordFile + ".missing}",
+		"Empty password files should fail":       "basic_auth: {username: prometheus, password_file: /dev/null}",
+	}
+	for message, config := range cases {
+		assert.ErrorIs(t, yaml.Unmarshal([]byte(config), &PromWatchConfig{}), ErrInvalidBasicAuth, message)
+	}
+}
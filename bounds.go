@@ -0,0 +1,131 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"fmt"
+)
+
+// Actions taken for values outside the bounds of a metric stat.
+const (
+	BoundsActionDrop  = "drop"
+	BoundsActionClamp = "clamp"
+)
+
+// Bounds are the inclusive limits values of a metric stat are expected to be
+// within. Either limit may be left unset.
+type Bounds struct {
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+}
+
+// countMetrics are the metrics of each namespace that are definitionally
+// non-negative counts or sizes. Their Sum and SampleCount stats get a default
+// lower bound of 0.
+var countMetrics = map[string]map[string]struct{}{
+	"AWS/ApplicationELB": setOf(
+		"RequestCount", "NewConnectionCount", "RejectedConnectionCount",
+		"ProcessedBytes", "HTTPCode_ELB_4XX_Count", "HTTPCode_ELB_5XX_Count",
+		"HTTPCode_Target_2XX_Count", "HTTPCode_Target_3XX_Count",
+		"HTTPCode_Target_4XX_Count", "HTTPCode_Target_5XX_Count",
+	),
+	"AWS/AutoScaling": setOf(
+		"GroupDesiredCapacity", "GroupInServiceInstances",
+		"GroupPendingInstances", "GroupTerminatingInstances",
+		"GroupTotalInstances",
+	),
+	"AWS/EBS": setOf(
+		"VolumeReadOps", "VolumeWriteOps", "VolumeReadBytes",
+		"VolumeWriteBytes", "VolumeQueueLength",
+	),
+	"AWS/EC2": setOf(
+		"NetworkIn", "NetworkOut", "NetworkPacketsIn", "NetworkPacketsOut",
+		"StatusCheckFailed", "StatusCheckFailed_Instance",
+		"StatusCheckFailed_System",
+	),
+	"AWS/ELB": setOf(
+		"RequestCount", "SpilloverCount", "SurgeQueueLength",
+		"HTTPCode_ELB_4XX", "HTTPCode_ELB_5XX", "HTTPCode_Backend_2XX",
+		"HTTPCode_Backend_3XX", "HTTPCode_Backend_4XX", "HTTPCode_Backend_5XX",
+	),
+	"AWS/GatewayELB": setOf(
+		"ActiveFlowCount", "NewFlowCount", "ProcessedBytes",
+	),
+	"AWS/GlobalAccelerator": setOf(
+		"NewFlowCount", "ProcessedBytesIn", "ProcessedBytesOut",
+		"PacketsProcessed",
+	),
+	"AWS/ElastiCache": setOf(
+		"CurrConnections", "NewConnections", "Evictions", "CacheHits",
+		"CacheMisses", "CurrItems",
+	),
+	"AWS/NetworkELB": setOf(
+		"NewFlowCount", "ProcessedBytes", "TCP_Client_Reset_Count",
+		"TCP_ELB_Reset_Count", "TCP_Target_Reset_Count",
+	),
+	"AWS/RDS": setOf(
+		"DatabaseConnections",
+	),
+	"AWS/SQS": setOf(
+		"NumberOfMessagesSent", "NumberOfMessagesReceived",
+		"NumberOfMessagesDeleted", "NumberOfEmptyReceives",
+		"ApproximateNumberOfMessagesVisible",
+		"ApproximateNumberOfMessagesNotVisible",
+		"ApproximateNumberOfMessagesDelayed", "SentMessageSize",
+	),
+}
+
+func setOf(values ...string) map[string]struct{} {
+	s := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		s[v] = struct{}{}
+	}
+
+	return s
+}
+
+// defaultBounds returns the built-in bounds for a stat of a metric in
+// namespace, if any.
+func defaultBounds(namespace, metric, stat string) *Bounds {
+	if stat != "Sum" && stat != "SampleCount" {
+		return nil
+	}
+	if _, ok := countMetrics[namespace][metric]; !ok {
+		return nil
+	}
+
+	min := 0.0
+	return &Bounds{Min: &min}
+}
+
+// valid returns an error if the bounds or action are invalid.
+func (b *Bounds) valid(action string) error {
+	switch action {
+	case "", BoundsActionDrop, BoundsActionClamp:
+	default:
+		return fmt.Errorf("Unknown bounds action: %s", action)
+	}
+
+	if b != nil && b.Min != nil && b.Max != nil && *b.Min > *b.Max {
+		return fmt.Errorf("Bounds min must not be greater than max: %f > %f", *b.Min, *b.Max)
+	}
+
+	return nil
+}
+
+// apply checks v against the bounds. It returns the value to store, whether
+// the value is kept, and whether it was out of bounds. Out of bounds values are
+// clamped to the exceeded limit or dropped depending on action.
+func (b *Bounds) apply(v float64, action string) (float64, bool, bool) {
+	if b == nil {
+		return v, true, false
+	}
+
+	switch {
+	case b.Min != nil && v < *b.Min:
+		return *b.Min, action == BoundsActionClamp, true
+	case b.Max != nil && v > *b.Max:
+		return *b.Max, action == BoundsActionClamp, true
+	}
+
+	return v, true, false
+}
@@ -0,0 +1,52 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+// carriedStat is the output of the last query of a metric stat that is not
+// queried in every run, i.e. collected every nth run or with a cadence, see
+// BaseCollector.carry.
+type carriedStat struct {
+	samples []Sample
+	series  []seriesEntry
+}
+
+// carried returns true if the output of the metric stat is kept across the
+// runs it is not queried in.
+func (s MetricStat) carried() bool {
+	return s.CollectEvery > 1 || s.Cadence != ""
+}
+
+// carriedStats returns the statKeys of the configured metric stats whose output
+// is carried across runs.
+func (b *BaseCollector) carriedStats() map[string]struct{} {
+	keys := map[string]struct{}{}
+	for _, s := range b.config.MetricStats {
+		if s.carried() {
+			keys[statKey(s.MetricName, s.Stat)] = struct{}{}
+		}
+	}
+
+	return keys
+}
+
+// carry replaces the carried output of the metric stats of keys in queried with
+// their output of this commit in fresh and returns the output of the last query
+// of the ones not queried, so every commit contains all configured metric
+// stats, not just the ones due in this run.
+func (b *BaseCollector) carry(keys, queried map[string]struct{}, fresh map[string]*carriedStat) []*carriedStat {
+	if b.carried == nil {
+		b.carried = map[string]*carriedStat{}
+	}
+
+	out := []*carriedStat{}
+	for key := range keys {
+		if _, ok := queried[key]; ok {
+			b.carried[key] = fresh[key]
+			continue
+		}
+		if c, ok := b.carried[key]; ok && c != nil {
+			out = append(out, c)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/stretchr/testify/assert"
+)
+
+// commitRun queries and stores a collection run of b at now answering every
+// query with value and returns the lines of the store.
+func commitRun(b *BaseCollector, now time.Time, value float64) []string {
+	resources := []*tagging.ResourceTagMapping{{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-a")}}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	dim := defaultMetricDimension(b.dimension, b.resourcePrefix)
+	b.makeQueries(index, b.namespace, dim)
+	due := b.dueCadences(now)
+	b.cadenceInputs(index, dim, due)
+	results := []*cloudwatch.MetricDataResult{}
+	for _, queries := range index.Queries {
+		for _, q := range queries {
+			results = append(results, &cloudwatch.MetricDataResult{
+				Id:         q.Id,
+				Values:     []*float64{aws.Float64(value)},
+				Timestamps: []*time.Time{aws.Time(now.Add(-5 * time.Minute))},
+			})
+		}
+	}
+	index.AddResults(&results)
+	b.storeResults(index)
+	b.runs++
+	if b.cadenceRuns == nil {
+		b.cadenceRuns = map[string]time.Time{}
+	}
+	for c, boundary := range due {
+		b.cadenceRuns[c] = boundary
+	}
+
+	return strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n")
+}
+
+// sampleLine returns the line of lines containing name, empty if none does.
+func sampleLine(lines []string, name string) string {
+	for _, l := range lines {
+		if strings.Contains(l, name) {
+			return l
+		}
+	}
+
+	return ""
+}
+
+func TestStoreResultsCarriesCollectEvery(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type: "ebs",
+		MetricStats: []MetricStat{
+			{MetricName: "VolumeReadBytes", Stat: "Sum"},
+			{MetricName: "VolumeWriteBytes", Stat: "Sum", CollectEvery: 3},
+		},
+	}))
+	b.store = NewStore(0)
+	b.withTime(&testTime{now: &now})
+
+	for run, want := range []struct{ read, write string }{
+		{"} 1.000000 ", "} 1.000000 "},
+		{"} 2.000000 ", "} 1.000000 "},
+		{"} 3.000000 ", "} 1.000000 "},
+		{"} 4.000000 ", "} 4.000000 "},
+	} {
+		lines := commitRun(b, now, float64(run+1))
+		assert.Len(t, lines, 2, "Run %d should commit both metric stats", run)
+		assert.Contains(t, sampleLine(lines, "volume_read_bytes"), want.read, "Run %d should commit the current read bytes", run)
+		assert.Contains(t, sampleLine(lines, "volume_write_bytes"), want.write, "Run %d should commit the write bytes of their last query", run)
+		now = now.Add(time.Minute)
+	}
+}
+
+func TestStoreResultsCarriesCadence(t *testing.T) {
+	now := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type: "ebs",
+		MetricStats: []MetricStat{
+			{MetricName: "VolumeReadBytes", Stat: "Sum"},
+			{MetricName: "VolumeWriteBytes", Stat: "Sum", Cadence: CadenceHourly},
+		},
+	}))
+	b.store = NewStore(0)
+	b.withTime(&testTime{now: &now})
+
+	for run, want := range []struct {
+		at          time.Duration
+		read, write string
+	}{
+		{0, "} 1.000000 ", "} 1.000000 "},
+		{5 * time.Minute, "} 2.000000 ", "} 1.000000 "},
+		{50 * time.Minute, "} 3.000000 ", "} 1.000000 "},
+		{time.Hour, "} 4.000000 ", "} 4.000000 "},
+		{time.Hour + 5*time.Minute, "} 5.000000 ", "} 4.000000 "},
+	} {
+		now = time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC).Add(want.at)
+		lines := commitRun(b, now, float64(run+1))
+		assert.Len(t, lines, 2, "Run %d should commit both metric stats", run)
+		assert.Contains(t, sampleLine(lines, "volume_read_bytes"), want.read, "Run %d should commit the current read bytes", run)
+		assert.Contains(t, sampleLine(lines, "volume_write_bytes"), want.write, "Run %d should commit the write bytes of the current boundary", run)
+	}
+}
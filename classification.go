@@ -0,0 +1,131 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+)
+
+// DefaultClassification is the value of the classification label of resources
+// matching no classification rule if no default is configured.
+const DefaultClassification = "none"
+
+// ClassificationRule assigns its value to the classification label of
+// resources whose tags match all conditions, see
+// CollectorConfig.ClassificationRules.
+type ClassificationRule struct {
+	Value string         `yaml:"value"`
+	Tags  []TagCondition `yaml:"tags"`
+}
+
+// TagCondition matches resources with the tag Key whose value matches the glob
+// Value, where * matches any sequence of characters and ? any single
+// character. The glob is compiled when the configuration is loaded.
+type TagCondition struct {
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+
+	value *regexp.Regexp
+}
+
+// UnmarshalYAML implements the Unmarshaller interface for TagCondition to
+// compile the glob.
+func (c *TagCondition) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type tmp TagCondition
+	var t tmp
+	if err := unmarshal(&t); err != nil {
+		return err
+	}
+	*c = TagCondition(t)
+	c.value = compileGlob(c.Value)
+
+	return nil
+}
+
+// compileGlob returns the anchored regular expression matching the glob.
+func compileGlob(glob string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(glob)
+	quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+	quoted = strings.ReplaceAll(quoted, `\?`, ".")
+
+	return regexp.MustCompile("^(?:" + quoted + ")$")
+}
+
+// matches returns true if any of tags has the key of the condition and a value
+// matching its glob.
+func (c TagCondition) matches(tags []*tagging.Tag) bool {
+	for _, t := range tags {
+		if aws.StringValue(t.Key) == c.Key && c.value.MatchString(aws.StringValue(t.Value)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches returns true if all conditions of the rule match tags.
+func (r ClassificationRule) matches(tags []*tagging.Tag) bool {
+	for _, c := range r.Tags {
+		if !c.matches(tags) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validClassification returns an error if rules are configured without label
+// or the other way round, if any rule lacks a value or conditions, or if the
+// label collides with one of the reserved labels.
+func validClassification(label string, rules []ClassificationRule, reserved ...string) error {
+	if label == "" && len(rules) == 0 {
+		return nil
+	}
+	if label == "" || len(rules) == 0 {
+		return fmt.Errorf("Classification requires both a label and rules")
+	}
+	for _, r := range reserved {
+		if toSnakeCase(sanitize(label)) == r {
+			return fmt.Errorf("Classification label collides with label: %s", label)
+		}
+	}
+	for _, r := range rules {
+		if r.Value == "" || len(r.Tags) == 0 {
+			return fmt.Errorf("Classification rules require a value and tags: %q", r.Value)
+		}
+		for _, c := range r.Tags {
+			if c.Key == "" || c.value == nil {
+				return fmt.Errorf("Classification rule tags require a key and value: %s", r.Value)
+			}
+		}
+	}
+
+	return nil
+}
+
+// classify returns the classification label of resource r as tag with the
+// value of the first matching rule, or the default value. The hits of the
+// returned value are counted. It returns nil without classification rules.
+func (b *BaseCollector) classify(r *tagging.ResourceTagMapping) *tagging.Tag {
+	if len(b.config.ClassificationRules) == 0 {
+		return nil
+	}
+
+	value := b.config.ClassificationDefault
+	if value == "" {
+		value = DefaultClassification
+	}
+	for _, rule := range b.config.ClassificationRules {
+		if rule.matches(r.Tags) {
+			value = rule.Value
+			break
+		}
+	}
+	b.Telemetry().ClassificationHitsCount.WithLabelValues(value).Inc()
+
+	return &tagging.Tag{Key: aws.String(b.config.ClassificationLabel), Value: aws.String(value)}
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+const classificationConfig = `
+type: ebs
+period: 60
+metric_stats:
+  - {name: VolumeReadBytes, stat: Sum}
+classification_label: tier
+classification_rules:
+  - value: gold
+    tags:
+      - {key: env, value: prod}
+      - {key: size, value: "x*"}
+  - value: silver
+    tags:
+      - {key: env, value: prod*}
+  - value: bronze
+    tags:
+      - {key: env, value: "st?g"}
+  - value: test
+    tags:
+      - {key: env, value: t.st}
+`
+
+func TestClassification(t *testing.T) {
+	conf := CollectorConfig{}
+	assert.Nil(t, yaml.UnmarshalStrict([]byte(classificationConfig), &conf))
+	b := stripInterface(CollectorFromConfig(conf))
+	assert.True(t, b.Valid())
+	b.store = NewStore(0)
+
+	volumes := map[string][]string{
+		"vol-gold":      {"env", "prod", "size", "xlarge"},
+		"vol-silver":    {"env", "prod", "size", "small"},
+		"vol-prodlike":  {"env", "production"},
+		"vol-bronze":    {"env", "stag"},
+		"vol-untagged":  {},
+		"vol-mismatch":  {"env", "staging"},
+		"vol-onlysize":  {"size", "xlarge"},
+		"vol-caseprod":  {"env", "PROD"},
+		"vol-wildcards": {"env", "test"},
+	}
+	resources := []*tagging.ResourceTagMapping{}
+	for v, kv := range volumes {
+		r := &tagging.ResourceTagMapping{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/" + v)}
+		for i := 0; i < len(kv); i += 2 {
+			r.Tags = append(r.Tags, &tagging.Tag{Key: aws.String(kv[i]), Value: aws.String(kv[i+1])})
+		}
+		resources = append(resources, r)
+	}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	b.makeQueries(index, b.namespace, b.metricDimensions())
+	results := []*cloudwatch.MetricDataResult{}
+	for _, queries := range index.Queries {
+		results = append(results, &cloudwatch.MetricDataResult{
+			Id:         queries[0].Id,
+			Values:     []*float64{aws.Float64(1)},
+			Timestamps: []*time.Time{aws.Time(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))},
+		})
+	}
+	index.AddResults(&results)
+	b.storeResults(index)
+
+	tiers := map[string]string{}
+	for _, l := range strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n") {
+		volume := strings.SplitN(strings.SplitN(l, `volume_id="`, 2)[1], `"`, 2)[0]
+		tiers[volume] = strings.SplitN(strings.SplitN(l, `tier="`, 2)[1], `"`, 2)[0]
+	}
+	assert.Equal(t, map[string]string{
+		"vol-gold":      "gold",
+		"vol-silver":    "silver",
+		"vol-prodlike":  "silver",
+		"vol-bronze":    "bronze",
+		"vol-untagged":  DefaultClassification,
+		"vol-mismatch":  DefaultClassification,
+		"vol-onlysize":  DefaultClassification,
+		"vol-caseprod":  DefaultClassification,
+		"vol-wildcards": DefaultClassification,
+	}, tiers, "The first matching rule should classify resources, all conditions have to match")
+
+	hits := b.Telemetry().ClassificationHitsCount
+	assert.Equal(t, float64(1), testutil.ToFloat64(hits.WithLabelValues("gold")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(hits.WithLabelValues("silver")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(hits.WithLabelValues("bronze")))
+	assert.Equal(t, float64(5), testutil.ToFloat64(hits.WithLabelValues(DefaultClassification)), "Unclassified resources should be counted as default")
+}
+
+func TestClassificationDefault(t *testing.T) {
+	conf := CollectorConfig{}
+	assert.Nil(t, yaml.UnmarshalStrict([]byte(classificationConfig+"classification_default: other\n"), &conf))
+	b := stripInterface(CollectorFromConfig(conf))
+
+	tag := b.classify(&tagging.ResourceTagMapping{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-a")})
+	assert.Equal(t, "tier", aws.StringValue(tag.Key))
+	assert.Equal(t, "other", aws.StringValue(tag.Value), "The configured default should be used")
+
+	b = stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"}))
+	assert.Nil(t, b.classify(&tagging.ResourceTagMapping{}), "Collectors without rules should not classify")
+}
+
+func TestValidClassification(t *testing.T) {
+	rules := []ClassificationRule{{Value: "gold", Tags: []TagCondition{{Key: "env", Value: "prod", value: compileGlob("prod")}}}}
+
+	assert.Nil(t, validClassification("", nil))
+	assert.Nil(t, validClassification("tier", rules, "arn"))
+	assert.NotNil(t, validClassification("", rules), "Rules should require a label")
+	assert.NotNil(t, validClassification("tier", nil), "A label should require rules")
+	assert.NotNil(t, validClassification("arn", rules, "arn"), "Reserved labels should be rejected")
+	assert.NotNil(t, validClassification("tier", []ClassificationRule{{Value: "gold"}}), "Rules should require tags")
+	assert.NotNil(t, validClassification("tier", []ClassificationRule{{Tags: rules[0].Tags}}), "Rules should require a value")
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+)
+
+// CloudFrontRegion is the only region CloudFront distributions can be listed
+// and their metrics queried in.
+const CloudFrontRegion = "us-east-1"
+
+// CloudFrontCollector collects the metrics of CloudFront distributions. They
+// are global resources with their metrics published in us-east-1 with the
+// Region=Global dimension.
+type CloudFrontCollector struct {
+	base *BaseCollector
+}
+
+// NewCloudFrontCollector returns a CloudFrontCollector pinned to
+// CloudFrontRegion regardless of the configured region.
+func NewCloudFrontCollector(c CollectorConfig) (MetricCollector, error) {
+	if c.Region != "" && c.Region != CloudFrontRegion {
+		Logger.Infow("CloudFront is only available in "+CloudFrontRegion+", ignoring configured region", "name", c.Name, "region", c.Region)
+	}
+	c.Region = CloudFrontRegion
+
+	b := &BaseCollector{
+		config:         c,
+		namespace:      "AWS/CloudFront",
+		resourceName:   "cloudfront:distribution",
+		dimension:      "DistributionId",
+		resourcePrefix: "distribution/",
+	}
+
+	return &CloudFrontCollector{
+		base: b,
+	}, nil
+}
+
+func (a *CloudFrontCollector) Valid() bool {
+	return a.base.Valid()
+}
+
+func (a *CloudFrontCollector) Run() *CollectorProc {
+	return a.base.run(nil, cloudFrontMetricDimension)
+}
+
+// cloudFrontMetricDimension sets the distribution ID and the Global region as
+// dimensions for CloudWatch, CloudFront metrics are only published with both.
+func cloudFrontMetricDimension(resource *tagging.ResourceTagMapping) ([]*cloudwatch.Dimension, error) {
+	d, err := defaultMetricDimension("DistributionId", "distribution/")(resource)
+	if err != nil {
+		return d, err
+	}
+
+	return append(d, &cloudwatch.Dimension{Name: aws.String("Region"), Value: aws.String("Global")}), nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloudFrontMetricDimension(t *testing.T) {
+	d, err := cloudFrontMetricDimension(&tagging.ResourceTagMapping{
+		ResourceARN: aws.String("arn:aws:cloudfront::000000000000:distribution/E123ABCDEF4567"),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []*cloudwatch.Dimension{
+		{Name: aws.String("DistributionId"), Value: aws.String("E123ABCDEF4567")},
+		{Name: aws.String("Region"), Value: aws.String("Global")},
+	}, d, "Distributions should be queried with the Global region dimension")
+
+	_, err = cloudFrontMetricDimension(&tagging.ResourceTagMapping{ResourceARN: aws.String("not-an-arn")})
+	assert.ErrorIs(t, err, ErrCanNotParseARN)
+}
+
+func TestCloudFrontCollectorRegion(t *testing.T) {
+	for _, region := range []string{"", "eu-west-1", RegionAll} {
+		c, err := CollectorFromConfig(CollectorConfig{Type: "cloudfront", Region: region})
+		assert.Nil(t, err)
+		a, ok := c.(*CloudFrontCollector)
+		assert.True(t, ok, "Region %q should produce a single CloudFront collector", region)
+		assert.Equal(t, CloudFrontRegion, a.base.config.Region, "CloudFront collectors should be pinned to us-east-1")
+	}
+}
+
+func TestCloudFrontCollector(t *testing.T) {
+	arn := "arn:aws:cloudfront::000000000000:distribution/E123ABCDEF4567"
+	client := &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{{
+			{ResourceARN: aws.String(arn), Tags: []*tagging.Tag{{Key: aws.String("team"), Value: aws.String("edge")}}},
+		}},
+	}
+	c, _ := CollectorFromConfig(CollectorConfig{
+		Type:        "cloudfront",
+		Region:      "eu-west-1",
+		Offset:      300,
+		Interval:    300,
+		Period:      300,
+		TagFilters:  []TagFilter{{Key: "team", Value: "edge"}},
+		MetricStats: []MetricStat{{MetricName: "Requests", Stat: "Sum"}},
+	})
+	a := c.(*CloudFrontCollector)
+	assert.True(t, a.Valid())
+	a.base._client = client
+	a.base.store = NewStore(0)
+
+	// The query ID is derived from the ARN, so the result can be prepared
+	// before collecting.
+	client.MetricDataResultPages = [][]*cloudwatch.MetricDataResult{{{
+		Id:         aws.String("id_" + id(&tagging.ResourceTagMapping{ResourceARN: aws.String(arn)}) + "_0"),
+		Values:     []*float64{aws.Float64(42)},
+		Timestamps: []*time.Time{aws.Time(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))},
+	}}}
+	assert.Nil(t, a.base.collect(context.Background(), nil, cloudFrontMetricDimension))
+
+	calls := client.Calls()
+	in := calls[0].Input.(*tagging.GetResourcesInput)
+	assert.Equal(t, "cloudfront:distribution", aws.StringValue(in.ResourceTypeFilters[0]))
+	assert.Equal(t, "team", aws.StringValue(in.TagFilters[0].Key))
+	q := calls[1].Input.([]*cloudwatch.GetMetricDataInput)[0].MetricDataQueries[0]
+	assert.Equal(t, "AWS/CloudFront", aws.StringValue(q.MetricStat.Metric.Namespace))
+	assert.Len(t, q.MetricStat.Metric.Dimensions, 2)
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(a.base.store.String(),
+			`promwatch_aws_cloudfront_requests_sum{arn="`+arn+`",distribution_id="E123ABCDEF4567"} 42.000000 1609459200000`)
+	}, time.Second, time.Millisecond, "Distributions should be exported with their ID")
+}
@@ -2,14 +2,26 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"strings"
 
 	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v2"
 )
 
 const (
-	DefaultListen = "localhost:11999"
+	DefaultListen      = "localhost:11999"
+	DefaultMetricsPath = "/metrics"
+
+	ResourceSourceAWSConfig = "aws_config"
+
+	QueryIDSHA1  = "sha1"
+	QueryIDShort = "short"
 
 	LogError = "error"
 	LogWarn  = "warn"
@@ -17,6 +29,42 @@ const (
 	LogDebug = "debug"
 )
 
+var (
+	ErrUnknownTelemetryLabel = errors.New("Unknown telemetry label in configuration")
+	ErrInvalidMetricsPath    = errors.New("Invalid metrics path")
+)
+
+// reservedPaths are the paths of the other endpoints served on the listen
+// address, see newMux. Paths ending in / match everything below.
+var reservedPaths = []string{
+	"/ingest",
+	"/-/reload",
+	"/version",
+	"/healthz",
+	"/readyz",
+	"/api/v1/series-map",
+	"/collectors",
+	"/collectors/",
+	HistoryPath,
+	NamedMetricsPath,
+}
+
+// validMetricsPath returns an error if path is not absolute, ends in a slash,
+// or is taken by another endpoint.
+func validMetricsPath(path string) error {
+	if !strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") {
+		return fmt.Errorf("%w: %s", ErrInvalidMetricsPath, path)
+	}
+
+	for _, p := range reservedPaths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return fmt.Errorf("%w: %s is taken by another endpoint", ErrInvalidMetricsPath, path)
+		}
+	}
+
+	return nil
+}
+
 // levels allows to resolve a string value like "debug" to a zap Level which are
 // represented by int8.
 type levels map[string]zapcore.Level
@@ -42,6 +90,125 @@ type PromWatchConfig struct {
 	Listen     string            `yaml:"listen"`
 	LogLevel   string            `yaml:"log_level"`
 	Collectors []MetricCollector `yaml:"collectors"`
+	// MetricsPath is the path the metrics are served on, DefaultMetricsPath
+	// if not set.
+	MetricsPath string `yaml:"metrics_path"`
+	// TelemetryListen serves PromWatch's own metrics on their own address
+	// instead of together with the collector metrics if set.
+	TelemetryListen string `yaml:"telemetry_listen"`
+	// ETagIgnoreTelemetry excludes PromWatch's own metrics from the ETag of
+	// the metrics endpoint so it only changes when collectors commit.
+	ETagIgnoreTelemetry bool `yaml:"etag_ignore_telemetry"`
+	// TelemetryLabels are the collector labels attached to PromWatch's own
+	// per collector metrics.
+	TelemetryLabels []string `yaml:"telemetry_labels"`
+	// CloudWatchRateLimit is the maximum number of GetMetricData requests
+	// per second shared by all collectors. Requests are not limited if 0.
+	CloudWatchRateLimit float64 `yaml:"cloudwatch_rate_limit"`
+	// PushURL is the URL collector samples are pushed to as remote write
+	// requests after every commit.
+	PushURL string `yaml:"push_url"`
+	// RemoteWrite holds the tenant and credentials of the requests to
+	// PushURL.
+	RemoteWrite RemoteWriteConfig `yaml:"remote_write"`
+	// MetricStreamIngest enables the /ingest endpoint receiving CloudWatch
+	// metric stream records from a Kinesis Data Firehose HTTP endpoint
+	// delivery.
+	MetricStreamIngest bool `yaml:"metric_stream_ingest"`
+	// MetricStreamAccessKey is the access key Firehose requests to the
+	// ingest endpoint have to carry. Requests are not checked if empty.
+	MetricStreamAccessKey string `yaml:"metric_stream_access_key"`
+	// TextfileOutput is the path of the file the metrics are periodically
+	// written to for the node_exporter textfile collector. No file is
+	// written if empty.
+	TextfileOutput string `yaml:"textfile_output"`
+	// TextfileInterval is the number of seconds between textfile writes.
+	TextfileInterval int `yaml:"textfile_interval"`
+	// StoreBackend selects where committed collector metrics are kept,
+	// StoreBackendMemory or StoreBackendRedis to share them between
+	// replicas.
+	StoreBackend string      `yaml:"store_backend"`
+	Redis        RedisConfig `yaml:"redis"`
+	// LeaderElection lets only one replica poll AWS while the others serve
+	// the metrics shared through the store backend.
+	LeaderElection LeaderElectionConfig `yaml:"leader_election"`
+	// InstanceLabel are labels added to every series of the collectors,
+	// e.g. {promwatch_instance: account-a}, to tell apart multiple
+	// instances feeding the same Prometheus.
+	InstanceLabel map[string]string `yaml:"instance_label"`
+	// TLSCertFile and TLSKeyFile serve the HTTP endpoints over HTTPS with
+	// the key pair if both are set.
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
+	// BasicAuth requires HTTP basic auth on the metrics, control, and debug
+	// endpoints if a username is set.
+	BasicAuth BasicAuthConfig `yaml:"basic_auth"`
+	// CollectorOverrides enables the /collectors/<name>/overrides endpoint
+	// to override collection parameters at runtime.
+	CollectorOverrides bool `yaml:"collector_overrides"`
+	// FamilyCollision is the policy for collector metric families colliding
+	// with PromWatch telemetry families, FamilyCollisionRename appending
+	// FamilyCollisionSuffix, FamilyCollisionDrop, or FamilyCollisionError.
+	FamilyCollision       string `yaml:"family_collision"`
+	FamilyCollisionSuffix string `yaml:"family_collision_suffix"`
+	// Exposition selects how the collector metrics are served on /metrics,
+	// ExpositionText from the stores or ExpositionRegistry gathered with
+	// the telemetry.
+	Exposition string `yaml:"exposition"`
+	// AuditLog logs the AWS API calls of the collectors if a path is set.
+	AuditLog AuditLogConfig `yaml:"audit_log"`
+	// Defaults are applied to the collectors leaving the fields unset.
+	Defaults CollectorDefaults `yaml:"defaults"`
+}
+
+// CollectorDefaults are the values of collector fields used for collectors not
+// setting the field. The fields are pointers to tell fields set to zero apart
+// from unset fields.
+type CollectorDefaults struct {
+	Offset   *int    `yaml:"offset"`
+	Interval *int    `yaml:"interval"`
+	Period   *int    `yaml:"period"`
+	Region   *string `yaml:"region"`
+}
+
+// apply returns c with the defaults set that have no value in set, the fields
+// set by the collector.
+func (d CollectorDefaults) apply(c CollectorConfig, set CollectorDefaults) CollectorConfig {
+	if d.Offset != nil && set.Offset == nil {
+		c.Offset = *d.Offset
+	}
+	if d.Interval != nil && set.Interval == nil {
+		c.Interval = *d.Interval
+	}
+	if d.Period != nil && set.Period == nil {
+		c.Period = *d.Period
+	}
+	if d.Region != nil && set.Region == nil {
+		c.Region = *d.Region
+	}
+
+	return c
+}
+
+// collectorEntry is a collector of the YAML configuration along with the
+// fields with defaults it sets.
+type collectorEntry struct {
+	config CollectorConfig
+	set    struct {
+		CollectorDefaults `yaml:",inline"`
+		// Other holds all other fields so unmarshalling the entry a
+		// second time passes in strict mode.
+		Other map[string]interface{} `yaml:",inline"`
+	}
+}
+
+// UnmarshalYAML implements the Unmarshaller interface for collectorEntry.
+func (e *collectorEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&e.config); err != nil {
+		return err
+	}
+
+	return unmarshal(&e.set)
 }
 
 // CollectorConfig is the configuration of a specific collector as defined in
@@ -57,6 +224,137 @@ type CollectorConfig struct {
 	TagFilters  []TagFilter  `yaml:"tag_filters"`
 	MetricStats []MetricStat `yaml:"metric_stats"`
 	MergeTags   []string     `yaml:"merge_tags"`
+
+	// StaticLabels are added as is to every series of the collector, e.g.
+	// the environment or team, regardless of the tags of the resources.
+	StaticLabels map[string]string `yaml:"static_labels"`
+
+	// ResourceGraceCycles is the number of consecutive collection runs a
+	// previously discovered resource is kept after it went missing from
+	// discovery results.
+	ResourceGraceCycles int `yaml:"resource_grace_cycles"`
+
+	// ResourceSource selects where resources are listed from. The default
+	// is the source of the collector type, ResourceSourceAWSConfig uses
+	// the AWS Config advanced query in ResourceQuery.
+	ResourceSource string `yaml:"resource_source"`
+	ResourceQuery  string `yaml:"resource_query"`
+
+	// ActiveHours are the daily UTC time windows in the format HH:MM-HH:MM
+	// the collector is active in. The collector is always active if empty.
+	ActiveHours []string `yaml:"active_hours"`
+
+	// ARNLabels are the components of the resource ARN added as labels,
+	// any of region, account_id, partition, and service.
+	ARNLabels []string `yaml:"arn_labels"`
+
+	// CadenceOffset is the number of seconds the hourly and daily cadence
+	// boundaries of metric stats are shifted by, e.g. to avoid all
+	// collectors querying at midnight.
+	CadenceOffset int `yaml:"cadence_offset"`
+
+	// AllowUnknownRegion accepts well formed regions that are not known
+	// to the AWS SDK, e.g. recently launched regions.
+	AllowUnknownRegion bool `yaml:"allow_unknown_region"`
+
+	// DisableDefaultBounds disables the built-in lower bound of 0 for the
+	// Sum and SampleCount stats of count-like metrics.
+	DisableDefaultBounds bool `yaml:"disable_default_bounds"`
+
+	// DualWrite emits series under their legacy names as well while
+	// options changing metric names are rolled out.
+	DualWrite DualWrite `yaml:"dual_write"`
+
+	// AccountAlias uses the alias of the account as value of the
+	// account_id ARN label instead of the ID.
+	AccountAlias bool `yaml:"account_alias"`
+
+	// Expose selects whether the metrics are served on /metrics, on
+	// /metrics/<name>, or both, see ExposeDefault, ExposeNamedOnly, and
+	// ExposeBoth.
+	Expose string `yaml:"expose"`
+
+	// MaxConsecutivePanics is the number of consecutive runs the collector
+	// may panic in before it stops itself, DefaultMaxConsecutivePanics if
+	// 0.
+	MaxConsecutivePanics int `yaml:"max_consecutive_panics"`
+
+	// HistoryCommits is the number of commits retained to look up past
+	// samples on the history endpoint. No history is kept if 0.
+	HistoryCommits int `yaml:"history_commits"`
+
+	// StoreHintBytes pre-grows the buffers of the in memory store, and the
+	// buffer of the first commit, for collectors with a large and stable
+	// number of series.
+	StoreHintBytes int `yaml:"store_hint_bytes"`
+
+	// EndpointLabel emits the endpoint address of every resource as label of
+	// an info series, or of all series with EndpointLabelOnSeries. It is
+	// supported by the ec, ec_host, and rds collectors.
+	EndpointLabel         bool `yaml:"endpoint_label"`
+	EndpointLabelOnSeries bool `yaml:"endpoint_label_on_series"`
+
+	// OrphanResults exports query results that belong to no resource of
+	// the collection labeled with OrphanARN instead of dropping them.
+	OrphanResults bool `yaml:"orphan_results"`
+
+	// StaleMarkers pushes a stale marker for every series of the last
+	// commit missing from the next one. Markers are only pushed to PushURL,
+	// never stored.
+	StaleMarkers bool `yaml:"stale_markers"`
+
+	// QueryID selects the resource IDs used in CloudWatch query IDs, the
+	// hex encoded sha1 of the ARN by default or with QueryIDSHA1, a
+	// shorter base36 encoded hash with QueryIDShort.
+	QueryID string `yaml:"query_id"`
+
+	// Expressions are the Metric Math expressions evaluated over the metric
+	// stats of every resource.
+	Expressions []Expression `yaml:"expressions"`
+
+	// DimensionFilters drop the dimension combinations of queries whose
+	// dimension values do not pass all filters.
+	DimensionFilters []DimensionFilter `yaml:"dimension_filters"`
+
+	// LogLevel overrides the global log level for the messages of the
+	// collector.
+	LogLevel string `yaml:"log_level"`
+
+	// NegativeCache demotes resources without datapoints to be queried
+	// less often.
+	NegativeCache NegativeCache `yaml:"negative_cache"`
+
+	// RoleARN is the ARN of the IAM role assumed to collect the metrics,
+	// e.g. of another account.
+	RoleARN string `yaml:"role_arn"`
+
+	// AssumeRoleARN is an alias of RoleARN.
+	AssumeRoleARN string `yaml:"assume_role_arn"`
+
+	// ClassificationRules are evaluated in order against the tags of every
+	// resource, the value of the first matching rule, or
+	// ClassificationDefault, is added as ClassificationLabel.
+	ClassificationLabel   string               `yaml:"classification_label"`
+	ClassificationDefault string               `yaml:"classification_default"`
+	ClassificationRules   []ClassificationRule `yaml:"classification_rules"`
+
+	// MetricNameSuffix is appended to the names of the metrics of the
+	// collector as is, e.g. _fifo to tell FIFO queues apart from standard
+	// queues.
+	MetricNameSuffix string `yaml:"metric_name_suffix"`
+
+	// MetricPrefix replaces DefaultMetricPrefix in the names of the
+	// metrics of the collector, e.g. to avoid conflicts with other
+	// exporters.
+	MetricPrefix string `yaml:"metric_prefix"`
+
+	// AWSOptions are applied to the AWS SDK config of the collector, see
+	// AWSOptions.
+	AWSOptions AWSOptions `yaml:"aws_options"`
+
+	// Level selects the level of resources collected by collector types
+	// with several, e.g. instance or cluster of docdb.
+	Level string `yaml:"level"`
 }
 
 // UnmarshalYAML implements the Unmarshaller interface for PromWatchConfig to
@@ -66,16 +364,69 @@ func (c *PromWatchConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 	type tmp struct {
 		Listen     string
 		LogLevel   string `yaml:"log_level"`
-		Collectors []CollectorConfig
+		Collectors []collectorEntry
+		Defaults   CollectorDefaults `yaml:"defaults"`
+
+		MetricsPath     string `yaml:"metrics_path"`
+		TelemetryListen string `yaml:"telemetry_listen"`
+
+		ETagIgnoreTelemetry bool     `yaml:"etag_ignore_telemetry"`
+		TelemetryLabels     []string `yaml:"telemetry_labels"`
+		CloudWatchRateLimit float64  `yaml:"cloudwatch_rate_limit"`
+		PushURL             string   `yaml:"push_url"`
+
+		RemoteWrite RemoteWriteConfig `yaml:"remote_write"`
+
+		MetricStreamIngest    bool   `yaml:"metric_stream_ingest"`
+		MetricStreamAccessKey string `yaml:"metric_stream_access_key"`
+
+		TextfileOutput   string `yaml:"textfile_output"`
+		TextfileInterval int    `yaml:"textfile_interval"`
+
+		StoreBackend string      `yaml:"store_backend"`
+		Redis        RedisConfig `yaml:"redis"`
+
+		LeaderElection LeaderElectionConfig `yaml:"leader_election"`
+
+		InstanceLabel map[string]string `yaml:"instance_label"`
+
+		TLSCertFile string `yaml:"tls_cert_file"`
+		TLSKeyFile  string `yaml:"tls_key_file"`
+
+		BasicAuth BasicAuthConfig `yaml:"basic_auth"`
+
+		CollectorOverrides bool `yaml:"collector_overrides"`
+
+		FamilyCollision       string `yaml:"family_collision"`
+		FamilyCollisionSuffix string `yaml:"family_collision_suffix"`
+
+		Exposition string `yaml:"exposition"`
+
+		AuditLog AuditLogConfig `yaml:"audit_log"`
 	}
 	var t tmp
 	if err := unmarshal(&t); err != nil {
 		return err
 	}
 
+	c.Defaults = t.Defaults
+	collectors := make([]CollectorConfig, 0, len(t.Collectors))
+	for _, e := range t.Collectors {
+		collectors = append(collectors, t.Defaults.apply(e.config, e.set.CollectorDefaults))
+	}
+
+	for _, m := range exposeCollisions(collectors) {
+		Logger.Warn(m)
+	}
+
 	// quick and easy and given the config is loaded only once on
 	// service startup the performance impact is negligible
-	for _, v := range t.Collectors {
+	for _, v := range collectors {
+		roleARN, err := collectorRoleARN(v.RoleARN, v.AssumeRoleARN)
+		if err != nil {
+			return err
+		}
+		v.RoleARN = roleARN
 		collector, err := CollectorFromConfig(v)
 		if err != nil {
 			return err
@@ -94,6 +445,121 @@ func (c *PromWatchConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 	} else {
 		c.Listen = t.Listen
 	}
+	if err := validListen(c.Listen); err != nil {
+		return err
+	}
+
+	c.MetricsPath = t.MetricsPath
+	if c.MetricsPath == "" {
+		c.MetricsPath = DefaultMetricsPath
+	}
+	if err := validMetricsPath(c.MetricsPath); err != nil {
+		return err
+	}
+
+	c.TelemetryListen = t.TelemetryListen
+	if err := validListen(c.TelemetryListen); err != nil {
+		return err
+	}
+
+	c.ETagIgnoreTelemetry = t.ETagIgnoreTelemetry
+	c.CloudWatchRateLimit = t.CloudWatchRateLimit
+	c.PushURL = t.PushURL
+	if t.RemoteWrite.enabled() && c.PushURL == "" {
+		return fmt.Errorf("%w: remote_write requires push_url", ErrInvalidRemoteWrite)
+	}
+	remoteWrite, err := t.RemoteWrite.resolve()
+	if err != nil {
+		return err
+	}
+	c.RemoteWrite = remoteWrite
+	c.MetricStreamIngest = t.MetricStreamIngest
+	c.MetricStreamAccessKey = t.MetricStreamAccessKey
+	c.TextfileOutput = t.TextfileOutput
+
+	if t.TextfileInterval <= 0 {
+		c.TextfileInterval = DefaultTextfileInterval
+	} else {
+		c.TextfileInterval = t.TextfileInterval
+	}
+
+	switch t.StoreBackend {
+	case "", StoreBackendMemory:
+		c.StoreBackend = StoreBackendMemory
+	case StoreBackendRedis:
+		c.StoreBackend = t.StoreBackend
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownStoreBackend, t.StoreBackend)
+	}
+
+	c.Redis = t.Redis
+	if c.Redis.KeyPrefix == "" {
+		c.Redis.KeyPrefix = DefaultRedisKeyPrefix
+	}
+
+	c.LeaderElection = t.LeaderElection
+	if c.LeaderElection.Enabled && c.StoreBackend != StoreBackendRedis {
+		return ErrLeaderElectionBackend
+	}
+	if c.LeaderElection.Key == "" {
+		c.LeaderElection.Key = DefaultLeaderKey
+	}
+	if c.LeaderElection.TTL <= 0 {
+		c.LeaderElection.TTL = DefaultLeaderTTL
+	}
+
+	if _, err := newInstanceLabels(t.InstanceLabel); err != nil {
+		return err
+	}
+	c.InstanceLabel = t.InstanceLabel
+
+	if err := validTLS(t.TLSCertFile, t.TLSKeyFile); err != nil {
+		return err
+	}
+	c.TLSCertFile, c.TLSKeyFile = t.TLSCertFile, t.TLSKeyFile
+
+	basicAuth, err := t.BasicAuth.resolve()
+	if err != nil {
+		return err
+	}
+	c.BasicAuth = basicAuth
+	c.CollectorOverrides = t.CollectorOverrides
+
+	c.FamilyCollision, c.FamilyCollisionSuffix = t.FamilyCollision, t.FamilyCollisionSuffix
+	if c.FamilyCollision == "" {
+		c.FamilyCollision = FamilyCollisionRename
+	}
+	if c.FamilyCollisionSuffix == "" {
+		c.FamilyCollisionSuffix = DefaultFamilyCollisionSuffix
+	}
+	if err := validFamilyCollision(c.FamilyCollision, c.FamilyCollisionSuffix); err != nil {
+		return err
+	}
+
+	c.Exposition = t.Exposition
+	if c.Exposition == "" {
+		c.Exposition = ExpositionText
+	}
+	if err := validExposition(c.Exposition, c.StoreBackend); err != nil {
+		return err
+	}
+
+	auditLog, err := t.AuditLog.withDefaults()
+	if err != nil {
+		return err
+	}
+	c.AuditLog = auditLog
+
+	if t.TelemetryLabels == nil {
+		c.TelemetryLabels = DefaultTelemetryLabels
+	} else {
+		for _, l := range t.TelemetryLabels {
+			if !isTelemetryLabel(l) {
+				return fmt.Errorf("%w: %s", ErrUnknownTelemetryLabel, l)
+			}
+		}
+		c.TelemetryLabels = t.TelemetryLabels
+	}
 
 	if t.LogLevel == "" {
 		c.LogLevel = LogInfo
@@ -104,6 +570,21 @@ func (c *PromWatchConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 	return nil
 }
 
+// isTelemetryLabel returns true if l is a label that can be attached to
+// collector telemetry.
+func isTelemetryLabel(l string) bool {
+	for _, d := range DefaultTelemetryLabels {
+		if l == d {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadConfig reads the configuration from the file config. Files with the .gz
+// extension are decompressed first, e.g. large generated configurations. The
+// defaults are returned if the file can not be read.
 func loadConfig(config string) (*PromWatchConfig, error) {
 	parsed := PromWatchConfig{}
 	content, err := os.ReadFile(config)
@@ -111,6 +592,29 @@ func loadConfig(config string) (*PromWatchConfig, error) {
 		return &parsed, nil
 	}
 
+	if content, err = decompressConfig(config, content); err != nil {
+		return &parsed, err
+	}
+
 	err = yaml.Unmarshal(content, &parsed)
 	return &parsed, err
 }
+
+// decompressConfig returns content of the configuration file config
+// decompressed if the file has the .gz extension, as is otherwise.
+func decompressConfig(config string, content []byte) ([]byte, error) {
+	if !strings.HasSuffix(config, ".gz") {
+		return content, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(content))
+	if err == nil {
+		defer r.Close()
+		content, err = io.ReadAll(r)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can not decompress config %s: %w", config, err)
+	}
+
+	return content, nil
+}
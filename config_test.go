@@ -2,6 +2,10 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -37,6 +41,18 @@ func TestConfigUnmarshalling(t *testing.T) {
 		},
 	})
 
+	staticC, _ := CollectorFromConfig(CollectorConfig{
+		Type:         "ebs",
+		Name:         "static labels",
+		StaticLabels: map[string]string{"environment": "production", "team": "platform"},
+	})
+
+	fifoC, _ := CollectorFromConfig(CollectorConfig{
+		Type:             "sqs",
+		Name:             "fifo queues",
+		MetricNameSuffix: "_fifo",
+	})
+
 	cases := []struct {
 		str      []byte
 		expected PromWatchConfig
@@ -62,16 +78,166 @@ collectors:
   - name: VolumeReadBytes
     stat: Sum `),
 			PromWatchConfig{
-				Listen:     "localhost:11999",
-				LogLevel:   LogDebug,
-				Collectors: []MetricCollector{ebsC},
+				Listen:                "localhost:11999",
+				LogLevel:              LogDebug,
+				Collectors:            []MetricCollector{ebsC},
+				TelemetryLabels:       DefaultTelemetryLabels,
+				TextfileInterval:      DefaultTextfileInterval,
+				StoreBackend:          StoreBackendMemory,
+				Redis:                 RedisConfig{KeyPrefix: DefaultRedisKeyPrefix},
+				LeaderElection:        LeaderElectionConfig{Key: DefaultLeaderKey, TTL: DefaultLeaderTTL},
+				FamilyCollision:       FamilyCollisionRename,
+				FamilyCollisionSuffix: DefaultFamilyCollisionSuffix,
+				Exposition:            ExpositionText,
+				MetricsPath:           DefaultMetricsPath,
+				AuditLog:              AuditLogConfig{SampleRate: 1, MaxSizeBytes: DefaultAuditMaxSizeBytes},
 			},
 			"EBS config should parse correctly"},
 		{[]byte("collectors:"),
 			PromWatchConfig{
-				Listen:   "localhost:11999",
-				LogLevel: LogInfo},
+				Listen:                "localhost:11999",
+				LogLevel:              LogInfo,
+				TelemetryLabels:       DefaultTelemetryLabels,
+				TextfileInterval:      DefaultTextfileInterval,
+				StoreBackend:          StoreBackendMemory,
+				Redis:                 RedisConfig{KeyPrefix: DefaultRedisKeyPrefix},
+				LeaderElection:        LeaderElectionConfig{Key: DefaultLeaderKey, TTL: DefaultLeaderTTL},
+				FamilyCollision:       FamilyCollisionRename,
+				FamilyCollisionSuffix: DefaultFamilyCollisionSuffix,
+				Exposition:            ExpositionText,
+				MetricsPath:           DefaultMetricsPath,
+				AuditLog:              AuditLogConfig{SampleRate: 1, MaxSizeBytes: DefaultAuditMaxSizeBytes}},
 			"Default values should be set"},
+		{[]byte(`
+telemetry_labels: [collector_name, collector_type]`),
+			PromWatchConfig{
+				Listen:                "localhost:11999",
+				LogLevel:              LogInfo,
+				TelemetryLabels:       []string{LabelCollectorName, LabelCollectorType},
+				TextfileInterval:      DefaultTextfileInterval,
+				StoreBackend:          StoreBackendMemory,
+				Redis:                 RedisConfig{KeyPrefix: DefaultRedisKeyPrefix},
+				LeaderElection:        LeaderElectionConfig{Key: DefaultLeaderKey, TTL: DefaultLeaderTTL},
+				FamilyCollision:       FamilyCollisionRename,
+				FamilyCollisionSuffix: DefaultFamilyCollisionSuffix,
+				Exposition:            ExpositionText,
+				MetricsPath:           DefaultMetricsPath,
+				AuditLog:              AuditLogConfig{SampleRate: 1, MaxSizeBytes: DefaultAuditMaxSizeBytes}},
+			"Telemetry labels should parse correctly"},
+		{[]byte(`
+telemetry_labels: []`),
+			PromWatchConfig{
+				Listen:                "localhost:11999",
+				LogLevel:              LogInfo,
+				TelemetryLabels:       []string{},
+				TextfileInterval:      DefaultTextfileInterval,
+				StoreBackend:          StoreBackendMemory,
+				Redis:                 RedisConfig{KeyPrefix: DefaultRedisKeyPrefix},
+				LeaderElection:        LeaderElectionConfig{Key: DefaultLeaderKey, TTL: DefaultLeaderTTL},
+				FamilyCollision:       FamilyCollisionRename,
+				FamilyCollisionSuffix: DefaultFamilyCollisionSuffix,
+				Exposition:            ExpositionText,
+				MetricsPath:           DefaultMetricsPath,
+				AuditLog:              AuditLogConfig{SampleRate: 1, MaxSizeBytes: DefaultAuditMaxSizeBytes}},
+			"Empty telemetry labels should be kept"},
+		{[]byte(`
+store_backend: redis
+redis:
+  address: localhost:6379
+  db: 2`),
+			PromWatchConfig{
+				Listen:                "localhost:11999",
+				LogLevel:              LogInfo,
+				TelemetryLabels:       DefaultTelemetryLabels,
+				TextfileInterval:      DefaultTextfileInterval,
+				StoreBackend:          StoreBackendRedis,
+				Redis:                 RedisConfig{Address: "localhost:6379", DB: 2, KeyPrefix: DefaultRedisKeyPrefix},
+				LeaderElection:        LeaderElectionConfig{Key: DefaultLeaderKey, TTL: DefaultLeaderTTL},
+				FamilyCollision:       FamilyCollisionRename,
+				FamilyCollisionSuffix: DefaultFamilyCollisionSuffix,
+				Exposition:            ExpositionText,
+				MetricsPath:           DefaultMetricsPath,
+				AuditLog:              AuditLogConfig{SampleRate: 1, MaxSizeBytes: DefaultAuditMaxSizeBytes}},
+			"Redis store backend should parse correctly"},
+		{[]byte(`
+store_backend: redis
+leader_election:
+  enabled: true
+  ttl: 10`),
+			PromWatchConfig{
+				Listen:                "localhost:11999",
+				LogLevel:              LogInfo,
+				TelemetryLabels:       DefaultTelemetryLabels,
+				TextfileInterval:      DefaultTextfileInterval,
+				StoreBackend:          StoreBackendRedis,
+				Redis:                 RedisConfig{KeyPrefix: DefaultRedisKeyPrefix},
+				LeaderElection:        LeaderElectionConfig{Enabled: true, Key: DefaultLeaderKey, TTL: 10},
+				FamilyCollision:       FamilyCollisionRename,
+				FamilyCollisionSuffix: DefaultFamilyCollisionSuffix,
+				Exposition:            ExpositionText,
+				MetricsPath:           DefaultMetricsPath,
+				AuditLog:              AuditLogConfig{SampleRate: 1, MaxSizeBytes: DefaultAuditMaxSizeBytes}},
+			"Leader election should parse correctly"},
+		{[]byte(`
+instance_label:
+  promwatch_instance: account-a`),
+			PromWatchConfig{
+				Listen:                "localhost:11999",
+				LogLevel:              LogInfo,
+				TelemetryLabels:       DefaultTelemetryLabels,
+				TextfileInterval:      DefaultTextfileInterval,
+				StoreBackend:          StoreBackendMemory,
+				Redis:                 RedisConfig{KeyPrefix: DefaultRedisKeyPrefix},
+				LeaderElection:        LeaderElectionConfig{Key: DefaultLeaderKey, TTL: DefaultLeaderTTL},
+				FamilyCollision:       FamilyCollisionRename,
+				FamilyCollisionSuffix: DefaultFamilyCollisionSuffix,
+				Exposition:            ExpositionText,
+				MetricsPath:           DefaultMetricsPath,
+				AuditLog:              AuditLogConfig{SampleRate: 1, MaxSizeBytes: DefaultAuditMaxSizeBytes},
+				InstanceLabel:         map[string]string{"promwatch_instance": "account-a"}},
+			"Instance label should parse correctly"},
+		{[]byte(`
+collectors:
+- type: sqs
+  name: fifo queues
+  metric_name_suffix: _fifo`),
+			PromWatchConfig{
+				Listen:                "localhost:11999",
+				LogLevel:              LogInfo,
+				Collectors:            []MetricCollector{fifoC},
+				TelemetryLabels:       DefaultTelemetryLabels,
+				TextfileInterval:      DefaultTextfileInterval,
+				StoreBackend:          StoreBackendMemory,
+				Redis:                 RedisConfig{KeyPrefix: DefaultRedisKeyPrefix},
+				LeaderElection:        LeaderElectionConfig{Key: DefaultLeaderKey, TTL: DefaultLeaderTTL},
+				FamilyCollision:       FamilyCollisionRename,
+				FamilyCollisionSuffix: DefaultFamilyCollisionSuffix,
+				Exposition:            ExpositionText,
+				MetricsPath:           DefaultMetricsPath,
+				AuditLog:              AuditLogConfig{SampleRate: 1, MaxSizeBytes: DefaultAuditMaxSizeBytes}},
+			"Metric name suffix should parse correctly"},
+		{[]byte(`
+collectors:
+- type: ebs
+  name: static labels
+  static_labels:
+    environment: production
+    team: platform`),
+			PromWatchConfig{
+				Listen:                "localhost:11999",
+				LogLevel:              LogInfo,
+				Collectors:            []MetricCollector{staticC},
+				TelemetryLabels:       DefaultTelemetryLabels,
+				TextfileInterval:      DefaultTextfileInterval,
+				StoreBackend:          StoreBackendMemory,
+				Redis:                 RedisConfig{KeyPrefix: DefaultRedisKeyPrefix},
+				LeaderElection:        LeaderElectionConfig{Key: DefaultLeaderKey, TTL: DefaultLeaderTTL},
+				FamilyCollision:       FamilyCollisionRename,
+				FamilyCollisionSuffix: DefaultFamilyCollisionSuffix,
+				Exposition:            ExpositionText,
+				MetricsPath:           DefaultMetricsPath,
+				AuditLog:              AuditLogConfig{SampleRate: 1, MaxSizeBytes: DefaultAuditMaxSizeBytes}},
+			"Static labels should parse correctly"},
 	}
 
 	for _, c := range cases {
@@ -81,3 +247,170 @@ collectors:
 		assert.Equal(t, c.expected, got, c.message)
 	}
 }
+
+func TestConfigUnknownTelemetryLabel(t *testing.T) {
+	var got PromWatchConfig
+	err := yaml.Unmarshal([]byte(`telemetry_labels: [collector_region]`), &got)
+	assert.ErrorIs(t, err, ErrUnknownTelemetryLabel)
+}
+
+func TestConfigRoleARN(t *testing.T) {
+	cases := []struct {
+		message  string
+		config   string
+		expected string
+		err      error
+	}{
+		{
+			message:  "role_arn should be used as role",
+			config:   "role_arn: arn:aws:iam::123456789012:role/promwatch",
+			expected: "arn:aws:iam::123456789012:role/promwatch",
+		},
+		{
+			message:  "assume_role_arn should be an alias of role_arn",
+			config:   "assume_role_arn: arn:aws:iam::123456789012:role/promwatch",
+			expected: "arn:aws:iam::123456789012:role/promwatch",
+		},
+		{
+			message:  "Setting both to the same role should be accepted",
+			config:   "role_arn: arn:aws:iam::123456789012:role/promwatch\n  assume_role_arn: arn:aws:iam::123456789012:role/promwatch",
+			expected: "arn:aws:iam::123456789012:role/promwatch",
+		},
+		{
+			message: "Setting both to different roles should be rejected",
+			config:  "role_arn: arn:aws:iam::123456789012:role/promwatch\n  assume_role_arn: arn:aws:iam::123456789012:role/other",
+			err:     ErrConflictingRoleARN,
+		},
+		{
+			message: "ARNs other than of IAM roles should be rejected",
+			config:  "assume_role_arn: arn:aws:iam::123456789012:user/promwatch",
+			err:     ErrInvalidRoleARN,
+		},
+	}
+
+	for _, c := range cases {
+		var got PromWatchConfig
+		err := yaml.Unmarshal([]byte("collectors:\n- type: ebs\n  "+c.config), &got)
+		if c.err != nil {
+			assert.ErrorIs(t, err, c.err, c.message)
+			continue
+		}
+		assert.Nil(t, err, c.message)
+		assert.Equal(t, c.expected, got.Collectors[0].(*BaseCollector).config.RoleARN, c.message)
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	var got PromWatchConfig
+	err := yaml.UnmarshalStrict([]byte(`
+defaults:
+  offset: 600
+  interval: 300
+  period: 300
+  region: eu-west-1
+collectors:
+- type: ebs
+- type: sqs
+  offset: 0
+  interval: 60
+  region: us-east-1
+`), &got)
+	assert.Nil(t, err)
+
+	inherited := stripInterface(got.Collectors[0], nil).config
+	assert.Equal(t, 600, inherited.Offset, "Collectors without offset should inherit the default")
+	assert.Equal(t, 300, inherited.Interval, "Collectors without interval should inherit the default")
+	assert.Equal(t, 300, inherited.Period, "Collectors without period should inherit the default")
+	assert.Equal(t, "eu-west-1", inherited.Region, "Collectors without region should inherit the default")
+
+	set := stripInterface(got.Collectors[1], nil).config
+	assert.Equal(t, 0, set.Offset, "Offsets set to 0 should be kept")
+	assert.Equal(t, 60, set.Interval, "Set intervals should be kept")
+	assert.Equal(t, 300, set.Period, "Unset fields should inherit the default")
+	assert.Equal(t, "us-east-1", set.Region, "Set regions should be kept")
+}
+
+func TestConfigMetricStatsShorthand(t *testing.T) {
+	var got PromWatchConfig
+	err := yaml.UnmarshalStrict([]byte(`
+collectors:
+- type: ebs
+  metric_stats:
+  - name_prefix: Volume
+    names: [ReadBytes, WriteBytes]
+    stats: [Sum, Average]
+`), &got)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []MetricStat{
+		{MetricName: "VolumeReadBytes", Stat: "Sum"},
+		{MetricName: "VolumeReadBytes", Stat: "Average"},
+		{MetricName: "VolumeWriteBytes", Stat: "Sum"},
+		{MetricName: "VolumeWriteBytes", Stat: "Average"},
+	}, stripInterface(got.Collectors[0], nil).config.MetricStats, "The shorthand should expand when loading the config")
+}
+
+func TestConfigMetricsPath(t *testing.T) {
+	var got PromWatchConfig
+	err := yaml.Unmarshal([]byte("metrics_path: /aws\ntelemetry_listen: localhost:12000"), &got)
+	assert.Nil(t, err)
+	assert.Equal(t, "/aws", got.MetricsPath)
+	assert.Equal(t, "localhost:12000", got.TelemetryListen)
+
+	for _, path := range []string{"metrics", "/metrics/", "/", "/healthz", "/metrics/aws", "/debug/collectors/x"} {
+		var got PromWatchConfig
+		err := yaml.Unmarshal([]byte("metrics_path: "+path), &got)
+		assert.ErrorIs(t, err, ErrInvalidMetricsPath, path)
+	}
+}
+
+func TestConfigUnknownStoreBackend(t *testing.T) {
+	var got PromWatchConfig
+	err := yaml.Unmarshal([]byte(`store_backend: etcd`), &got)
+	assert.ErrorIs(t, err, ErrUnknownStoreBackend)
+}
+
+func TestConfigLeaderElectionBackend(t *testing.T) {
+	var got PromWatchConfig
+	err := yaml.Unmarshal([]byte("leader_election:\n  enabled: true"), &got)
+	assert.ErrorIs(t, err, ErrLeaderElectionBackend)
+}
+
+func TestConfigInvalidInstanceLabel(t *testing.T) {
+	var got PromWatchConfig
+	err := yaml.Unmarshal([]byte("instance_label:\n  promwatch-instance: account-a"), &got)
+	assert.ErrorIs(t, err, ErrInvalidInstanceLabel)
+}
+
+func TestLoadConfigGzip(t *testing.T) {
+	content := []byte(`
+log_level: debug
+collectors:
+- type: ebs
+  name: test collector
+  offset: 600
+  interval: 300
+  metric_stats:
+  - name: VolumeReadBytes
+    stat: Sum`)
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "promwatch.yml")
+	assert.Nil(t, os.WriteFile(plain, content, 0o600))
+	compressed := bytes.Buffer{}
+	w := gzip.NewWriter(&compressed)
+	_, _ = w.Write(content)
+	assert.Nil(t, w.Close())
+	gz := filepath.Join(dir, "promwatch.yml.gz")
+	assert.Nil(t, os.WriteFile(gz, compressed.Bytes(), 0o600))
+
+	expected, err := loadConfig(plain)
+	assert.Nil(t, err)
+	got, err := loadConfig(gz)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, got, "Compressed configs should parse identically")
+	assert.Len(t, got.Collectors, 1)
+
+	assert.Nil(t, os.WriteFile(gz, content, 0o600))
+	_, err = loadConfig(gz)
+	assert.NotNil(t, err, "Configs with .gz extension that are not compressed should fail")
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// DimensionFilter restricts the values of a dimension of the dimension
+// combinations queried, e.g. to leave out the internal topics of Kafka
+// clusters. The regular expressions are anchored and compiled when the
+// configuration is loaded.
+type DimensionFilter struct {
+	Dimension string `yaml:"dimension"`
+	// Include requires the value of the dimension to match, Exclude
+	// requires it not to match.
+	Include string `yaml:"include"`
+	Exclude string `yaml:"exclude"`
+
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+}
+
+// UnmarshalYAML implements the Unmarshaller interface for DimensionFilter to
+// compile the regular expressions.
+func (f *DimensionFilter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type tmp DimensionFilter
+	var t tmp
+	if err := unmarshal(&t); err != nil {
+		return err
+	}
+	*f = DimensionFilter(t)
+
+	var err error
+	if f.Include != "" {
+		if f.include, err = regexp.Compile("^(?:" + f.Include + ")$"); err != nil {
+			return fmt.Errorf("Invalid dimension filter include: %s: %w", f.Dimension, err)
+		}
+	}
+	if f.Exclude != "" {
+		if f.exclude, err = regexp.Compile("^(?:" + f.Exclude + ")$"); err != nil {
+			return fmt.Errorf("Invalid dimension filter exclude: %s: %w", f.Dimension, err)
+		}
+	}
+
+	return nil
+}
+
+// valid returns an error if the filter has no dimension or neither include
+// nor exclude.
+func (f DimensionFilter) valid() error {
+	if f.Dimension == "" {
+		return fmt.Errorf("Dimension filters require a dimension")
+	}
+	if f.Include == "" && f.Exclude == "" {
+		return fmt.Errorf("Dimension filters require include or exclude: %s", f.Dimension)
+	}
+
+	return nil
+}
+
+// allows returns true if the value of the dimension of the filter in dims
+// passes the filter. Combinations without the dimension pass.
+func (f DimensionFilter) allows(dims []*cloudwatch.Dimension) bool {
+	for _, d := range dims {
+		if aws.StringValue(d.Name) != f.Dimension {
+			continue
+		}
+		value := aws.StringValue(d.Value)
+		if f.include != nil && !f.include.MatchString(value) {
+			return false
+		}
+		if f.exclude != nil && f.exclude.MatchString(value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// allowedDimensions returns true if the dimension combination passes all
+// filters.
+func allowedDimensions(filters []DimensionFilter, dims []*cloudwatch.Dimension) bool {
+	for _, f := range filters {
+		if !f.allows(dims) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func dimensionFilters(t *testing.T, config string) []DimensionFilter {
+	var filters []DimensionFilter
+	assert.Nil(t, yaml.Unmarshal([]byte(config), &filters))
+	return filters
+}
+
+func TestDimensionFilters(t *testing.T) {
+	dims := func(topic, client string) []*cloudwatch.Dimension {
+		return []*cloudwatch.Dimension{
+			{Name: aws.String("Cluster Name"), Value: aws.String("kafka")},
+			{Name: aws.String("Topic"), Value: aws.String(topic)},
+			{Name: aws.String("Client ID"), Value: aws.String(client)},
+		}
+	}
+
+	include := dimensionFilters(t, `[{dimension: Topic, include: "orders-.*"}]`)
+	assert.True(t, allowedDimensions(include, dims("orders-eu", "a")))
+	assert.False(t, allowedDimensions(include, dims("payments", "a")), "Values not matching include should be dropped")
+	assert.False(t, allowedDimensions(include, dims("my-orders-eu", "a")), "Regular expressions should be anchored")
+
+	exclude := dimensionFilters(t, `[{dimension: Topic, exclude: "__.*"}]`)
+	assert.True(t, allowedDimensions(exclude, dims("orders-eu", "a")))
+	assert.False(t, allowedDimensions(exclude, dims("__consumer_offsets", "a")), "Values matching exclude should be dropped")
+	assert.True(t, allowedDimensions(exclude, dims("__consumer_offsets", "a")[:1]), "Combinations without the dimension should pass")
+
+	both := dimensionFilters(t, `[{dimension: Topic, include: ".*-eu", exclude: "test-.*"}, {dimension: Client ID, exclude: "debug"}]`)
+	assert.True(t, allowedDimensions(both, dims("orders-eu", "a")))
+	assert.False(t, allowedDimensions(both, dims("test-eu", "a")), "Exclude should apply to values matching include")
+	assert.False(t, allowedDimensions(both, dims("orders-eu", "debug")), "Combinations failing any filter should be dropped")
+	assert.True(t, allowedDimensions(nil, dims("test-eu", "debug")))
+
+	var filters []DimensionFilter
+	assert.NotNil(t, yaml.Unmarshal([]byte(`[{dimension: Topic, include: "("}]`), &filters), "Invalid regular expressions should fail loading the configuration")
+
+	for _, f := range dimensionFilters(t, `[{include: ".*"}, {dimension: Topic}]`) {
+		assert.NotNil(t, f.valid())
+	}
+}
+
+func TestMakeQueriesDimensionFilters(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:   "alb",
+		Period: 60,
+		MetricStats: []MetricStat{
+			{MetricName: "RequestCount", Stat: "Sum", DimensionSets: []DimensionSet{
+				{"AvailabilityZone": "us-east-1a"},
+				{"AvailabilityZone": "us-east-1b"},
+				{"AvailabilityZone": "us-east-1c"},
+			}},
+		},
+		DimensionFilters: dimensionFilters(t, `[{dimension: AvailabilityZone, exclude: "us-east-1b"}, {dimension: LoadBalancer, exclude: "app/internal-.*"}]`),
+	}))
+	assert.True(t, b.Valid())
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:elasticloadbalancing:us-east-1:000000000000:loadbalancer/app/public/0123456789abcdef")},
+		{ResourceARN: aws.String("arn:aws:elasticloadbalancing:us-east-1:000000000000:loadbalancer/app/internal-api/0123456789abcdef")},
+	}
+
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	queries := b.makeQueries(index, b.namespace, b.metricDimensions())
+	zones := []string{}
+	for _, q := range queries {
+		d := q.MetricStat.Metric.Dimensions
+		assert.Equal(t, "app/public/0123456789abcdef", aws.StringValue(d[0].Value), "Resources failing a filter should not be queried")
+		zones = append(zones, aws.StringValue(d[1].Value))
+	}
+	assert.ElementsMatch(t, []string{"us-east-1a", "us-east-1c"}, zones, "Dimension sets failing a filter should not be queried")
+	assert.Equal(t, 4.0, testutil.ToFloat64(b.Telemetry().FilteredDimensionsCount), "Dropped combinations should be counted")
+	assert.Equal(t, 2, b.seriesPerResource(), "Dimension sets failing a filter should not be estimated")
+}
@@ -0,0 +1,378 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"gopkg.in/yaml.v2"
+)
+
+// DoctorCommand is the command checking a configuration against AWS, see
+// runDoctor.
+const DoctorCommand = "doctor"
+
+// MaxDoctorResources is the maximum number of discovered resources of a
+// collector doctor queries metrics for, and the maximum number of lines of the
+// sample render.
+const MaxDoctorResources = 10
+
+// MaxDoctorPages is the maximum number of GetResources pages doctor discovers
+// per collector, so checking a collector with many resources stays fast.
+const MaxDoctorPages = 1
+
+// Status of a doctor step.
+const (
+	DoctorPass = "pass"
+	DoctorWarn = "warn"
+	DoctorFail = "fail"
+)
+
+// Doctor steps in the order they are run for every collector.
+const (
+	DoctorStepConfig    = "config"
+	DoctorStepValidate  = "validate"
+	DoctorStepIdentity  = "identity"
+	DoctorStepDiscovery = "discovery"
+	DoctorStepProbe     = "probe"
+	DoctorStepRender    = "render"
+)
+
+// doctorStep is the outcome of a step of doctor.
+type doctorStep struct {
+	Step      string   `json:"step"`
+	Collector string   `json:"collector,omitempty"`
+	Status    string   `json:"status"`
+	Message   string   `json:"message"`
+	Lines     []string `json:"lines,omitempty"`
+}
+
+// doctorReport holds the steps of a doctor run in order.
+type doctorReport struct {
+	Steps []doctorStep `json:"steps"`
+}
+
+func (r *doctorReport) add(step, collector, status, format string, args ...interface{}) {
+	r.Steps = append(r.Steps, doctorStep{Step: step, Collector: collector, Status: status, Message: fmt.Sprintf(format, args...)})
+}
+
+// failed returns true if any step failed.
+func (r *doctorReport) failed() bool {
+	for _, s := range r.Steps {
+		if s.Status == DoctorFail {
+			return true
+		}
+	}
+
+	return false
+}
+
+var doctorColors = map[string]string{
+	DoctorPass: "\x1b[32m",
+	DoctorWarn: "\x1b[33m",
+	DoctorFail: "\x1b[31m",
+}
+
+// writeText writes the report as one line per step followed by the lines of
+// the step indented, the status is colorized if color is set.
+func (r *doctorReport) writeText(w io.Writer, color bool) {
+	for _, s := range r.Steps {
+		status := strings.ToUpper(s.Status)
+		if color {
+			status = doctorColors[s.Status] + status + "\x1b[0m"
+		}
+		name := s.Step
+		if s.Collector != "" {
+			name += " " + s.Collector
+		}
+		fmt.Fprintf(w, "[%s] %s: %s\n", status, name, s.Message)
+		for _, l := range s.Lines {
+			fmt.Fprintf(w, "    %s\n", l)
+		}
+	}
+}
+
+// runDoctor runs the doctor command with its arguments and writes the report to
+// w. The exit code is 1 if any step failed and 2 for invalid arguments. The
+// client is used for all AWS requests if not nil.
+func runDoctor(args []string, w io.Writer, client Client) int {
+	fs := flag.NewFlagSet(DoctorCommand, flag.ContinueOnError)
+	fs.SetOutput(w)
+	configFile := fs.String("config", "promwatch.yml", "Config file")
+	asJSON := fs.Bool("json", false, "Write the report as JSON")
+	color := fs.Bool("color", true, "Colorize the status of the text report")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	report := doctor(*configFile, client)
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		report.writeText(w, *color)
+	}
+
+	if report.failed() {
+		return 1
+	}
+
+	return 0
+}
+
+// doctor checks the configuration in configFile, then checks the credentials
+// once per distinct region and role, discovers the resources of every
+// collector on up to MaxDoctorPages pages, and queries the metrics of up to
+// MaxDoctorResources of them. A single metric is probed once per distinct
+// namespace and region.
+func doctor(configFile string, client Client) *doctorReport {
+	report := &doctorReport{}
+
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		report.add(DoctorStepConfig, "", DoctorFail, "%s: %s", ErrConfigNotReadable, err)
+		return report
+	}
+	content, err = decompressConfig(configFile, content)
+	if err != nil {
+		report.add(DoctorStepConfig, "", DoctorFail, "%s", err)
+		return report
+	}
+	conf := PromWatchConfig{}
+	if err := yaml.UnmarshalStrict(content, &conf); err != nil {
+		report.add(DoctorStepConfig, "", DoctorFail, "%s", err)
+		return report
+	}
+	if len(conf.Collectors) == 0 {
+		report.add(DoctorStepConfig, "", DoctorWarn, "no collectors defined")
+		return report
+	}
+	report.add(DoctorStepConfig, "", DoctorPass, "%d collectors", len(conf.Collectors))
+
+	// The checks run to completion, the command is not cancelled.
+	ctx := context.Background()
+
+	identified := map[string]bool{}
+	probed := map[string]struct{}{}
+	for _, c := range conf.Collectors {
+		b, getResources, dim, err := doctorTarget(c)
+		if err != nil {
+			report.add(DoctorStepValidate, "", DoctorFail, "%s", err)
+			continue
+		}
+		name := b.config.Name
+		if name == "" {
+			name = b.config.Type
+		}
+
+		if !c.Valid() {
+			report.add(DoctorStepValidate, name, DoctorFail, "invalid configuration, see the log for details")
+			continue
+		}
+		report.add(DoctorStepValidate, name, DoctorPass, "valid")
+
+		if client != nil {
+			b._client = client
+		}
+		identity := b.config.Region + " " + b.config.RoleARN
+		ok, checked := identified[identity]
+		if !checked {
+			step := b.doctorIdentity(ctx, name)
+			ok = step.Status == DoctorPass
+			identified[identity] = ok
+			report.Steps = append(report.Steps, step)
+		}
+		if !ok {
+			if checked {
+				report.add(DoctorStepIdentity, name, DoctorFail, "credentials failed in region %s", doctorRegion(b.config.Region))
+			}
+			continue
+		}
+
+		index, err := getResources(withMaxPages(ctx, MaxDoctorPages))
+		if err != nil {
+			report.add(DoctorStepDiscovery, name, DoctorFail, "%s", doctorError(err))
+			continue
+		}
+		if len(index.Resources) == 0 {
+			report.add(DoctorStepDiscovery, name, DoctorWarn, "no resources found, check the tag filters")
+			continue
+		}
+		report.add(DoctorStepDiscovery, name, DoctorPass, "%d resources, pages limited to %d", len(index.Resources), MaxDoctorPages)
+		index = limitResources(index, MaxDoctorResources)
+
+		key := b.namespace + " " + b.config.Region
+		if _, ok := probed[key]; !ok {
+			probed[key] = struct{}{}
+			report.Steps = append(report.Steps, b.doctorProbe(ctx, index, dim, name))
+		}
+		report.Steps = append(report.Steps, b.doctorRender(ctx, index, dim, name))
+	}
+
+	return report
+}
+
+// doctorTarget returns the collector to check for c, including the resource
+// getter and metric dimensions it runs with. Collectors for all regions are
+// checked in the default region of the environment. Unknown collectors are
+// returned as error.
+func doctorTarget(c MetricCollector) (*BaseCollector, resourceGetter, metricDimensions, error) {
+	switch c := c.(type) {
+	case *ASGCollector:
+		return c.base, c.getGroups, asgMetricDimension, nil
+	case *ECHostCollector:
+		return c.base, c.getClusters, cacheNodeMetricDimension, nil
+	case *MSKBrokerCollector:
+		return c.base, c.getBrokers, mskBrokerMetricDimension, nil
+	case *CloudFrontCollector:
+		return c.base, c.base.getResources, cloudFrontMetricDimension, nil
+	case *GlobalAcceleratorCollector:
+		return c.base, c.base.getResources, c.base.metricDimensions(), nil
+	case *AllRegionsCollector:
+		if inner, err := CollectorFromConfig(c.base.config); err == nil {
+			return doctorTarget(inner)
+		}
+		return c.base, c.base.getResources, c.base.metricDimensions(), nil
+	case *BaseCollector:
+		return c, c.getResources, c.metricDimensions(), nil
+	}
+
+	return nil, nil, nil, fmt.Errorf("unknown collector %T", c)
+}
+
+// doctorError returns the message of err with the missing IAM action if the
+// request was denied.
+func doctorError(err error) string {
+	if action, ok := missingAction(err); ok && isAuthError(err) {
+		return fmt.Sprintf("%s, missing permission %s", err, action)
+	}
+
+	return err.Error()
+}
+
+// limitResources returns an index with the first max resources of index by ID.
+func limitResources(index *ResourceIndex, max int) *ResourceIndex {
+	ids := make([]string, 0, len(index.Resources))
+	for id := range index.Resources {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if len(ids) > max {
+		ids = ids[:max]
+	}
+
+	limited := NewResourceIndex()
+	for _, id := range ids {
+		limited.Resources[id] = index.Resources[id]
+	}
+
+	return limited
+}
+
+// doctorIdentity checks the credentials of the collector in its region with
+// STS GetCallerIdentity, which requires no permissions.
+func (b *BaseCollector) doctorIdentity(ctx context.Context, name string) doctorStep {
+	step := doctorStep{Step: DoctorStepIdentity, Collector: name}
+	client, err := b.client()
+	var out *sts.GetCallerIdentityOutput
+	if err == nil {
+		out, err = client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{}, b.Telemetry())
+	}
+	if err != nil {
+		step.Status, step.Message = DoctorFail, doctorError(err)
+		return step
+	}
+	step.Status, step.Message = DoctorPass, fmt.Sprintf("%s in region %s", aws.StringValue(out.Arn), doctorRegion(b.config.Region))
+
+	return step
+}
+
+// doctorProbe queries a single metric of the first resource of index to check
+// access to the namespace of the collector in its region.
+func (b *BaseCollector) doctorProbe(ctx context.Context, index *ResourceIndex, dim metricDimensions, name string) doctorStep {
+	step := doctorStep{Step: DoctorStepProbe, Collector: name}
+	in := b.getMetricDataInput(limitResources(index, 1), dim)
+	if len(in) == 0 || len(in[0].MetricDataQueries) == 0 {
+		step.Status, step.Message = DoctorWarn, "no metric stats to probe"
+		return step
+	}
+	in[0].MetricDataQueries = in[0].MetricDataQueries[:1]
+
+	client, err := b.client()
+	if err == nil {
+		_, err = client.GetMetricData(ctx, in[:1], b.Telemetry())
+	}
+	if err != nil {
+		step.Status, step.Message = DoctorFail, doctorError(err)
+		return step
+	}
+	step.Status, step.Message = DoctorPass, fmt.Sprintf("queried %s in region %s", b.namespace, doctorRegion(b.config.Region))
+
+	return step
+}
+
+func doctorRegion(region string) string {
+	if region == "" {
+		return "of the environment"
+	}
+
+	return region
+}
+
+// doctorRender queries the metrics of the resources of index and renders up to
+// MaxDoctorResources lines of the samples as they would be served.
+func (b *BaseCollector) doctorRender(ctx context.Context, index *ResourceIndex, dim metricDimensions, name string) doctorStep {
+	step := doctorStep{Step: DoctorStepRender, Collector: name}
+	in := b.getMetricDataInput(index, dim)
+
+	if len(in) == 0 {
+		step.Status, step.Message = DoctorWarn, "no metric stats to query"
+		return step
+	}
+
+	client, err := b.client()
+	if err != nil {
+		step.Status, step.Message = DoctorFail, doctorError(err)
+		return step
+	}
+	res, err := client.GetMetricData(ctx, in, b.Telemetry())
+	if err != nil {
+		step.Status, step.Message = DoctorFail, doctorError(err)
+		return step
+	}
+	index.AddResults(res)
+	b.store = NewStore(0)
+	if err := b.storeResults(index); err != nil {
+		step.Status, step.Message = DoctorFail, doctorError(err)
+		return step
+	}
+
+	content := strings.TrimSuffix(b.store.String(), "\n")
+	if content == "" {
+		step.Status, step.Message = DoctorWarn, fmt.Sprintf("no datapoints for %d resources", len(index.Resources))
+		return step
+	}
+	// Only the samples are shown, not the TYPE lines declaring their
+	// families.
+	step.Lines = []string{}
+	for _, l := range strings.Split(content, "\n") {
+		if !strings.HasPrefix(l, "#") {
+			step.Lines = append(step.Lines, l)
+		}
+	}
+	if len(step.Lines) > MaxDoctorResources {
+		step.Lines = step.Lines[:MaxDoctorResources]
+	}
+	step.Status, step.Message = DoctorPass, fmt.Sprintf("samples of %d resources", len(index.Resources))
+
+	return step
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/stretchr/testify/assert"
+)
+
+const doctorConfig = `
+collectors:
+  - type: ebs
+    name: Volumes
+    region: us-east-1
+    period: 60
+    metric_stats:
+      - {name: VolumeReadBytes, stat: Sum}
+      - {name: VolumeWriteBytes, stat: Sum}
+  - type: ebs
+    name: More Volumes
+    region: us-east-1
+    period: 60
+    metric_stats:
+      - {name: VolumeIdleTime, stat: Sum}
+`
+
+func doctorFixture() *FakeClient {
+	resources := []*tagging.ResourceTagMapping{}
+	results := []*cloudwatch.MetricDataResult{}
+	for i := 0; i < 12; i++ {
+		r := &tagging.ResourceTagMapping{ResourceARN: aws.String(fmt.Sprintf("arn:aws:ec2:us-east-1:000000000000:volume/vol-%02d", i))}
+		resources = append(resources, r)
+		for j := 0; j < 2; j++ {
+			results = append(results, &cloudwatch.MetricDataResult{
+				Id:         aws.String(fmt.Sprintf("id_%s_%d", id(r), j)),
+				Values:     []*float64{aws.Float64(1)},
+				Timestamps: []*time.Time{aws.Time(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))},
+			})
+		}
+	}
+
+	// The second page is beyond the page limit of doctor.
+	more := []*tagging.ResourceTagMapping{{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-12")}}
+
+	return &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{resources, more},
+		MetricDataResultPages:   [][]*cloudwatch.MetricDataResult{results},
+		Identity:                &sts.GetCallerIdentityOutput{Arn: aws.String("arn:aws:iam::000000000000:user/doctor")},
+	}
+}
+
+func runDoctorWith(t *testing.T, config string, client Client, args ...string) (int, doctorReport) {
+	configFile := filepath.Join(t.TempDir(), "promwatch.yml")
+	assert.Nil(t, os.WriteFile(configFile, []byte(config), 0o600))
+
+	var out bytes.Buffer
+	code := runDoctor(append([]string{"-config", configFile, "-json"}, args...), &out, client)
+	var report doctorReport
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &report), out.String())
+
+	return code, report
+}
+
+func steps(report doctorReport) []string {
+	got := []string{}
+	for _, s := range report.Steps {
+		got = append(got, strings.Join(strings.Fields(s.Step+" "+s.Collector+" "+s.Status), " "))
+	}
+
+	return got
+}
+
+func TestDoctor(t *testing.T) {
+	client := doctorFixture()
+	code, report := runDoctorWith(t, doctorConfig, client)
+
+	assert.Equal(t, 0, code)
+	assert.Equal(t, []string{
+		"config pass",
+		"validate Volumes pass",
+		"identity Volumes pass",
+		"discovery Volumes pass",
+		"probe Volumes pass",
+		"render Volumes pass",
+		"validate More Volumes pass",
+		"discovery More Volumes pass",
+		"render More Volumes pass",
+	}, steps(report), "Credentials should be checked and namespaces probed once per region")
+	assert.Equal(t, "arn:aws:iam::000000000000:user/doctor in region us-east-1", report.Steps[2].Message)
+	assert.Equal(t, "12 resources, pages limited to 1", report.Steps[3].Message, "Discovery should stop at the page limit")
+	assert.Len(t, report.Steps[5].Lines, MaxDoctorResources, "Sample renders should be limited")
+	assert.Contains(t, report.Steps[5].Message, fmt.Sprintf("%d resources", MaxDoctorResources), "Metrics should only be queried for a limited number of resources")
+
+	queries := 0
+	for _, c := range client.Calls() {
+		if in, ok := c.Input.([]*cloudwatch.GetMetricDataInput); ok {
+			for _, i := range in {
+				queries += len(i.MetricDataQueries)
+			}
+		}
+	}
+	assert.Equal(t, 1+2*MaxDoctorResources+MaxDoctorResources, queries, "Probes should query a single metric")
+}
+
+func TestDoctorFailures(t *testing.T) {
+	denied := doctorFixture()
+	denied.Errors = map[string]error{MethodGetMetricData: errAccessDenied}
+	code, report := runDoctorWith(t, doctorConfig, denied)
+	assert.Equal(t, 1, code, "Failed steps should fail the run")
+	assert.Equal(t, DoctorFail, report.Steps[4].Status)
+	assert.Contains(t, report.Steps[4].Message, "missing permission cloudwatch:GetMetricData")
+
+	code, report = runDoctorWith(t, doctorConfig, &FakeClient{})
+	assert.Equal(t, 0, code, "Warnings should not fail the run")
+	assert.Equal(t, DoctorWarn, report.Steps[3].Status, "Collectors without resources should warn")
+
+	unidentified := doctorFixture()
+	unidentified.Errors = map[string]error{MethodGetCallerIdentity: errAccessDenied}
+	code, report = runDoctorWith(t, doctorConfig, unidentified)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, []string{
+		"config pass",
+		"validate Volumes pass",
+		"identity Volumes fail",
+		"validate More Volumes pass",
+		"identity More Volumes fail",
+	}, steps(report), "Collectors should not be discovered with failing credentials")
+	assert.Len(t, unidentified.Calls(), 1, "Credentials should be checked once per region")
+
+	code, report = runDoctorWith(t, "collectors:\n  - type: ebs\n    metric_stat: []\n", &FakeClient{})
+	assert.Equal(t, 1, code)
+	assert.Equal(t, []string{"config fail"}, steps(report), "Unknown keys should fail the configuration")
+
+	code, report = runDoctorWith(t, "collectors:\n  - type: ebs\n    interval: 120\n    offset: 60\n", &FakeClient{})
+	assert.Equal(t, 1, code)
+	assert.Equal(t, []string{"config pass", "validate ebs fail"}, steps(report))
+
+	var out bytes.Buffer
+	assert.Equal(t, 1, runDoctor([]string{"-config", filepath.Join(t.TempDir(), "missing.yml"), "-color=false"}, &out, &FakeClient{}))
+	assert.True(t, strings.HasPrefix(out.String(), "[FAIL] config: "), out.String())
+
+	assert.Equal(t, 2, runDoctor([]string{"-unknown"}, &bytes.Buffer{}, nil), "Invalid arguments should exit with 2")
+}
+
+// unknownCollector is a MetricCollector doctor does not know.
+type unknownCollector struct{}
+
+func (unknownCollector) Valid() bool         { return true }
+func (unknownCollector) Run() *CollectorProc { return nil }
+
+func TestDoctorTargetUnknown(t *testing.T) {
+	_, _, _, err := doctorTarget(unknownCollector{})
+	assert.EqualError(t, err, "unknown collector main.unknownCollector", "Unknown collectors should be reported instead of panicking")
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// DefaultMetricPrefix is the prefix of the names of all metrics collected from
+// CloudWatch unless a collector sets its own.
+const DefaultMetricPrefix = "promwatch_aws_"
+
+// matchMetricPrefix matches prefixes that are valid metric names on their own,
+// so names starting with them are valid too.
+var matchMetricPrefix = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// DualWriteDateFormat is the format of the dual write expiry date.
+const DualWriteDateFormat = "2006-01-02"
+
+// dualWriteWarnInterval is the interval the expiry warning of dual write is
+// repeated in.
+const dualWriteWarnInterval = 24 * time.Hour
+
+// DualWrite configures emitting every series under its legacy name in addition
+// to its current name while options changing metric names are rolled out, so
+// dashboards can be migrated gradually.
+type DualWrite struct {
+	Enabled bool `yaml:"enabled"`
+	// Expires is the date in the format YYYY-MM-DD after which a warning is
+	// logged daily as a reminder to disable dual write.
+	Expires string `yaml:"expires"`
+}
+
+// expiry returns the parsed expiry date or the zero time if not set.
+func (d DualWrite) expiry() (time.Time, error) {
+	if d.Expires == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(DualWriteDateFormat, d.Expires)
+	if err != nil {
+		return t, fmt.Errorf("Invalid dual write expiry %q, expected YYYY-MM-DD: %w", d.Expires, err)
+	}
+
+	return t, nil
+}
+
+// legacyMetricName returns the name of the metric stat as emitted by PromWatch
+// without any options changing metric names. Dotted metric names are snake
+// cased as a whole like before snakeMetricName, so their legacy names stay
+// stable.
+func legacyMetricName(collectorType, metric, stat string) string {
+	return fmt.Sprintf(
+		"%s%s_%s_%s",
+		DefaultMetricPrefix,
+		collectorType,
+		toSnakeCase(sanitize(metric)),
+		toSnakeCase(sanitize(stat)))
+}
+
+// prefixedMetricName returns the name of the metric stat starting with prefix
+// instead of DefaultMetricPrefix.
+func prefixedMetricName(prefix, collectorType, metric, stat string) string {
+	return fmt.Sprintf(
+		"%s%s_%s_%s",
+		prefix,
+		collectorType,
+		snakeMetricName(metric),
+		toSnakeCase(sanitize(stat)))
+}
+
+// metricName returns the name of the metric stat. Options changing metric names
+// are applied here.
+func (b *BaseCollector) metricName(metric, stat string) string {
+	return prefixedMetricName(b.metricPrefix(), b.config.Type, metric, stat) + b.config.MetricNameSuffix
+}
+
+// metricPrefix returns the configured metric prefix or DefaultMetricPrefix.
+func (b *BaseCollector) metricPrefix() string {
+	if b.config.MetricPrefix != "" {
+		return b.config.MetricPrefix
+	}
+
+	return DefaultMetricPrefix
+}
+
+// metricNames returns the names a metric stat is emitted as. With dual write
+// enabled the legacy name is returned as well if it differs from the current
+// one.
+func (b *BaseCollector) metricNames(metric, stat string) []string {
+	name := b.metricName(metric, stat)
+	if !b.config.DualWrite.Enabled {
+		return []string{name}
+	}
+
+	legacy := legacyMetricName(b.config.Type, metric, stat)
+	if legacy == name {
+		return []string{name}
+	}
+
+	return []string{name, legacy}
+}
+
+// seriesPerResource returns the number of series emitted per resource, which
+// includes the series duplicated by dual write and of every dimension set not
+// dropped by the dimension filters.
+func (b *BaseCollector) seriesPerResource() int {
+	n := 0
+	for _, s := range b.config.MetricStats {
+		sets := 0
+		for _, set := range s.dimensionSets(b.namespace) {
+			if allowedDimensions(b.config.DimensionFilters, set.dimensions()) {
+				sets++
+			}
+		}
+		n += len(b.metricNames(s.MetricName, s.Stat)) * sets
+	}
+	n += len(b.config.Expressions)
+
+	return n
+}
+
+// warnDualWriteExpiry logs a warning if dual write is enabled past its expiry
+// date. The warning is repeated every dualWriteWarnInterval. It returns true if
+// the warning was logged.
+func (b *BaseCollector) warnDualWriteExpiry(now time.Time) bool {
+	if !b.config.DualWrite.Enabled {
+		return false
+	}
+
+	expiry, err := b.config.DualWrite.expiry()
+	if err != nil || expiry.IsZero() || now.Before(expiry) {
+		return false
+	}
+	if !b.dualWriteWarned.IsZero() && now.Sub(b.dualWriteWarned) < dualWriteWarnInterval {
+		return false
+	}
+
+	b.dualWriteWarned = now
+	b.logger().Warnw("dual write is enabled past its expiry, legacy metric names are still emitted",
+		"id", b.ID(), "name", b.config.Name, "type", b.config.Type, "expires", b.config.DualWrite.Expires)
+
+	return true
+}
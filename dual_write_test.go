@@ -0,0 +1,96 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDualWriteExpiry(t *testing.T) {
+	cases := []struct {
+		dualWrite DualWrite
+		times     []time.Time
+		expected  []bool
+		message   string
+	}{
+		{
+			dualWrite: DualWrite{Enabled: true, Expires: "2021-02-01"},
+			times: []time.Time{
+				time.Date(2021, 1, 31, 23, 0, 0, 0, time.UTC),
+				time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+				time.Date(2021, 2, 1, 12, 0, 0, 0, time.UTC),
+				time.Date(2021, 2, 2, 0, 0, 0, 0, time.UTC),
+			},
+			expected: []bool{false, true, false, true},
+			message:  "Warning should be logged once expired and repeated daily",
+		},
+		{
+			dualWrite: DualWrite{Enabled: false, Expires: "2021-02-01"},
+			times:     []time.Time{time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)},
+			expected:  []bool{false},
+			message:   "Warning should not be logged if dual write is disabled",
+		},
+		{
+			dualWrite: DualWrite{Enabled: true},
+			times:     []time.Time{time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)},
+			expected:  []bool{false},
+			message:   "Warning should not be logged without expiry",
+		},
+	}
+
+	for _, c := range cases {
+		b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs", DualWrite: c.dualWrite}))
+		warned := []bool{}
+		for _, now := range c.times {
+			warned = append(warned, b.warnDualWriteExpiry(now))
+		}
+		assert.Equal(t, c.expected, warned, c.message)
+	}
+}
+
+func TestDualWriteStartupWarning(t *testing.T) {
+	now := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:        "ebs",
+		DualWrite:   DualWrite{Enabled: true, Expires: "2021-02-01"},
+		ActiveHours: []string{"12:00-13:00"},
+	}))
+	b.withTime(&testTime{now: &now})
+
+	assert.Nil(t, b.collectIfActive(context.Background(), nil, nil))
+	assert.Equal(t, now, b.dualWriteWarned, "Warning should be logged on the first run even outside active hours")
+}
+
+func TestMetricNames(t *testing.T) {
+	cases := []struct {
+		dualWrite DualWrite
+		prefix    string
+		expected  []string
+		message   string
+	}{
+		{DualWrite{}, "", []string{"promwatch_aws_ebs_volume_read_bytes_sum"}, "Metric stats should have a single name by default"},
+		{DualWrite{Enabled: true}, "", []string{"promwatch_aws_ebs_volume_read_bytes_sum"}, "Legacy names equal to the current names should not be duplicated"},
+		{DualWrite{}, "cloudwatch_", []string{"cloudwatch_ebs_volume_read_bytes_sum"}, "The prefix should replace the default prefix"},
+		{DualWrite{Enabled: true}, "cloudwatch_", []string{"cloudwatch_ebs_volume_read_bytes_sum", "promwatch_aws_ebs_volume_read_bytes_sum"}, "Dual write should emit the names with the default prefix"},
+	}
+
+	for _, c := range cases {
+		b := stripInterface(CollectorFromConfig(CollectorConfig{
+			Type:         "ebs",
+			DualWrite:    c.dualWrite,
+			MetricPrefix: c.prefix,
+			MetricStats:  []MetricStat{{MetricName: "VolumeReadBytes", Stat: "Sum"}},
+		}))
+		assert.Equal(t, c.expected, b.metricNames("VolumeReadBytes", "Sum"), c.message)
+		assert.Equal(t, len(c.expected), b.seriesPerResource(), c.message)
+	}
+
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "kinesis", DualWrite: DualWrite{Enabled: true}}))
+	assert.Equal(t, []string{
+		"promwatch_aws_kinesis_get_records_iterator_age_milliseconds_maximum",
+		"promwatch_aws_kinesis_get_records__iterator_age_milliseconds_maximum",
+	}, b.metricNames("GetRecords.IteratorAgeMilliseconds", "Maximum"), "Legacy names of dotted metrics should be snake cased as a whole")
+}
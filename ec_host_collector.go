@@ -2,11 +2,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/elasticache"
 	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
@@ -46,8 +46,8 @@ func (a *ECHostCollector) Valid() bool {
 	return a.base.Valid()
 }
 
-func (a *ECHostCollector) getClusters() (*ResourceIndex, error) {
-	resources, err := a.base.getResources()
+func (a *ECHostCollector) getClusters(ctx context.Context) (*ResourceIndex, error) {
+	resources, err := a.base.getResources(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -57,12 +57,12 @@ func (a *ECHostCollector) getClusters() (*ResourceIndex, error) {
 		resourceMap[*r.ResourceARN] = r.Tags
 	}
 
-	client, err := DefaultAWSClient(a.base.config.Region)
+	client, err := a.base.client()
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := client.DescribeCacheClusters(&elasticache.DescribeCacheClustersInput{
+	res, err := client.DescribeCacheClusters(ctx, &elasticache.DescribeCacheClustersInput{
 		ShowCacheClustersNotInReplicationGroups: aws.Bool(true),
 		ShowCacheNodeInfo:                       aws.Bool(true),
 	}, a.base.Telemetry())
@@ -87,6 +87,7 @@ func (a *ECHostCollector) getClusters() (*ResourceIndex, error) {
 
 	// convert cache clusters to resource tag mapping
 	mapping := []*tagging.ResourceTagMapping{}
+	endpoints := map[string]string{}
 	for _, cluster := range cacheClusters {
 		for _, n := range cluster.CacheNodes {
 			// append node id to the cluster name so it looks similar to a redis cluster id
@@ -95,11 +96,21 @@ func (a *ECHostCollector) getClusters() (*ResourceIndex, error) {
 				ResourceARN: &arnWithNodeID,
 				Tags:        cluster.Tags,
 			})
-			Logger.Debugf("Cache ARN: %s", aws.StringValue(cluster.ARN))
+			// Nodes being created have no endpoint yet.
+			if n.Endpoint != nil && aws.StringValue(n.Endpoint.Address) != "" {
+				endpoints[arnWithNodeID] = aws.StringValue(n.Endpoint.Address)
+			}
+			a.base.logger().Debugf("Cache ARN: %s", aws.StringValue(cluster.ARN))
 		}
 	}
 
-	return NewResourceIndexFromTagMapping(&mapping, id), nil
+	// The endpoints come with the clusters, no additional request is
+	// required.
+	if a.base.config.EndpointLabel {
+		a.base.endpoints.set(endpoints)
+	}
+
+	return NewResourceIndexFromTagMapping(&mapping, a.base.resourceID()), nil
 }
 
 func (a *ECHostCollector) Run() *CollectorProc {
@@ -107,7 +118,7 @@ func (a *ECHostCollector) Run() *CollectorProc {
 }
 
 func cacheNodeMetricDimension(resource *tagging.ResourceTagMapping) ([]*cloudwatch.Dimension, error) {
-	arn, err := arn.Parse(*resource.ResourceARN)
+	arn, err := parseARN(*resource.ResourceARN)
 	if err != nil {
 		return []*cloudwatch.Dimension{}, ErrCanNotParseARN
 	}
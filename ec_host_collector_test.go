@@ -2,10 +2,12 @@
 package main
 
 import (
+	"context"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/elasticache"
 	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
 	"github.com/stretchr/testify/assert"
 )
@@ -40,3 +42,47 @@ func TestCacheNodeMetricDimension(t *testing.T) {
 		assert.Equal(t, c.expected, got, c.message)
 	}
 }
+
+func TestGetClusters(t *testing.T) {
+	memcachedARN := "arn:aws:elasticache:us-east-1:000000000000:cluster:memcached"
+	redisARN := "arn:aws:elasticache:us-east-1:000000000000:cluster:redis"
+	client := &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{
+			{
+				{ResourceARN: aws.String(memcachedARN), Tags: []*tagging.Tag{{Key: aws.String("team"), Value: aws.String("metrics")}}},
+				{ResourceARN: aws.String(redisARN)},
+			},
+		},
+		CacheClusterPages: [][]*elasticache.CacheCluster{
+			{
+				{
+					ARN:    aws.String(memcachedARN),
+					Engine: aws.String("memcached"),
+					CacheNodes: []*elasticache.CacheNode{
+						{CacheNodeId: aws.String("0001")},
+						{CacheNodeId: aws.String("0002")},
+					},
+				},
+				{
+					ARN:        aws.String(redisARN),
+					Engine:     aws.String("redis"),
+					CacheNodes: []*elasticache.CacheNode{{CacheNodeId: aws.String("0001")}},
+				},
+			},
+		},
+	}
+
+	c, _ := NewECHostCollector(CollectorConfig{Type: "ec_host"})
+	e := c.(*ECHostCollector)
+	e.base._client = client
+
+	index, err := e.getClusters(context.Background())
+	assert.Nil(t, err)
+
+	arns := []string{}
+	for _, r := range index.Resources {
+		arns = append(arns, *r.ResourceARN)
+		assert.Equal(t, "metrics", *r.Tags[0].Value, "Cluster tags should be carried over to nodes")
+	}
+	assert.ElementsMatch(t, []string{memcachedARN + ":0001", memcachedARN + ":0002"}, arns, "Only memcached nodes should be indexed")
+}
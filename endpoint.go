@@ -0,0 +1,144 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+// LabelEndpoint is the label holding the endpoint address of a resource, see
+// CollectorConfig.EndpointLabel.
+const LabelEndpoint = "endpoint"
+
+// endpointTypes are the collector types supporting endpoint labels.
+var endpointTypes = map[string]struct{}{
+	"ec":      {},
+	"ec_host": {},
+	"rds":     {},
+}
+
+// endpointCache holds the endpoint addresses of the resources of a collector by
+// ARN. Resources without an address, e.g. pending instances, are missing.
+type endpointCache struct {
+	sync.Mutex
+
+	addresses  map[string]string
+	refreshing bool
+}
+
+// get returns the address of the resource with the ARN, empty if unknown.
+func (c *endpointCache) get(arn string) string {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.addresses[arn]
+}
+
+// set replaces the addresses of all resources.
+func (c *endpointCache) set(addresses map[string]string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.addresses = addresses
+}
+
+// validEndpointLabel returns an error if the endpoint label is enabled for a
+// collector type without endpoints, or on series without being enabled.
+func validEndpointLabel(typ string, enabled, onSeries bool) error {
+	if _, ok := endpointTypes[typ]; enabled && !ok {
+		return fmt.Errorf("Endpoint labels are not supported by collector type: %s", typ)
+	}
+	if onSeries && !enabled {
+		return fmt.Errorf("Endpoint labels on series require endpoint_label")
+	}
+
+	return nil
+}
+
+// refreshEndpoints looks up the endpoints of the resources of ec and rds
+// collectors in the background, unless a lookup is in flight already, so
+// discovery is not delayed by the additional request. Commits use the
+// endpoints of the last successful lookup. The endpoints of ec_host
+// collectors are taken from their discovery instead.
+func (b *BaseCollector) refreshEndpoints(ctx context.Context) {
+	if !b.config.EndpointLabel || (b.config.Type != "ec" && b.config.Type != "rds") {
+		return
+	}
+
+	b.endpoints.Lock()
+	if b.endpoints.refreshing {
+		b.endpoints.Unlock()
+		return
+	}
+	b.endpoints.refreshing = true
+	b.endpoints.Unlock()
+
+	go func() {
+		defer func() {
+			b.endpoints.Lock()
+			b.endpoints.refreshing = false
+			b.endpoints.Unlock()
+		}()
+
+		addresses, err := b.describeEndpoints(ctx)
+		if b.HandleError(err) == nil {
+			b.endpoints.set(addresses)
+		}
+	}()
+}
+
+// describeEndpoints returns the endpoint addresses of all cache clusters or DB
+// instances by ARN. Cache clusters are addressed by their configuration
+// endpoint if they have one, by the endpoint of their first node otherwise.
+func (b *BaseCollector) describeEndpoints(ctx context.Context) (map[string]string, error) {
+	client, err := b.client()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := map[string]string{}
+	if b.config.Type == "rds" {
+		res, err := client.DescribeDBInstances(ctx, &rds.DescribeDBInstancesInput{}, b.Telemetry())
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range *res {
+			if i.Endpoint != nil && aws.StringValue(i.Endpoint.Address) != "" {
+				addresses[aws.StringValue(i.DBInstanceArn)] = aws.StringValue(i.Endpoint.Address)
+			}
+		}
+
+		return addresses, nil
+	}
+
+	res, err := client.DescribeCacheClusters(ctx, &elasticache.DescribeCacheClustersInput{
+		ShowCacheNodeInfo: aws.Bool(true),
+	}, b.Telemetry())
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range *res {
+		var endpoint *elasticache.Endpoint
+		if c.ConfigurationEndpoint != nil {
+			endpoint = c.ConfigurationEndpoint
+		} else if len(c.CacheNodes) > 0 {
+			endpoint = c.CacheNodes[0].Endpoint
+		}
+		if endpoint != nil && aws.StringValue(endpoint.Address) != "" {
+			addresses[aws.StringValue(c.ARN)] = aws.StringValue(endpoint.Address)
+		}
+	}
+
+	return addresses, nil
+}
+
+// endpointInfoName returns the name of the info series carrying the endpoint
+// label of every resource.
+func (b *BaseCollector) endpointInfoName() string {
+	return fmt.Sprintf("%s%s_endpoint_info", b.metricPrefix(), b.config.Type)
+}
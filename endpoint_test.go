@@ -0,0 +1,167 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/rds"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/stretchr/testify/assert"
+)
+
+// storeEndpoints stores a datapoint for every query of index and returns the
+// stored lines without timestamps in order.
+func storeEndpoints(b *BaseCollector, index *ResourceIndex, dim metricDimensions) []string {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.withTime(&testTime{now: &now})
+	b.store = NewStore(0)
+	b.makeQueries(index, b.namespace, dim)
+	results := []*cloudwatch.MetricDataResult{}
+	for _, queries := range index.Queries {
+		results = append(results, &cloudwatch.MetricDataResult{
+			Id:         queries[0].Id,
+			Values:     []*float64{aws.Float64(1)},
+			Timestamps: []*time.Time{aws.Time(now)},
+		})
+	}
+	index.AddResults(&results)
+	b.storeResults(index)
+
+	lines := []string{}
+	for _, l := range strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n") {
+		lines = append(lines, l[:strings.LastIndex(l, "} ")+1])
+	}
+	sort.Strings(lines)
+
+	return lines
+}
+
+// waitForEndpoints runs a refresh of the endpoints of b and waits for it to
+// finish.
+func waitForEndpoints(t *testing.T, b *BaseCollector) {
+	b.refreshEndpoints(context.Background())
+	assert.Eventually(t, func() bool {
+		b.endpoints.Lock()
+		defer b.endpoints.Unlock()
+		return !b.endpoints.refreshing
+	}, time.Second, time.Millisecond)
+}
+
+func TestEndpointLabelCacheCluster(t *testing.T) {
+	arn := func(id string) string { return "arn:aws:elasticache:us-east-1:000000000000:cluster:" + id }
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String(arn("memcached"))},
+		{ResourceARN: aws.String(arn("redis-0001-001"))},
+		{ResourceARN: aws.String(arn("pending"))},
+	}
+	client := &FakeClient{
+		CacheClusterPages: [][]*elasticache.CacheCluster{{
+			{
+				ARN:                   aws.String(arn("memcached")),
+				ConfigurationEndpoint: &elasticache.Endpoint{Address: aws.String("memcached.cfg.use1.cache.amazonaws.com")},
+				CacheNodes:            []*elasticache.CacheNode{{Endpoint: &elasticache.Endpoint{Address: aws.String("memcached.0001.use1.cache.amazonaws.com")}}},
+			},
+			{
+				ARN:        aws.String(arn("redis-0001-001")),
+				CacheNodes: []*elasticache.CacheNode{{Endpoint: &elasticache.Endpoint{Address: aws.String("redis-0001-001.use1.cache.amazonaws.com")}}},
+			},
+			{
+				ARN:        aws.String(arn("pending")),
+				CacheNodes: []*elasticache.CacheNode{{}},
+			},
+		}},
+	}
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:          "ec",
+		EndpointLabel: true,
+		MetricStats:   []MetricStat{{MetricName: "CPUUtilization", Stat: "Maximum"}},
+	}))
+	b._client = client
+	waitForEndpoints(t, b)
+
+	assert.Equal(t, []string{
+		`promwatch_aws_ec_cpu_utilization_maximum{arn="arn:aws:elasticache:us-east-1:000000000000:cluster:memcached",cache_cluster_id="memcached"}`,
+		`promwatch_aws_ec_cpu_utilization_maximum{arn="arn:aws:elasticache:us-east-1:000000000000:cluster:pending",cache_cluster_id="pending"}`,
+		`promwatch_aws_ec_cpu_utilization_maximum{arn="arn:aws:elasticache:us-east-1:000000000000:cluster:redis-0001-001",cache_cluster_id="redis-0001-001"}`,
+		`promwatch_aws_ec_endpoint_info{arn="arn:aws:elasticache:us-east-1:000000000000:cluster:memcached",cache_cluster_id="memcached",endpoint="memcached.cfg.use1.cache.amazonaws.com"}`,
+		`promwatch_aws_ec_endpoint_info{arn="arn:aws:elasticache:us-east-1:000000000000:cluster:redis-0001-001",cache_cluster_id="redis-0001-001",endpoint="redis-0001-001.use1.cache.amazonaws.com"}`,
+	}, storeEndpoints(b, NewResourceIndexFromTagMapping(&resources, id), b.metricDimensions()),
+		"Clusters should be addressed by their configuration endpoint or first node, pending clusters should have no info series")
+}
+
+func TestEndpointLabelCacheNode(t *testing.T) {
+	clusterARN := "arn:aws:elasticache:us-east-1:000000000000:cluster:memcached"
+	client := &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{{{ResourceARN: aws.String(clusterARN)}}},
+		CacheClusterPages: [][]*elasticache.CacheCluster{{{
+			ARN:    aws.String(clusterARN),
+			Engine: aws.String("memcached"),
+			CacheNodes: []*elasticache.CacheNode{
+				{CacheNodeId: aws.String("0001"), Endpoint: &elasticache.Endpoint{Address: aws.String("memcached.0001.use1.cache.amazonaws.com")}},
+				{CacheNodeId: aws.String("0002")},
+			},
+		}}},
+	}
+	c, _ := NewECHostCollector(CollectorConfig{
+		Type:                  "ec_host",
+		EndpointLabel:         true,
+		EndpointLabelOnSeries: true,
+		MetricStats:           []MetricStat{{MetricName: "CPUUtilization", Stat: "Maximum"}},
+	})
+	e := c.(*ECHostCollector)
+	e.base._client = client
+
+	index, err := e.getClusters(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		`promwatch_aws_ec_host_cpu_utilization_maximum{arn="arn:aws:elasticache:us-east-1:000000000000:cluster:memcached:0001",cache_cluster_id="memcached",endpoint="memcached.0001.use1.cache.amazonaws.com"}`,
+		`promwatch_aws_ec_host_cpu_utilization_maximum{arn="arn:aws:elasticache:us-east-1:000000000000:cluster:memcached:0002",cache_cluster_id="memcached"}`,
+	}, storeEndpoints(e.base, index, cacheNodeMetricDimension), "Node endpoints should be taken from discovery and added to the series")
+
+	assert.Len(t, client.Calls(), 2, "No additional requests should be issued for node endpoints")
+}
+
+func TestEndpointLabelDBInstance(t *testing.T) {
+	arn := func(id string) string { return "arn:aws:rds:us-east-1:000000000000:db:" + id }
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String(arn("available"))},
+		{ResourceARN: aws.String(arn("creating"))},
+	}
+	client := &FakeClient{
+		DBInstancePages: [][]*rds.DBInstance{{
+			{DBInstanceArn: aws.String(arn("available")), Endpoint: &rds.Endpoint{Address: aws.String("available.abc.us-east-1.rds.amazonaws.com")}},
+			{DBInstanceArn: aws.String(arn("creating"))},
+		}},
+	}
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:          "rds",
+		EndpointLabel: true,
+		MetricStats:   []MetricStat{{MetricName: "CPUUtilization", Stat: "Maximum"}},
+	}))
+	b._client = client
+
+	lines := storeEndpoints(b, NewResourceIndexFromTagMapping(&resources, id), b.metricDimensions())
+	assert.Len(t, lines, 2, "Commits before the first lookup finished should have no info series")
+
+	waitForEndpoints(t, b)
+	assert.Equal(t, []string{
+		`promwatch_aws_rds_cpu_utilization_maximum{arn="arn:aws:rds:us-east-1:000000000000:db:available",db_instance_identifier="available"}`,
+		`promwatch_aws_rds_cpu_utilization_maximum{arn="arn:aws:rds:us-east-1:000000000000:db:creating",db_instance_identifier="creating"}`,
+		`promwatch_aws_rds_endpoint_info{arn="arn:aws:rds:us-east-1:000000000000:db:available",db_instance_identifier="available",endpoint="available.abc.us-east-1.rds.amazonaws.com"}`,
+	}, storeEndpoints(b, NewResourceIndexFromTagMapping(&resources, id), b.metricDimensions()),
+		"Instances without endpoint should have no info series")
+}
+
+func TestValidEndpointLabel(t *testing.T) {
+	assert.Nil(t, validEndpointLabel("ebs", false, false))
+	assert.Nil(t, validEndpointLabel("rds", true, true))
+	assert.NotNil(t, validEndpointLabel("ebs", true, false), "Types without endpoints should be rejected")
+	assert.NotNil(t, validEndpointLabel("rds", false, true), "Labels on series should require endpoint labels")
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Exposure modes of collectors, see CollectorConfig.Expose.
+const (
+	// ExposeDefault serves the metrics of a collector on /metrics only.
+	ExposeDefault = "default"
+	// ExposeNamedOnly serves the metrics of a collector on /metrics/<name>
+	// only.
+	ExposeNamedOnly = "named_only"
+	// ExposeBoth serves the metrics of a collector on /metrics and
+	// /metrics/<name>.
+	ExposeBoth = "both"
+)
+
+// NamedMetricsPath is the path prefix of the metrics of collectors by name.
+const NamedMetricsPath = "/metrics/"
+
+// validExpose returns an error if expose is not a known exposure mode or a
+// named mode is used without a collector name to derive the path from.
+func validExpose(expose, name string) error {
+	switch expose {
+	case "", ExposeDefault:
+		return nil
+	case ExposeNamedOnly, ExposeBoth:
+		if exposePath(name) == "" {
+			return fmt.Errorf("Exposure mode %s requires a collector name", expose)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown exposure mode: %s", expose)
+}
+
+// exposePath returns the path segment a collector with the given name is
+// served under below NamedMetricsPath.
+func exposePath(name string) string {
+	return strings.ToLower(sanitize(name))
+}
+
+// exposeCollisions returns a message for every named path differently named
+// collectors are served on, which would mix their metrics on an endpoint meant
+// for one of them. Collectors of the same name, e.g. in different regions, are
+// expected to share the path.
+func exposeCollisions(configs []CollectorConfig) []string {
+	names := map[string][]string{}
+	paths := []string{}
+	seen := map[string]struct{}{}
+	for _, c := range configs {
+		if c.Expose != ExposeNamedOnly && c.Expose != ExposeBoth {
+			continue
+		}
+		if _, ok := seen[c.Name]; ok {
+			continue
+		}
+		seen[c.Name] = struct{}{}
+
+		p := exposePath(c.Name)
+		if _, ok := names[p]; !ok {
+			paths = append(paths, p)
+		}
+		names[p] = append(names[p], c.Name)
+	}
+
+	collisions := []string{}
+	for _, p := range paths {
+		if len(names[p]) > 1 {
+			collisions = append(collisions, fmt.Sprintf("Collectors %q are all served at %s%s", names[p], NamedMetricsPath, p))
+		}
+	}
+
+	return collisions
+}
+
+// inDefault returns true if the metrics of the collector are part of the
+// combined /metrics body.
+func (p *CollectorProc) inDefault() bool {
+	return p.Expose != ExposeNamedOnly
+}
+
+// inNamed returns true if the metrics of the collector are served on its
+// named path.
+func (p *CollectorProc) inNamed() bool {
+	return p.Expose == ExposeNamedOnly || p.Expose == ExposeBoth
+}
+
+// namedMetricsHandler serves the metrics of the collectors exposed on the named
+// path of the request, e.g. /metrics/billing. Requests for paths no collector
+// is exposed on are answered with 404 Not Found.
+func namedMetricsHandler(procs []*CollectorProc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, NamedMetricsPath)
+
+		found := false
+		declared := map[string]struct{}{}
+		for _, c := range procs {
+			if !c.inNamed() || exposePath(c.Name) != path {
+				continue
+			}
+			found = true
+			writeDeclared(w, c.Store.String(), declared)
+		}
+
+		if !found {
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// collectorsHandler serves the ID, name, exposure mode, and overrides of every
+// collector as JSON list.
+func collectorsHandler(procs []*CollectorProc) http.Handler {
+	type collector struct {
+		ID        CollectorID     `json:"id"`
+		Name      string          `json:"name"`
+		Expose    string          `json:"expose"`
+		Path      string          `json:"path,omitempty"`
+		Overrides *overrideStatus `json:"overrides,omitempty"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		collectors := make([]collector, 0, len(procs))
+		for _, c := range procs {
+			e := collector{ID: c.ID, Name: c.Name, Expose: c.Expose, Overrides: newOverrideStatus(c.Overrides, time.Now())}
+			if e.Expose == "" {
+				e.Expose = ExposeDefault
+			}
+			if c.inNamed() {
+				e.Path = NamedMetricsPath + exposePath(c.Name)
+			}
+			collectors = append(collectors, e)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(collectors)
+	})
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExposeModes(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	procs := testProcs("default 1\n", "named_only 2\n", "both 3\n")
+	procs[0].Name, procs[0].Expose = "main", ""
+	procs[1].Name, procs[1].Expose = "Billing Data", ExposeNamedOnly
+	procs[2].Name, procs[2].Expose = "health", ExposeBoth
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", etagHandler(metricsHandler(procs, reg), procs, reg, false))
+	mux.Handle(NamedMetricsPath, namedMetricsHandler(procs))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, http.NoBody))
+		return rec
+	}
+
+	rec := get("/metrics")
+	assert.Equal(t, "default 1\nboth 3\n", rec.Body.String(), "Named only collectors should be excluded from /metrics")
+
+	etag := rec.Header().Get("ETag")
+	procs[1].Store.Add("named_only 2\n")
+	procs[1].Store.Commit()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code, "Commits of named only collectors should not invalidate the ETag")
+
+	rec = get("/metrics/main")
+	assert.Equal(t, http.StatusNotFound, rec.Code, "Default collectors should not be served on a named path")
+
+	rec = get("/metrics/billing_data")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "named_only 2\n", rec.Body.String(), "Named only collectors should be served on their sanitized name")
+
+	rec = get("/metrics/health")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "both 3\n", rec.Body.String(), "Collectors exposed on both should be served on their name")
+
+	assert.Equal(t, http.StatusNotFound, get("/metrics/unknown").Code)
+}
+
+func TestCollectorsHandler(t *testing.T) {
+	procs := testProcs("", "")
+	procs[0].Name = "main"
+	procs[1].Name, procs[1].Expose = "Billing Data", ExposeNamedOnly
+
+	rec := httptest.NewRecorder()
+	collectorsHandler(procs).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/collectors", http.NoBody))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var got []map[string]string
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, []map[string]string{
+		{"id": "a", "name": "main", "expose": ExposeDefault},
+		{"id": "b", "name": "Billing Data", "expose": ExposeNamedOnly, "path": "/metrics/billing_data"},
+	}, got)
+}
+
+func TestExposeCollisions(t *testing.T) {
+	configs := []CollectorConfig{
+		{Name: "billing data", Expose: ExposeNamedOnly, Region: "us-east-1"},
+		{Name: "billing data", Expose: ExposeNamedOnly, Region: "eu-west-1"},
+		{Name: "health", Expose: ExposeBoth},
+		{Name: "health", Expose: ExposeDefault},
+	}
+	assert.Empty(t, exposeCollisions(configs), "Collectors of the same name should share the path")
+
+	configs = append(configs, CollectorConfig{Name: "billing.data", Expose: ExposeBoth})
+	assert.Equal(t,
+		[]string{`Collectors ["billing data" "billing.data"] are all served at /metrics/billing_data`},
+		exposeCollisions(configs),
+		"Different names sanitized to the same path should collide")
+}
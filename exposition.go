@@ -0,0 +1,174 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Exposition formats of the collector metrics on /metrics, see
+// PromWatchConfig.Exposition.
+const (
+	// ExpositionText concatenates the text of the collector stores and the
+	// telemetry gathered from the registry.
+	ExpositionText = "text"
+	// ExpositionRegistry gathers the collector metrics from the registry
+	// along with the telemetry.
+	ExpositionRegistry = "registry"
+)
+
+// ExpositionHelp is the help text of collector metric families exposed through
+// the registry.
+const ExpositionHelp = "Metric collected by PromWatch from AWS CloudWatch."
+
+var (
+	ErrUnknownExposition = errors.New("Unknown exposition")
+	ErrExpositionBackend = errors.New("Registry exposition requires the memory store backend")
+)
+
+// exposition holds the committed samples of all collectors if the registry
+// exposition is configured. It is set on start and read only after, the
+// collector metrics are served from the stores if nil.
+var exposition *registryExposition
+
+// validExposition returns an error if e is not a known exposition or the
+// registry exposition is used with a store backend that commits on other
+// replicas than the one serving.
+func validExposition(e, backend string) error {
+	switch e {
+	case ExpositionText:
+		return nil
+	case ExpositionRegistry:
+		if backend != StoreBackendMemory {
+			return ErrExpositionBackend
+		}
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s", ErrUnknownExposition, e)
+}
+
+// registryExposition exposes the samples of the last commit of every collector
+// as gauges with their timestamp, the same as the lines in the collector stores.
+// It is a Gatherer instead of a Prometheus collector, as a registry rejects the
+// several samples of a series returned for the periods of a query window.
+type registryExposition struct {
+	sync.Mutex
+	samples map[CollectorID][]Sample
+}
+
+func newRegistryExposition() *registryExposition {
+	return &registryExposition{samples: map[CollectorID][]Sample{}}
+}
+
+// set replaces the samples of the collector id. Calls on a nil exposition are
+// ignored.
+func (e *registryExposition) set(id CollectorID, samples []Sample) {
+	if e == nil {
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+	e.samples[id] = samples
+}
+
+// inRegistry returns true if the metrics of the collector are part of the
+// combined /metrics body through the registry exposition instead of its store.
+func (p *CollectorProc) inRegistry() bool {
+	return p.Registry && p.inDefault()
+}
+
+// Gather returns the families of all committed samples sorted by name, the
+// samples of a family sorted by series and timestamp. Label names vary between
+// the series of a family, e.g. by merge tags, so every sample is turned into a
+// metric of its own. Samples that do not form a valid metric are logged and
+// skipped instead of failing the whole gathering.
+func (e *registryExposition) Gather() ([]*dto.MetricFamily, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	type entry struct {
+		series string
+		sample Sample
+		metric *dto.Metric
+	}
+	entries := map[string][]entry{}
+	for _, samples := range e.samples {
+		for _, s := range samples {
+			m, err := sampleMetric(s)
+			if err != nil {
+				Logger.Warnw("skipping sample that is no valid metric", "sample", s.String(), "error", err)
+				continue
+			}
+			entries[s.Name] = append(entries[s.Name], entry{labelsToString(s.Labels), s, m})
+		}
+	}
+
+	out := make([]*dto.MetricFamily, 0, len(entries))
+	for name, family := range entries {
+		sort.Slice(family, func(i, j int) bool {
+			if family[i].series != family[j].series {
+				return family[i].series < family[j].series
+			}
+			return family[i].sample.Timestamp < family[j].sample.Timestamp
+		})
+		name, help := name, ExpositionHelp
+		mf := &dto.MetricFamily{Name: &name, Help: &help, Type: dto.MetricType_GAUGE.Enum()}
+		for _, en := range family {
+			mf.Metric = append(mf.Metric, en.metric)
+		}
+		out = append(out, mf)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GetName() < out[j].GetName() })
+
+	return out, nil
+}
+
+// sampleMetric returns s as a gauge with its timestamp or an error if s does not
+// form a valid metric.
+func sampleMetric(s Sample) (*dto.Metric, error) {
+	names := make([]string, len(s.Labels))
+	values := make([]string, len(s.Labels))
+	for i, l := range s.Labels {
+		names[i], values[i] = l.Name, l.Value
+	}
+	m, err := prometheus.NewConstMetric(prometheus.NewDesc(s.Name, ExpositionHelp, names, nil), prometheus.GaugeValue, s.Value, values...)
+	if err != nil {
+		return nil, err
+	}
+	out := &dto.Metric{}
+	if err := prometheus.NewMetricWithTimestamp(time.UnixMilli(s.Timestamp), m).Write(out); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// concatGatherers gathers the families of all its gatherers, like
+// prometheus.Gatherers, but without its consistency checks, which reject the
+// several samples of a series of the registry exposition. The families are
+// kept apart by the family guard, see FamilyGuard.
+type concatGatherers []prometheus.Gatherer
+
+// Gather returns the families of all gatherers sorted by name. Errors of the
+// gatherers are collected, the families they returned are kept.
+func (gs concatGatherers) Gather() ([]*dto.MetricFamily, error) {
+	out := []*dto.MetricFamily{}
+	errs := prometheus.MultiError{}
+	for _, g := range gs {
+		mfs, err := g.Gather()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		out = append(out, mfs...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].GetName() < out[j].GetName() })
+
+	return out, errs.MaybeUnwrap()
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRegistryExposition(t *testing.T) {
+	exposition = newRegistryExposition()
+	t.Cleanup(func() { exposition = nil })
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:      "ebs",
+		MergeTags: []string{"team"},
+		MetricStats: []MetricStat{
+			{MetricName: "VolumeReadBytes", Stat: "Sum"},
+		},
+	}))
+	b.store = NewStore(0)
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-a")},
+		{
+			ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-b"),
+			Tags:        []*tagging.Tag{{Key: aws.String("team"), Value: aws.String("storage")}},
+		},
+	}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	b.makeQueries(index, b.namespace, b.metricDimensions())
+	results := []*cloudwatch.MetricDataResult{}
+	for _, queries := range index.Queries {
+		for _, q := range queries {
+			results = append(results, &cloudwatch.MetricDataResult{
+				Id:         q.Id,
+				Values:     []*float64{aws.Float64(2), aws.Float64(1)},
+				Timestamps: []*time.Time{aws.Time(now.Add(time.Minute)), aws.Time(now)},
+			})
+		}
+	}
+	index.AddResults(&results)
+	b.storeResults(index)
+
+	assert.Len(t, strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n"), 4,
+		"The store should still get all samples for the named path")
+
+	// Series of a family have different label names, e.g. by merge tags,
+	// and every sample of a series is exposed like in the store.
+	expected := `
+# HELP promwatch_aws_ebs_volume_read_bytes_sum Metric collected by PromWatch from AWS CloudWatch.
+# TYPE promwatch_aws_ebs_volume_read_bytes_sum gauge
+promwatch_aws_ebs_volume_read_bytes_sum{arn="arn:aws:ec2:us-east-1:000000000000:volume/vol-a",volume_id="vol-a"} 1 1609459200000
+promwatch_aws_ebs_volume_read_bytes_sum{arn="arn:aws:ec2:us-east-1:000000000000:volume/vol-a",volume_id="vol-a"} 2 1609459260000
+promwatch_aws_ebs_volume_read_bytes_sum{arn="arn:aws:ec2:us-east-1:000000000000:volume/vol-b",team="storage",volume_id="vol-b"} 1 1609459200000
+promwatch_aws_ebs_volume_read_bytes_sum{arn="arn:aws:ec2:us-east-1:000000000000:volume/vol-b",team="storage",volume_id="vol-b"} 2 1609459260000
+`
+	assert.Equal(t, strings.TrimPrefix(expected, "\n"), gatheredText(t, exposition))
+}
+
+func TestRegistryExpositionInvalidSample(t *testing.T) {
+	e := newRegistryExposition()
+	e.set("a", []Sample{
+		{Name: "valid", Labels: []Label{{"arn", "a"}}, Value: 1, Timestamp: 1000},
+		{Name: "invalid-name", Labels: []Label{{"arn", "a"}}, Value: 1, Timestamp: 1000},
+	})
+	e.set("b", []Sample{{Name: "valid", Labels: []Label{{"arn", "a"}}, Value: 2, Timestamp: 500}})
+
+	expected := `
+# HELP valid Metric collected by PromWatch from AWS CloudWatch.
+# TYPE valid gauge
+valid{arn="a"} 2 500
+valid{arn="a"} 1 1000
+`
+	assert.Equal(t, strings.TrimPrefix(expected, "\n"), gatheredText(t, e),
+		"Invalid samples should be skipped and the samples of series of several collectors kept")
+}
+
+// gatheredText returns the families gathered from g in the text format.
+func gatheredText(t *testing.T, g prometheus.Gatherer) string {
+	mfs, err := g.Gather()
+	assert.Nil(t, err)
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		_, err := expfmt.MetricFamilyToText(&buf, mf)
+		assert.Nil(t, err)
+	}
+
+	return buf.String()
+}
+
+func TestMetricsHandlerRegistry(t *testing.T) {
+	e := newRegistryExposition()
+	e.set("a", []Sample{
+		{Name: "exposed", Labels: []Label{{"arn", "a"}}, Value: 1, Timestamp: 1000},
+		{Name: "exposed", Labels: []Label{{"arn", "a"}}, Value: 2, Timestamp: 2000},
+	})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "telemetry", Help: "Telemetry."}))
+
+	procs := testProcs("exposed{arn=\"a\"} 1.000000 1000\n", "ingested 2\n")
+	procs[0].Registry = true
+
+	rec := serve(metricsHandler(procs, concatGatherers{e, reg}), "", false)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "ingested 2\n"+
+		"# HELP exposed Metric collected by PromWatch from AWS CloudWatch.\n# TYPE exposed gauge\nexposed{arn=\"a\"} 1 1000\nexposed{arn=\"a\"} 2 2000\n"+
+		"# HELP telemetry Telemetry.\n# TYPE telemetry gauge\ntelemetry 0\n",
+		rec.Body.String(), "Stores of collectors exposed through the registry should be skipped and every sample of a series served")
+}
+
+func TestConfigExposition(t *testing.T) {
+	var got PromWatchConfig
+	assert.Nil(t, yaml.Unmarshal([]byte("exposition: registry"), &got))
+	assert.Equal(t, ExpositionRegistry, got.Exposition)
+
+	assert.ErrorIs(t, yaml.Unmarshal([]byte("exposition: json"), &PromWatchConfig{}), ErrUnknownExposition)
+	assert.ErrorIs(t, yaml.Unmarshal([]byte("{exposition: registry, store_backend: redis}"), &PromWatchConfig{}), ErrExpositionBackend)
+}
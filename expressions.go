@@ -0,0 +1,185 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// Expression is a CloudWatch Metric Math expression evaluated for every
+// resource of a collector. The metric stats of the collector are referenced as
+// m1, m2, and so on in the order they are configured, e.g. m1/m2*100.
+type Expression struct {
+	Expression string `yaml:"expression"`
+	// Label names the series of the expression.
+	Label string `yaml:"label"`
+}
+
+// matchMetricRef matches the references of expressions to metric stats.
+var matchMetricRef = regexp.MustCompile(`\bm([0-9]+)\b`)
+
+// refs returns the indices of the metric stats referenced by the expression.
+func (e Expression) refs() []int {
+	refs := []int{}
+	for _, m := range matchMetricRef.FindAllStringSubmatch(e.Expression, -1) {
+		i, _ := strconv.Atoi(m[1])
+		refs = append(refs, i-1)
+	}
+
+	return refs
+}
+
+// validExpressions returns an error if an expression has no label, references
+// no metric stat, or references a metric stat that is not queried exactly once
+// per resource with every other one, which CloudWatch requires of all queries
+// an expression refers to.
+func (b *BaseCollector) validExpressions() error {
+	for _, e := range b.config.Expressions {
+		if strings.TrimSpace(e.Label) == "" {
+			return fmt.Errorf("Expressions require a label: %s", e.Expression)
+		}
+		refs := e.refs()
+		if len(refs) == 0 {
+			return fmt.Errorf("Expression references no metric stat: %s", e.Expression)
+		}
+		for _, i := range refs {
+			if i < 0 || i >= len(b.config.MetricStats) {
+				return fmt.Errorf("Expression references unknown metric stat m%d: %s", i+1, e.Expression)
+			}
+			s := b.config.MetricStats[i]
+			sets := s.dimensionSets(b.namespace)
+			if s.Cadence != "" || s.CollectEvery > 1 || len(sets) > 1 || len(sets[0]) > 0 {
+				return fmt.Errorf("Expression references metric stat m%d with cadence, collect every, or dimension sets: %s", i+1, e.Expression)
+			}
+		}
+	}
+
+	return nil
+}
+
+// expressionName returns the name of the series of an expression.
+func (b *BaseCollector) expressionName(label string) string {
+	return fmt.Sprintf("%s%s_%s%s", b.metricPrefix(), b.config.Type, snakeMetricName(label), b.config.MetricNameSuffix)
+}
+
+// makeExpressionQueries produces the queries of the configured expressions for
+// every resource in index, referencing the queries of the metric stats of the
+// same resource. Expressions are left out for resources some referenced metric
+// stat was not queried for, e.g. as it is disabled by an override.
+func (b *BaseCollector) makeExpressionQueries(index *ResourceIndex) []*cloudwatch.MetricDataQuery {
+	dataQuery := []*cloudwatch.MetricDataQuery{}
+	if len(b.config.Expressions) == 0 {
+		return dataQuery
+	}
+
+	for _, id := range b.queryOrder(index) {
+		queried := map[string]struct{}{}
+		for _, q := range index.Queries[id] {
+			queried[*q.Id] = struct{}{}
+		}
+
+	expressions:
+		for k, e := range b.config.Expressions {
+			for _, i := range e.refs() {
+				if _, ok := queried[fmt.Sprintf("%s_%s_%d", "id", id, i)]; !ok {
+					continue expressions
+				}
+			}
+			if b.queryBudgetExhausted() {
+				return dataQuery
+			}
+			queryID := fmt.Sprintf("%s_%s_%d", "e", id, k)
+			if err := validQueryID(queryID); err != nil {
+				_ = b.HandleError(fmt.Errorf("%w, resource %s", err, aws.StringValue(index.Resources[id].ResourceARN)))
+				continue
+			}
+
+			expression := matchMetricRef.ReplaceAllStringFunc(e.Expression, func(ref string) string {
+				i, _ := strconv.Atoi(ref[1:])
+				return fmt.Sprintf("%s_%s_%d", "id", id, i-1)
+			})
+			query := cloudwatch.MetricDataQuery{
+				Id:         aws.String(queryID),
+				Expression: aws.String(expression),
+				Label:      aws.String(e.Label),
+			}
+			dataQuery = append(dataQuery, &query)
+			index.Queries[id] = append(index.Queries[id], &query)
+			b.queries++
+		}
+	}
+
+	return dataQuery
+}
+
+// queryResource returns the resource ID of a query ID of the form
+// <prefix>_<resource ID>_<suffix>.
+func queryResource(queryID string) string {
+	parts := strings.SplitN(queryID, "_", 3)
+	if len(parts) < 2 {
+		return queryID
+	}
+
+	return parts[1]
+}
+
+// splitQueries splits the queries into chunks of at most
+// MaxMetricDataQueryItems. Expressions can only reference queries of the same
+// request, so if there are any the queries of a resource are kept together
+// unless they exceed a chunk on their own.
+func splitQueries(dataQuery []*cloudwatch.MetricDataQuery) [][]*cloudwatch.MetricDataQuery {
+	expressions := false
+	for _, q := range dataQuery {
+		if q.Expression != nil {
+			expressions = true
+			break
+		}
+	}
+
+	chunks := [][]*cloudwatch.MetricDataQuery{}
+	if !expressions {
+		for i := 0; i < len(dataQuery); i += MaxMetricDataQueryItems {
+			end := i + MaxMetricDataQueryItems
+			if end > len(dataQuery) {
+				end = len(dataQuery)
+			}
+			chunks = append(chunks, dataQuery[i:end])
+		}
+
+		return chunks
+	}
+
+	order := []string{}
+	groups := map[string][]*cloudwatch.MetricDataQuery{}
+	for _, q := range dataQuery {
+		r := queryResource(*q.Id)
+		if _, ok := groups[r]; !ok {
+			order = append(order, r)
+		}
+		groups[r] = append(groups[r], q)
+	}
+
+	chunk := []*cloudwatch.MetricDataQuery{}
+	for _, r := range order {
+		group := groups[r]
+		if len(chunk) > 0 && len(chunk)+len(group) > MaxMetricDataQueryItems {
+			chunks = append(chunks, chunk)
+			chunk = []*cloudwatch.MetricDataQuery{}
+		}
+		for len(group) > MaxMetricDataQueryItems {
+			chunks = append(chunks, group[:MaxMetricDataQueryItems])
+			group = group[MaxMetricDataQueryItems:]
+		}
+		chunk = append(chunk, group...)
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
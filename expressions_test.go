@@ -0,0 +1,149 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func errorRateCollector() *BaseCollector {
+	return stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:     "lambda",
+		Offset:   300,
+		Interval: 300,
+		Period:   300,
+		MetricStats: []MetricStat{
+			{MetricName: "Errors", Stat: "Sum"},
+			{MetricName: "Invocations", Stat: "Sum"},
+		},
+		Expressions: []Expression{{Expression: "m1/m2*100", Label: "ErrorRate"}},
+	}))
+}
+
+func TestMakeExpressionQueries(t *testing.T) {
+	b := errorRateCollector()
+	assert.True(t, b.Valid())
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:lambda:us-east-1:000000000000:function:my-function")},
+	}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	rid := id(resources[0])
+
+	queries := b.makeQueries(index, b.namespace, defaultMetricDimension(b.dimension, b.resourcePrefix))
+	assert.Len(t, queries, 3)
+	e := queries[2]
+	assert.Equal(t, "e_"+rid+"_0", aws.StringValue(e.Id))
+	assert.Equal(t, fmt.Sprintf("id_%s_0/id_%s_1*100", rid, rid), aws.StringValue(e.Expression), "Expressions should reference the queries of the resource")
+	assert.Equal(t, "ErrorRate", aws.StringValue(e.Label))
+	assert.Nil(t, e.MetricStat)
+	assert.Equal(t, e, index.Queries[rid][2], "Expression queries should be indexed by resource")
+	assert.Equal(t, 3, b.seriesPerResource())
+
+	b.override = &Override{DisableMetrics: []string{"Errors"}}
+	index = NewResourceIndexFromTagMapping(&resources, id)
+	queries = b.makeQueries(index, b.namespace, defaultMetricDimension(b.dimension, b.resourcePrefix))
+	assert.Len(t, queries, 1, "Expressions referencing metric stats not queried should be left out")
+}
+
+func TestValidExpressions(t *testing.T) {
+	stats := []MetricStat{
+		{MetricName: "Errors", Stat: "Sum"},
+		{MetricName: "Invocations", Stat: "Sum"},
+		{MetricName: "Duration", Stat: "Average", CollectEvery: 2},
+		{MetricName: "Throttles", Stat: "Sum", DimensionSets: []DimensionSet{{"Resource": "my-function:live"}}},
+	}
+	cases := []struct {
+		expression Expression
+		valid      bool
+		message    string
+	}{
+		{Expression{Expression: "m1/m2*100", Label: "ErrorRate"}, true, "Expressions over metric stats should be valid"},
+		{Expression{Expression: "FILL(m1, 0)", Label: "Errors"}, true, "Functions should be valid"},
+		{Expression{Expression: "m1/m2*100"}, false, "Expressions without label should be invalid"},
+		{Expression{Expression: "100", Label: "Constant"}, false, "Expressions without reference should be invalid"},
+		{Expression{Expression: "m1/m5", Label: "Unknown"}, false, "Unknown metric stats should be invalid"},
+		{Expression{Expression: "m0", Label: "Unknown"}, false, "Metric stats should be referenced from m1"},
+		{Expression{Expression: "m3/m2", Label: "Every"}, false, "Metric stats not queried every run should be invalid"},
+		{Expression{Expression: "m4/m2", Label: "Sets"}, false, "Metric stats with dimension sets should be invalid"},
+	}
+
+	for _, c := range cases {
+		b := stripInterface(CollectorFromConfig(CollectorConfig{
+			Type:        "lambda",
+			Offset:      300,
+			Interval:    300,
+			Period:      300,
+			MetricStats: stats,
+			Expressions: []Expression{c.expression},
+		}))
+		assert.Equal(t, c.valid, b.Valid(), c.message)
+	}
+}
+
+func TestStoreResultsExpression(t *testing.T) {
+	b := errorRateCollector()
+	b.store = NewStore(0)
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:lambda:us-east-1:000000000000:function:my-function")},
+	}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	b.makeQueries(index, b.namespace, defaultMetricDimension(b.dimension, b.resourcePrefix))
+
+	ts := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	results := []*cloudwatch.MetricDataResult{}
+	for i, q := range index.Queries[id(resources[0])] {
+		results = append(results, &cloudwatch.MetricDataResult{
+			Id:         q.Id,
+			Label:      q.Label,
+			Values:     []*float64{aws.Float64([]float64{5, 200, 2.5}[i])},
+			Timestamps: []*time.Time{aws.Time(ts)},
+		})
+	}
+	index.AddResults(&results)
+	b.storeResults(index)
+
+	assert.Contains(t, strings.Split(storeSamples(b.store), "\n"),
+		`promwatch_aws_lambda_error_rate{arn="arn:aws:lambda:us-east-1:000000000000:function:my-function",function_name="my-function"} 2.500000 1609459200000`,
+		"Expression results should be named by their label")
+}
+
+func TestSplitQueriesExpressions(t *testing.T) {
+	b := errorRateCollector()
+	resources := []*tagging.ResourceTagMapping{}
+	for i := 0; i < 400; i++ {
+		resources = append(resources, &tagging.ResourceTagMapping{
+			ResourceARN: aws.String(fmt.Sprintf("arn:aws:lambda:us-east-1:000000000000:function:f-%d", i)),
+		})
+	}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	in := b.getMetricDataInput(index, defaultMetricDimension(b.dimension, b.resourcePrefix))
+
+	assert.Len(t, in, 3)
+	total := 0
+	for _, i := range in {
+		assert.LessOrEqual(t, len(i.MetricDataQueries), MaxMetricDataQueryItems)
+		assert.Equal(t, 0, len(i.MetricDataQueries)%3, "Queries of a resource should not be split across requests")
+		ids := map[string]struct{}{}
+		for _, q := range i.MetricDataQueries {
+			ids[*q.Id] = struct{}{}
+		}
+		for _, q := range i.MetricDataQueries {
+			if q.Expression == nil {
+				continue
+			}
+			for _, ref := range strings.Split(*q.Expression, "/") {
+				_, ok := ids[strings.TrimSuffix(ref, "*100")]
+				assert.True(t, ok, "Expressions should only reference queries of the same request")
+			}
+		}
+		total += len(i.MetricDataQueries)
+	}
+	assert.Equal(t, 1200, total)
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Policies for collector metric families that collide with a family of the
+// PromWatch telemetry, see PromWatchConfig.FamilyCollision.
+const (
+	// FamilyCollisionRename appends the configured suffix to the collector
+	// family.
+	FamilyCollisionRename = "rename"
+	// FamilyCollisionDrop drops the collector family.
+	FamilyCollisionDrop = "drop"
+	// FamilyCollisionError drops the collector family and reports an error
+	// of the collector.
+	FamilyCollisionError = "error"
+)
+
+// DefaultFamilyCollisionSuffix is appended to collector families colliding with
+// telemetry families by the rename policy.
+const DefaultFamilyCollisionSuffix = "_cloudwatch"
+
+var (
+	ErrFamilyCollision        = errors.New("Metric family collides with PromWatch telemetry")
+	ErrUnknownFamilyCollision = errors.New("Unknown family collision policy")
+	ErrInvalidFamilySuffix    = errors.New("Invalid family collision suffix")
+)
+
+// matchFamilySuffix matches suffixes keeping valid metric names valid.
+var matchFamilySuffix = regexp.MustCompile(`^[a-zA-Z0-9_:]+$`)
+
+// matchDescName matches the family name in the string of a *prometheus.Desc,
+// which has no accessor for it.
+var matchDescName = regexp.MustCompile(`^Desc\{fqName: "([^"]+)"`)
+
+// describer is implemented by the collectors and registries whose families
+// are guarded against, e.g. *prometheus.Registry.
+type describer interface {
+	Describe(chan<- *prometheus.Desc)
+}
+
+// familyGuard checks the committed families of all collectors against the
+// telemetry served on the same endpoint. It is set on start and read only
+// after, collector families are not checked if nil.
+var familyGuard *FamilyGuard
+
+// FamilyGuard keeps collector metric families apart from the families of the
+// PromWatch telemetry. Both are concatenated in the /metrics response, and a
+// family present twice with different labels fails the whole scrape in strict
+// parsers.
+type FamilyGuard struct {
+	policy    string
+	suffix    string
+	describer describer
+
+	once  sync.Once
+	taken map[string]struct{}
+}
+
+// NewFamilyGuard returns a guard checking against the families described by d
+// with the given policy and rename suffix.
+func NewFamilyGuard(policy, suffix string, d describer) *FamilyGuard {
+	return &FamilyGuard{policy: policy, suffix: suffix, describer: d}
+}
+
+// validFamilyCollision returns an error if policy is not a known family
+// collision policy or suffix would produce invalid metric names.
+func validFamilyCollision(policy, suffix string) error {
+	switch policy {
+	case FamilyCollisionRename, FamilyCollisionDrop, FamilyCollisionError:
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownFamilyCollision, policy)
+	}
+	if !matchFamilySuffix.MatchString(suffix) {
+		return fmt.Errorf("%w: %q", ErrInvalidFamilySuffix, suffix)
+	}
+
+	return nil
+}
+
+// families returns the names of the telemetry families. It is called once per
+// commit and returns nil if g is nil. The names are taken from the descriptions
+// of the registered collectors on the first call, so vectors without children
+// are included even though they are not exposed yet. Telemetry is registered
+// on start, so the names don't change after.
+func (g *FamilyGuard) families() map[string]struct{} {
+	if g == nil {
+		return nil
+	}
+	g.once.Do(func() {
+		ch := make(chan *prometheus.Desc)
+		go func() {
+			g.describer.Describe(ch)
+			close(ch)
+		}()
+		g.taken = map[string]struct{}{}
+		for desc := range ch {
+			if m := matchDescName.FindStringSubmatch(desc.String()); m != nil {
+				g.taken[m[1]] = struct{}{}
+			}
+		}
+	})
+
+	return g.taken
+}
+
+// guardFamilies returns names with the families in taken renamed or dropped
+// according to the policy of the family guard. Every collision is counted by
+// family and logged, the error policy reports it as collector error. Renamed
+// families still colliding are dropped.
+func (b *BaseCollector) guardFamilies(taken map[string]struct{}, names []string) []string {
+	if len(taken) == 0 {
+		return names
+	}
+
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, ok := taken[name]; !ok {
+			out = append(out, name)
+			continue
+		}
+		b.Telemetry().FamilyCollisionsCount.WithLabelValues(name).Inc()
+		switch familyGuard.policy {
+		case FamilyCollisionRename:
+			renamed := name + familyGuard.suffix
+			if _, ok := taken[renamed]; !ok {
+				b.logger().Warnw("metric family collides with telemetry, renamed", "family", name, "renamed", renamed)
+				out = append(out, renamed)
+				continue
+			}
+			b.logger().Warnw("metric family collides with telemetry, dropped", "family", name, "renamed", renamed)
+		case FamilyCollisionError:
+			_ = b.HandleError(fmt.Errorf("%w, dropped: %s", ErrFamilyCollision, name))
+		default:
+			b.logger().Warnw("metric family collides with telemetry, dropped", "family", name)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,116 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestFamilyCollision(t *testing.T) {
+	t.Cleanup(func() { familyGuard = nil })
+
+	// The telemetry registry is replaced by one exposing a family named
+	// like the collector output, as produced by a custom metric prefix.
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promwatch_aws_ebs_volume_read_bytes_sum",
+		Help: "Colliding telemetry.",
+	}))
+
+	cases := []struct {
+		policy   string
+		suffix   string
+		expected []string
+		errors   float64
+	}{
+		{FamilyCollisionRename, DefaultFamilyCollisionSuffix, []string{
+			`promwatch_aws_ebs_volume_read_bytes_sum_cloudwatch{arn="arn:aws:ec2:us-east-1:000000000000:volume/vol-a",volume_id="vol-a"} 1.000000 1609459200000`,
+			`promwatch_aws_ebs_volume_write_bytes_sum{arn="arn:aws:ec2:us-east-1:000000000000:volume/vol-a",volume_id="vol-a"} 1.000000 1609459200000`,
+		}, 0},
+		{FamilyCollisionDrop, DefaultFamilyCollisionSuffix, []string{
+			`promwatch_aws_ebs_volume_write_bytes_sum{arn="arn:aws:ec2:us-east-1:000000000000:volume/vol-a",volume_id="vol-a"} 1.000000 1609459200000`,
+		}, 0},
+		{FamilyCollisionError, DefaultFamilyCollisionSuffix, []string{
+			`promwatch_aws_ebs_volume_write_bytes_sum{arn="arn:aws:ec2:us-east-1:000000000000:volume/vol-a",volume_id="vol-a"} 1.000000 1609459200000`,
+		}, 1},
+		// Renaming to another telemetry family drops the family.
+		{FamilyCollisionRename, "", []string{
+			`promwatch_aws_ebs_volume_write_bytes_sum{arn="arn:aws:ec2:us-east-1:000000000000:volume/vol-a",volume_id="vol-a"} 1.000000 1609459200000`,
+		}, 0},
+	}
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range cases {
+		familyGuard = NewFamilyGuard(c.policy, c.suffix, reg)
+		b := stripInterface(CollectorFromConfig(CollectorConfig{
+			Type: "ebs",
+			Name: "collision-" + c.policy + c.suffix,
+			MetricStats: []MetricStat{
+				{MetricName: "VolumeReadBytes", Stat: "Sum"},
+				{MetricName: "VolumeWriteBytes", Stat: "Sum"},
+			},
+		}))
+		b.store = NewStore(0)
+		resources := []*tagging.ResourceTagMapping{
+			{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-a")},
+		}
+		index := NewResourceIndexFromTagMapping(&resources, id)
+		b.makeQueries(index, b.namespace, b.metricDimensions())
+		results := []*cloudwatch.MetricDataResult{}
+		for _, queries := range index.Queries {
+			for _, q := range queries {
+				results = append(results, &cloudwatch.MetricDataResult{
+					Id:         q.Id,
+					Values:     []*float64{aws.Float64(1), aws.Float64(1)},
+					Timestamps: []*time.Time{aws.Time(now), aws.Time(now)},
+				})
+			}
+		}
+		index.AddResults(&results)
+		b.storeResults(index)
+
+		lines := strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n")
+		assert.ElementsMatch(t, append(c.expected, c.expected...), lines, c.policy)
+		assert.Equal(t, float64(1), testutil.ToFloat64(b.Telemetry().FamilyCollisionsCount.WithLabelValues("promwatch_aws_ebs_volume_read_bytes_sum")),
+			"Collisions should be counted once per commit and family")
+		assert.Equal(t, c.errors, testutil.ToFloat64(b.Telemetry().ErrorCount), c.policy)
+	}
+}
+
+func TestFamilyGuardFamilies(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "promwatch_gauge", Help: "Gauge."}))
+	reg.MustRegister(prometheus.NewCounterVec(prometheus.CounterOpts{Name: "promwatch_vec_total", Help: "Vector."}, []string{"id"}))
+	reg.MustRegister(prometheus.NewHistogram(prometheus.HistogramOpts{Name: "promwatch_seconds", Help: "Histogram."}))
+	g := NewFamilyGuard(FamilyCollisionDrop, DefaultFamilyCollisionSuffix, reg)
+
+	expected := map[string]struct{}{"promwatch_gauge": {}, "promwatch_vec_total": {}, "promwatch_seconds": {}}
+	assert.Equal(t, expected, g.families(), "Vectors without children should be guarded against")
+
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "promwatch_late", Help: "Late."}))
+	assert.Equal(t, expected, g.families(), "Families should be computed once")
+
+	assert.Nil(t, (*FamilyGuard)(nil).families())
+}
+
+func TestConfigFamilyCollision(t *testing.T) {
+	var got PromWatchConfig
+	assert.Nil(t, yaml.Unmarshal([]byte("{}"), &got))
+	assert.Equal(t, FamilyCollisionRename, got.FamilyCollision)
+	assert.Equal(t, DefaultFamilyCollisionSuffix, got.FamilyCollisionSuffix)
+
+	assert.Nil(t, yaml.Unmarshal([]byte("{family_collision: drop, family_collision_suffix: _aws}"), &got))
+	assert.Equal(t, FamilyCollisionDrop, got.FamilyCollision)
+	assert.Equal(t, "_aws", got.FamilyCollisionSuffix)
+
+	assert.ErrorIs(t, yaml.Unmarshal([]byte("{family_collision: merge}"), &PromWatchConfig{}), ErrUnknownFamilyCollision)
+	assert.ErrorIs(t, yaml.Unmarshal([]byte("{family_collision_suffix: -aws}"), &PromWatchConfig{}), ErrInvalidFamilySuffix)
+}
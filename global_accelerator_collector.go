@@ -0,0 +1,42 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+// GlobalAcceleratorRegion is the only region Global Accelerator accelerators
+// can be listed and their metrics queried in.
+const GlobalAcceleratorRegion = "us-west-2"
+
+// GlobalAcceleratorCollector collects the metrics of Global Accelerator
+// accelerators. They are global resources with their metrics published in
+// us-west-2.
+type GlobalAcceleratorCollector struct {
+	base *BaseCollector
+}
+
+// NewGlobalAcceleratorCollector returns a GlobalAcceleratorCollector pinned to
+// GlobalAcceleratorRegion regardless of the configured region.
+func NewGlobalAcceleratorCollector(c CollectorConfig) (MetricCollector, error) {
+	if c.Region != "" && c.Region != GlobalAcceleratorRegion {
+		Logger.Infow("Global Accelerator is only available in "+GlobalAcceleratorRegion+", ignoring configured region", "name", c.Name, "region", c.Region)
+	}
+	c.Region = GlobalAcceleratorRegion
+
+	b := &BaseCollector{
+		config:         c,
+		namespace:      "AWS/GlobalAccelerator",
+		resourceName:   "globalaccelerator:accelerator",
+		dimension:      "Accelerator",
+		resourcePrefix: "accelerator/",
+	}
+
+	return &GlobalAcceleratorCollector{
+		base: b,
+	}, nil
+}
+
+func (g *GlobalAcceleratorCollector) Valid() bool {
+	return g.base.Valid()
+}
+
+func (g *GlobalAcceleratorCollector) Run() *CollectorProc {
+	return g.base.Run()
+}
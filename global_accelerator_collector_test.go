@@ -0,0 +1,69 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobalAcceleratorCollectorRegion(t *testing.T) {
+	for _, region := range []string{"", "eu-west-1", RegionAll} {
+		c, err := CollectorFromConfig(CollectorConfig{Type: "globalaccelerator", Region: region})
+		assert.Nil(t, err)
+		g, ok := c.(*GlobalAcceleratorCollector)
+		assert.True(t, ok, "Region %q should produce a single Global Accelerator collector", region)
+		assert.Equal(t, GlobalAcceleratorRegion, g.base.config.Region, "Global Accelerator collectors should be pinned to us-west-2")
+	}
+}
+
+func TestGlobalAcceleratorCollector(t *testing.T) {
+	arn := "arn:aws:globalaccelerator::000000000000:accelerator/1234abcd-abcd-1234-abcd-1234abcdef01"
+	client := &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{{
+			{ResourceARN: aws.String(arn), Tags: []*tagging.Tag{{Key: aws.String("team"), Value: aws.String("edge")}}},
+		}},
+	}
+	c, _ := CollectorFromConfig(CollectorConfig{
+		Type:        "globalaccelerator",
+		Region:      "eu-west-1",
+		Offset:      300,
+		Interval:    300,
+		Period:      300,
+		TagFilters:  []TagFilter{{Key: "team", Value: "edge"}},
+		MetricStats: []MetricStat{{MetricName: "NewFlowCount", Stat: "Sum"}},
+	})
+	g := c.(*GlobalAcceleratorCollector)
+	assert.True(t, g.Valid())
+	g.base._client = client
+	g.base.store = NewStore(0)
+
+	// The query ID is derived from the ARN, so the result can be prepared
+	// before collecting.
+	client.MetricDataResultPages = [][]*cloudwatch.MetricDataResult{{{
+		Id:         aws.String("id_" + id(&tagging.ResourceTagMapping{ResourceARN: aws.String(arn)}) + "_0"),
+		Values:     []*float64{aws.Float64(42)},
+		Timestamps: []*time.Time{aws.Time(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))},
+	}}}
+	assert.Nil(t, g.base.collect(context.Background(), nil, g.base.metricDimensions()))
+
+	calls := client.Calls()
+	in := calls[0].Input.(*tagging.GetResourcesInput)
+	assert.Equal(t, "globalaccelerator:accelerator", aws.StringValue(in.ResourceTypeFilters[0]))
+	q := calls[1].Input.([]*cloudwatch.GetMetricDataInput)[0].MetricDataQueries[0]
+	assert.Equal(t, "AWS/GlobalAccelerator", aws.StringValue(q.MetricStat.Metric.Namespace))
+	assert.Equal(t, []*cloudwatch.Dimension{
+		{Name: aws.String("Accelerator"), Value: aws.String("1234abcd-abcd-1234-abcd-1234abcdef01")},
+	}, q.MetricStat.Metric.Dimensions, "Accelerators should be queried by their ID")
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(g.base.store.String(),
+			`promwatch_aws_globalaccelerator_new_flow_count_sum{arn="`+arn+`",accelerator="1234abcd-abcd-1234-abcd-1234abcdef01"} 42.000000 1609459200000`)
+	}, time.Second, time.Millisecond, "Accelerators should be exported with their ID")
+}
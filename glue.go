@@ -2,18 +2,23 @@
 package main
 
 import (
-	"bytes"
-
+	"context"
 	// sha1 is good enough for this use case, disabling linter
 	"crypto/sha1" // nolint:gosec
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	t "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
 	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
@@ -24,22 +29,38 @@ var TimestampAscending = "TimestampAscending"
 
 var ErrCanNotParseARN = errors.New("Can not parse the provided ARN")
 var ErrNoSuchCollectorType = errors.New("Unknown collector type in configuration")
+var ErrNoSuchLevel = errors.New("Unknown level of collector type in configuration")
+var ErrNotRESTAPI = errors.New("Resource is not an API Gateway REST API")
+var ErrNotECSService = errors.New("Resource is not an ECS service of a cluster")
+var ErrNotMSKCluster = errors.New("Resource is not an MSK cluster")
+var ErrNotMSKBroker = errors.New("Resource is not an MSK broker")
+var ErrCloseTimeout = errors.New("Timeout waiting for collector to stop")
+
+// CloseTimeout is the maximum duration CollectorProc.Close waits for a
+// collector to stop.
+var CloseTimeout = 30 * time.Second
 
 type CollectorID string
 
+// ResourcePrefixARN as resource prefix of a collector type uses the full ARN of
+// resources as dimension value, e.g. StateMachineArn of Step Functions.
+const ResourcePrefixARN = "arn:"
+
 // implementations of extraTags should take a resource mapping and create a list
 // of tags mixing in any additional tags that should show up on the Prometheus
 // metrcis as labels.
 type extraTags func(*tagging.ResourceTagMapping) ([]*tagging.Tag, error)
 
 // implementations of metricDimensions should produce dimensions to query
-// CloudWatch with from a resource tag mapping.
+// CloudWatch with from a resource tag mapping. All dimensions are set on every
+// query of the resource, e.g. ECS services are identified by cluster and service
+// name together.
 type metricDimensions func(*tagging.ResourceTagMapping) ([]*cloudwatch.Dimension, error)
 
 // implementations of resourceGetter should get a list of AWS resources from any
 // source (AWS APIs or otherwise) and prepare a ResourceIndex that can be used
-// to get metrics from CloudWatch.
-type resourceGetter func() (*ResourceIndex, error)
+// to get metrics from CloudWatch. Requests are aborted once ctx is cancelled.
+type resourceGetter func(ctx context.Context) (*ResourceIndex, error)
 
 // CollectorType specifies basic properties and behaviour of collectors.
 type CollectorType struct {
@@ -47,6 +68,42 @@ type CollectorType struct {
 	Namespace      string
 	Dimension      string
 	ResourcePrefix string
+	// MetricDimensions derives the dimensions of resources whose ID can
+	// not be derived by removing the resource prefix, defaultMetricDimension
+	// is used if nil.
+	MetricDimensions metricDimensions
+	// DimensionLabels derives the labels of resources queried by several
+	// dimensions, or by a dimension that is not the resource ID, from
+	// those, see BaseCollector.dimensionLabels.
+	DimensionLabels metricDimensions
+	// Level names the level of resources the type collects if it has
+	// Levels, the variants of the type selected by CollectorConfig.Level,
+	// e.g. clusters instead of instances.
+	Level  string
+	Levels map[string]*CollectorType
+}
+
+// level returns the variant of the collector type for level, the type itself
+// if level is empty or its own level.
+func (t *CollectorType) level(level string) (*CollectorType, error) {
+	if level == "" || level == t.Level {
+		return t, nil
+	}
+	if l, ok := t.Levels[level]; ok {
+		return l, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrNoSuchLevel, level)
+}
+
+// rdsClusterType collects the cluster level metrics of RDS clusters. It is
+// shared by aurora and rds_cluster, which collect the same clusters, e.g. also
+// Multi-AZ DB clusters, with the metric names of their own type.
+var rdsClusterType = &CollectorType{
+	ResourceName:   "rds:cluster",
+	Namespace:      "AWS/RDS",
+	Dimension:      "DBClusterIdentifier",
+	ResourcePrefix: "cluster:",
 }
 
 // collectorTypes is a map of collector types for resources that are supported
@@ -64,6 +121,12 @@ var collectorTypes = map[string]*CollectorType{
 		Dimension:      "VolumeId",
 		ResourcePrefix: "volume/",
 	},
+	"ec2": {
+		ResourceName:   "ec2:instance",
+		Namespace:      "AWS/EC2",
+		Dimension:      "InstanceId",
+		ResourcePrefix: "instance/",
+	},
 	"ec": {
 		ResourceName:   "elasticache:cluster",
 		Namespace:      "AWS/ElastiCache",
@@ -82,6 +145,12 @@ var collectorTypes = map[string]*CollectorType{
 		Dimension:      "LoadBalancer",
 		ResourcePrefix: "loadbalancer/",
 	},
+	"gwlb": {
+		ResourceName:   "elasticloadbalancing:loadbalancer/gwy",
+		Namespace:      "AWS/GatewayELB",
+		Dimension:      "LoadBalancer",
+		ResourcePrefix: "loadbalancer/",
+	},
 	"sqs": {
 		ResourceName:   "sqs",
 		Namespace:      "AWS/SQS",
@@ -94,24 +163,125 @@ var collectorTypes = map[string]*CollectorType{
 		Dimension:      "DBInstanceIdentifier",
 		ResourcePrefix: "db:",
 	},
+	"aurora":      rdsClusterType,
+	"rds_cluster": rdsClusterType,
 	"neptune": {
 		ResourceName:   "rds:db",
 		Namespace:      "AWS/Neptune",
 		Dimension:      "DBInstanceIdentifier",
 		ResourcePrefix: "db:",
 	},
+	"docdb": {
+		ResourceName:   "rds:db",
+		Namespace:      "AWS/DocDB",
+		Dimension:      "DBInstanceIdentifier",
+		ResourcePrefix: "db:",
+		Level:          "instance",
+		Levels: map[string]*CollectorType{
+			"cluster": {
+				ResourceName:   "rds:cluster",
+				Namespace:      "AWS/DocDB",
+				Dimension:      "DBClusterIdentifier",
+				ResourcePrefix: "cluster:",
+			},
+		},
+	},
+	"lambda": {
+		ResourceName:   "lambda:function",
+		Namespace:      "AWS/Lambda",
+		Dimension:      "FunctionName",
+		ResourcePrefix: "function:",
+	},
+	"dynamodb": {
+		ResourceName:   "dynamodb:table",
+		Namespace:      "AWS/DynamoDB",
+		Dimension:      "TableName",
+		ResourcePrefix: "table/",
+	},
+	"s3": {
+		ResourceName:   "s3",
+		Namespace:      "AWS/S3",
+		Dimension:      "BucketName",
+		ResourcePrefix: "",
+	},
+	"kinesis": {
+		ResourceName:   "kinesis:stream",
+		Namespace:      "AWS/Kinesis",
+		Dimension:      "StreamName",
+		ResourcePrefix: "stream/",
+	},
+	"apigw": {
+		ResourceName:     "apigateway",
+		Namespace:        "AWS/ApiGateway",
+		Dimension:        "ApiId",
+		ResourcePrefix:   "/restapis/",
+		MetricDimensions: apiGatewayMetricDimension,
+	},
+	"ecs": {
+		ResourceName:     "ecs:service",
+		Namespace:        "AWS/ECS",
+		Dimension:        "ServiceName",
+		ResourcePrefix:   "service/",
+		MetricDimensions: ecsServiceMetricDimension,
+		DimensionLabels:  ecsServiceMetricDimension,
+	},
+	"msk": {
+		ResourceName:     "kafka:cluster",
+		Namespace:        "AWS/Kafka",
+		Dimension:        "Cluster Name",
+		ResourcePrefix:   "cluster/",
+		MetricDimensions: mskMetricDimension,
+		DimensionLabels:  mskMetricDimension,
+	},
+	"redshift": {
+		ResourceName:   "redshift:cluster",
+		Namespace:      "AWS/Redshift",
+		Dimension:      "ClusterIdentifier",
+		ResourcePrefix: "cluster:",
+	},
+	"es": {
+		ResourceName:   "es:domain",
+		Namespace:      "AWS/ES",
+		Dimension:      "DomainName",
+		ResourcePrefix: "domain/",
+	},
+	"firehose": {
+		ResourceName:   "firehose:deliverystream",
+		Namespace:      "AWS/Firehose",
+		Dimension:      "DeliveryStreamName",
+		ResourcePrefix: "deliverystream/",
+	},
+	"sfn": {
+		ResourceName:   "states:stateMachine",
+		Namespace:      "AWS/States",
+		Dimension:      "StateMachineArn",
+		ResourcePrefix: ResourcePrefixARN,
+	},
 }
 
 func CollectorFromConfig(c CollectorConfig) (MetricCollector, error) {
+	c.Region = normalizeRegion(c.Region)
+	c.MetricStats = expandMetricStats(c.MetricStats)
+	// CloudFront and Global Accelerator are global, copies in every region
+	// would all collect the same resources.
+	if c.Region == RegionAll && c.Type != "cloudfront" && c.Type != "globalaccelerator" {
+		return NewAllRegionsCollector(c)
+	}
+
 	if t, ok := collectorTypes[c.Type]; ok {
 		Logger.Debugf("Found collector type %s", c.Type)
+		t, err := t.level(c.Level)
+		if err != nil {
+			return nil, err
+		}
 
 		return &BaseCollector{
-			config:         c,
-			namespace:      t.Namespace,
-			resourceName:   t.ResourceName,
-			dimension:      t.Dimension,
-			resourcePrefix: t.ResourcePrefix,
+			config:          c,
+			namespace:       t.Namespace,
+			resourceName:    t.ResourceName,
+			dimension:       t.Dimension,
+			resourcePrefix:  t.ResourcePrefix,
+			dimensionLabels: t.DimensionLabels,
 		}, nil
 	}
 
@@ -122,6 +292,15 @@ func CollectorFromConfig(c CollectorConfig) (MetricCollector, error) {
 	case "ec_host":
 		Logger.Debug("Found ec_host collector type")
 		return NewECHostCollector(c)
+	case "cloudfront":
+		Logger.Debug("Found cloudfront collector type")
+		return NewCloudFrontCollector(c)
+	case "globalaccelerator":
+		Logger.Debug("Found globalaccelerator collector type")
+		return NewGlobalAcceleratorCollector(c)
+	case "msk_broker":
+		Logger.Debug("Found msk_broker collector type")
+		return NewMSKBrokerCollector(c)
 	}
 
 	return nil, ErrNoSuchCollectorType
@@ -133,15 +312,83 @@ func CollectorFromConfig(c CollectorConfig) (MetricCollector, error) {
 // handle the situation.
 type CollectorProc struct {
 	ID CollectorID
+	// Name and Expose are the configured name and exposure mode of the
+	// collector, see CollectorConfig.Expose.
+	Name   string
+	Expose string
+	// Overrides holds the runtime overrides of the collector, nil if the
+	// collector does not support overrides.
+	Overrides *Overrides
+	// Registry is set if the collector exposes its samples through the
+	// registry exposition, see PromWatchConfig.Exposition.
+	Registry bool
+	// History holds the last commits of the collector, nil if disabled.
+	History *History
 	// Done will receive a collector whenever it stops running to allow further
 	// inspection when required. Also when it was stopped using the stop
 	// channel.
 	Done chan MetricCollector
-	// Stop signals the collector to shut down.
+	// Stop signals the collector to shut down. It must not be used anymore
+	// after calling Close.
 	Stop chan string
 	// Store makes the internal store of a collector available, e.g. to
 	// aggregate metrics in an HTTP handler.
 	Store Store
+	// SeriesMap maps the series of the latest commit to the resources they
+	// were collected from. It is nil if the collector does not provide one.
+	SeriesMap *SeriesMap
+
+	// exited is closed once the collector goroutine returned.
+	exited    chan struct{}
+	closeOnce sync.Once
+	// ready reports whether the collector completed a successful
+	// collection, see Ready.
+	ready func() bool
+}
+
+func newCollectorProc(id CollectorID, store Store) *CollectorProc {
+	return &CollectorProc{
+		ID:    id,
+		Store: store,
+		// Buffered to never block a stopping collector in case nobody is
+		// receiving.
+		Done:   make(chan MetricCollector, 1),
+		Stop:   make(chan string, 1),
+		exited: make(chan struct{}),
+	}
+}
+
+// Close signals the collector to stop, cancelling a collection in flight, and
+// waits for it to stop for at most CloseTimeout. It is safe to call Close
+// multiple times.
+func (p *CollectorProc) Close() error {
+	// Procs not backed by a collector goroutine have nothing to stop.
+	if p.exited == nil {
+		return nil
+	}
+
+	p.closeOnce.Do(func() { close(p.Stop) })
+
+	timer := time.NewTimer(CloseTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-p.exited:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%w: %s", ErrCloseTimeout, p.ID)
+	}
+}
+
+// Ready returns true once the collector completed a successful collection.
+// Procs not backed by a collector, e.g. of the metric stream ingester, are
+// always ready.
+func (p *CollectorProc) Ready() bool {
+	if p.ready == nil {
+		return true
+	}
+
+	return p.ready()
 }
 
 // MetricCollector is the interface used to abstract out the collection of
@@ -162,6 +409,32 @@ type MetricCollector interface {
 type TagFilter struct {
 	Key   string `yaml:"key"`
 	Value string `yaml:"value"`
+	// Values match resources tagged with any of the values. Value is one
+	// of them if both are set.
+	Values []string `yaml:"values"`
+}
+
+// values returns all values the filter matches.
+func (f TagFilter) values() []string {
+	if len(f.Values) == 0 {
+		return []string{f.Value}
+	}
+	if f.Value == "" {
+		return f.Values
+	}
+
+	return append([]string{f.Value}, f.Values...)
+}
+
+// matches returns true if v is any of the values of the filter.
+func (f TagFilter) matches(v string) bool {
+	for _, value := range f.values() {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
 }
 
 // MetricStat is a pair of metric name and a specific kind of statistic like sum
@@ -169,6 +442,239 @@ type TagFilter struct {
 type MetricStat struct {
 	MetricName string `yaml:"name"`
 	Stat       string `yaml:"stat"`
+	// CollectEvery allows to query expensive or low priority metrics only
+	// on every nth collection run. Values of 0 and 1 query the metric on
+	// every run.
+	CollectEvery int `yaml:"collect_every"`
+	// Cadence queries the metric aligned to UTC hour or day boundaries
+	// instead of on every interval, see cadences.
+	Cadence string `yaml:"cadence"`
+	// Bounds are the limits values are expected to be within. Values out
+	// of bounds are handled according to BoundsAction, drop by default.
+	Bounds       *Bounds `yaml:"bounds"`
+	BoundsAction string  `yaml:"bounds_action"`
+	// DimensionSets query the metric once per set with the dimensions of
+	// the set added to the dimensions of the resource, for metrics
+	// published with more dimensions than the resource dimension. An empty
+	// set queries the resource dimensions only.
+	DimensionSets []DimensionSet `yaml:"dimension_sets"`
+	// ZeroFill emits a zero value at every timestamp of the queried window
+	// without datapoint, so series of idle resources do not disappear.
+	ZeroFill bool `yaml:"zero_fill"`
+	// NamePrefix, Names, and Stats are a shorthand for several metric
+	// stats, see expandMetricStats.
+	NamePrefix string   `yaml:"name_prefix"`
+	Names      []string `yaml:"names"`
+	Stats      []string `yaml:"stats"`
+}
+
+// shorthand returns true if the metric stat uses the shorthand for several
+// metric stats.
+func (s MetricStat) shorthand() bool {
+	return s.NamePrefix != "" || len(s.Names) > 0 || len(s.Stats) > 0
+}
+
+// expandMetricStats expands metric stats using the shorthand into one metric
+// stat per combination of their names and stats, all other options are copied.
+// The name and stat are combined with the names and stats lists, and every name
+// is prefixed with the name prefix. Metric stats not using the shorthand are
+// kept as is.
+func expandMetricStats(stats []MetricStat) []MetricStat {
+	if len(stats) == 0 {
+		return stats
+	}
+
+	expanded := make([]MetricStat, 0, len(stats))
+	for _, s := range stats {
+		if !s.shorthand() {
+			expanded = append(expanded, s)
+			continue
+		}
+
+		names := s.Names
+		if s.MetricName != "" || len(names) == 0 {
+			names = append([]string{s.MetricName}, names...)
+		}
+		statNames := s.Stats
+		if s.Stat != "" || len(statNames) == 0 {
+			statNames = append([]string{s.Stat}, statNames...)
+		}
+
+		for _, name := range names {
+			for _, stat := range statNames {
+				e := s
+				e.MetricName = s.NamePrefix + name
+				e.Stat = stat
+				e.NamePrefix, e.Names, e.Stats = "", nil, nil
+				expanded = append(expanded, e)
+			}
+		}
+	}
+
+	return expanded
+}
+
+// DimensionSet maps the names of the dimensions added to a query to their
+// values.
+type DimensionSet map[string]string
+
+// dimensions returns the dimensions of the set ordered by name.
+func (d DimensionSet) dimensions() []*cloudwatch.Dimension {
+	names := make([]string, 0, len(d))
+	for n := range d {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	dims := make([]*cloudwatch.Dimension, 0, len(d))
+	for _, n := range names {
+		dims = append(dims, &cloudwatch.Dimension{Name: aws.String(n), Value: aws.String(d[n])})
+	}
+
+	return dims
+}
+
+// tags returns the dimensions of the set as tags to label the series of the
+// set apart.
+func (d DimensionSet) tags() []*t.Tag {
+	tags := make([]*t.Tag, 0, len(d))
+	for _, dim := range d.dimensions() {
+		tags = append(tags, &t.Tag{Key: aws.String(dimensionLabel(*dim.Name)), Value: dim.Value})
+	}
+
+	return tags
+}
+
+// defaultDimensionSets are the dimension sets of metrics in a namespace that
+// are only published with more dimensions than the resource dimension, used
+// if the metric stat has no dimension sets configured.
+var defaultDimensionSets = map[string]map[string][]DimensionSet{
+	"AWS/S3": {
+		"BucketSizeBytes": {{"StorageType": "StandardStorage"}},
+		"NumberOfObjects": {{"StorageType": "AllStorageTypes"}},
+	},
+}
+
+// dimensionSets returns the dimension sets of the metric stat in namespace,
+// the default dimension sets of the metric or a single empty set if none are
+// configured.
+func (s MetricStat) dimensionSets(namespace string) []DimensionSet {
+	if len(s.DimensionSets) > 0 {
+		return s.DimensionSets
+	}
+	if sets, ok := defaultDimensionSets[namespace][s.MetricName]; ok {
+		return sets
+	}
+
+	return []DimensionSet{nil}
+}
+
+// Cadences of metric stats that change infrequently.
+const (
+	CadenceHourly = "hourly"
+	CadenceDaily  = "daily"
+)
+
+// cadences maps the cadences to their duration.
+var cadences = map[string]time.Duration{
+	CadenceHourly: time.Hour,
+	CadenceDaily:  24 * time.Hour,
+}
+
+// due returns true if the metric stat should be queried in the collection run
+// with the given number.
+func (s MetricStat) due(run uint64) bool {
+	if s.CollectEvery <= 1 {
+		return true
+	}
+
+	return run%uint64(s.CollectEvery) == 0
+}
+
+// matchRegion matches well formed region names like us-east-1 or
+// us-gov-west-1.
+var matchRegion = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+// normalizeRegion removes surrounding whitespace and lower cases region names.
+func normalizeRegion(region string) string {
+	return strings.ToLower(strings.TrimSpace(region))
+}
+
+// knownRegion returns true if the region is part of any AWS partition known to
+// the SDK.
+func knownRegion(region string) bool {
+	for _, p := range endpoints.DefaultPartitions() {
+		if _, ok := p.Regions()[region]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateRegion returns an error if the region is neither empty nor a region
+// known to the SDK. Well formed regions unknown to the SDK, e.g. recently
+// launched ones, are accepted if allowUnknown is set.
+func validateRegion(region string, allowUnknown bool) error {
+	if region == "" || knownRegion(region) {
+		return nil
+	}
+
+	if !matchRegion.MatchString(region) {
+		return fmt.Errorf("Malformed region: %s", region)
+	}
+
+	if !allowUnknown {
+		return fmt.Errorf("Unknown region, set allow_unknown_region to use it anyway: %s", region)
+	}
+
+	return nil
+}
+
+// activeWindow is a daily UTC time window given as offsets from midnight. The
+// end is exclusive. Windows with an end before the start span midnight.
+type activeWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// parseActiveWindow parses a time window in the format HH:MM-HH:MM, e.g.
+// 08:00-18:00. The end may be 24:00 to include the last minute of the day.
+func parseActiveWindow(str string) (activeWindow, error) {
+	parts := strings.Split(str, "-")
+	if len(parts) != 2 {
+		return activeWindow{}, fmt.Errorf("Invalid active hours, expected HH:MM-HH:MM: %s", str)
+	}
+
+	var bounds [2]time.Duration
+	for i, p := range parts {
+		var h, m int
+		if n, err := fmt.Sscanf(strings.TrimSpace(p), "%d:%d", &h, &m); err != nil || n != 2 {
+			return activeWindow{}, fmt.Errorf("Invalid active hours, expected HH:MM-HH:MM: %s", str)
+		}
+		if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+			return activeWindow{}, fmt.Errorf("Invalid time of day in active hours: %s", str)
+		}
+		bounds[i] = time.Duration(h)*time.Hour + time.Duration(m)*time.Minute
+	}
+
+	if bounds[0] == bounds[1] {
+		return activeWindow{}, fmt.Errorf("Active hours must not be empty: %s", str)
+	}
+
+	return activeWindow{start: bounds[0], end: bounds[1]}, nil
+}
+
+// contains returns true if the time of day of t in UTC is within the window.
+func (w activeWindow) contains(t time.Time) bool {
+	t = t.UTC()
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+
+	if w.start < w.end {
+		return d >= w.start && d < w.end
+	}
+
+	return d >= w.start || d < w.end
 }
 
 // Time wraps around time.Now() to make testing easier in case the current time
@@ -205,6 +711,14 @@ func id(r *t.ResourceTagMapping) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+// shortID creates a base36 encoded ID of at most 13 characters from the first
+// 64 bits of the sha1 of the resource ARN. Unlike the 40 characters of id it
+// leaves room for long query ID prefixes within the CloudWatch limit of 255.
+func shortID(r *t.ResourceTagMapping) string {
+	sum := sha1.Sum([]byte(*r.ResourceARN)) // nolint:gosec
+	return strconv.FormatUint(binary.BigEndian.Uint64(sum[:8]), 36)
+}
+
 var matchFirstCap = regexp.MustCompile("(.)([A-Z][a-z]+)")
 var matchAllCap = regexp.MustCompile("([a-z0-9])([A-Z])")
 
@@ -216,32 +730,71 @@ func toSnakeCase(str string) string {
 	return strings.ToLower(s)
 }
 
+// snakeMetricName converts a CloudWatch metric name into the snake cased part
+// of a Prometheus metric name. Names like GetRecords.IteratorAgeMilliseconds
+// are dotted by operation, snake casing the parts separately avoids the double
+// underscores snake casing the sanitized name would produce.
+func snakeMetricName(str string) string {
+	parts := []string{}
+	for _, p := range strings.Split(str, ".") {
+		if p != "" {
+			parts = append(parts, toSnakeCase(sanitize(p)))
+		}
+	}
+	return strings.Join(parts, "_")
+}
+
+// dimensionLabel converts a CloudWatch dimension name into a Prometheus label
+// name. Names like "Cluster Name" of AWS/Kafka contain spaces, snake casing the
+// words separately avoids the double underscores snake casing the sanitized
+// name would produce. Queries use the dimension names as is.
+func dimensionLabel(name string) string {
+	parts := []string{}
+	for _, p := range strings.Fields(name) {
+		parts = append(parts, toSnakeCase(sanitize(p)))
+	}
+	return strings.Join(parts, "_")
+}
+
+// sanitizeReplacer replaces characters not supported in label keys. Replacers
+// are safe for concurrent use and expensive to build, so it is shared.
+var sanitizeReplacer = strings.NewReplacer(
+	" ", "_",
+	",", "_",
+	".", "_",
+	":", "_",
+	"-", "_",
+	"=", "_",
+	"/", "_",
+	"%", "_pct",
+)
+
 // sanitize converts a string into a Prometheus compatible label key. Certain
 // characters are not supported and have to be scrubbed or replaced.
 func sanitize(str string) string {
-	replacer := strings.NewReplacer(
-		" ", "_",
-		",", "_",
-		".", "_",
-		":", "_",
-		"-", "_",
-		"=", "_",
-		"/", "_",
-		"%", "_pct",
-	)
-	return replacer.Replace(str)
-}
-
-// escapeValue escapes double quotes in label values to avoid syntax errors
-// stringifying the metrics keys and values later on.
+	return sanitizeReplacer.Replace(str)
+}
+
+// escapeValue escapes double quotes, backslashes, and newlines in label values
+// to avoid syntax errors stringifying the metrics keys and values later on.
+// Other control characters are not valid in the exposition format and are
+// stripped so a single bad tag value can not corrupt the whole output.
 func escapeValue(str string) string {
-	replacer := strings.NewReplacer(
-		`"`, `\"`,
-		`\`, `\\`,
-	)
-	return replacer.Replace(str)
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, escapeReplacer.Replace(str))
 }
 
+// escapeReplacer escapes label values, see escapeValue.
+var escapeReplacer = strings.NewReplacer(
+	`"`, `\"`,
+	`\`, `\\`,
+	"\n", `\n`,
+)
+
 // ResourceIndex holds resources, queries, and results throughout the lifetime
 // of CloudWatch metrics query done by PromWatch. Using this index allows fast
 // access to queries, results, and resources correlated by the same IDs (used as
@@ -253,14 +806,26 @@ type ResourceIndex struct {
 	// Resources is used for all services that are supported by the
 	// resourcegroupstaggingapi
 	Resources map[string]*t.ResourceTagMapping
+	// DimensionSets holds the dimension set of queries by query ID, see
+	// MetricStat.DimensionSets.
+	DimensionSets map[string]DimensionSet
+	// ZeroFill holds the windows of queries of zero filled metric stats by
+	// query ID, see MetricStat.ZeroFill.
+	ZeroFill map[string]queryWindow
+	// Skipped holds the IDs of resources demoted by the negative cache
+	// which are not queried in this run, see NegativeCache.
+	Skipped map[string]struct{}
 }
 
 // NewResourceIndex returns *ResourceIndex with initialized properties.
 func NewResourceIndex() *ResourceIndex {
 	return &ResourceIndex{
-		Queries:   make(map[string][]*cloudwatch.MetricDataQuery),
-		Results:   make(map[string]*cloudwatch.MetricDataResult),
-		Resources: make(map[string]*t.ResourceTagMapping),
+		Queries:       make(map[string][]*cloudwatch.MetricDataQuery),
+		Results:       make(map[string]*cloudwatch.MetricDataResult),
+		Resources:     make(map[string]*t.ResourceTagMapping),
+		DimensionSets: make(map[string]DimensionSet),
+		ZeroFill:      make(map[string]queryWindow),
+		Skipped:       make(map[string]struct{}),
 	}
 }
 
@@ -271,7 +836,13 @@ func NewResourceIndexFromTagMapping(r *[]*t.ResourceTagMapping, ex func(*t.Resou
 	index := NewResourceIndex()
 
 	for _, item := range *r {
-		index.Resources[ex(item)] = item
+		key := ex(item)
+		// Shortened IDs of different resources may collide, the full sha1
+		// keeps them unique within the index.
+		if e, ok := index.Resources[key]; ok && aws.StringValue(e.ResourceARN) != aws.StringValue(item.ResourceARN) {
+			key = id(item)
+		}
+		index.Resources[key] = item
 	}
 
 	return index
@@ -283,43 +854,167 @@ func (i *ResourceIndex) AddResults(res *[]*cloudwatch.MetricDataResult) {
 	}
 }
 
-// tagsToString transforms tags into a string of Prometheus compatible metrics
-// labels.
-func tagsToString(tags []*t.Tag) string {
-	buf := bytes.Buffer{}
-	for i, t := range tags {
-		sep := ","
-		if i == len(tags)-1 {
-			sep = ""
-		}
+// Label is a Prometheus label name and value pair.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a single value of a time series as exported by the collectors.
+type Sample struct {
+	Name   string
+	Labels []Label
+	Value  float64
+	// Timestamp in milliseconds since epoch
+	Timestamp int64
+}
+
+// String formats the sample as line in the Prometheus text format.
+func (s Sample) String() string {
+	return string(appendSample(nil, s.Name, labelsToString(s.Labels), s.Value, s.Timestamp))
+}
+
+// appendSample appends a sample with labels already formatted by
+// labelsToString as line in the Prometheus text format to buf. Formatting the
+// labels once per resource and avoiding fmt saves allocations for large
+// numbers of samples.
+func appendSample(buf []byte, name, labels string, value float64, timestamp int64) []byte {
+	buf = append(buf, name...)
+	buf = append(buf, '{')
+	buf = append(buf, labels...)
+	buf = append(buf, "} "...)
+	// Same as the %f verb
+	buf = strconv.AppendFloat(buf, value, 'f', 6, 64)
+	buf = append(buf, ' ')
+	buf = strconv.AppendInt(buf, timestamp, 10)
 
-		fmt.Fprintf(&buf, `%s="%s"%s`, toSnakeCase(sanitize(*t.Key)), escapeValue(*t.Value), sep)
+	return append(buf, '\n')
+}
+
+// tagsToLabels transforms tags into Prometheus compatible labels.
+func tagsToLabels(tags []*t.Tag) []Label {
+	labels := make([]Label, 0, len(tags))
+	for _, t := range tags {
+		labels = append(labels, Label{Name: toSnakeCase(sanitize(*t.Key)), Value: *t.Value})
 	}
 
-	return buf.String()
+	return labels
 }
 
-// convertTags transforms AWS tags and extra tags into a string of Prometheus
-// compatible metrics labels.
-func convertTags(resource *t.ResourceTagMapping, mergeTags []string, tags ...*t.Tag) string {
+// labelsToString transforms labels into a string of Prometheus compatible
+// metrics labels.
+func labelsToString(labels []Label) string {
+	b := strings.Builder{}
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		b.WriteString(escapeValue(l.Value))
+		b.WriteByte('"')
+	}
+
+	return b.String()
+}
+
+// tagsToString transforms tags into a string of Prometheus compatible metrics
+// labels.
+func tagsToString(tags []*t.Tag) string {
+	return labelsToString(tagsToLabels(tags))
+}
+
+// convertLabels transforms AWS tags and extra tags into Prometheus compatible
+// labels. Only resource tags configured as merge tags are carried over.
+func convertLabels(resource *t.ResourceTagMapping, mergeTags []string, tags ...*t.Tag) []Label {
 	merge := map[string]struct{}{}
 
 	for _, t := range mergeTags {
 		merge[t] = struct{}{}
 	}
 
+	taken := map[string]struct{}{}
+	for _, t := range tags {
+		taken[toSnakeCase(sanitize(*t.Key))] = struct{}{}
+	}
+
 	for _, t := range resource.Tags {
-		if _, ok := merge[*t.Key]; ok {
-			tags = append(tags, t)
+		if _, ok := merge[*t.Key]; !ok {
+			continue
+		}
+		// Extra tags take precedence over merge tags resulting in the same
+		// label name as duplicate label names are invalid.
+		if _, ok := taken[toSnakeCase(sanitize(*t.Key))]; ok {
+			Logger.Warnw("merge tag collides with label, dropping it", "tag", *t.Key, "arn", aws.StringValue(resource.ResourceARN))
+			continue
 		}
+		tags = append(tags, t)
 	}
 
-	return tagsToString(tags)
+	return tagsToLabels(tags)
+}
+
+// staticLabels transforms the static labels of a collector into Prometheus
+// compatible labels sorted by name.
+func staticLabels(static map[string]string) []Label {
+	labels := make([]Label, 0, len(static))
+	for k, v := range static {
+		labels = append(labels, Label{Name: toSnakeCase(sanitize(k)), Value: v})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	return labels
+}
+
+// withStaticLabels appends the static labels to labels. Labels derived from the
+// resource take precedence over static labels of the same name.
+func withStaticLabels(labels, static []Label) []Label {
+	if len(static) == 0 {
+		return labels
+	}
+
+	taken := map[string]struct{}{}
+	for _, l := range labels {
+		taken[l.Name] = struct{}{}
+	}
+
+	out := labels[:len(labels):len(labels)]
+	for _, l := range static {
+		if _, ok := taken[l.Name]; ok {
+			continue
+		}
+		out = append(out, l)
+	}
+
+	return out
+}
+
+// convertTags transforms AWS tags and extra tags into a string of Prometheus
+// compatible metrics labels.
+func convertTags(resource *t.ResourceTagMapping, mergeTags []string, tags ...*t.Tag) string {
+	return labelsToString(convertLabels(resource, mergeTags, tags...))
+}
+
+// arnLabels maps the ARN components available as arn_labels to the name of the
+// label and a function extracting the component from a parsed ARN.
+var arnLabels = map[string]struct {
+	label string
+	value func(arn.ARN) string
+}{
+	"region":     {"aws_region", func(a arn.ARN) string { return a.Region }},
+	"account_id": {"aws_account_id", func(a arn.ARN) string { return a.AccountID }},
+	"partition":  {"aws_partition", func(a arn.ARN) string { return a.Partition }},
+	"service":    {"aws_service", func(a arn.ARN) string { return a.Service }},
 }
 
 // defaultExtraTags returns an extraTags function that adds the resource arn and
 // dimension to the tags that end up being Prometheus compatible metrics labels.
-func defaultExtraTags(dimension, resourcePrefix string) extraTags {
+// The dimension is left out if it is empty or its value is the ARN already in
+// the arn tag.
+// Additionally the ARN components named in components are added, unless they
+// are empty like the region of S3 bucket ARNs. If accountAlias is set it is
+// used as value of the account_id component instead of the ID.
+func defaultExtraTags(dimension, resourcePrefix, accountAlias string, components ...string) extraTags {
 	return func(resource *tagging.ResourceTagMapping) ([]*tagging.Tag, error) {
 		tags := []*tagging.Tag{
 			{
@@ -328,16 +1023,32 @@ func defaultExtraTags(dimension, resourcePrefix string) extraTags {
 			},
 		}
 
-		arn, err := arn.Parse(*resource.ResourceARN)
+		arn, err := parseARN(*resource.ResourceARN)
 		if err != nil {
 			return tags, ErrCanNotParseARN
 		}
 
-		val := strings.TrimPrefix(arn.Resource, resourcePrefix)
-		tags = append(tags, &tagging.Tag{
-			Key:   aws.String(dimension),
-			Value: aws.String(val),
-		})
+		if val := dimensionValue(*resource.ResourceARN, arn.Resource, resourcePrefix); dimension != "" && val != *resource.ResourceARN {
+			tags = append(tags, &tagging.Tag{
+				Key:   aws.String(dimensionLabel(dimension)),
+				Value: aws.String(val),
+			})
+		}
+
+		for _, c := range components {
+			l, ok := arnLabels[c]
+			if !ok || l.value(arn) == "" {
+				continue
+			}
+			val := l.value(arn)
+			if c == "account_id" && accountAlias != "" {
+				val = accountAlias
+			}
+			tags = append(tags, &tagging.Tag{
+				Key:   aws.String(l.label),
+				Value: aws.String(val),
+			})
+		}
 
 		return tags, nil
 	}
@@ -348,13 +1059,92 @@ func defaultExtraTags(dimension, resourcePrefix string) extraTags {
 // resources.
 func defaultMetricDimension(dimension, resourcePrefix string) metricDimensions {
 	return func(resource *tagging.ResourceTagMapping) ([]*cloudwatch.Dimension, error) {
-		arn, err := arn.Parse(*resource.ResourceARN)
+		arn, err := parseARN(*resource.ResourceARN)
 		if err != nil {
 			return []*cloudwatch.Dimension{}, ErrCanNotParseARN
 		}
 
-		val := strings.TrimPrefix(arn.Resource, resourcePrefix)
+		val := dimensionValue(*resource.ResourceARN, arn.Resource, resourcePrefix)
 
 		return []*cloudwatch.Dimension{{Name: aws.String(dimension), Value: aws.String(val)}}, nil
 	}
 }
+
+// apiGatewayMetricDimension sets the ID of a REST API as dimension for
+// CloudWatch. The resources of API Gateway ARNs are paths, e.g.
+// /restapis/abc123def, of which the last segment is the ID. Other API Gateway
+// resources like stages (/restapis/abc123def/stages/prod) are rejected.
+func apiGatewayMetricDimension(resource *tagging.ResourceTagMapping) ([]*cloudwatch.Dimension, error) {
+	arn, err := parseARN(*resource.ResourceARN)
+	if err != nil {
+		return []*cloudwatch.Dimension{}, ErrCanNotParseARN
+	}
+
+	segments := strings.Split(strings.Trim(arn.Resource, "/"), "/")
+	if len(segments) != 2 || segments[0] != "restapis" || segments[1] == "" {
+		return []*cloudwatch.Dimension{}, fmt.Errorf("%w: %s", ErrNotRESTAPI, *resource.ResourceARN)
+	}
+
+	return []*cloudwatch.Dimension{{Name: aws.String("ApiId"), Value: aws.String(segments[len(segments)-1])}}, nil
+}
+
+// ecsServiceMetricDimension sets the cluster and service name of an ECS service
+// as dimensions for CloudWatch. The resources of ECS service ARNs are of the
+// form service/my-cluster/my-service, services with ARNs of the old format
+// without the cluster name (service/my-service) are rejected.
+func ecsServiceMetricDimension(resource *tagging.ResourceTagMapping) ([]*cloudwatch.Dimension, error) {
+	arn, err := parseARN(*resource.ResourceARN)
+	if err != nil {
+		return []*cloudwatch.Dimension{}, ErrCanNotParseARN
+	}
+
+	segments := strings.Split(arn.Resource, "/")
+	if len(segments) != 3 || segments[0] != "service" || segments[1] == "" || segments[2] == "" {
+		return []*cloudwatch.Dimension{}, fmt.Errorf("%w: %s", ErrNotECSService, *resource.ResourceARN)
+	}
+
+	return []*cloudwatch.Dimension{
+		{Name: aws.String("ClusterName"), Value: aws.String(segments[1])},
+		{Name: aws.String("ServiceName"), Value: aws.String(segments[2])},
+	}, nil
+}
+
+// mskMetricDimension sets the name of an MSK cluster as dimension for
+// CloudWatch. The resources of MSK cluster ARNs are of the form
+// cluster/my-cluster/<uuid>, the dimension name contains a space.
+func mskMetricDimension(resource *tagging.ResourceTagMapping) ([]*cloudwatch.Dimension, error) {
+	arn, err := parseARN(*resource.ResourceARN)
+	if err != nil {
+		return []*cloudwatch.Dimension{}, ErrCanNotParseARN
+	}
+
+	segments := strings.Split(arn.Resource, "/")
+	if len(segments) != 3 || segments[0] != "cluster" || segments[1] == "" {
+		return []*cloudwatch.Dimension{}, fmt.Errorf("%w: %s", ErrNotMSKCluster, *resource.ResourceARN)
+	}
+
+	return []*cloudwatch.Dimension{{Name: aws.String("Cluster Name"), Value: aws.String(segments[1])}}, nil
+}
+
+// dimensionValue returns the dimension value of a resource, the full ARN for
+// ResourcePrefixARN and the resource ID otherwise.
+func dimensionValue(fullARN, resource, resourcePrefix string) string {
+	if resourcePrefix == ResourcePrefixARN {
+		return fullARN
+	}
+
+	return resourceID(resource, resourcePrefix)
+}
+
+// resourceID returns the ID of the resource of an ARN, i.e. the resource with
+// the resource prefix removed. Resources of the form type:id:qualifier, like
+// versioned or aliased Lambda functions (function:my-fn:prod), can carry a
+// qualifier after the ID which is dropped.
+func resourceID(resource, resourcePrefix string) string {
+	id := strings.TrimPrefix(resource, resourcePrefix)
+	if strings.HasSuffix(resourcePrefix, ":") {
+		id, _, _ = strings.Cut(id, ":")
+	}
+
+	return id
+}
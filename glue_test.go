@@ -2,11 +2,16 @@
 package main
 
 import (
+	"fmt"
+	"math"
+	"regexp"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
 )
 
 func TestToSnakeCase(t *testing.T) {
@@ -31,6 +36,123 @@ func TestToSnakeCase(t *testing.T) {
 	}
 }
 
+func TestSnakeMetricName(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"", ""},
+		{"IncomingBytes", "incoming_bytes"},
+		{"GetRecords.IteratorAgeMilliseconds", "get_records_iterator_age_milliseconds"},
+		{"PutRecords.ThrottledRecords", "put_records_throttled_records"},
+		{"SubscribeToShard.RateExceeded", "subscribe_to_shard_rate_exceeded"},
+		{"DeliveryToS3.Success", "delivery_to_s3_success"},
+		{"GetRecords..Bytes.", "get_records_bytes"},
+	}
+	for _, c := range cases {
+		got := snakeMetricName(c.input)
+		assert.Equal(t, c.expected, got, c.input)
+		assert.NotContains(t, got, "__", c.input)
+	}
+}
+
+func TestDimensionLabel(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"VolumeId", "volume_id"},
+		{"DBInstanceIdentifier", "db_instance_identifier"},
+		{"DBClusterIdentifier", "db_cluster_identifier"},
+		{"Cluster Name", "cluster_name"},
+		{"Broker ID", "broker_id"},
+		{"Consumer Group", "consumer_group"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, dimensionLabel(c.input), c.input)
+		assert.Equal(t, c.expected, toSnakeCase(sanitize(dimensionLabel(c.input))), "Label names should not change when sanitized again: %s", c.input)
+	}
+}
+
+func TestMSKMetricDimension(t *testing.T) {
+	cases := []struct {
+		arn      string
+		expected string
+		err      error
+	}{
+		{"arn:aws:kafka:us-east-1:123456789012:cluster/my-cluster/abcd1234-0123-4567-89ab-cdef01234567-1", "my-cluster", nil},
+		{"arn:aws:kafka:us-east-1:123456789012:cluster/my-cluster", "", ErrNotMSKCluster},
+		{"arn:aws:kafka:us-east-1:123456789012:topic/my-cluster/abcd1234-0123-4567-89ab-cdef01234567-1/orders", "", ErrNotMSKCluster},
+		{"not-an-arn", "", ErrCanNotParseARN},
+	}
+
+	for _, c := range cases {
+		d, err := mskMetricDimension(&tagging.ResourceTagMapping{ResourceARN: aws.String(c.arn)})
+		if c.err != nil {
+			assert.ErrorIs(t, err, c.err, c.arn)
+			assert.Empty(t, d, c.arn)
+			continue
+		}
+		assert.Nil(t, err, c.arn)
+		assert.Equal(t, []*cloudwatch.Dimension{{Name: aws.String("Cluster Name"), Value: aws.String(c.expected)}}, d, c.arn)
+	}
+}
+
+func TestAPIGatewayMetricDimension(t *testing.T) {
+	cases := []struct {
+		arn      string
+		expected string
+		err      error
+	}{
+		{"arn:aws:apigateway:us-east-1::/restapis/abc123def", "abc123def", nil},
+		{"arn:aws-cn:apigateway:cn-north-1::/restapis/0a1b2c3d4e", "0a1b2c3d4e", nil},
+		{"arn:aws:apigateway:us-east-1::/restapis/abc123def/stages/prod", "", ErrNotRESTAPI},
+		{"arn:aws:apigateway:us-east-1::/restapis/", "", ErrNotRESTAPI},
+		{"arn:aws:apigateway:us-east-1::/domainnames/example.com", "", ErrNotRESTAPI},
+		{"not-an-arn", "", ErrCanNotParseARN},
+	}
+
+	for _, c := range cases {
+		d, err := apiGatewayMetricDimension(&tagging.ResourceTagMapping{ResourceARN: aws.String(c.arn)})
+		if c.err != nil {
+			assert.ErrorIs(t, err, c.err, c.arn)
+			assert.Empty(t, d, c.arn)
+			continue
+		}
+		assert.Nil(t, err, c.arn)
+		assert.Equal(t, []*cloudwatch.Dimension{{Name: aws.String("ApiId"), Value: aws.String(c.expected)}}, d, c.arn)
+	}
+}
+
+func TestECSServiceMetricDimension(t *testing.T) {
+	cases := []struct {
+		arn     string
+		cluster string
+		service string
+		err     error
+	}{
+		{"arn:aws:ecs:us-east-1:123456789012:service/my-cluster/my-service", "my-cluster", "my-service", nil},
+		{"arn:aws:ecs:us-east-1:123456789012:service/my-service", "", "", ErrNotECSService},
+		{"arn:aws:ecs:us-east-1:123456789012:service/my-cluster/", "", "", ErrNotECSService},
+		{"arn:aws:ecs:us-east-1:123456789012:task/my-cluster/0123456789abcdef", "", "", ErrNotECSService},
+		{"not-an-arn", "", "", ErrCanNotParseARN},
+	}
+
+	for _, c := range cases {
+		d, err := ecsServiceMetricDimension(&tagging.ResourceTagMapping{ResourceARN: aws.String(c.arn)})
+		if c.err != nil {
+			assert.ErrorIs(t, err, c.err, c.arn)
+			assert.Empty(t, d, c.arn)
+			continue
+		}
+		assert.Nil(t, err, c.arn)
+		assert.Equal(t, []*cloudwatch.Dimension{
+			{Name: aws.String("ClusterName"), Value: aws.String(c.cluster)},
+			{Name: aws.String("ServiceName"), Value: aws.String(c.service)},
+		}, d, c.arn)
+	}
+}
+
 func TestSanitize(t *testing.T) {
 	cases := []struct {
 		input    string
@@ -40,11 +162,33 @@ func TestSanitize(t *testing.T) {
 		{"already_sane", "already_sane"},
 		{" ,.:-=/", "_______"},
 		{"balance%_average", "balance_pct_average"},
+		{"ClusterStatus.green", "ClusterStatus_green"},
 	}
 	for _, c := range cases {
 		got := sanitize(c.input)
 		assert.Equal(t, c.expected, got)
 	}
+
+	assert.Equal(t, "cluster_status_green", toSnakeCase(sanitize("ClusterStatus.green")), "Dotted OpenSearch metrics should not produce double underscores")
+}
+
+func TestEscapeValue(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{"", ""},
+		{"plain", "plain"},
+		{`"quoted"`, `\"quoted\"`},
+		{`back\slash`, `back\\slash`},
+		{"new\nline", `new\nline`},
+		{"carriage\r\nreturn", `carriage\nreturn`},
+		{"tab\tand\x00null", "tabandnull"},
+	}
+	for _, c := range cases {
+		got := escapeValue(c.input)
+		assert.Equal(t, c.expected, got)
+	}
 }
 
 func TestNewResourceIndexFromTagMapping(t *testing.T) {
@@ -63,6 +207,60 @@ func TestNewResourceIndexFromTagMapping(t *testing.T) {
 	assert.True(t, ok)
 }
 
+func TestNewResourceIndexFromTagMappingCollision(t *testing.T) {
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-a")},
+		{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-b")},
+		{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-b")},
+	}
+	index := NewResourceIndexFromTagMapping(&resources, func(*tagging.ResourceTagMapping) string {
+		return "collision"
+	})
+
+	assert.Len(t, index.Resources, 2, "Colliding IDs of different resources should fall back to the full sha1")
+	assert.Equal(t, resources[0], index.Resources["collision"])
+	assert.Equal(t, resources[2], index.Resources[id(resources[1])])
+}
+
+func TestShortID(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:    "alb",
+		Period:  60,
+		QueryID: QueryIDShort,
+		MetricStats: []MetricStat{
+			{MetricName: "RequestCount", Stat: "Sum", DimensionSets: []DimensionSet{
+				{"AvailabilityZone": "us-east-1a"},
+				{"AvailabilityZone": "us-east-1b"},
+			}},
+		},
+	}))
+
+	resources := []*tagging.ResourceTagMapping{}
+	for i := 0; i < 100000; i++ {
+		resources = append(resources, &tagging.ResourceTagMapping{
+			ResourceARN: aws.String(fmt.Sprintf("arn:aws:elasticloadbalancing:us-east-1:000000000000:loadbalancer/app/lb-%d/%016x", i, i)),
+		})
+	}
+	index := NewResourceIndexFromTagMapping(&resources, b.resourceID())
+	assert.Len(t, index.Resources, len(resources), "Short IDs should be unique")
+	for key, r := range index.Resources {
+		if len(key) > 13 || key != shortID(r) {
+			assert.Fail(t, "Short IDs should be at most 13 characters without fallback to the full sha1", key)
+		}
+	}
+
+	queries := b.makeQueries(index, b.namespace, defaultMetricDimension(b.dimension, b.resourcePrefix))
+	ids := map[string]struct{}{}
+	valid := regexp.MustCompile(`^[a-z][a-zA-Z0-9_]{0,254}$`)
+	for _, q := range queries {
+		if !valid.MatchString(aws.StringValue(q.Id)) {
+			assert.Fail(t, "Query IDs should be valid CloudWatch query IDs within the length limit", aws.StringValue(q.Id))
+		}
+		ids[aws.StringValue(q.Id)] = struct{}{}
+	}
+	assert.Len(t, ids, 2*len(resources), "Query IDs should be unique")
+}
+
 func TestConvertTags(t *testing.T) {
 	cases := []struct {
 		resource  *tagging.ResourceTagMapping
@@ -195,6 +393,29 @@ func TestConvertTags(t *testing.T) {
 			expected: `extra="tagValue",more_extra="anotherExtraValue",some_tag_key="someTagValue",merge_me="someOtherTagValue"`,
 			message:  "Only tags configured to be merged should be converted",
 		},
+		{
+			resource: &tagging.ResourceTagMapping{
+				Tags: []*tagging.Tag{
+					{
+						Key:   aws.String("aws_region"),
+						Value: aws.String("tagged-region"),
+					},
+					{
+						Key:   aws.String("team"),
+						Value: aws.String("metrics"),
+					},
+				},
+			},
+			mergeTags: []string{"aws_region", "team"},
+			extraTags: []*tagging.Tag{
+				{
+					Key:   aws.String("aws_region"),
+					Value: aws.String("us-east-1"),
+				},
+			},
+			expected: `aws_region="us-east-1",team="metrics"`,
+			message:  "Extra tags should win over merge tags with the same label name",
+		},
 	}
 
 	for _, c := range cases {
@@ -230,7 +451,7 @@ func TestExtraTagsCallback(t *testing.T) {
 					Value: aws.String("arn:aws:ec2:us-east-1:00000000000:volume/vol-0000000000000000"),
 				},
 				{
-					Key:   aws.String("VolumeId"),
+					Key:   aws.String("volume_id"),
 					Value: aws.String("vol-0000000000000000"),
 				},
 			},
@@ -240,12 +461,183 @@ func TestExtraTagsCallback(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		got, err := defaultExtraTags("VolumeId", "volume/")(c.resource)
+		got, err := defaultExtraTags("VolumeId", "volume/", "")(c.resource)
 		assert.Equal(t, c.expectedError, err, c.message)
 		assert.Equal(t, c.expected, got, c.message)
 	}
 }
 
+func TestExtraTagsLambda(t *testing.T) {
+	cases := []struct {
+		arn      string
+		expected string
+		message  string
+	}{
+		{
+			arn:      "arn:aws:lambda:us-east-1:000000000000:function:my-fn",
+			expected: `arn="arn:aws:lambda:us-east-1:000000000000:function:my-fn",function_name="my-fn"`,
+			message:  "Unqualified functions should be labeled with their name",
+		},
+		{
+			arn:      "arn:aws:lambda:us-east-1:000000000000:function:my-fn:prod",
+			expected: `arn="arn:aws:lambda:us-east-1:000000000000:function:my-fn:prod",function_name="my-fn"`,
+			message:  "Qualified functions should be labeled with their name, the qualifier is kept in the ARN",
+		},
+	}
+
+	for _, c := range cases {
+		resource := &tagging.ResourceTagMapping{ResourceARN: aws.String(c.arn)}
+		tags, err := defaultExtraTags("FunctionName", "function:", "")(resource)
+		assert.Nil(t, err, c.message)
+		assert.Equal(t, c.expected, convertTags(resource, nil, tags...), c.message)
+	}
+}
+
+func TestStepFunctionsDimensionARN(t *testing.T) {
+	typ := collectorTypes["sfn"]
+	arn := "arn:aws:states:us-east-1:000000000000:stateMachine:my-machine"
+	resource := &tagging.ResourceTagMapping{ResourceARN: aws.String(arn)}
+
+	dims, err := defaultMetricDimension(typ.Dimension, typ.ResourcePrefix)(resource)
+	assert.Nil(t, err)
+	assert.Equal(t, []*cloudwatch.Dimension{{Name: aws.String("StateMachineArn"), Value: aws.String(arn)}}, dims,
+		"State machines should be queried by their full ARN")
+
+	tags, err := defaultExtraTags(typ.Dimension, typ.ResourcePrefix, "", "region")(resource)
+	assert.Nil(t, err)
+	assert.Equal(t, `arn="`+arn+`",aws_region="us-east-1"`, convertTags(resource, nil, tags...),
+		"The dimension should not duplicate the arn label")
+}
+
+func TestRDSClusterMetricDimension(t *testing.T) {
+	for _, typ := range []string{"rds_cluster", "aurora"} {
+		b := stripInterface(CollectorFromConfig(CollectorConfig{Type: typ}))
+		got, err := b.metricDimensions()(&tagging.ResourceTagMapping{ResourceARN: aws.String("arn:aws:rds:us-east-1:123:cluster:my-aurora")})
+		assert.Nil(t, err, typ)
+		assert.Equal(t, []*cloudwatch.Dimension{{Name: aws.String("DBClusterIdentifier"), Value: aws.String("my-aurora")}}, got,
+			"Clusters should be queried by their cluster identifier")
+		assert.Equal(t, "AWS/RDS", b.namespace, typ)
+		assert.Equal(t, "rds:cluster", b.resourceName, typ)
+	}
+}
+
+func TestDocDBMetricDimension(t *testing.T) {
+	cases := []struct {
+		level    string
+		arn      string
+		expected []*cloudwatch.Dimension
+	}{
+		{"instance", "arn:aws:rds:us-east-1:000000000000:db:my-docdb-1", []*cloudwatch.Dimension{{Name: aws.String("DBInstanceIdentifier"), Value: aws.String("my-docdb-1")}}},
+		{"cluster", "arn:aws:rds:us-east-1:000000000000:cluster:my-docdb", []*cloudwatch.Dimension{{Name: aws.String("DBClusterIdentifier"), Value: aws.String("my-docdb")}}},
+	}
+
+	for _, c := range cases {
+		b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "docdb", Level: c.level}))
+		got, err := b.metricDimensions()(&tagging.ResourceTagMapping{ResourceARN: aws.String(c.arn)})
+		assert.Nil(t, err, c.level)
+		assert.Equal(t, c.expected, got, c.level)
+		assert.Equal(t, "AWS/DocDB", b.namespace, c.level)
+	}
+
+	_, err := CollectorFromConfig(CollectorConfig{Type: "docdb", Level: "shard"})
+	assert.ErrorIs(t, err, ErrNoSuchLevel)
+}
+
+func TestExtraTagsARNLabels(t *testing.T) {
+	cases := []struct {
+		arn        string
+		components []string
+		alias      string
+		expected   string
+		message    string
+	}{
+		{
+			arn:        "arn:aws:ec2:us-east-1:000000000000:volume/vol-0000000000000000",
+			components: []string{"region"},
+			expected:   `arn="arn:aws:ec2:us-east-1:000000000000:volume/vol-0000000000000000",volume_id="vol-0000000000000000",aws_region="us-east-1"`,
+			message:    "Region should be added",
+		},
+		{
+			arn:        "arn:aws:ec2:us-east-1:000000000000:volume/vol-0000000000000000",
+			components: []string{"account_id"},
+			expected:   `arn="arn:aws:ec2:us-east-1:000000000000:volume/vol-0000000000000000",volume_id="vol-0000000000000000",aws_account_id="000000000000"`,
+			message:    "Account ID should be added",
+		},
+		{
+			arn:        "arn:aws:ec2:us-east-1:000000000000:volume/vol-0000000000000000",
+			components: []string{"account_id"},
+			alias:      "production",
+			expected:   `arn="arn:aws:ec2:us-east-1:000000000000:volume/vol-0000000000000000",volume_id="vol-0000000000000000",aws_account_id="production"`,
+			message:    "Account alias should replace the account ID",
+		},
+		{
+			arn:        "arn:aws-cn:ec2:cn-north-1:000000000000:volume/vol-0000000000000000",
+			components: []string{"partition"},
+			expected:   `arn="arn:aws-cn:ec2:cn-north-1:000000000000:volume/vol-0000000000000000",volume_id="vol-0000000000000000",aws_partition="aws-cn"`,
+			message:    "Partition should be added",
+		},
+		{
+			arn:        "arn:aws:ec2:us-east-1:000000000000:volume/vol-0000000000000000",
+			components: []string{"service"},
+			expected:   `arn="arn:aws:ec2:us-east-1:000000000000:volume/vol-0000000000000000",volume_id="vol-0000000000000000",aws_service="ec2"`,
+			message:    "Service should be added",
+		},
+		{
+			arn:        "arn:aws:s3:::bucket",
+			components: []string{"region", "account_id", "partition", "service"},
+			expected:   `arn="arn:aws:s3:::bucket",volume_id="bucket",aws_partition="aws",aws_service="s3"`,
+			message:    "Empty components should be omitted",
+		},
+	}
+
+	for _, c := range cases {
+		resource := &tagging.ResourceTagMapping{ResourceARN: aws.String(c.arn)}
+		tags, err := defaultExtraTags("VolumeId", "volume/", c.alias, c.components...)(resource)
+		assert.Nil(t, err, c.message)
+		assert.Equal(t, c.expected, tagsToString(tags), c.message)
+	}
+}
+
+func TestResourceID(t *testing.T) {
+	cases := []struct {
+		resource string
+		prefix   string
+		expected string
+		message  string
+	}{
+		{"volume/vol-0000000000000000", "volume/", "vol-0000000000000000", "Prefix should be removed"},
+		{"function:my-fn", "function:", "my-fn", "Unqualified functions should keep their name"},
+		{"function:my-fn:42", "function:", "my-fn", "Versions should be dropped"},
+		{"function:my-fn:prod", "function:", "my-fn", "Aliases should be dropped"},
+		{"function:my-fn:$LATEST", "function:", "my-fn", "The latest version qualifier should be dropped"},
+		{"my-queue", "", "my-queue", "Resources without prefix should be kept"},
+		{"deliverystream/my-stream", "deliverystream/", "my-stream", "Delivery stream prefix should be removed"},
+		{"loadbalancer/app/my-lb/50dc6c495c0c9188", "loadbalancer/", "app/my-lb/50dc6c495c0c9188", "Slash separated resources should be kept"},
+		{"loadbalancer/gwy/my-gwlb/50dc6c495c0c9188", "loadbalancer/", "gwy/my-gwlb/50dc6c495c0c9188", "Gateway Load Balancers should be queried like ALBs"},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, resourceID(c.resource, c.prefix), c.message)
+	}
+}
+
+func TestTagFilterYAML(t *testing.T) {
+	var config CollectorConfig
+	assert.Nil(t, yaml.UnmarshalStrict([]byte(`
+tag_filters:
+- key: team
+  value: metrics
+- key: env
+  values: [prod, staging]
+`), &config))
+	assert.Equal(t, []TagFilter{
+		{Key: "team", Value: "metrics"},
+		{Key: "env", Values: []string{"prod", "staging"}},
+	}, config.TagFilters, "Both the scalar value and the values sequence should be parsed")
+	assert.Equal(t, []string{"metrics"}, config.TagFilters[0].values())
+	assert.Equal(t, []string{"prod", "staging"}, config.TagFilters[1].values())
+}
+
 func TestCollectorFromConfig(t *testing.T) {
 	cases := []struct {
 		config   *CollectorConfig
@@ -273,10 +665,293 @@ func TestCollectorFromConfig(t *testing.T) {
 			},
 			message: "Known type should produce collector",
 		},
+		{
+			config: &CollectorConfig{Type: "lambda"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "lambda"},
+				resourceName:   "lambda:function",
+				namespace:      "AWS/Lambda",
+				dimension:      "FunctionName",
+				resourcePrefix: "function:",
+			},
+			message: "Lambda type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "dynamodb"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "dynamodb"},
+				resourceName:   "dynamodb:table",
+				namespace:      "AWS/DynamoDB",
+				dimension:      "TableName",
+				resourcePrefix: "table/",
+			},
+			message: "DynamoDB type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "s3"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "s3"},
+				resourceName:   "s3",
+				namespace:      "AWS/S3",
+				dimension:      "BucketName",
+				resourcePrefix: "",
+			},
+			message: "S3 type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "kinesis"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "kinesis"},
+				resourceName:   "kinesis:stream",
+				namespace:      "AWS/Kinesis",
+				dimension:      "StreamName",
+				resourcePrefix: "stream/",
+			},
+			message: "Kinesis type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "apigw"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "apigw"},
+				resourceName:   "apigateway",
+				namespace:      "AWS/ApiGateway",
+				dimension:      "ApiId",
+				resourcePrefix: "/restapis/",
+			},
+			message: "API Gateway type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "ecs"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "ecs"},
+				resourceName:   "ecs:service",
+				namespace:      "AWS/ECS",
+				dimension:      "ServiceName",
+				resourcePrefix: "service/",
+			},
+			message: "ECS type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "redshift"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "redshift"},
+				resourceName:   "redshift:cluster",
+				namespace:      "AWS/Redshift",
+				dimension:      "ClusterIdentifier",
+				resourcePrefix: "cluster:",
+			},
+			message: "Redshift type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "msk"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "msk"},
+				resourceName:   "kafka:cluster",
+				namespace:      "AWS/Kafka",
+				dimension:      "Cluster Name",
+				resourcePrefix: "cluster/",
+			},
+			message: "MSK type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "es"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "es"},
+				resourceName:   "es:domain",
+				namespace:      "AWS/ES",
+				dimension:      "DomainName",
+				resourcePrefix: "domain/",
+			},
+			message: "OpenSearch type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "aurora"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "aurora"},
+				resourceName:   "rds:cluster",
+				namespace:      "AWS/RDS",
+				dimension:      "DBClusterIdentifier",
+				resourcePrefix: "cluster:",
+			},
+			message: "Aurora type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "rds_cluster"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "rds_cluster"},
+				resourceName:   "rds:cluster",
+				namespace:      "AWS/RDS",
+				dimension:      "DBClusterIdentifier",
+				resourcePrefix: "cluster:",
+			},
+			message: "RDS cluster type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "ec2"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "ec2"},
+				resourceName:   "ec2:instance",
+				namespace:      "AWS/EC2",
+				dimension:      "InstanceId",
+				resourcePrefix: "instance/",
+			},
+			message: "EC2 type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "gwlb"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "gwlb"},
+				resourceName:   "elasticloadbalancing:loadbalancer/gwy",
+				namespace:      "AWS/GatewayELB",
+				dimension:      "LoadBalancer",
+				resourcePrefix: "loadbalancer/",
+			},
+			message: "Gateway Load Balancer type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "sfn"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "sfn"},
+				resourceName:   "states:stateMachine",
+				namespace:      "AWS/States",
+				dimension:      "StateMachineArn",
+				resourcePrefix: ResourcePrefixARN,
+			},
+			message: "Step Functions type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "firehose"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "firehose"},
+				resourceName:   "firehose:deliverystream",
+				namespace:      "AWS/Firehose",
+				dimension:      "DeliveryStreamName",
+				resourcePrefix: "deliverystream/",
+			},
+			message: "Firehose type should produce collector",
+		},
+		{
+			config: &CollectorConfig{Type: "docdb"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "docdb"},
+				resourceName:   "rds:db",
+				namespace:      "AWS/DocDB",
+				dimension:      "DBInstanceIdentifier",
+				resourcePrefix: "db:",
+			},
+			message: "DocumentDB type should produce instance collector by default",
+		},
+		{
+			config: &CollectorConfig{Type: "docdb", Level: "instance"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "docdb", Level: "instance"},
+				resourceName:   "rds:db",
+				namespace:      "AWS/DocDB",
+				dimension:      "DBInstanceIdentifier",
+				resourcePrefix: "db:",
+			},
+			message: "DocumentDB instance level should produce instance collector",
+		},
+		{
+			config: &CollectorConfig{Type: "docdb", Level: "cluster"},
+			expected: &BaseCollector{
+				config:         CollectorConfig{Type: "docdb", Level: "cluster"},
+				resourceName:   "rds:cluster",
+				namespace:      "AWS/DocDB",
+				dimension:      "DBClusterIdentifier",
+				resourcePrefix: "cluster:",
+			},
+			message: "DocumentDB cluster level should produce cluster collector",
+		},
+		{
+			config:   &CollectorConfig{Type: "docdb", Level: "shard"},
+			expected: nil,
+			message:  "Unknown level should produce nil",
+		},
+		{
+			config:   &CollectorConfig{Type: "sqs", Level: "cluster"},
+			expected: nil,
+			message:  "Level of type without levels should produce nil",
+		},
 	}
 
 	for _, c := range cases {
 		got, _ := CollectorFromConfig(*c.config)
+		// Functions can not be compared, the labels derived from the
+		// dimensions are covered by TestMakeQueries.
+		if b, ok := got.(*BaseCollector); ok {
+			b.dimensionLabels = nil
+		}
 		assert.Equal(t, c.expected, got, c.message)
 	}
 }
+
+func TestNormalizeRegion(t *testing.T) {
+	c, err := CollectorFromConfig(CollectorConfig{Type: "ebs", Region: " US-East-1 "})
+	assert.Nil(t, err)
+	assert.Equal(t, "us-east-1", stripInterface(c, err).config.Region, "Region should be normalized")
+
+	assert.Nil(t, validateRegion("us-gov-west-1", false), "GovCloud regions should be valid")
+	assert.Nil(t, validateRegion("", false), "Empty region should be valid to use the default region")
+}
+
+func TestSampleString(t *testing.T) {
+	labels := []Label{{Name: "volume_id", Value: "vol-1"}, {Name: "team", Value: `a "quoted" \ value`}}
+	for _, v := range []float64{0, 1.5, -2.25, 1e21, 1.23456789e-7, math.Inf(1), math.Inf(-1), math.NaN()} {
+		s := Sample{Name: "promwatch_aws_ebs_volume_read_bytes_sum", Labels: labels, Value: v, Timestamp: 1611929698000}
+		legacy := fmt.Sprintf("%s{%s} %f %d\n", s.Name, labelsToString(s.Labels), s.Value, s.Timestamp)
+		assert.Equal(t, legacy, s.String(), "Samples should be formatted like with the %f verb: %v", v)
+	}
+
+	assert.Equal(t, `volume_id="vol-1",team="a \"quoted\" \\ value"`, labelsToString(labels))
+	assert.Equal(t, "", labelsToString(nil), "No labels should produce an empty string")
+}
+
+func TestExpandMetricStats(t *testing.T) {
+	bounds := &Bounds{Min: aws.Float64(0)}
+	cases := []struct {
+		stats    []MetricStat
+		expected []MetricStat
+		message  string
+	}{
+		{
+			stats:    []MetricStat{{MetricName: "VolumeReadBytes", Stat: "Sum"}},
+			expected: []MetricStat{{MetricName: "VolumeReadBytes", Stat: "Sum"}},
+			message:  "Metric stats without shorthand should be kept as is",
+		},
+		{
+			stats: []MetricStat{{MetricName: "VolumeReadBytes", Stats: []string{"Sum", "Average"}}},
+			expected: []MetricStat{
+				{MetricName: "VolumeReadBytes", Stat: "Sum"},
+				{MetricName: "VolumeReadBytes", Stat: "Average"},
+			},
+			message: "Several stats of one metric should expand to one metric stat per stat",
+		},
+		{
+			stats: []MetricStat{{NamePrefix: "Volume", Names: []string{"ReadBytes", "WriteBytes"}, Stats: []string{"Sum", "Average"}, Bounds: bounds}},
+			expected: []MetricStat{
+				{MetricName: "VolumeReadBytes", Stat: "Sum", Bounds: bounds},
+				{MetricName: "VolumeReadBytes", Stat: "Average", Bounds: bounds},
+				{MetricName: "VolumeWriteBytes", Stat: "Sum", Bounds: bounds},
+				{MetricName: "VolumeWriteBytes", Stat: "Average", Bounds: bounds},
+			},
+			message: "Prefixed names and stats should expand to their cartesian product keeping other options",
+		},
+		{
+			stats: []MetricStat{
+				{MetricName: "VolumeIdleTime", Stat: "Average"},
+				{MetricName: "ReadBytes", NamePrefix: "Volume", Names: []string{"WriteBytes"}, Stat: "Sum"},
+			},
+			expected: []MetricStat{
+				{MetricName: "VolumeIdleTime", Stat: "Average"},
+				{MetricName: "VolumeReadBytes", Stat: "Sum"},
+				{MetricName: "VolumeWriteBytes", Stat: "Sum"},
+			},
+			message: "Name and stat should be combined with the lists and keep their order",
+		},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.expected, expandMetricStats(c.stats), c.message)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+)
+
+// sortedProcs returns the collector procs ordered by their ID. Iterating a map
+// has no stable order, sorting makes sure the metrics output and anything
+// derived from it is the same for unchanged stores.
+func sortedProcs(collectors map[CollectorID]*CollectorProc) []*CollectorProc {
+	procs := make([]*CollectorProc, 0, len(collectors))
+	for _, c := range collectors {
+		procs = append(procs, c)
+	}
+
+	sort.Slice(procs, func(i, j int) bool {
+		return procs[i].ID < procs[j].ID
+	})
+
+	return procs
+}
+
+// metricsHandler writes the metrics of all collector stores followed by the
+// PromWatch telemetry gathered from the registry. Collectors exposed on their
+// named path only are skipped, as are collectors exposed through the registry.
+func metricsHandler(procs []*CollectorProc, gatherer prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Logger.Debug("metrics requested")
+		// Print metrics collected from CloudWatch to the response
+		declared := map[string]struct{}{}
+		for _, c := range procs {
+			if !c.inDefault() || c.inRegistry() {
+				continue
+			}
+			Logger.Debugw("producing metrics for collector", "id", c.ID)
+			writeDeclared(w, c.Store.String(), declared)
+		}
+
+		// To avoid mixed uncompressed and compressed content compressions is
+		// disabled here. The response will still be compressed as the whole
+		// handler is being wrapped for compression.
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+			DisableCompression: true,
+		}).ServeHTTP(w, r)
+	})
+}
+
+// etagHandler wraps h to answer conditional requests. The ETag is derived from
+// the generation of every collector store and, unless ignoreTelemetry is set,
+// the state of the telemetry gathered from gatherer. Stores of collectors not
+// part of the combined metrics do not affect the ETag. Requests with a matching
+// If-None-Match header get a 304 Not Modified without invoking h.
+//
+// The ETag is weak as the same content might be served with different content
+// encodings by an outer compression handler.
+func etagHandler(h http.Handler, procs []*CollectorProc, gatherer prometheus.Gatherer, ignoreTelemetry bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hasher := fnv.New64a()
+		buf := make([]byte, 8)
+		for _, c := range procs {
+			if !c.inDefault() {
+				continue
+			}
+			_, _ = hasher.Write([]byte(c.ID))
+			binary.BigEndian.PutUint64(buf, c.Store.Generation())
+			_, _ = hasher.Write(buf)
+		}
+
+		if !ignoreTelemetry {
+			if err := hashTelemetry(hasher, gatherer); err != nil {
+				// Without a reliable hash the response can not be cached,
+				// serve it without an ETag.
+				Logger.Error(err)
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		etag := fmt.Sprintf(`W/"%x"`, hasher.Sum64())
+		w.Header().Set("ETag", etag)
+
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			notModifiedCount.Inc()
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// hashTelemetry writes the text representation of all gathered metric families
+// to hasher. The counter of 304 responses is skipped as it would otherwise
+// invalidate the ETag with every 304 served.
+func hashTelemetry(hasher hash.Hash, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	for _, mf := range families {
+		if mf.GetName() == "promwatch_http_not_modified_total" {
+			continue
+		}
+		if _, err := expfmt.MetricFamilyToText(hasher, mf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// etagMatches implements the weak comparison of If-None-Match header values.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// healthzHandler serves the liveness probe, it always succeeds once the server
+// is up.
+func healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// readyzHandler serves the readiness probe. It fails with 503 and lists the
+// collectors that are not ready until every collector completed a successful
+// collection.
+func readyzHandler(procs []*CollectorProc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pending := []string{}
+		for _, c := range procs {
+			if !c.Ready() {
+				pending = append(pending, string(c.ID))
+			}
+		}
+
+		if len(pending) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "collectors not ready: %s\n", strings.Join(pending, ", "))
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/handlers"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func testProcs(contents ...string) []*CollectorProc {
+	collectors := map[CollectorID]*CollectorProc{}
+	for i, c := range contents {
+		s := NewStore(0)
+		s.Add(c)
+		s.Commit()
+		id := CollectorID(string(rune('a' + i)))
+		collectors[id] = &CollectorProc{ID: id, Store: s}
+	}
+
+	return sortedProcs(collectors)
+}
+
+func serve(h http.Handler, etag string, gz bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if gz {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestSortedProcs(t *testing.T) {
+	procs := testProcs("a\n", "b\n", "c\n")
+	assert.Equal(t, CollectorID("a"), procs[0].ID)
+	assert.Equal(t, CollectorID("b"), procs[1].ID)
+	assert.Equal(t, CollectorID("c"), procs[2].ID)
+}
+
+func TestETagHandler(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total", Help: "Test counter."})
+	reg.MustRegister(counter)
+
+	procs := testProcs("first 1\n", "second 2\n")
+	h := etagHandler(metricsHandler(procs, reg), procs, reg, false)
+
+	rec := serve(h, "", false)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "first 1\nsecond 2\n")
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(t, etag, "ETag should be set on full responses")
+
+	rec = serve(h, etag, false)
+	assert.Equal(t, http.StatusNotModified, rec.Code, "Unchanged stores should produce 304")
+	assert.Empty(t, rec.Body.String())
+
+	procs[1].Store.Add("second 3\n")
+	procs[1].Store.Commit()
+	rec = serve(h, etag, false)
+	assert.Equal(t, http.StatusOK, rec.Code, "Commit should invalidate the ETag")
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+	etag = rec.Header().Get("ETag")
+
+	counter.Inc()
+	rec = serve(h, etag, false)
+	assert.Equal(t, http.StatusOK, rec.Code, "Telemetry changes should invalidate the ETag")
+}
+
+func TestETagHandlerIgnoreTelemetry(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total", Help: "Test counter."})
+	reg.MustRegister(counter)
+
+	procs := testProcs("first 1\n")
+	h := etagHandler(metricsHandler(procs, reg), procs, reg, true)
+
+	etag := serve(h, "", false).Header().Get("ETag")
+	counter.Inc()
+	assert.Equal(t, http.StatusNotModified, serve(h, etag, false).Code, "Telemetry should not affect the ETag")
+
+	procs[0].Store.Commit()
+	assert.Equal(t, http.StatusOK, serve(h, etag, false).Code, "Commit should invalidate the ETag")
+}
+
+func TestETagHandlerGzip(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	procs := testProcs("first 1\n")
+	h := handlers.CompressHandler(etagHandler(metricsHandler(procs, reg), procs, reg, false))
+
+	rec := serve(h, "", true)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	r, err := gzip.NewReader(rec.Body)
+	assert.Nil(t, err)
+	body, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "first 1\n", string(body))
+
+	etag := rec.Header().Get("ETag")
+	assert.Equal(t, http.StatusNotModified, serve(h, etag, true).Code, "ETag should match for compressed responses")
+	assert.Equal(t, http.StatusNotModified, serve(h, etag, false).Code, "Weak ETag should match across encodings")
+}
+
+func TestETagMatches(t *testing.T) {
+	cases := []struct {
+		header   string
+		expected bool
+	}{
+		{"", false},
+		{`W/"abc"`, true},
+		{`"abc"`, true},
+		{`"def", W/"abc"`, true},
+		{`"def"`, false},
+		{"*", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, etagMatches(c.header, `W/"abc"`), c.header)
+	}
+}
+
+func TestHealthzHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	healthzHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", http.NoBody))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestReadyzHandler(t *testing.T) {
+	ready := false
+	procs := testProcs("first 1\n", "second 2\n")
+	procs[0].ready = func() bool { return ready }
+	h := readyzHandler(procs)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", http.NoBody))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "Collectors without successful collection should not be ready")
+	assert.Contains(t, rec.Body.String(), string(procs[0].ID), "Collectors not ready should be listed")
+
+	ready = true
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", http.NoBody))
+	assert.Equal(t, http.StatusOK, rec.Code, "All collectors should be ready")
+}
@@ -0,0 +1,265 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryPath is the path prefix of the history of collectors by name.
+const HistoryPath = "/debug/collectors/"
+
+var ErrInvalidSelector = errors.New("Invalid label selector")
+
+// historyCommit is a commit retained by History.
+type historyCommit struct {
+	time    time.Time
+	samples []Sample
+	size    int
+}
+
+// History retains the samples of the last commits of a collector to look up
+// what PromWatch emitted in the past, e.g. when a value is disputed. It is a
+// ring of at most max commits, so memory usage is bounded by max times the
+// size of a commit.
+type History struct {
+	sync.Mutex
+
+	max     int
+	commits []historyCommit
+	// next is the index the next commit is written to once the ring is
+	// full.
+	next int
+	size int
+}
+
+// NewHistory returns a History retaining the last max commits.
+func NewHistory(max int) *History {
+	return &History{max: max, commits: make([]historyCommit, 0, max)}
+}
+
+// sampleSize estimates the memory used by a sample in bytes.
+func sampleSize(s Sample) int {
+	// value and timestamp
+	size := len(s.Name) + 16
+	for _, l := range s.Labels {
+		size += len(l.Name) + len(l.Value)
+	}
+
+	return size
+}
+
+// add retains the samples of a commit at t, evicting the oldest commit if
+// the ring is full. It returns the estimated size of all retained commits in
+// bytes.
+func (h *History) add(t time.Time, samples []Sample) int {
+	c := historyCommit{time: t, samples: samples}
+	for _, s := range samples {
+		c.size += sampleSize(s)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if len(h.commits) < h.max {
+		h.commits = append(h.commits, c)
+	} else {
+		h.size -= h.commits[h.next].size
+		h.commits[h.next] = c
+		h.next = (h.next + 1) % h.max
+	}
+	h.size += c.size
+
+	return h.size
+}
+
+// historySample is a retained sample as returned by History.query.
+type historySample struct {
+	Commit    time.Time         `json:"commit"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Value     string            `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+// query returns the retained samples of commits at or after since in commit
+// order. Samples have to be of the given metric, if not empty, and match all
+// matchers.
+func (h *History) query(metric string, matchers []labelMatcher, since time.Time) []historySample {
+	h.Lock()
+	defer h.Unlock()
+
+	found := []historySample{}
+	for i := range h.commits {
+		// The oldest commit is at next once the ring is full.
+		c := h.commits[(h.next+i)%len(h.commits)]
+		if c.time.Before(since) {
+			continue
+		}
+
+		for _, s := range c.samples {
+			if metric != "" && s.Name != metric {
+				continue
+			}
+			if !matchLabels(s.Labels, matchers) {
+				continue
+			}
+
+			labels := make(map[string]string, len(s.Labels))
+			for _, l := range s.Labels {
+				labels[l.Name] = l.Value
+			}
+			found = append(found, historySample{
+				Commit:    c.time,
+				Name:      s.Name,
+				Labels:    labels,
+				Value:     strconv.FormatFloat(s.Value, 'f', -1, 64),
+				Timestamp: s.Timestamp,
+			})
+		}
+	}
+
+	return found
+}
+
+// labelMatcher matches the value of a label by equality or regular expression,
+// like the matchers of PromQL selectors.
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (m labelMatcher) matches(value string) bool {
+	switch m.op {
+	case "=":
+		return value == m.value
+	case "!=":
+		return value != m.value
+	case "=~":
+		return m.re.MatchString(value)
+	case "!~":
+		return !m.re.MatchString(value)
+	}
+
+	return false
+}
+
+// matchLabels returns true if labels match all matchers. Missing labels have
+// the empty value.
+func matchLabels(labels []Label, matchers []labelMatcher) bool {
+	for _, m := range matchers {
+		value := ""
+		for _, l := range labels {
+			if l.Name == m.name {
+				value = l.Value
+				break
+			}
+		}
+		if !m.matches(value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchMatcher matches the next matcher of a selector and the separating comma.
+var matchMatcher = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*"((?:[^"\\]|\\.)*)"\s*(?:,|$)`)
+
+// parseSelector parses a PromQL like label selector, e.g.
+// {volume_id="vol-1",region=~"us-.*"}, the braces are optional. Regular
+// expressions are anchored.
+func parseSelector(selector string) ([]labelMatcher, error) {
+	s := strings.TrimSpace(selector)
+	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+		s = s[1 : len(s)-1]
+	}
+
+	matchers := []labelMatcher{}
+	for strings.TrimSpace(s) != "" {
+		m := matchMatcher.FindStringSubmatch(s)
+		if m == nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSelector, selector)
+		}
+		s = s[len(m[0]):]
+
+		value, err := strconv.Unquote(`"` + m[3] + `"`)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrInvalidSelector, selector, err)
+		}
+		matcher := labelMatcher{name: m[1], op: m[2], value: value}
+		if matcher.op == "=~" || matcher.op == "!~" {
+			matcher.re, err = regexp.Compile("^(?:" + value + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %s", ErrInvalidSelector, selector, err)
+			}
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers, nil
+}
+
+// parseSince parses the since query parameter given as Unix timestamp in
+// seconds or RFC 3339 time. The empty string is the zero time.
+func parseSince(since string) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if ts, err := strconv.ParseFloat(since, 64); err == nil {
+		sec := int64(ts)
+		return time.Unix(sec, int64((ts-float64(sec))*1e9)), nil
+	}
+
+	return time.Parse(time.RFC3339, since)
+}
+
+// historyHandler serves /debug/collectors/<name>/history with the retained
+// samples of the collectors with the given named path, see exposePath, keyed
+// by collector ID. The metric, labels, and since query parameters filter the
+// samples by metric name, label selector, and commit time.
+func historyHandler(procs []*CollectorProc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, HistoryPath), "/history")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		q := r.URL.Query()
+		matchers, err := parseSelector(q.Get("labels"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		since, err := parseSince(q.Get("since"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		found := map[CollectorID][]historySample{}
+		for _, p := range procs {
+			if p.History == nil || exposePath(p.Name) != name {
+				continue
+			}
+			found[p.ID] = p.History.query(q.Get("metric"), matchers, since)
+		}
+		if len(found) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(found)
+	})
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func historySamples(value float64, volumes ...string) []Sample {
+	samples := []Sample{}
+	for _, v := range volumes {
+		samples = append(samples, Sample{
+			Name:      "promwatch_aws_ebs_volume_read_bytes_sum",
+			Labels:    []Label{{"volume_id", v}},
+			Value:     value,
+			Timestamp: int64(value) * 1000,
+		})
+	}
+	return samples
+}
+
+func TestHistoryEviction(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := NewHistory(2)
+
+	commit := func(i int, volumes ...string) int {
+		return h.add(start.Add(time.Duration(i)*time.Minute), historySamples(float64(i), volumes...))
+	}
+	one := commit(1, "vol-a")
+	assert.Equal(t, sampleSize(historySamples(1, "vol-a")[0]), one)
+	two := commit(2, "vol-a", "vol-b")
+	assert.Equal(t, 3*one, two, "Sizes of all retained commits should be summed")
+	assert.Equal(t, 4*one, commit(3, "vol-a", "vol-b"), "Sizes of evicted commits should be subtracted")
+
+	values := []string{}
+	for _, s := range h.query("", nil, time.Time{}) {
+		values = append(values, s.Value)
+	}
+	assert.Equal(t, []string{"2", "2", "3", "3"}, values, "Only the last commits should be retained in commit order")
+
+	commit(4, "vol-c")
+	found := h.query("", nil, time.Time{})
+	assert.Len(t, found, 3)
+	assert.Equal(t, "3", found[0].Value, "The ring should keep commit order after wrapping")
+	assert.Equal(t, "4", found[2].Value)
+}
+
+func TestParseSelector(t *testing.T) {
+	labels := []Label{{"volume_id", "vol-a"}, {"region", "us-east-1"}}
+
+	cases := []struct {
+		selector string
+		matches  bool
+		message  string
+	}{
+		{``, true, "Empty selectors should match everything"},
+		{`{volume_id="vol-a"}`, true, "Equal labels should match"},
+		{`volume_id="vol-b"`, false, "Different labels should not match"},
+		{`{volume_id!="vol-b", region=~"us-.*"}`, true, "All matchers should match"},
+		{`{region=~"us"}`, false, "Regular expressions should be anchored"},
+		{`{region!~"eu-.*"}`, true, "Negated regular expressions should match"},
+		{`{missing=""}`, true, "Missing labels should have the empty value"},
+		{`{volume_id="vol-a,\"b\""}`, false, "Quoted values should be unescaped"},
+	}
+
+	for _, c := range cases {
+		matchers, err := parseSelector(c.selector)
+		assert.Nil(t, err, c.message)
+		assert.Equal(t, c.matches, matchLabels(labels, matchers), c.message)
+	}
+
+	for _, s := range []string{`{volume_id=vol-a}`, `{volume_id=="a"}`, `{region=~"("}`, `{a="1" b="2"}`} {
+		_, err := parseSelector(s)
+		assert.ErrorIs(t, err, ErrInvalidSelector, s)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:           "ebs",
+		Name:           "Volumes",
+		HistoryCommits: 2,
+		MetricStats:    []MetricStat{{MetricName: "VolumeReadBytes", Stat: "Sum"}},
+	}))
+	b.store = NewStore(0)
+	b.history = NewHistory(b.config.HistoryCommits)
+	b.withTime(&testTime{now: &now})
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-a")},
+		{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-b")},
+	}
+
+	for i := 1; i <= 3; i++ {
+		index := NewResourceIndexFromTagMapping(&resources, id)
+		b.makeQueries(index, b.namespace, defaultMetricDimension(b.dimension, b.resourcePrefix))
+		results := []*cloudwatch.MetricDataResult{}
+		for _, queries := range index.Queries {
+			results = append(results, &cloudwatch.MetricDataResult{
+				Id:         queries[0].Id,
+				Values:     []*float64{aws.Float64(float64(i))},
+				Timestamps: []*time.Time{aws.Time(now)},
+			})
+		}
+		index.AddResults(&results)
+		b.storeResults(index)
+		now = now.Add(time.Minute)
+	}
+	assert.Equal(t, float64(b.history.size), testutil.ToFloat64(b.Telemetry().HistoryBytes), "History memory should be reported")
+
+	procs := []*CollectorProc{{ID: "a", Name: b.config.Name, History: b.history}}
+	get := func(query url.Values) (int, map[CollectorID][]historySample) {
+		rec := httptest.NewRecorder()
+		historyHandler(procs).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, HistoryPath+"volumes/history?"+query.Encode(), http.NoBody))
+		var got map[CollectorID][]historySample
+		if rec.Code == http.StatusOK {
+			assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &got))
+		}
+		return rec.Code, got
+	}
+
+	code, got := get(url.Values{
+		"metric": {"promwatch_aws_ebs_volume_read_bytes_sum"},
+		"labels": {`{volume_id=~"vol-(a|c)"}`},
+	})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, got["a"], 2, "Matching samples of all retained commits should be returned")
+	for i, s := range got["a"] {
+		assert.Equal(t, "vol-a", s.Labels["volume_id"])
+		assert.Equal(t, []string{"2", "3"}[i], s.Value)
+	}
+
+	_, got = get(url.Values{"since": {"2021-01-01T00:02:00Z"}})
+	assert.Len(t, got["a"], 2, "Commits before since should be skipped")
+	assert.Equal(t, "3", got["a"][0].Value)
+
+	_, got = get(url.Values{"metric": {"unknown"}})
+	assert.Empty(t, got["a"])
+
+	code, _ = get(url.Values{"labels": {`{volume_id=vol-a}`}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get(url.Values{"since": {"yesterday"}})
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	rec := httptest.NewRecorder()
+	historyHandler(procs).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, HistoryPath+"unknown/history", http.NoBody))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,362 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricStreamID identifies the store of ingested metric stream samples
+// alongside the collector stores.
+const MetricStreamID = CollectorID("metric-stream")
+
+// MetricStreamTTL is the duration after which series not updated by the metric
+// stream anymore are dropped.
+const MetricStreamTTL = 15 * time.Minute
+
+// MaxIngestRequestSize is the maximum size of Firehose request bodies as
+// received, Firehose sends at most 64 MiB per request.
+const MaxIngestRequestSize = 64 << 20
+
+// MaxIngestDecodedSize is the maximum size of gzip encoded Firehose request
+// bodies after decompression.
+const MaxIngestDecodedSize = 256 << 20
+
+var ErrInvalidAccessKey = errors.New("Invalid Firehose access key")
+var ErrIngestRequestTooLarge = errors.New("Firehose request too large")
+var ErrUnsupportedStreamFormat = errors.New("Unsupported metric stream output format, only JSON is supported")
+
+// streamTypes maps CloudWatch namespaces shared by several collector types, or
+// of collector types not in collectorTypes, to the type used in metric names.
+var streamTypes = map[string]string{
+	"AWS/AutoScaling": "asg",
+	"AWS/RDS":         "rds",
+}
+
+// firehoseRequest is the body of requests sent by Kinesis Data Firehose to
+// HTTP endpoints.
+type firehoseRequest struct {
+	RequestID string `json:"requestId"`
+	Timestamp int64  `json:"timestamp"`
+	Records   []struct {
+		Data string `json:"data"`
+	} `json:"records"`
+}
+
+// firehoseResponse is the body Kinesis Data Firehose expects in responses.
+type firehoseResponse struct {
+	RequestID    string `json:"requestId"`
+	Timestamp    int64  `json:"timestamp"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+// metricStreamRecord is a single metric of a CloudWatch metric stream in JSON
+// output format.
+type metricStreamRecord struct {
+	Namespace  string            `json:"namespace"`
+	MetricName string            `json:"metric_name"`
+	Dimensions map[string]string `json:"dimensions"`
+	Timestamp  int64             `json:"timestamp"`
+	Value      struct {
+		Max   float64 `json:"max"`
+		Min   float64 `json:"min"`
+		Sum   float64 `json:"sum"`
+		Count float64 `json:"count"`
+	} `json:"value"`
+}
+
+// StreamIngester receives CloudWatch metric stream records delivered by
+// Kinesis Data Firehose and keeps the latest sample of every series in a Store
+// to be served alongside the collector metrics.
+type StreamIngester struct {
+	sync.Mutex
+
+	accessKey      string
+	maxRequestSize int64
+	maxDecodedSize int64
+	store          Store
+	series         map[string]Sample
+	time           Time
+}
+
+// NewStreamIngester returns a StreamIngester. Requests have to carry the
+// access key configured for the Firehose HTTP endpoint unless accessKey is
+// empty.
+func NewStreamIngester(accessKey string) *StreamIngester {
+	return &StreamIngester{
+		accessKey:      accessKey,
+		maxRequestSize: MaxIngestRequestSize,
+		maxDecodedSize: MaxIngestDecodedSize,
+		store:          NewStore(0),
+		series:         map[string]Sample{},
+		time:           &realTime{},
+	}
+}
+
+// Proc returns a CollectorProc making the store of ingested samples available
+// to the metrics handler.
+func (i *StreamIngester) Proc() *CollectorProc {
+	return &CollectorProc{
+		ID:    MetricStreamID,
+		Store: i.store,
+	}
+}
+
+// ServeHTTP implements the Kinesis Data Firehose HTTP endpoint delivery
+// protocol.
+func (i *StreamIngester) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := i.parseRequest(w, r)
+	resp := firehoseResponse{
+		RequestID: req.RequestID,
+		Timestamp: i.time.Now().UnixMilli(),
+	}
+
+	status := http.StatusOK
+	if err == nil {
+		var samples []Sample
+		samples, err = req.samples()
+		i.add(samples)
+	}
+
+	if err != nil {
+		Logger.Warnw("metric stream ingestion failed", "error", err)
+		resp.ErrorMessage = err.Error()
+		status = http.StatusBadRequest
+		if errors.Is(err, ErrInvalidAccessKey) {
+			status = http.StatusUnauthorized
+		}
+		if errors.Is(err, ErrIngestRequestTooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// parseRequest checks the access key of the request and decodes its body. The
+// body is limited to maxRequestSize bytes as received and maxDecodedSize bytes
+// after decompression.
+func (i *StreamIngester) parseRequest(w http.ResponseWriter, r *http.Request) (*firehoseRequest, error) {
+	req := &firehoseRequest{RequestID: r.Header.Get("X-Amz-Firehose-Request-Id")}
+	if i.accessKey != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Amz-Firehose-Access-Key")), []byte(i.accessKey)) != 1 {
+		return req, ErrInvalidAccessKey
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, i.maxRequestSize)
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return req, tooLarge(err)
+		}
+		defer gz.Close()
+		body = &cappedReader{r: gz, n: i.maxDecodedSize}
+	}
+
+	if err := json.NewDecoder(body).Decode(req); err != nil {
+		return req, fmt.Errorf("Can not parse Firehose request: %w", tooLarge(err))
+	}
+
+	return req, nil
+}
+
+// tooLarge returns ErrIngestRequestTooLarge for errors of bodies exceeding the
+// maximum request size and err otherwise.
+func tooLarge(err error) error {
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return fmt.Errorf("%w: more than %d bytes", ErrIngestRequestTooLarge, maxBytes.Limit)
+	}
+
+	return err
+}
+
+// cappedReader reads from r and fails with ErrIngestRequestTooLarge once more
+// than n bytes were read.
+type cappedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > c.n+1 {
+		p = p[:c.n+1]
+	}
+	n, err := c.r.Read(p)
+	c.n -= int64(n)
+	if c.n < 0 {
+		return 0, fmt.Errorf("%w: decompressed body exceeds the limit", ErrIngestRequestTooLarge)
+	}
+
+	return n, err
+}
+
+// samples decodes all records of the request and parses them into samples.
+// Records in the OpenTelemetry output formats, which are binary protocol
+// buffers instead of JSON objects, are rejected with
+// ErrUnsupportedStreamFormat.
+func (f *firehoseRequest) samples() ([]Sample, error) {
+	samples := []Sample{}
+	for _, r := range f.Records {
+		data, err := base64.StdEncoding.DecodeString(r.Data)
+		if err != nil {
+			return samples, fmt.Errorf("Can not decode Firehose record: %w", err)
+		}
+
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] != '{' {
+			return samples, ErrUnsupportedStreamFormat
+		}
+
+		s, err := parseMetricStreamRecords(data)
+		samples = append(samples, s...)
+		if err != nil {
+			return samples, err
+		}
+	}
+
+	return samples, nil
+}
+
+// parseMetricStreamRecords parses newline delimited metric stream records in
+// JSON output format into samples named the same way as the samples produced
+// by collectors.
+func parseMetricStreamRecords(data []byte) ([]Sample, error) {
+	samples := []Sample{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var r metricStreamRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return samples, fmt.Errorf("Can not parse metric stream record: %w", err)
+		}
+
+		samples = append(samples, r.samples()...)
+	}
+
+	return samples, scanner.Err()
+}
+
+// samples converts the statistics of the record to samples.
+func (r *metricStreamRecord) samples() []Sample {
+	names := make([]string, 0, len(r.Dimensions))
+	for n := range r.Dimensions {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	labels := make([]Label, 0, len(names))
+	for _, n := range names {
+		labels = append(labels, Label{Name: dimensionLabel(n), Value: r.Dimensions[n]})
+	}
+
+	stats := []struct {
+		stat  string
+		value float64
+	}{
+		{"Maximum", r.Value.Max},
+		{"Minimum", r.Value.Min},
+		{"Sum", r.Value.Sum},
+		{"SampleCount", r.Value.Count},
+	}
+	if r.Value.Count > 0 {
+		stats = append(stats, struct {
+			stat  string
+			value float64
+		}{"Average", r.Value.Sum / r.Value.Count})
+	}
+
+	samples := make([]Sample, 0, len(stats))
+	for _, s := range stats {
+		samples = append(samples, Sample{
+			Name: fmt.Sprintf(
+				"promwatch_aws_%s_%s_%s",
+				streamType(r.Namespace),
+				snakeMetricName(r.MetricName),
+				toSnakeCase(sanitize(s.stat))),
+			Labels:    labels,
+			Value:     s.value,
+			Timestamp: r.Timestamp,
+		})
+	}
+
+	return samples
+}
+
+// streamType resolves a CloudWatch namespace to the collector type used in
+// metric names. Namespaces in streamTypes resolve to their type there, other
+// namespaces of several collector types to the first of them in sorted order
+// so the names do not change between records. Namespaces without a collector
+// type are converted to snake case.
+func streamType(namespace string) string {
+	if name, ok := streamTypes[namespace]; ok {
+		return name
+	}
+
+	names := []string{}
+	for name, t := range collectorTypes {
+		if t.Namespace == namespace {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return names[0]
+	}
+
+	return toSnakeCase(sanitize(strings.TrimPrefix(namespace, "AWS/")))
+}
+
+// add updates the series with the samples, drops series that have not been
+// updated within the MetricStreamTTL, and commits the result to the store.
+func (i *StreamIngester) add(samples []Sample) {
+	if len(samples) == 0 {
+		return
+	}
+
+	i.Lock()
+	defer i.Unlock()
+
+	for _, s := range samples {
+		key := s.Name + "\xff" + labelsKey(s.Labels)
+		if prev, ok := i.series[key]; ok && prev.Timestamp > s.Timestamp {
+			continue
+		}
+		i.series[key] = s
+	}
+
+	cutoff := i.time.Now().Add(-MetricStreamTTL).UnixMilli()
+	keys := make([]string, 0, len(i.series))
+	for k, s := range i.series {
+		if s.Timestamp < cutoff {
+			delete(i.series, k)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := bytes.Buffer{}
+	for _, k := range keys {
+		buf.WriteString(i.series[k].String())
+	}
+	i.store.Add(buf.String())
+	i.store.Commit()
+}
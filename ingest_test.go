@@ -0,0 +1,193 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const metricStreamPayload = `{"metric_stream_name":"promwatch","account_id":"123456789012","region":"us-east-1","namespace":"AWS/SQS","metric_name":"NumberOfMessagesSent","dimensions":{"QueueName":"orders"},"timestamp":1611929698000,"value":{"max":4.0,"min":1.0,"sum":10.0,"count":4.0},"unit":"Count"}
+{"metric_stream_name":"promwatch","account_id":"123456789012","region":"us-east-1","namespace":"AWS/Lambda","metric_name":"Errors","dimensions":{},"timestamp":1611929698000,"value":{"max":0.0,"min":0.0,"sum":0.0,"count":0.0},"unit":"Count"}
+`
+
+func firehoseBody(t *testing.T, records ...string) []byte {
+	req := map[string]interface{}{
+		"requestId": "ed4acda5-034f-9f42-bba1-f29aea6d7d8f",
+		"timestamp": 1611929700000,
+	}
+	data := []map[string]string{}
+	for _, r := range records {
+		data = append(data, map[string]string{"data": base64.StdEncoding.EncodeToString([]byte(r))})
+	}
+	req["records"] = data
+
+	b, err := json.Marshal(req)
+	assert.Nil(t, err)
+
+	return b
+}
+
+func TestParseMetricStreamRecords(t *testing.T) {
+	samples, err := parseMetricStreamRecords([]byte(metricStreamPayload))
+	assert.Nil(t, err)
+
+	labels := []Label{{Name: "queue_name", Value: "orders"}}
+	expected := []Sample{
+		{Name: "promwatch_aws_sqs_number_of_messages_sent_maximum", Labels: labels, Value: 4, Timestamp: 1611929698000},
+		{Name: "promwatch_aws_sqs_number_of_messages_sent_minimum", Labels: labels, Value: 1, Timestamp: 1611929698000},
+		{Name: "promwatch_aws_sqs_number_of_messages_sent_sum", Labels: labels, Value: 10, Timestamp: 1611929698000},
+		{Name: "promwatch_aws_sqs_number_of_messages_sent_sample_count", Labels: labels, Value: 4, Timestamp: 1611929698000},
+		{Name: "promwatch_aws_sqs_number_of_messages_sent_average", Labels: labels, Value: 2.5, Timestamp: 1611929698000},
+		{Name: "promwatch_aws_lambda_errors_maximum", Labels: []Label{}, Timestamp: 1611929698000},
+		{Name: "promwatch_aws_lambda_errors_minimum", Labels: []Label{}, Timestamp: 1611929698000},
+		{Name: "promwatch_aws_lambda_errors_sum", Labels: []Label{}, Timestamp: 1611929698000},
+		{Name: "promwatch_aws_lambda_errors_sample_count", Labels: []Label{}, Timestamp: 1611929698000},
+	}
+	assert.Equal(t, expected, samples, "Records should be parsed into samples named like collector samples")
+
+	_, err = parseMetricStreamRecords([]byte("{invalid"))
+	assert.NotNil(t, err, "Invalid records should return an error")
+}
+
+func TestStreamIngester(t *testing.T) {
+	now := time.Unix(1611929700, 0)
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	_, _ = gz.Write(firehoseBody(t, metricStreamPayload))
+	_ = gz.Close()
+
+	cases := []struct {
+		body      []byte
+		gzip      bool
+		accessKey string
+		status    int
+		contains  string
+		message   string
+	}{
+		{firehoseBody(t, metricStreamPayload), false, "secret", http.StatusOK,
+			`promwatch_aws_sqs_number_of_messages_sent_sum{queue_name="orders"} 10.000000 1611929698000`,
+			"Records should be served from the store"},
+		{gzipped.Bytes(), true, "secret", http.StatusOK,
+			`promwatch_aws_sqs_number_of_messages_sent_average{queue_name="orders"} 2.500000 1611929698000`,
+			"Gzip encoded requests should be accepted"},
+		{firehoseBody(t, metricStreamPayload), false, "wrong", http.StatusUnauthorized, "",
+			"Requests with an invalid access key should be rejected"},
+		{[]byte("{invalid"), false, "secret", http.StatusBadRequest, "",
+			"Invalid requests should be rejected"},
+		{firehoseBody(t, "{invalid"), false, "secret", http.StatusBadRequest, "",
+			"Invalid records should be rejected"},
+		{firehoseBody(t, "\x0a\x2b\x0a\x29otel"), false, "secret", http.StatusBadRequest, "",
+			"Records in the OpenTelemetry output formats should be rejected"},
+	}
+
+	for _, c := range cases {
+		i := NewStreamIngester("secret")
+		i.time = &testTime{now: &now}
+
+		req := httptest.NewRequest(http.MethodPost, "/ingest", bytes.NewReader(c.body))
+		req.Header.Set("X-Amz-Firehose-Request-Id", "ed4acda5-034f-9f42-bba1-f29aea6d7d8f")
+		req.Header.Set("X-Amz-Firehose-Access-Key", c.accessKey)
+		if c.gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		rec := httptest.NewRecorder()
+		i.ServeHTTP(rec, req)
+
+		assert.Equal(t, c.status, rec.Code, c.message)
+
+		var resp firehoseResponse
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &resp), c.message)
+		assert.Equal(t, "ed4acda5-034f-9f42-bba1-f29aea6d7d8f", resp.RequestID, c.message)
+		assert.Equal(t, now.UnixMilli(), resp.Timestamp, c.message)
+
+		assert.Contains(t, i.Proc().Store.String(), c.contains, c.message)
+	}
+}
+
+func TestStreamIngesterLimits(t *testing.T) {
+	body := firehoseBody(t, metricStreamPayload)
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	_, _ = gz.Write(body)
+	_ = gz.Close()
+
+	cases := []struct {
+		body           []byte
+		gzip           bool
+		maxRequestSize int64
+		maxDecodedSize int64
+		status         int
+		message        string
+	}{
+		{body, false, int64(len(body)), MaxIngestDecodedSize, http.StatusOK,
+			"Requests within the limit should be accepted"},
+		{body, false, int64(len(body)) - 1, MaxIngestDecodedSize, http.StatusRequestEntityTooLarge,
+			"Requests over the limit should be rejected"},
+		{gzipped.Bytes(), true, MaxIngestRequestSize, int64(len(body)), http.StatusOK,
+			"Requests decompressed within the limit should be accepted"},
+		{gzipped.Bytes(), true, int64(gzipped.Len()) / 2, MaxIngestDecodedSize, http.StatusRequestEntityTooLarge,
+			"Compressed requests over the limit should be rejected"},
+		{gzipped.Bytes(), true, MaxIngestRequestSize, int64(len(body)) - 1, http.StatusRequestEntityTooLarge,
+			"Requests decompressed over the limit should be rejected"},
+	}
+
+	for _, c := range cases {
+		i := NewStreamIngester("")
+		i.maxRequestSize = c.maxRequestSize
+		i.maxDecodedSize = c.maxDecodedSize
+
+		req := httptest.NewRequest(http.MethodPost, "/ingest", bytes.NewReader(c.body))
+		if c.gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		rec := httptest.NewRecorder()
+		i.ServeHTTP(rec, req)
+
+		assert.Equal(t, c.status, rec.Code, c.message)
+	}
+}
+
+func TestStreamType(t *testing.T) {
+	cases := []struct {
+		namespace string
+		expected  string
+	}{
+		{"AWS/RDS", "rds"},
+		{"AWS/AutoScaling", "asg"},
+		{"AWS/SQS", "sqs"},
+		{"AWS/DocDB", "docdb"},
+		{"AWS/Kafka", "msk"},
+		{"AWS/ElastiCache", "ec"},
+		{"AWS/Usage", "usage"},
+	}
+
+	for _, c := range cases {
+		// Several collector types share namespaces, resolving them has to
+		// be stable across records.
+		for n := 0; n < 20; n++ {
+			assert.Equal(t, c.expected, streamType(c.namespace), c.namespace)
+		}
+	}
+}
+
+func TestStreamIngesterTTL(t *testing.T) {
+	now := time.UnixMilli(1611929698000)
+	i := NewStreamIngester("")
+	i.time = &testTime{now: &now}
+
+	i.add([]Sample{{Name: "old", Timestamp: now.UnixMilli()}})
+	now = now.Add(MetricStreamTTL + time.Minute)
+	i.add([]Sample{{Name: "new", Timestamp: now.UnixMilli()}})
+
+	out := i.store.String()
+	assert.NotContains(t, out, "old{", "Series older than the TTL should be dropped")
+	assert.Contains(t, out, "new{", "Recent series should be kept")
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+var ErrInvalidInstanceLabel = errors.New("Invalid instance label")
+
+// instanceLabels are added to every series of the collectors to tell apart the
+// series of multiple PromWatch instances feeding the same Prometheus, see
+// PromWatchConfig.InstanceLabel. They are set on start and read only after.
+var instanceLabels []Label
+
+// matchLabelName matches valid Prometheus label names.
+var matchLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// newInstanceLabels returns the labels of the configured instance label
+// ordered by name. Names have to be valid label names not reserved for
+// internal use by a __ prefix.
+func newInstanceLabels(m map[string]string) ([]Label, error) {
+	labels := make([]Label, 0, len(m))
+	for name, value := range m {
+		if !matchLabelName.MatchString(name) || (len(name) > 1 && name[:2] == "__") {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidInstanceLabel, name)
+		}
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	return labels, nil
+}
+
+// withInstanceLabels adds the instance labels to labels. Instance labels take
+// precedence over labels of the same name, e.g. merge tags, as duplicate label
+// names are invalid.
+func withInstanceLabels(labels []Label) []Label {
+	if len(instanceLabels) == 0 {
+		return labels
+	}
+
+	taken := map[string]struct{}{}
+	for _, l := range instanceLabels {
+		taken[l.Name] = struct{}{}
+	}
+
+	out := make([]Label, 0, len(labels)+len(instanceLabels))
+	for _, l := range labels {
+		if _, ok := taken[l.Name]; ok {
+			continue
+		}
+		out = append(out, l)
+	}
+
+	return append(out, instanceLabels...)
+}
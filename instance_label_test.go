@@ -0,0 +1,64 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewInstanceLabels(t *testing.T) {
+	labels, err := newInstanceLabels(map[string]string{"promwatch_instance": "account-a", "env": "prod"})
+	assert.Nil(t, err)
+	assert.Equal(t, []Label{{"env", "prod"}, {"promwatch_instance", "account-a"}}, labels, "Labels should be ordered by name")
+
+	for _, name := range []string{"", "promwatch-instance", "0instance", "__name__"} {
+		_, err := newInstanceLabels(map[string]string{name: "a"})
+		assert.ErrorIs(t, err, ErrInvalidInstanceLabel, name)
+	}
+}
+
+func TestStoreResultsInstanceLabel(t *testing.T) {
+	instanceLabels = []Label{{"promwatch_instance", "account-a"}}
+	defer func() { instanceLabels = nil }()
+
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:        "ebs",
+		MergeTags:   []string{"promwatch_instance"},
+		MetricStats: []MetricStat{{MetricName: "VolumeReadBytes", Stat: "Sum"}, {MetricName: "VolumeWriteBytes", Stat: "Sum"}},
+	}))
+	b.store = NewStore(0)
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-a")},
+		{
+			ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-b"),
+			Tags:        []*tagging.Tag{{Key: aws.String("promwatch_instance"), Value: aws.String("tag")}},
+		},
+	}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	b.makeQueries(index, b.namespace, defaultMetricDimension(b.dimension, b.resourcePrefix))
+	results := []*cloudwatch.MetricDataResult{}
+	for _, queries := range index.Queries {
+		for _, q := range queries {
+			results = append(results, &cloudwatch.MetricDataResult{
+				Id:         q.Id,
+				Values:     []*float64{aws.Float64(1)},
+				Timestamps: []*time.Time{aws.Time(time.Unix(1, 0))},
+			})
+		}
+	}
+	index.AddResults(&results)
+	b.storeResults(index)
+
+	lines := strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n")
+	assert.Len(t, lines, 4)
+	for _, l := range lines {
+		assert.Equal(t, 1, strings.Count(l, `promwatch_instance=`), "Every series should carry the instance label once")
+		assert.Contains(t, l, `promwatch_instance="account-a"}`, "The instance label should take precedence over merge tags")
+	}
+}
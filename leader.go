@@ -0,0 +1,212 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultLeaderKey is the key of the leader lock.
+const DefaultLeaderKey = "leader"
+
+// DefaultLeaderTTL is the default number of seconds the leader lock is held
+// without being renewed.
+const DefaultLeaderTTL = 30
+
+var ErrLeaderElectionBackend = errors.New("Leader election requires the redis store backend")
+
+// LeaderElectionConfig configures leader election between replicas.
+type LeaderElectionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Key is the name of the lock, prefixed with the Redis key prefix.
+	Key string `yaml:"key"`
+	// TTL is the number of seconds the lock is held without being renewed.
+	// The lock is renewed every third of the TTL.
+	TTL int `yaml:"ttl"`
+}
+
+// LockBackend holds a lock with expiry on behalf of a holder identified by id.
+type LockBackend interface {
+	// Acquire takes the lock for id if it is not held. It returns false if
+	// the lock is held by another holder.
+	Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error)
+	// Renew extends the lock if it is still held by id. It returns false if
+	// the lock expired or is held by another holder.
+	Renew(ctx context.Context, id string, ttl time.Duration) (bool, error)
+	// Release gives up the lock if it is held by id.
+	Release(ctx context.Context, id string) error
+}
+
+// leader is consulted by collectors before polling AWS if set, see
+// BaseCollector.collectIfActive. Without leader election every replica is
+// leader.
+var leader *LeaderElector
+
+// isLeader returns true if this replica is supposed to poll AWS.
+func isLeader() bool {
+	return leader == nil || leader.IsLeader()
+}
+
+// LeaderElector runs the leader election state machine. Followers try to
+// acquire the lock every interval, the leader renews it every interval and
+// steps down as soon as renewing fails.
+type LeaderElector struct {
+	sync.Mutex
+
+	backend  LockBackend
+	id       string
+	ttl      time.Duration
+	isLeader bool
+}
+
+// NewLeaderElector returns a LeaderElector holding the lock of backend for ttl
+// under a unique ID of this replica.
+func NewLeaderElector(backend LockBackend, ttl time.Duration) *LeaderElector {
+	host, _ := os.Hostname()
+
+	return &LeaderElector{
+		backend: backend,
+		id:      fmt.Sprintf("%s/%s", host, uuid.New()),
+		ttl:     ttl,
+	}
+}
+
+// IsLeader returns true if the replica currently holds the lock.
+func (l *LeaderElector) IsLeader() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.isLeader
+}
+
+// step advances the state machine once. Followers try to acquire the lock, the
+// leader tries to renew it. Errors are treated like losing the lock, as the
+// lock might expire while the backend is unreachable.
+func (l *LeaderElector) step(ctx context.Context) {
+	// Only Start advances the state, so it can be read without holding the
+	// lock while waiting for the backend.
+	wasLeader := l.IsLeader()
+
+	var ok bool
+	var err error
+	if wasLeader {
+		ok, err = l.backend.Renew(ctx, l.id, l.ttl)
+	} else {
+		ok, err = l.backend.Acquire(ctx, l.id, l.ttl)
+	}
+	if err != nil {
+		Logger.Errorw("leader election failed", "id", l.id, "error", err)
+		ok = false
+	}
+
+	switch {
+	case ok && !wasLeader:
+		Logger.Infow("elected leader, starting to poll AWS", "id", l.id)
+	case !ok && wasLeader:
+		Logger.Warnw("lost leadership, stopping to poll AWS", "id", l.id)
+	}
+	l.setLeader(ok)
+}
+
+func (l *LeaderElector) setLeader(ok bool) {
+	l.Lock()
+	defer l.Unlock()
+	l.isLeader = ok
+	leaderState.Set(boolFloat(ok))
+}
+
+// Start takes the first step of the state machine, so collectors started
+// afterwards know whether they are leader right away, and keeps advancing it
+// every third of the TTL in the background until stop is closed. The lock is
+// released when stopped so another replica can take over right away.
+func (l *LeaderElector) Start(stop <-chan struct{}) {
+	l.stepWithTimeout()
+
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				l.stepWithTimeout()
+			case <-stop:
+				l.release()
+				return
+			}
+		}
+	}()
+}
+
+// stepWithTimeout takes a step limited to a third of the TTL, so a hanging
+// backend does not delay stepping down beyond the expiry of the lock.
+func (l *LeaderElector) stepWithTimeout() {
+	ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+	defer cancel()
+	l.step(ctx)
+}
+
+func (l *LeaderElector) release() {
+	if !l.IsLeader() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+	defer cancel()
+	if err := l.backend.Release(ctx, l.id); err != nil {
+		Logger.Errorw("releasing leader lock failed", "id", l.id, "error", err)
+	}
+	l.setLeader(false)
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// renewScript extends the expiry of the lock only if held by the caller.
+var renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseScript deletes the lock only if held by the caller.
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// RedisLock is a LockBackend holding the lock as Redis key with expiry.
+type RedisLock struct {
+	client redis.UniversalClient
+	key    string
+}
+
+// Lock returns a RedisLock of the prefixed key.
+func (r *RedisBackend) Lock(key string) *RedisLock {
+	return &RedisLock{client: r.client, key: r.prefix + key}
+}
+
+func (r *RedisLock) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	return r.client.SetNX(ctx, r.key, id, ttl).Result()
+}
+
+func (r *RedisLock) Renew(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	n, err := renewScript.Run(ctx, r.client, []string{r.key}, id, ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+func (r *RedisLock) Release(ctx context.Context, id string) error {
+	return releaseScript.Run(ctx, r.client, []string{r.key}, id).Err()
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLock is a LockBackend returning scripted results.
+type fakeLock struct {
+	ok       bool
+	err      error
+	calls    []string
+	released bool
+}
+
+func (f *fakeLock) Acquire(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	f.calls = append(f.calls, "acquire")
+	return f.ok, f.err
+}
+
+func (f *fakeLock) Renew(ctx context.Context, id string, ttl time.Duration) (bool, error) {
+	f.calls = append(f.calls, "renew")
+	return f.ok, f.err
+}
+
+func (f *fakeLock) Release(ctx context.Context, id string) error {
+	f.released = true
+	return nil
+}
+
+func TestLeaderElectorStep(t *testing.T) {
+	errUnreachable := errors.New("unreachable")
+	lock := &fakeLock{}
+	l := NewLeaderElector(lock, 30*time.Second)
+
+	steps := []struct {
+		ok       bool
+		err      error
+		call     string
+		expected bool
+		message  string
+	}{
+		{false, nil, "acquire", false, "Follower should stay follower while the lock is held"},
+		{true, nil, "acquire", true, "Follower should become leader when acquiring the lock"},
+		{true, nil, "renew", true, "Leader should stay leader when renewing the lock"},
+		{false, nil, "renew", false, "Leader should step down when renewing the lock fails"},
+		{true, nil, "acquire", true, "Follower should become leader again"},
+		{true, errUnreachable, "renew", false, "Leader should step down when the backend is unreachable"},
+		{true, errUnreachable, "acquire", false, "Follower should stay follower when the backend is unreachable"},
+	}
+
+	for _, s := range steps {
+		lock.ok, lock.err, lock.calls = s.ok, s.err, nil
+		l.step(context.Background())
+		assert.Equal(t, []string{s.call}, lock.calls, s.message)
+		assert.Equal(t, s.expected, l.IsLeader(), s.message)
+	}
+}
+
+func TestLeaderElectorRelease(t *testing.T) {
+	lock := &fakeLock{ok: true}
+	l := NewLeaderElector(lock, 30*time.Second)
+
+	l.release()
+	assert.False(t, lock.released, "Followers should not release the lock")
+
+	l.step(context.Background())
+	l.release()
+	assert.True(t, lock.released, "Leader should release the lock")
+	assert.False(t, l.IsLeader(), "Leader should step down after releasing the lock")
+}
+
+func TestRedisLock(t *testing.T) {
+	r, m := newTestRedisBackend(t)
+	ctx := context.Background()
+	lock := r.Lock(DefaultLeaderKey)
+	ttl := 30 * time.Second
+
+	ok, err := lock.Acquire(ctx, "a", ttl)
+	assert.Nil(t, err)
+	assert.True(t, ok, "Free lock should be acquired")
+	holder, _ := m.Get("promwatch:leader")
+	assert.Equal(t, "a", holder, "Lock should be held under the prefixed key")
+
+	ok, err = lock.Acquire(ctx, "b", ttl)
+	assert.Nil(t, err)
+	assert.False(t, ok, "Held lock should not be acquired by others")
+
+	ok, err = lock.Renew(ctx, "b", ttl)
+	assert.Nil(t, err)
+	assert.False(t, ok, "Lock should not be renewed by others")
+
+	m.FastForward(20 * time.Second)
+	ok, err = lock.Renew(ctx, "a", ttl)
+	assert.Nil(t, err)
+	assert.True(t, ok, "Lock should be renewed by the holder")
+	m.FastForward(20 * time.Second)
+	assert.True(t, m.Exists("promwatch:leader"), "Renewing should extend the expiry")
+
+	assert.Nil(t, lock.Release(ctx, "b"))
+	assert.True(t, m.Exists("promwatch:leader"), "Lock should not be released by others")
+	assert.Nil(t, lock.Release(ctx, "a"))
+	assert.False(t, m.Exists("promwatch:leader"), "Lock should be released by the holder")
+
+	ok, _ = lock.Acquire(ctx, "b", ttl)
+	assert.True(t, ok, "Released lock should be acquired by others")
+	m.FastForward(ttl)
+	ok, _ = lock.Renew(ctx, "b", ttl)
+	assert.False(t, ok, "Expired lock should not be renewed")
+	ok, _ = lock.Acquire(ctx, "a", ttl)
+	assert.True(t, ok, "Expired lock should be acquired by others")
+}
+
+func TestCollectIfLeader(t *testing.T) {
+	lock := &fakeLock{}
+	leader = NewLeaderElector(lock, 30*time.Second)
+	defer func() { leader = nil }()
+
+	client := &FakeClient{}
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"}))
+	b._client = client
+	b.store = NewStore(0)
+	dim := defaultMetricDimension(b.dimension, b.resourcePrefix)
+
+	assert.Nil(t, b.collectIfActive(context.Background(), nil, dim))
+	assert.Empty(t, client.Calls(), "Followers should not issue AWS calls")
+
+	lock.ok = true
+	leader.step(context.Background())
+	assert.Nil(t, b.collectIfActive(context.Background(), nil, dim))
+	assert.NotEmpty(t, client.Calls(), "Leader should issue AWS calls")
+}
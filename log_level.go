@@ -0,0 +1,53 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logCore is the core all loggers write to. It is enabled for all levels, the
+// loggers wrap it with their own level, see levelCore.
+var logCore zapcore.Core
+
+// levelCore gates a core by its own level, so loggers sharing the core can log
+// at different levels, e.g. collectors with a log level override.
+type levelCore struct {
+	zapcore.Core
+	level zapcore.LevelEnabler
+}
+
+func (c levelCore) Enabled(l zapcore.Level) bool {
+	return c.level.Enabled(l)
+}
+
+func (c levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return levelCore{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c levelCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(e.Level) {
+		return ce.AddCore(e, c)
+	}
+
+	return ce
+}
+
+// newLevelLogger returns a logger writing to logCore at level.
+func newLevelLogger(level zapcore.LevelEnabler) *zap.SugaredLogger {
+	return zap.New(levelCore{Core: logCore, level: level}).Sugar()
+}
+
+// logger returns the logger of the collector, the global Logger unless the
+// collector has its own log level configured.
+func (b *BaseCollector) logger() *zap.SugaredLogger {
+	if b.config.LogLevel == "" {
+		return Logger
+	}
+
+	b.logOnce.Do(func() {
+		b.log = newLevelLogger(Levels.Get(b.config.LogLevel))
+	})
+
+	return b.log
+}
@@ -0,0 +1,41 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestCollectorLogLevel(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	defer func(c zapcore.Core, l zapcore.Level) {
+		logCore = c
+		Logger = newLevelLogger(Level)
+		Level.SetLevel(l)
+	}(logCore, Level.Level())
+	logCore = core
+	Logger = newLevelLogger(Level)
+	Level.SetLevel(zapcore.WarnLevel)
+
+	verbose := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs", LogLevel: LogDebug}))
+	quiet := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs", LogLevel: LogError}))
+	global := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"}))
+
+	for _, b := range []*BaseCollector{verbose, quiet, global} {
+		b.logger().Debugw("debug", "level", b.config.LogLevel)
+		b.logger().Warnw("warn", "level", b.config.LogLevel)
+	}
+
+	got := []string{}
+	for _, e := range logs.AllUntimed() {
+		got = append(got, e.Message+" "+e.ContextMap()["level"].(string))
+	}
+	assert.Equal(t, []string{"debug debug", "warn debug", "warn "}, got,
+		"Collectors should log at their own level and the global level otherwise")
+	assert.Same(t, verbose.logger(), verbose.logger(), "Collector loggers should be created once")
+
+	assert.False(t, stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs", LogLevel: "verbose"})).Valid())
+}
@@ -4,24 +4,61 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/handlers"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 // Build time information that is being set during compile time. See the
-// Makefile for details.
+// Makefile for details. Builds without the Makefile, e.g. by go install, fall
+// back to the build info embedded by the Go toolchain, see fromBuildInfo.
 var (
 	Version = "none"
 	GitHash = "none"
 	Date    = "none"
 )
 
+// shortHashLength is the length of the git hash set from the build info, like
+// the abbreviated hash set by the Makefile.
+const shortHashLength = 7
+
+// fromBuildInfo returns version, git hash, and date with the values that were
+// not set during compile time taken from the build info. The module version is
+// only known for builds of a tagged module version, the VCS revision and time
+// only for builds of a checkout.
+func fromBuildInfo(info *debug.BuildInfo, version, hash, date string) (string, string, string) {
+	if info == nil {
+		return version, hash, date
+	}
+
+	if v := info.Main.Version; version == "none" && v != "" && v != "(devel)" {
+		version = strings.TrimPrefix(v, "v")
+	}
+	for _, s := range info.Settings {
+		switch {
+		case s.Key == "vcs.revision" && hash == "none" && s.Value != "":
+			hash = s.Value
+			if len(hash) > shortHashLength {
+				hash = hash[:shortHashLength]
+			}
+		case s.Key == "vcs.time" && date == "none" && s.Value != "":
+			date = s.Value
+		}
+	}
+
+	return version, hash, date
+}
+
 // Logger is the global zap.SugaredLogger.
 var Logger *zap.SugaredLogger
 
@@ -31,13 +68,17 @@ var Level = zap.NewAtomicLevel()
 // init is used to configure and instanciate the Logger to ensure logging is
 // available early.
 func init() {
-	logger := zap.New(zapcore.NewCore(
+	if info, ok := debug.ReadBuildInfo(); ok {
+		Version, GitHash, Date = fromBuildInfo(info, Version, GitHash, Date)
+	}
+
+	logCore = zapcore.NewCore(
 		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
 		zapcore.Lock(os.Stdout),
-		Level,
-	))
+		zapcore.DebugLevel,
+	)
 
-	Logger = logger.Sugar()
+	Logger = newLevelLogger(Level)
 	Logger.Infow("PromWatch starting",
 		"version", Version,
 		"githash", GitHash,
@@ -45,6 +86,17 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == DoctorCommand {
+		// The report is written to stdout, so logs go to stderr.
+		logCore = zapcore.NewCore(
+			zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+			zapcore.Lock(os.Stderr),
+			zapcore.DebugLevel,
+		)
+		Logger = newLevelLogger(Level)
+		os.Exit(runDoctor(os.Args[2:], os.Stdout, nil))
+	}
+
 	var configFile string
 	flag.StringVar(&configFile, "config", "promwatch.yml", "Config file")
 	flag.Parse()
@@ -54,19 +106,199 @@ func main() {
 
 	Level.SetLevel(Levels.Get(conf.LogLevel))
 
-	if len(conf.Collectors) == 0 {
+	if len(conf.Collectors) == 0 && !conf.MetricStreamIngest {
 		Logger.Warnf("No collectors defined, nothing to do.")
 		os.Exit(0)
 	}
 
 	// Capacity never has to be larger than the number of collectors defined
 	done := make(chan MetricCollector, len(conf.Collectors))
-	collectors := map[CollectorID]*CollectorProc{}
 
 	// Set up Prometheus metrics for PromWatch itself
-	InitializeTelemetry()
+	InitializeTelemetry(conf.TelemetryLabels)
+
+	// The instance labels are validated with the configuration.
+	instanceLabels, _ = newInstanceLabels(conf.InstanceLabel)
+
+	if conf.AuditLog.Path != "" {
+		auditLog, err = NewAuditLogger(conf.AuditLog)
+		dieOnError(err)
+	}
+
+	familyGuard = NewFamilyGuard(conf.FamilyCollision, conf.FamilyCollisionSuffix, registry)
+
+	// The collector metrics are gathered separately so the family guard
+	// only checks against the telemetry.
+	var gatherer prometheus.Gatherer = registry
+	collectorGatherers := concatGatherers{}
+	if conf.Exposition == ExpositionRegistry {
+		exposition = newRegistryExposition()
+		collectorGatherers = append(collectorGatherers, exposition)
+		gatherer = concatGatherers{exposition, registry}
+	}
+
+	// The telemetry is left out of the metrics path if served on its own
+	// listener.
+	served := gatherer
+	if conf.TelemetryListen != "" {
+		served = collectorGatherers
+	}
+
+	if conf.CloudWatchRateLimit > 0 {
+		chunkScheduler = NewChunkScheduler(conf.CloudWatchRateLimit)
+	}
+
+	if conf.PushURL != "" {
+		pusher = NewPusher(conf.PushURL, conf.RemoteWrite)
+		go pusher.Run(nil)
+	}
+
+	if conf.StoreBackend == StoreBackendRedis {
+		redisBackend = NewRedisBackend(conf.Redis)
+	}
+
+	if conf.LeaderElection.Enabled {
+		leader = NewLeaderElector(
+			redisBackend.Lock(conf.LeaderElection.Key),
+			time.Duration(conf.LeaderElection.TTL)*time.Second)
+		leader.Start(nil)
+	}
+
+	procs := sortedProcs(startCollectors(conf.Collectors, done))
+
+	var ingester *StreamIngester
+	if conf.MetricStreamIngest {
+		ingester = NewStreamIngester(conf.MetricStreamAccessKey)
+		procs = append(procs, ingester.Proc())
+	}
+
+	if conf.TextfileOutput != "" {
+		w := NewTextfileWriter(conf.TextfileOutput, procs, gatherer)
+		go w.Run(time.Duration(conf.TextfileInterval)*time.Second, nil)
+	}
+
+	r := &reloader{configFile: configFile}
+	r.watchSignals(nil)
+	mux := newMux(conf, procs, served, r)
+	if ingester != nil {
+		mux.Handle("/ingest", ingester)
+	}
+
+	if conf.TelemetryListen != "" {
+		tl, err := listen(conf.TelemetryListen)
+		dieOnError(err)
+		go func() {
+			dieOnError(runServer(tl, telemetryMux(conf, registry), conf))
+		}()
+	}
+
+	l, err := listen(conf.Listen)
+	dieOnError(err)
+	dieOnError(runServer(l, mux, conf))
+}
+
+// newMux returns the mux of the endpoints served on the listen address. The
+// metrics of all collectors and the metrics gathered from gatherer are served
+// on the metrics path. The ingest endpoint is added by the caller if enabled.
+func newMux(conf *PromWatchConfig, procs []*CollectorProc, gatherer prometheus.Gatherer, reload http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	// Only the version and probe endpoints are served without basic auth.
+	mux.Handle("/-/reload", basicAuthHandler(reload, conf.BasicAuth))
+	mux.Handle("/version", versionHandler())
+	mux.Handle("/healthz", healthzHandler())
+	mux.Handle("/readyz", readyzHandler(procs))
+	mux.Handle("/api/v1/series-map", basicAuthHandler(seriesMapHandler(procs), conf.BasicAuth))
+	mux.Handle("/collectors", basicAuthHandler(collectorsHandler(procs), conf.BasicAuth))
+	if conf.CollectorOverrides {
+		mux.Handle("/collectors/", basicAuthHandler(overridesHandler(procs, &realTime{}), conf.BasicAuth))
+	}
+	mux.Handle(HistoryPath, basicAuthHandler(historyHandler(procs), conf.BasicAuth))
+	mux.Handle(NamedMetricsPath, basicAuthHandler(namedMetricsHandler(procs), conf.BasicAuth))
+	mux.Handle(conf.MetricsPath, basicAuthHandler(etagHandler(
+		metricsHandler(procs, gatherer),
+		procs,
+		gatherer,
+		conf.ETagIgnoreTelemetry,
+	), conf.BasicAuth))
+
+	return mux
+}
+
+// telemetryMux returns the mux serving the PromWatch telemetry gathered from
+// gatherer on the metrics path of the telemetry listen address.
+func telemetryMux(conf *PromWatchConfig, gatherer prometheus.Gatherer) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(conf.MetricsPath, basicAuthHandler(promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		// Compressed by the server, see runServer.
+		DisableCompression: true,
+	}), conf.BasicAuth))
+
+	return mux
+}
+
+// runServer serves h on l, over HTTPS if a key pair is configured. It blocks
+// until the server fails.
+func runServer(l net.Listener, h http.Handler, conf *PromWatchConfig) error {
+	s := &http.Server{
+		Handler:           handlers.CompressHandler(h),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       2 * time.Second,
+		WriteTimeout:      2 * time.Second,
+		IdleTimeout:       30 * time.Second,
+	}
+
+	if conf.TLSCertFile != "" {
+		return s.ServeTLS(l, conf.TLSCertFile, conf.TLSKeyFile)
+	}
+
+	return s.Serve(l)
+}
+
+// runningProcs holds the procs of the running collectors, see startCollectors.
+var runningProcs = &procSet{procs: map[CollectorID]*CollectorProc{}}
+
+// procSet is a set of CollectorProcs safe for concurrent use.
+type procSet struct {
+	sync.Mutex
+
+	procs map[CollectorID]*CollectorProc
+}
 
-	for _, c := range conf.Collectors {
+func (s *procSet) add(p *CollectorProc) {
+	s.Lock()
+	defer s.Unlock()
+	s.procs[p.ID] = p
+}
+
+func (s *procSet) remove(id CollectorID) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.procs, id)
+}
+
+// ready returns the number of procs in the set that are ready, see
+// CollectorProc.Ready.
+func (s *procSet) ready() int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for _, p := range s.procs {
+		if p.Ready() {
+			n++
+		}
+	}
+
+	return n
+}
+
+// startCollectors starts all valid collectors and sends every collector that
+// stopped to done. The collectors gauge is set to the number of collectors
+// defined and the ready gauge counts the running collectors that are ready.
+func startCollectors(configured []MetricCollector, done chan<- MetricCollector) map[CollectorID]*CollectorProc {
+	collectorsTotal.Set(float64(len(configured)))
+
+	collectors := map[CollectorID]*CollectorProc{}
+	for _, c := range configured {
 		// We still want to go on starting other collectors in case any one is
 		// invalid and can not be started.
 		if !c.Valid() {
@@ -75,42 +307,18 @@ func main() {
 		}
 		proc := c.Run()
 		collectors[proc.ID] = proc
+		runningProcs.add(proc)
 		// fan in messages from done channel
 		go func() {
 			d := <-proc.Done
+			runningProcs.remove(proc.ID)
 			done <- d
 			Logger.Warnf("collector %s was stopped, closing channels.", proc.ID)
 			close(proc.Done)
 		}()
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		Logger.Debug("metrics requested")
-		// Print metrics collected from CloudWatch to the response
-		for i, c := range collectors {
-			Logger.Debugw("producing metrics for collector", "id", i)
-			fmt.Fprint(w, c.Store.String())
-		}
-
-		// To avoid mixed uncompressed and compressed content compressions is
-		// disabled here. The response will still be compressed as the whole
-		// handler is being wrapped for compression.
-		promhttp.HandlerFor(registry, promhttp.HandlerOpts{
-			DisableCompression: true,
-		}).ServeHTTP(w, r)
-	})
-
-	s := &http.Server{
-		Addr:              conf.Listen,
-		Handler:           handlers.CompressHandler(mux),
-		ReadHeaderTimeout: 5 * time.Second,
-		ReadTimeout:       2 * time.Second,
-		WriteTimeout:      2 * time.Second,
-		IdleTimeout:       30 * time.Second,
-	}
-
-	dieOnError(s.ListenAndServe())
+	return collectors
 }
 
 func dieOnError(err error) {
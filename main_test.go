@@ -0,0 +1,164 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+// TestMain fails the package tests if any goroutine is still running after all
+// tests finished.
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func TestFromBuildInfo(t *testing.T) {
+	info := &debug.BuildInfo{
+		Main: debug.Module{Path: "github.com/crowdstrike/promwatch", Version: "v0.7.3"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs", Value: "git"},
+			{Key: "vcs.revision", Value: "0123456789abcdef0123456789abcdef01234567"},
+			{Key: "vcs.time", Value: "2021-01-01T00:00:00Z"},
+		},
+	}
+
+	version, hash, date := fromBuildInfo(info, "none", "none", "none")
+	assert.Equal(t, "0.7.3", version, "Module versions should be used without the v prefix")
+	assert.Equal(t, "0123456", hash, "VCS revisions should be abbreviated")
+	assert.Equal(t, "2021-01-01T00:00:00Z", date)
+
+	version, hash, date = fromBuildInfo(info, "1.0.0", "abcdef0", "2022-01-01T00:00:00Z")
+	assert.Equal(t, []string{"1.0.0", "abcdef0", "2022-01-01T00:00:00Z"}, []string{version, hash, date}, "Values set during compile time should be kept")
+
+	version, hash, date = fromBuildInfo(&debug.BuildInfo{Main: debug.Module{Version: "(devel)"}}, "none", "none", "none")
+	assert.Equal(t, []string{"none", "none", "none"}, []string{version, hash, date}, "Development builds without VCS info should keep the defaults")
+
+	version, _, _ = fromBuildInfo(nil, "none", "none", "none")
+	assert.Equal(t, "none", version)
+}
+
+func TestStartCollectors(t *testing.T) {
+	configured := []MetricCollector{}
+	stats := []MetricStat{{MetricName: "VolumeReadOps", Stat: "Sum"}}
+	for _, c := range []CollectorConfig{
+		{Type: "ebs", Name: "a", Interval: 60, Offset: 120, Period: 60, MetricStats: stats},
+		{Type: "ebs", Name: "b", Interval: 60, Offset: 120, Period: 60, MetricStats: stats},
+		{Type: "ebs", Name: "invalid", Interval: 120, Offset: 60, Period: 60, MetricStats: stats},
+	} {
+		b := stripInterface(CollectorFromConfig(c))
+		b._client = &FakeClient{}
+		configured = append(configured, b)
+	}
+
+	done := make(chan MetricCollector, len(configured))
+	procs := startCollectors(configured, done)
+	assert.Len(t, procs, 2, "Invalid collectors should not be started")
+	assert.Equal(t, float64(3), testutil.ToFloat64(collectorsTotal), "All configured collectors should be counted")
+	assert.Eventually(t, func() bool { return testutil.ToFloat64(collectorsReady) == 2 }, time.Second, 10*time.Millisecond,
+		"Collectors should be ready once their first collection is committed")
+
+	stopped := sortedProcs(procs)[0]
+	assert.Nil(t, stopped.Close())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Stopped collector should be sent to done")
+	}
+	assert.Equal(t, float64(1), testutil.ToFloat64(collectorsReady), "Stopped collectors should not be ready")
+
+	for _, p := range procs {
+		assert.Nil(t, p.Close())
+	}
+	<-done
+}
+
+func TestNewMux(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total", Help: "Test counter."})
+	reg.MustRegister(counter)
+
+	conf := &PromWatchConfig{MetricsPath: "/aws"}
+	procs := testProcs("first 1\n")
+	get := func(h http.Handler, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, http.NoBody))
+		return rec
+	}
+
+	mux := newMux(conf, procs, prometheus.Gatherers{}, http.NotFoundHandler())
+	rec := get(mux, "/aws")
+	assert.Equal(t, http.StatusOK, rec.Code, "Metrics should be served on the metrics path")
+	assert.Equal(t, "first 1\n", rec.Body.String(), "Telemetry should not be served with the collector metrics")
+	// Redirected to the named metrics of collectors below /metrics/.
+	assert.NotEqual(t, http.StatusOK, get(mux, "/metrics").Code, "The default metrics path should not be served")
+	assert.Equal(t, http.StatusOK, get(mux, "/healthz").Code, "Other endpoints should keep their paths")
+
+	telemetry := telemetryMux(conf, reg)
+	rec = get(telemetry, "/aws")
+	assert.Equal(t, http.StatusOK, rec.Code, "Telemetry should be served on the metrics path")
+	assert.Contains(t, rec.Body.String(), "test_total 0")
+	assert.NotContains(t, rec.Body.String(), "first", "Collector metrics should not be served with the telemetry")
+}
+
+func TestNewMuxOverrides(t *testing.T) {
+	procs := testProcs("")
+	procs[0].Name, procs[0].Overrides = "volumes", &Overrides{}
+	get := func(h http.Handler, auth bool) int {
+		req := httptest.NewRequest(http.MethodGet, "/collectors/volumes/overrides", http.NoBody)
+		if auth {
+			req.SetBasicAuth("promwatch", "secret")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	conf := &PromWatchConfig{MetricsPath: DefaultMetricsPath}
+	assert.Equal(t, http.StatusNotFound, get(newMux(conf, procs, prometheus.Gatherers{}, http.NotFoundHandler()), false),
+		"Overrides should not be served unless enabled")
+
+	conf.CollectorOverrides = true
+	assert.Equal(t, http.StatusOK, get(newMux(conf, procs, prometheus.Gatherers{}, http.NotFoundHandler()), false),
+		"Overrides should be served if enabled")
+
+	conf.BasicAuth = BasicAuthConfig{Username: "promwatch", Password: "secret"}
+	mux := newMux(conf, procs, prometheus.Gatherers{}, http.NotFoundHandler())
+	assert.Equal(t, http.StatusUnauthorized, get(mux, false), "Overrides should require basic auth if configured")
+	assert.Equal(t, http.StatusOK, get(mux, true), "Overrides should be served with valid credentials")
+}
+
+func TestNewMuxBasicAuth(t *testing.T) {
+	conf := &PromWatchConfig{
+		MetricsPath:        DefaultMetricsPath,
+		BasicAuth:          BasicAuthConfig{Username: "promwatch", Password: "secret"},
+		CollectorOverrides: true,
+	}
+	procs := testProcs("first 1\n")
+	procs[0].Name, procs[0].Overrides = "volumes", &Overrides{}
+	mux := newMux(conf, procs, prometheus.Gatherers{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(path string, auth bool) int {
+		req := httptest.NewRequest(http.MethodGet, path, http.NoBody)
+		if auth {
+			req.SetBasicAuth("promwatch", "secret")
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for _, path := range []string{"/metrics", "/metrics/volumes", "/-/reload", "/collectors", "/collectors/volumes/overrides", "/api/v1/series-map", HistoryPath + "a/history"} {
+		assert.Equal(t, http.StatusUnauthorized, get(path, false), path+" should require basic auth")
+		assert.NotEqual(t, http.StatusUnauthorized, get(path, true), path+" should be served with valid credentials")
+	}
+	for _, path := range []string{"/version", "/healthz", "/readyz"} {
+		assert.NotEqual(t, http.StatusUnauthorized, get(path, false), path+" should not require basic auth")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/kafka"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+)
+
+// MSKBrokerCollector collects the per broker metrics of MSK clusters. The
+// clusters are discovered by tags and their brokers listed with ListNodes.
+type MSKBrokerCollector struct {
+	base *BaseCollector
+}
+
+func NewMSKBrokerCollector(c CollectorConfig) (MetricCollector, error) {
+	b := &BaseCollector{
+		config:          c,
+		resourceName:    "kafka:cluster",
+		namespace:       "AWS/Kafka",
+		dimension:       "Cluster Name",
+		resourcePrefix:  "cluster/",
+		dimensionLabels: mskBrokerMetricDimension,
+	}
+
+	return &MSKBrokerCollector{
+		base: b,
+	}, nil
+}
+
+func (m *MSKBrokerCollector) Valid() bool {
+	return m.base.Valid()
+}
+
+func (m *MSKBrokerCollector) getBrokers(ctx context.Context) (*ResourceIndex, error) {
+	clusters, err := m.base.getResources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := m.base.client()
+	if err != nil {
+		return nil, err
+	}
+
+	// convert brokers to resource tag mapping
+	mapping := []*tagging.ResourceTagMapping{}
+	for _, c := range clusters.Resources {
+		nodes, err := client.ListNodes(ctx, &kafka.ListNodesInput{ClusterArn: c.ResourceARN}, m.base.Telemetry())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, n := range *nodes {
+			// Only brokers have broker level metrics
+			if n.BrokerNodeInfo == nil || n.BrokerNodeInfo.BrokerId == nil {
+				continue
+			}
+			// append the broker ID to the cluster ARN so every broker
+			// is a resource of its own
+			id := strconv.FormatFloat(*n.BrokerNodeInfo.BrokerId, 'f', -1, 64)
+			arnWithBrokerID := fmt.Sprintf("%s/%s", *c.ResourceARN, id)
+			mapping = append(mapping, &tagging.ResourceTagMapping{
+				ResourceARN: &arnWithBrokerID,
+				Tags:        c.Tags,
+			})
+		}
+	}
+
+	return NewResourceIndexFromTagMapping(&mapping, m.base.resourceID()), nil
+}
+
+func (m *MSKBrokerCollector) Run() *CollectorProc {
+	return m.base.run(m.getBrokers, mskBrokerMetricDimension)
+}
+
+// mskBrokerMetricDimension sets the cluster name and broker ID of MSK brokers
+// as dimensions for CloudWatch. Broker resources are cluster ARNs with the
+// broker ID appended, e.g. cluster/my-cluster/<uuid>/1. The dimension names
+// contain spaces and are passed on as is.
+func mskBrokerMetricDimension(resource *tagging.ResourceTagMapping) ([]*cloudwatch.Dimension, error) {
+	arn, err := parseARN(*resource.ResourceARN)
+	if err != nil {
+		return []*cloudwatch.Dimension{}, ErrCanNotParseARN
+	}
+
+	segments := strings.Split(arn.Resource, "/")
+	if len(segments) != 4 || segments[0] != "cluster" || segments[1] == "" || segments[3] == "" {
+		return []*cloudwatch.Dimension{}, fmt.Errorf("%w: %s", ErrNotMSKBroker, *resource.ResourceARN)
+	}
+
+	return []*cloudwatch.Dimension{
+		{Name: aws.String("Cluster Name"), Value: aws.String(segments[1])},
+		{Name: aws.String("Broker ID"), Value: aws.String(segments[3])},
+	}, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/kafka"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMSKBrokerMetricDimension(t *testing.T) {
+	cases := []struct {
+		arn      string
+		expected []*cloudwatch.Dimension
+		err      error
+	}{
+		{
+			"arn:aws:kafka:us-east-1:123456789012:cluster/my-cluster/abcd1234-0123-4567-89ab-cdef01234567-1/2",
+			[]*cloudwatch.Dimension{
+				{Name: aws.String("Cluster Name"), Value: aws.String("my-cluster")},
+				{Name: aws.String("Broker ID"), Value: aws.String("2")},
+			},
+			nil,
+		},
+		{"arn:aws:kafka:us-east-1:123456789012:cluster/my-cluster/abcd1234-0123-4567-89ab-cdef01234567-1", []*cloudwatch.Dimension{}, ErrNotMSKBroker},
+		{"not an arn", []*cloudwatch.Dimension{}, ErrCanNotParseARN},
+	}
+
+	for _, c := range cases {
+		got, err := mskBrokerMetricDimension(&tagging.ResourceTagMapping{ResourceARN: aws.String(c.arn)})
+		assert.ErrorIs(t, err, c.err, c.arn)
+		assert.Equal(t, c.expected, got, c.arn)
+	}
+}
+
+func TestGetBrokers(t *testing.T) {
+	clusterARN := "arn:aws:kafka:us-east-1:000000000000:cluster/my-cluster/abcd1234-0123-4567-89ab-cdef01234567-1"
+	client := &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{
+			{{ResourceARN: aws.String(clusterARN), Tags: []*tagging.Tag{{Key: aws.String("team"), Value: aws.String("streaming")}}}},
+		},
+		NodeInfoPages: [][]*kafka.NodeInfo{
+			{
+				{NodeType: aws.String("BROKER"), BrokerNodeInfo: &kafka.BrokerNodeInfo{BrokerId: aws.Float64(1)}},
+				{NodeType: aws.String("BROKER"), BrokerNodeInfo: &kafka.BrokerNodeInfo{BrokerId: aws.Float64(2)}},
+				{NodeType: aws.String("ZOOKEEPER"), ZookeeperNodeInfo: &kafka.ZookeeperNodeInfo{ZookeeperId: aws.Float64(1)}},
+			},
+		},
+	}
+
+	c, _ := CollectorFromConfig(CollectorConfig{Type: "msk_broker"})
+	m := c.(*MSKBrokerCollector)
+	m.base._client = client
+
+	index, err := m.getBrokers(context.Background())
+	assert.Nil(t, err)
+
+	arns := []string{}
+	for _, r := range index.Resources {
+		arns = append(arns, *r.ResourceARN)
+		assert.Equal(t, "streaming", *r.Tags[0].Value, "Cluster tags should be carried over to brokers")
+	}
+	assert.ElementsMatch(t, []string{clusterARN + "/1", clusterARN + "/2"}, arns, "Only brokers should be indexed")
+
+	calls := client.Calls()
+	assert.Equal(t, MethodListNodes, calls[len(calls)-1].Method)
+	assert.Equal(t, clusterARN, aws.StringValue(calls[len(calls)-1].Input.(*kafka.ListNodesInput).ClusterArn),
+		"Nodes should be listed by cluster ARN")
+}
+
+func TestStoreResultsMSKBroker(t *testing.T) {
+	c, _ := NewMSKBrokerCollector(CollectorConfig{
+		Type:        "msk_broker",
+		MetricStats: []MetricStat{{MetricName: "BytesInPerSec", Stat: "Average"}},
+	})
+	b := c.(*MSKBrokerCollector).base
+	b.store = NewStore(0)
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:kafka:us-east-1:000000000000:cluster/my-cluster/abcd1234-0123-4567-89ab-cdef01234567-1/1")},
+	}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	b.makeQueries(index, b.namespace, mskBrokerMetricDimension)
+
+	results := []*cloudwatch.MetricDataResult{}
+	for _, queries := range index.Queries {
+		for _, q := range queries {
+			assert.Equal(t, []string{"Cluster Name", "Broker ID"},
+				[]string{*q.MetricStat.Metric.Dimensions[0].Name, *q.MetricStat.Metric.Dimensions[1].Name},
+				"Dimension names should be queried as is")
+			results = append(results, &cloudwatch.MetricDataResult{
+				Id:         q.Id,
+				Values:     []*float64{aws.Float64(42)},
+				Timestamps: []*time.Time{aws.Time(time.Unix(1611929698, 0))},
+			})
+		}
+	}
+	index.AddResults(&results)
+	b.storeResults(index)
+
+	assert.Equal(t,
+		`promwatch_aws_msk_broker_bytes_in_per_sec_average{arn="arn:aws:kafka:us-east-1:000000000000:cluster/my-cluster/abcd1234-0123-4567-89ab-cdef01234567-1/1",cluster_name="my-cluster",broker_id="1"} 42.000000 1611929698000`,
+		strings.TrimSuffix(storeSamples(b.store), "\n"), "Brokers should be labeled by cluster name and broker ID")
+}
@@ -0,0 +1,118 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+// DefaultNegativeCacheEvery is the default number of runs demoted resources are
+// queried every, see NegativeCache.
+const DefaultNegativeCacheEvery = 12
+
+// NegativeCache demotes resources whose queries consistently return no
+// datapoints, e.g. volumes attached to stopped instances, to be queried only on
+// every few runs to save on CloudWatch costs.
+type NegativeCache struct {
+	// EmptyRuns is the number of consecutive runs without datapoints after
+	// which a resource is demoted. The negative cache is disabled if 0.
+	EmptyRuns int `yaml:"empty_runs"`
+	// Every is the number of runs demoted resources are queried every,
+	// DefaultNegativeCacheEvery if 0.
+	Every int `yaml:"every"`
+}
+
+func (n NegativeCache) every() int {
+	if n.Every == 0 {
+		return DefaultNegativeCacheEvery
+	}
+
+	return n.Every
+}
+
+// negativeEntry is the state of a resource in the negative cache.
+type negativeEntry struct {
+	// empty is the number of consecutive runs without datapoints, capped
+	// at NegativeCache.EmptyRuns.
+	empty int
+	// skipped is the number of runs skipped since the resource was last
+	// queried while demoted.
+	skipped int
+	// queries is the number of queries of the resource in the last run it
+	// was queried in.
+	queries int
+}
+
+// probation returns the IDs of the demoted resources of index skipped in this
+// run and updates the negative cache telemetry. Entries of resources not in
+// index anymore are pruned, so the cache is bounded by the resources of the
+// collector.
+func (b *BaseCollector) probation(index *ResourceIndex) map[string]struct{} {
+	c := b.config.NegativeCache
+	if c.EmptyRuns <= 0 {
+		return nil
+	}
+	if b.negative == nil {
+		b.negative = map[string]*negativeEntry{}
+	}
+
+	skip := map[string]struct{}{}
+	demoted, saved := 0, 0
+	for id, e := range b.negative {
+		if _, ok := index.Resources[id]; !ok {
+			delete(b.negative, id)
+			continue
+		}
+		if e.empty < c.EmptyRuns {
+			continue
+		}
+
+		demoted++
+		if e.skipped < c.every()-1 {
+			e.skipped++
+			skip[id] = struct{}{}
+			saved += e.queries
+			continue
+		}
+		e.skipped = 0
+	}
+	b.Telemetry().DemotedResources.Set(float64(demoted))
+	b.Telemetry().ProbationSavedQueries.Set(float64(saved))
+
+	return skip
+}
+
+// updateNegativeCache records for every resource queried in this run whether
+// any of its queries returned datapoints. Resources returning datapoints are
+// restored to be queried on every run right away.
+func (b *BaseCollector) updateNegativeCache(index *ResourceIndex) {
+	c := b.config.NegativeCache
+	if c.EmptyRuns <= 0 {
+		return
+	}
+	if b.negative == nil {
+		b.negative = map[string]*negativeEntry{}
+	}
+
+	for id, queries := range index.Queries {
+		data := false
+		for _, q := range queries {
+			if res, ok := index.Results[*q.Id]; ok && len(res.Values) > 0 {
+				data = true
+				break
+			}
+		}
+
+		e, ok := b.negative[id]
+		if !ok {
+			e = &negativeEntry{}
+			b.negative[id] = e
+		}
+		e.queries = len(queries)
+		if !data {
+			if e.empty < c.EmptyRuns {
+				e.empty++
+			}
+			continue
+		}
+		if e.empty >= c.EmptyRuns {
+			b.logger().Debugw("restoring resource returning datapoints again", "arn", *index.Resources[id].ResourceARN, "id", b.ID())
+		}
+		e.empty, e.skipped = 0, 0
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegativeCache(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:          "ebs",
+		NegativeCache: NegativeCache{EmptyRuns: 2, Every: 3},
+		MetricStats: []MetricStat{
+			{MetricName: "VolumeReadBytes", Stat: "Sum"},
+			{MetricName: "VolumeWriteBytes", Stat: "Sum"},
+		},
+	}))
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-a")},
+		{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-b")},
+	}
+	quiet := id(resources[1])
+
+	// run returns whether the quiet resource was queried, it returns
+	// datapoints if data is set.
+	run := func(data bool) bool {
+		index := NewResourceIndexFromTagMapping(&resources, id)
+		index.Skipped = b.probation(index)
+		b.makeQueries(index, b.namespace, defaultMetricDimension(b.dimension, b.resourcePrefix))
+		results := []*cloudwatch.MetricDataResult{}
+		for rid, queries := range index.Queries {
+			for _, q := range queries {
+				res := &cloudwatch.MetricDataResult{Id: q.Id}
+				if rid != quiet || data {
+					res.Values = []*float64{aws.Float64(1)}
+					res.Timestamps = []*time.Time{aws.Time(time.Now())}
+				}
+				results = append(results, res)
+			}
+		}
+		index.AddResults(&results)
+		b.updateNegativeCache(index)
+
+		_, queried := index.Queries[quiet]
+		return queried
+	}
+
+	assert.True(t, run(false))
+	assert.True(t, run(false), "Resources should be queried until they were empty in enough runs")
+	assert.False(t, run(false), "Resources empty in consecutive runs should be demoted")
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.Telemetry().DemotedResources))
+	assert.Equal(t, 2.0, testutil.ToFloat64(b.Telemetry().ProbationSavedQueries), "Queries of skipped resources should be counted as saved")
+	assert.False(t, run(false))
+	assert.True(t, run(false), "Demoted resources should be queried on every few runs")
+	assert.Equal(t, 0.0, testutil.ToFloat64(b.Telemetry().ProbationSavedQueries))
+	assert.False(t, run(false))
+	assert.False(t, run(false))
+	assert.True(t, run(true))
+	assert.True(t, run(false), "Resources returning datapoints should be restored right away")
+	assert.Equal(t, 0.0, testutil.ToFloat64(b.Telemetry().DemotedResources))
+
+	resources = resources[:1]
+	run(false)
+	assert.NotContains(t, b.negative, quiet, "Resources gone from discovery should be pruned")
+}
+
+func TestNegativeCacheDisabled(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"}))
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-a")},
+	}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	assert.Nil(t, b.probation(index))
+	b.updateNegativeCache(index)
+	assert.Nil(t, b.negative)
+
+	assert.False(t, stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs", NegativeCache: NegativeCache{EmptyRuns: -1}})).Valid())
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// OrphanARN is the value of the arn label of orphan results, see
+// CollectorConfig.OrphanResults.
+const OrphanARN = "unknown"
+
+// Query IDs of metric stats and expressions, see makeStatQueries and
+// makeExpressionQueries. Resource IDs never contain underscores, so the index of
+// the metric stat or expression can be told apart from the dimension set.
+var (
+	matchStatQueryID       = regexp.MustCompile(`^id_[a-z0-9]+_(\d+)(?:_\d+)?$`)
+	matchExpressionQueryID = regexp.MustCompile(`^e_[a-z0-9]+_(\d+)$`)
+)
+
+// orphanResults returns the results of index that belong to no query of any
+// resource in index ordered by query ID, e.g. results of resources removed from
+// the index while their queries were in flight.
+func orphanResults(index *ResourceIndex) []*cloudwatch.MetricDataResult {
+	queried := map[string]struct{}{}
+	for id := range index.Resources {
+		for _, q := range index.Queries[id] {
+			queried[aws.StringValue(q.Id)] = struct{}{}
+		}
+	}
+
+	orphans := []*cloudwatch.MetricDataResult{}
+	for id, r := range index.Results {
+		if _, ok := queried[id]; !ok {
+			orphans = append(orphans, r)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return aws.StringValue(orphans[i].Id) < aws.StringValue(orphans[j].Id)
+	})
+
+	return orphans
+}
+
+// orphanNames returns the series names of an orphan result derived from its
+// query ID, nil if the ID matches no configured metric stat or expression.
+func (b *BaseCollector) orphanNames(queryID string) []string {
+	if m := matchStatQueryID.FindStringSubmatch(queryID); m != nil {
+		i, err := strconv.Atoi(m[1])
+		if err != nil || i >= len(b.config.MetricStats) {
+			return nil
+		}
+		s := b.config.MetricStats[i]
+		return b.metricNames(s.MetricName, s.Stat)
+	}
+	if m := matchExpressionQueryID.FindStringSubmatch(queryID); m != nil {
+		k, err := strconv.Atoi(m[1])
+		if err != nil || k >= len(b.config.Expressions) {
+			return nil
+		}
+		return []string{b.expressionName(b.config.Expressions[k].Label)}
+	}
+
+	return nil
+}
+
+// orphanSamples counts the orphan results of index and, if enabled, returns
+// their samples labeled with the unknown ARN, as the resource they belong to is
+// not known anymore, their query ID to keep the series of different resources
+// apart and the static labels. Their families are guarded against taken, see
+// guardFamilies.
+func (b *BaseCollector) orphanSamples(index *ResourceIndex, taken map[string]struct{}) []Sample {
+	samples := []Sample{}
+	static := staticLabels(b.config.StaticLabels)
+	for _, res := range orphanResults(index) {
+		b.Telemetry().OrphanResultsCount.Inc()
+		if !b.config.OrphanResults {
+			continue
+		}
+		queryID := aws.StringValue(res.Id)
+		names := b.guardFamilies(taken, b.orphanNames(queryID))
+		labels := withInstanceLabels(withStaticLabels([]Label{{"arn", OrphanARN}, {"query_id", queryID}}, static))
+		for i, v := range res.Values {
+			for _, name := range names {
+				samples = append(samples, Sample{
+					Name:      name,
+					Labels:    labels,
+					Value:     *v,
+					Timestamp: res.Timestamps[i].Unix() * 1000,
+				})
+			}
+		}
+	}
+
+	return samples
+}
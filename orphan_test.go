@@ -0,0 +1,93 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrphanResults(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, export := range []bool{false, true} {
+		b := stripInterface(CollectorFromConfig(CollectorConfig{
+			Type:          "ebs",
+			OrphanResults: export,
+			StaticLabels:  map[string]string{"team": "platform"},
+			MetricStats: []MetricStat{
+				{MetricName: "VolumeReadBytes", Stat: "Sum"},
+				{MetricName: "VolumeWriteBytes", Stat: "Sum"},
+			},
+		}))
+		b.store = NewStore(0)
+		resources := []*tagging.ResourceTagMapping{
+			{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-a")},
+			{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-deleted")},
+		}
+		index := NewResourceIndexFromTagMapping(&resources, id)
+		b.makeQueries(index, b.namespace, b.metricDimensions())
+		results := []*cloudwatch.MetricDataResult{}
+		for _, queries := range index.Queries {
+			for _, q := range queries {
+				results = append(results, &cloudwatch.MetricDataResult{
+					Id:         q.Id,
+					Values:     []*float64{aws.Float64(1)},
+					Timestamps: []*time.Time{aws.Time(now)},
+				})
+			}
+		}
+		index.AddResults(&results)
+		// The resource is removed while its queries are in flight.
+		deleted := id(resources[1])
+		delete(index.Resources, deleted)
+		b.storeResults(index)
+
+		assert.Equal(t, float64(2), testutil.ToFloat64(b.Telemetry().OrphanResultsCount), "Orphan results should be counted")
+		lines := strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n")
+		if !export {
+			assert.Len(t, lines, 2, "Orphan results should be dropped by default")
+			for _, l := range lines {
+				assert.NotContains(t, l, OrphanARN)
+			}
+			continue
+		}
+
+		assert.Len(t, lines, 4)
+		assert.Contains(t, lines, fmt.Sprintf(`promwatch_aws_ebs_volume_read_bytes_sum{arn="unknown",query_id="id_%s_0",team="platform"} 1.000000 1609459200000`, deleted))
+		assert.Contains(t, lines, fmt.Sprintf(`promwatch_aws_ebs_volume_write_bytes_sum{arn="unknown",query_id="id_%s_1",team="platform"} 1.000000 1609459200000`, deleted),
+			"Orphan results should be named after the metric stat of their query ID and carry the static labels")
+	}
+}
+
+func TestOrphanNames(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type: "lambda",
+		MetricStats: []MetricStat{
+			{MetricName: "Errors", Stat: "Sum"},
+			{MetricName: "Invocations", Stat: "Sum"},
+		},
+		Expressions: []Expression{{Expression: "m1/m2*100", Label: "ErrorRate"}},
+	}))
+
+	cases := []struct {
+		id       string
+		expected []string
+	}{
+		{"id_abc123_0", []string{"promwatch_aws_lambda_errors_sum"}},
+		{"id_abc123_1_2", []string{"promwatch_aws_lambda_invocations_sum"}},
+		{"e_abc123_0", []string{"promwatch_aws_lambda_error_rate"}},
+		{"id_abc123_2", nil},
+		{"e_abc123_1", nil},
+		{"unknown", nil},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, b.orphanNames(c.id), c.id)
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxOverrideTTL is the longest time an override can be active.
+const MaxOverrideTTL = 24 * time.Hour
+
+// MaxIntervalMultiplier is the largest factor an override can stretch the
+// interval of a collector by.
+const MaxIntervalMultiplier = 10
+
+var ErrInvalidOverride = errors.New("Invalid override")
+
+// Override tightens the collection parameters of a collector for a limited
+// time, e.g. to reduce CloudWatch costs during an incident without a config
+// rollout. Overrides only live in memory and are lost on restart.
+type Override struct {
+	// IntervalMultiplier stretches the interval of the collector, between
+	// 1 and MaxIntervalMultiplier.
+	IntervalMultiplier int `json:"interval_multiplier,omitempty"`
+	// DisableMetrics are the names of metrics not queried anymore.
+	DisableMetrics []string `json:"disable_metrics,omitempty"`
+	// MaxQueriesPerRun limits the number of queries of a collection if
+	// larger than 0.
+	MaxQueriesPerRun int `json:"max_queries_per_run,omitempty"`
+	// TTL is the duration the override is active for, at most
+	// MaxOverrideTTL.
+	TTL string `json:"ttl"`
+	// Expires is the time the override expires, derived from the TTL when
+	// the override is accepted.
+	Expires time.Time `json:"expires"`
+}
+
+// validate rejects overrides that would loosen instead of tighten the limits
+// of a collector or lack a valid TTL, and sets the expiry relative to now.
+func (o *Override) validate(now time.Time) error {
+	if o.TTL == "" {
+		return fmt.Errorf("%w: ttl is required", ErrInvalidOverride)
+	}
+	ttl, err := time.ParseDuration(o.TTL)
+	if err != nil {
+		return fmt.Errorf("%w: ttl: %s", ErrInvalidOverride, err)
+	}
+	if ttl <= 0 || ttl > MaxOverrideTTL {
+		return fmt.Errorf("%w: ttl must be between 0 and %s: %s", ErrInvalidOverride, MaxOverrideTTL, o.TTL)
+	}
+
+	if o.IntervalMultiplier == 0 {
+		o.IntervalMultiplier = 1
+	}
+	if o.IntervalMultiplier < 1 {
+		return fmt.Errorf("%w: interval multiplier below 1 would shorten the interval: %d", ErrInvalidOverride, o.IntervalMultiplier)
+	}
+	if o.IntervalMultiplier > MaxIntervalMultiplier {
+		return fmt.Errorf("%w: interval multiplier must be at most %d: %d", ErrInvalidOverride, MaxIntervalMultiplier, o.IntervalMultiplier)
+	}
+
+	if o.MaxQueriesPerRun < 0 {
+		return fmt.Errorf("%w: max queries per run must not be negative: %d", ErrInvalidOverride, o.MaxQueriesPerRun)
+	}
+
+	o.Expires = now.Add(ttl)
+
+	return nil
+}
+
+// disables returns true if the metric is disabled by the override.
+func (o *Override) disables(metric string) bool {
+	if o == nil {
+		return false
+	}
+	for _, m := range o.DisableMetrics {
+		if m == metric {
+			return true
+		}
+	}
+
+	return false
+}
+
+// interval returns the interval stretched by the override.
+func (o *Override) interval(interval time.Duration) time.Duration {
+	if o == nil {
+		return interval
+	}
+
+	return interval * time.Duration(o.IntervalMultiplier)
+}
+
+// Overrides holds the override of a collector. A new override is pending until
+// the collector applies it at the boundary of its next tick, so a collection
+// in flight is never changed midway. Overrides of linked collectors, e.g. the
+// sub-collectors of a collector for all regions, are set along.
+type Overrides struct {
+	sync.Mutex
+
+	pending *Override
+	active  *Override
+	linked  []*Overrides
+}
+
+// set makes o the pending override, replacing any pending one.
+func (s *Overrides) set(o Override) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.pending = &o
+	for _, l := range s.linked {
+		l.set(o)
+	}
+}
+
+// link sets the overrides of s on l as well. The pending or active override of
+// s is set on l right away.
+func (s *Overrides) link(l *Overrides) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.linked = append(s.linked, l)
+	if s.pending != nil {
+		l.set(*s.pending)
+	} else if s.active != nil {
+		l.set(*s.active)
+	}
+}
+
+// apply is called at tick boundaries. It activates the pending override and
+// drops the active one once expired. It returns the active override or nil.
+func (s *Overrides) apply(now time.Time) *Override {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pending != nil {
+		s.active, s.pending = s.pending, nil
+	}
+	if s.active != nil && !now.Before(s.active.Expires) {
+		s.active = nil
+	}
+
+	return s.active
+}
+
+// status returns the active and pending override. Expired overrides are not
+// returned even if the collector did not drop them yet.
+func (s *Overrides) status(now time.Time) (active, pending *Override) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.active != nil && now.Before(s.active.Expires) {
+		active = s.active
+	}
+	if s.pending != nil && now.Before(s.pending.Expires) {
+		pending = s.pending
+	}
+
+	return active, pending
+}
+
+// overrideStatus is the JSON representation of the overrides of a collector.
+type overrideStatus struct {
+	Active  *Override `json:"active,omitempty"`
+	Pending *Override `json:"pending,omitempty"`
+}
+
+func newOverrideStatus(s *Overrides, now time.Time) *overrideStatus {
+	if s == nil {
+		return nil
+	}
+	active, pending := s.status(now)
+	if active == nil && pending == nil {
+		return nil
+	}
+
+	return &overrideStatus{Active: active, Pending: pending}
+}
+
+// overridesHandler serves /collectors/<name>/overrides for the collectors with
+// the given named path, see exposePath. GET returns the overrides of every
+// matching collector keyed by ID, PATCH sets the override in the body on all
+// of them.
+func overridesHandler(procs []*CollectorProc, t Time) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/collectors/"), "/overrides")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		matched := []*CollectorProc{}
+		for _, p := range procs {
+			if p.Overrides != nil && exposePath(p.Name) == name {
+				matched = append(matched, p)
+			}
+		}
+		if len(matched) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPatch:
+			var o Override
+			dec := json.NewDecoder(r.Body)
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&o); err != nil {
+				http.Error(w, fmt.Sprintf("%s: %s", ErrInvalidOverride, err), http.StatusBadRequest)
+				return
+			}
+			if err := o.validate(t.Now()); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for _, p := range matched {
+				Logger.Infow("override set", "id", p.ID, "name", p.Name, "override", o)
+				p.Overrides.set(o)
+			}
+		default:
+			w.Header().Set("Allow", "GET, PATCH")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		status := map[CollectorID]*overrideStatus{}
+		for _, p := range matched {
+			status[p.ID] = newOverrideStatus(p.Overrides, t.Now())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(status)
+	})
+}
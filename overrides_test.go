@@ -0,0 +1,220 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverrideValidate(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		override Override
+		valid    bool
+		message  string
+	}{
+		{Override{TTL: "1h"}, true, "Overrides with a TTL only should be valid"},
+		{Override{IntervalMultiplier: 10, MaxQueriesPerRun: 100, DisableMetrics: []string{"a"}, TTL: "24h"}, true, "Overrides at the limits should be valid"},
+		{Override{IntervalMultiplier: 2}, false, "Overrides without TTL should be rejected"},
+		{Override{TTL: "0s"}, false, "Overrides with a TTL of 0 should be rejected"},
+		{Override{TTL: "-1h"}, false, "Overrides with a negative TTL should be rejected"},
+		{Override{TTL: "25h"}, false, "Overrides with a TTL above 24h should be rejected"},
+		{Override{TTL: "one hour"}, false, "Overrides with an invalid TTL should be rejected"},
+		{Override{IntervalMultiplier: -1, TTL: "1h"}, false, "Overrides shortening the interval should be rejected"},
+		{Override{IntervalMultiplier: 11, TTL: "1h"}, false, "Overrides stretching the interval by more than 10 should be rejected"},
+		{Override{MaxQueriesPerRun: -1, TTL: "1h"}, false, "Overrides with negative max queries should be rejected"},
+	}
+
+	for _, c := range cases {
+		err := c.override.validate(now)
+		if !c.valid {
+			assert.True(t, errors.Is(err, ErrInvalidOverride), c.message)
+			continue
+		}
+		assert.Nil(t, err, c.message)
+		assert.GreaterOrEqual(t, c.override.IntervalMultiplier, 1, c.message)
+		assert.True(t, c.override.Expires.After(now), c.message)
+	}
+}
+
+func TestOverridesApply(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	o := Override{IntervalMultiplier: 2, TTL: "1h"}
+	assert.Nil(t, o.validate(now))
+
+	s := &Overrides{}
+	linked := &Overrides{}
+	s.link(linked)
+	s.set(o)
+
+	active, pending := s.status(now)
+	assert.Nil(t, active, "Overrides should not be active before the next tick")
+	assert.Equal(t, &o, pending)
+
+	assert.Equal(t, &o, s.apply(now), "Pending overrides should be activated at the next tick")
+	active, pending = s.status(now)
+	assert.Equal(t, &o, active)
+	assert.Nil(t, pending)
+	assert.Equal(t, &o, linked.apply(now), "Overrides should be set on linked overrides")
+
+	late := &Overrides{}
+	s.link(late)
+	assert.Equal(t, &o, late.apply(now), "Active overrides should be set on overrides linked later")
+
+	expired := now.Add(time.Hour)
+	active, _ = s.status(expired)
+	assert.Nil(t, active, "Expired overrides should not be reported")
+	assert.Nil(t, s.apply(expired), "Expired overrides should be dropped")
+}
+
+func TestOverrideTick(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:     "ebs",
+		Interval: 60,
+		Period:   60,
+		MetricStats: []MetricStat{
+			{MetricName: "VolumeReadBytes", Stat: "Sum"},
+			{MetricName: "VolumeWriteBytes", Stat: "Sum"},
+		},
+	}))
+	b._client = &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{{
+			{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-a")},
+			{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-b")},
+			{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-c")},
+		}},
+	}
+	b.store = NewStore(0)
+	b.withTime(&testTime{now: &now})
+	b.overrides = &Overrides{}
+	dim := defaultMetricDimension(b.dimension, b.resourcePrefix)
+
+	queries := func() []string {
+		index, err := b.getResources(context.Background())
+		assert.Nil(t, err)
+		b.queries = 0
+		in := b.getMetricDataInput(index, dim)
+		names := []string{}
+		for _, i := range in {
+			assert.Equal(t, b.interval(), i.EndTime.Sub(*i.StartTime))
+			for _, q := range i.MetricDataQueries {
+				names = append(names, *q.MetricStat.Metric.Dimensions[0].Value+" "+*q.MetricStat.Metric.MetricName)
+			}
+		}
+		return names
+	}
+
+	o := Override{IntervalMultiplier: 3, DisableMetrics: []string{"VolumeWriteBytes"}, MaxQueriesPerRun: 2, TTL: "10m"}
+	assert.Nil(t, o.validate(now))
+	b.overrides.set(o)
+	assert.Len(t, queries(), 6, "Overrides should not apply before the next tick")
+
+	assert.Equal(t, 3*time.Minute, b.tick(context.Background(), nil, dim), "The interval should be stretched by the multiplier")
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.Telemetry().OverrideActive))
+	limited := queries()
+	assert.Len(t, limited, 2, "Queries should be limited")
+	for _, q := range limited {
+		assert.True(t, strings.HasSuffix(q, " VolumeReadBytes"), "Disabled metrics should be skipped")
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, limited, queries(), "Limited queries should be the same in every run")
+	}
+
+	now = now.Add(10 * time.Minute)
+	assert.Equal(t, time.Minute, b.tick(context.Background(), nil, dim), "Expired overrides should not stretch the interval")
+	assert.Equal(t, 0.0, testutil.ToFloat64(b.Telemetry().OverrideActive))
+	assert.Len(t, queries(), 6, "Expired overrides should not limit queries")
+}
+
+func TestOverrideExpiryCapsTick(t *testing.T) {
+	cases := []struct {
+		ttl      string
+		expected time.Duration
+		message  string
+	}{
+		{"30m", 10 * time.Minute, "Overrides expiring after the stretched interval should not cap it"},
+		{"4m", 4 * time.Minute, "The next tick should be at the expiry of the override"},
+		{"30s", time.Minute, "The next tick should not be before the configured interval"},
+	}
+
+	for _, c := range cases {
+		now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		b := stripInterface(CollectorFromConfig(CollectorConfig{
+			Type:        "ebs",
+			Interval:    60,
+			Period:      60,
+			MetricStats: []MetricStat{{MetricName: "VolumeReadBytes", Stat: "Sum"}},
+		}))
+		b._client = &FakeClient{}
+		b.store = NewStore(0)
+		b.withTime(&testTime{now: &now})
+		b.overrides = &Overrides{}
+
+		o := Override{IntervalMultiplier: 10, TTL: c.ttl}
+		assert.Nil(t, o.validate(now))
+		b.overrides.set(o)
+		assert.Equal(t, c.expected, b.tick(context.Background(), nil, defaultMetricDimension(b.dimension, b.resourcePrefix)), c.message)
+	}
+}
+
+func TestOverridesHandler(t *testing.T) {
+	// collectorsHandler reports overrides relative to the current time.
+	now := time.Now().UTC().Round(0)
+	procs := testProcs("", "")
+	procs[0].Name, procs[0].Overrides = "Billing Data", &Overrides{}
+	procs[1].Name, procs[1].Overrides = "health", &Overrides{}
+	h := overridesHandler(procs, &testTime{now: &now})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do(http.MethodPatch, "/collectors/billing_data/overrides", `{"interval_multiplier": 0.5, "ttl": "1h"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "Non-integer multipliers should be rejected")
+	rec = do(http.MethodPatch, "/collectors/billing_data/overrides", `{"interval_multiplier": 2, "ttl": "48h"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "Overrides exceeding the max TTL should be rejected")
+	rec = do(http.MethodPatch, "/collectors/billing_data/overrides", `{"max_queries": 10, "ttl": "1h"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "Unknown fields should be rejected")
+	active, pending := procs[0].Overrides.status(now)
+	assert.Nil(t, active)
+	assert.Nil(t, pending, "Rejected overrides should not be set")
+
+	rec = do(http.MethodPatch, "/collectors/billing_data/overrides", `{"interval_multiplier": 2, "ttl": "1h"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var got map[CollectorID]*overrideStatus
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, 2, got["a"].Pending.IntervalMultiplier, "Accepted overrides should be pending")
+	assert.Equal(t, now.Add(time.Hour), got["a"].Pending.Expires)
+	_, pending = procs[1].Overrides.status(now)
+	assert.Nil(t, pending, "Overrides should only be set on the named collector")
+
+	procs[0].Overrides.apply(now)
+	rec = do(http.MethodGet, "/collectors/billing_data/overrides", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	got = nil
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, 2, got["a"].Active.IntervalMultiplier, "Applied overrides should be reported active")
+
+	rec = httptest.NewRecorder()
+	collectorsHandler(procs).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/collectors", http.NoBody))
+	assert.Contains(t, rec.Body.String(), `"overrides":{"active":{"interval_multiplier":2`, "Overrides should be listed with the collectors")
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/collectors/unknown/overrides", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/collectors/health", "").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodDelete, "/collectors/health/overrides", "").Code)
+}
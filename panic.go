@@ -0,0 +1,86 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// DefaultMaxConsecutivePanics is the number of consecutive runs a collector may
+// panic in before it stops itself, see CollectorConfig.MaxConsecutivePanics.
+const DefaultMaxConsecutivePanics = 3
+
+// RepanicEnv is the environment variable that disables the recovery of
+// collector panics if set to a non-empty value, e.g. to get a crash with the
+// full trace while debugging.
+const RepanicEnv = "PROMWATCH_REPANIC"
+
+var ErrCollectorPanic = errors.New("Collector panicked")
+
+// recoverPanic recovers a panic of the collector in the given phase so it does
+// not take down the whole process. The panic is logged with its stack, counted,
+// and returned as error in err. It has to be deferred directly to be able to
+// recover.
+func (b *BaseCollector) recoverPanic(phase string, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if os.Getenv(RepanicEnv) != "" {
+		panic(r)
+	}
+
+	b.logger().Errorw("collector panicked", "id", b.ID(), "name", b.config.Name, "type", b.config.Type, "phase", phase, "panic", r, "stack", string(debug.Stack()))
+	b.Telemetry().PanicsCount.Inc()
+	atomic.StoreInt32(&b.panicked, 1)
+	*err = fmt.Errorf("%w during %s: %v", ErrCollectorPanic, phase, r)
+}
+
+// safeCollect runs collectIfActive, recovering panics.
+func (b *BaseCollector) safeCollect(ctx context.Context, getResources resourceGetter, dim metricDimensions) (err error) {
+	defer b.recoverPanic("collect", &err)
+
+	return b.collectIfActive(ctx, getResources, dim)
+}
+
+// safeStoreResults runs storeResults, recovering panics. A panic fails the
+// store phase. It returns the error of the commit or the panic.
+func (b *BaseCollector) safeStoreResults(index *ResourceIndex) (err error) {
+	var panicErr error
+	defer func() {
+		if panicErr != nil {
+			b.recordPhase(PhaseStore, panicErr)
+			_ = b.HandleError(panicErr)
+			err = panicErr
+		}
+	}()
+	defer b.recoverPanic("store", &panicErr)
+
+	return b.storeResults(index)
+}
+
+// countPanics updates the number of consecutive runs that panicked. It is
+// called after every collection. As results are stored asynchronously, a panic
+// storing the results of a run is counted with the run after it.
+func (b *BaseCollector) countPanics() {
+	if atomic.SwapInt32(&b.panicked, 0) == 1 {
+		b.consecutivePanics++
+	} else {
+		b.consecutivePanics = 0
+	}
+}
+
+// panicLoop returns true if the collector panicked in as many consecutive runs
+// as allowed and should stop instead of continuing to panic.
+func (b *BaseCollector) panicLoop() bool {
+	max := b.config.MaxConsecutivePanics
+	if max == 0 {
+		max = DefaultMaxConsecutivePanics
+	}
+
+	return b.consecutivePanics >= max
+}
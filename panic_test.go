@@ -0,0 +1,98 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
+)
+
+func panickingGetter(ctx context.Context) (*ResourceIndex, error) {
+	var index *ResourceIndex
+	// nil pointer dereference like a missing field of an AWS response
+	return index, errors.New(index.Resources["missing"].String())
+}
+
+// panicStore is a Store panicking on commit.
+type panicStore struct {
+	Store
+}
+
+func (panicStore) Commit() {
+	panic("commit failed")
+}
+
+func TestCollectorPanicLoop(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs", MaxConsecutivePanics: 2}))
+	b._client = &FakeClient{}
+	proc := b.run(panickingGetter, defaultMetricDimension(b.dimension, b.resourcePrefix))
+
+	select {
+	case c := <-proc.Done:
+		assert.Equal(t, b, c, "Collectors panicking in consecutive runs should stop through the done channel")
+	case <-time.After(time.Second):
+		assert.Fail(t, "Collector did not stop after consecutive panics")
+	}
+	assert.Nil(t, proc.Close())
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(b.Telemetry().PanicsCount), "Panics should be counted")
+	assert.Equal(t, 2.0, testutil.ToFloat64(b.Telemetry().ErrorCount), "Runs that panicked should fail")
+}
+
+func TestCountPanics(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs", Interval: 60}))
+	b._client = &FakeClient{}
+	b.store = NewStore(0)
+	dim := defaultMetricDimension(b.dimension, b.resourcePrefix)
+
+	b.tick(context.Background(), panickingGetter, dim)
+	b.tick(context.Background(), panickingGetter, dim)
+	assert.Equal(t, 2, b.consecutivePanics)
+	assert.False(t, b.panicLoop(), "Collectors should keep running below the default max")
+
+	b.tick(context.Background(), nil, dim)
+	assert.Equal(t, 0, b.consecutivePanics, "Runs without panic should reset the consecutive panics")
+
+	for i := 0; i < DefaultMaxConsecutivePanics; i++ {
+		b.tick(context.Background(), panickingGetter, dim)
+	}
+	assert.True(t, b.panicLoop(), "Collectors should stop after the default max of consecutive panics")
+	assert.Equal(t, float64(2+DefaultMaxConsecutivePanics), testutil.ToFloat64(b.Telemetry().PanicsCount))
+}
+
+func TestStoreResultsPanic(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:        "ebs",
+		MetricStats: []MetricStat{{MetricName: "VolumeReadBytes", Stat: "Sum"}},
+	}))
+	b.store = panicStore{NewStore(0)}
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff")},
+	}
+
+	assert.NotPanics(t, func() { b.safeStoreResults(NewResourceIndexFromTagMapping(&resources, id)) })
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.Telemetry().PanicsCount))
+	assert.Equal(t, 0.0, testutil.ToFloat64(b.Telemetry().PhaseHealthy.WithLabelValues(PhaseStore)), "Panics should fail the store phase")
+
+	b.countPanics()
+	assert.Equal(t, 1, b.consecutivePanics, "Store panics should be counted with the next run")
+}
+
+func TestRepanic(t *testing.T) {
+	t.Setenv(RepanicEnv, "1")
+
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"}))
+	b._client = &FakeClient{}
+	assert.Panics(t, func() {
+		_ = b.safeCollect(context.Background(), panickingGetter, defaultMetricDimension(b.dimension, b.resourcePrefix))
+	}, "Panics should not be recovered with the repanic environment variable set")
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Phases of a collection run whose health is tracked separately.
+const (
+	PhaseDiscovery = "discovery"
+	PhaseQuery     = "query"
+	PhaseStore     = "store"
+)
+
+// phaseFailureThreshold is the number of consecutive failures after which a
+// phase is considered failing persistently.
+const phaseFailureThreshold = 3
+
+// iamActions maps Client methods to the IAM action they require.
+var iamActions = map[string]string{
+	MethodGetResources:              "tag:GetResources",
+	MethodGetMetricData:             "cloudwatch:GetMetricData",
+	MethodDescribeAutoScalingGroups: "autoscaling:DescribeAutoScalingGroups",
+	MethodDescribeCacheClusters:     "elasticache:DescribeCacheClusters",
+	MethodListConfigResources:       "config:SelectResourceConfig",
+	MethodDescribeRegions:           "ec2:DescribeRegions",
+	MethodListAccountAliases:        "iam:ListAccountAliases",
+	MethodDescribeDBInstances:       "rds:DescribeDBInstances",
+	MethodListNodes:                 "kafka:ListNodes",
+}
+
+// authErrorCodes are the AWS error codes of requests denied due to missing
+// permissions.
+var authErrorCodes = map[string]struct{}{
+	"AccessDenied":          {},
+	"AccessDeniedException": {},
+	"AuthorizationError":    {},
+	"UnauthorizedOperation": {},
+}
+
+// isAuthError returns true if err is caused by missing permissions.
+func isAuthError(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	_, ok := authErrorCodes[aerr.Code()]
+
+	return ok
+}
+
+// missingAction returns the IAM action required by the failed method of err,
+// if known.
+func missingAction(err error) (string, bool) {
+	var merr *MethodError
+	if !errors.As(err, &merr) {
+		return "", false
+	}
+	action, ok := iamActions[merr.Method]
+
+	return action, ok
+}
+
+// phaseHealth tracks the consecutive failures of every phase of a collector.
+// It is safe for concurrent use as results are stored asynchronously.
+type phaseHealth struct {
+	sync.Mutex
+
+	failures map[string]int
+	// hinted holds the phases a missing permission was logged for in the
+	// current streak of failures.
+	hinted map[string]bool
+}
+
+// record updates the health of phase with the result of its latest run. It
+// returns the IAM action to hint at if phase is the only phase failing
+// persistently due to missing permissions and was not hinted at yet in the
+// current streak of failures.
+func (h *phaseHealth) record(phase string, err error) (string, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.failures == nil {
+		h.failures = map[string]int{}
+		h.hinted = map[string]bool{}
+	}
+
+	if err == nil {
+		h.failures[phase] = 0
+		h.hinted[phase] = false
+		return "", false
+	}
+
+	h.failures[phase]++
+	if h.hinted[phase] || h.failures[phase] < phaseFailureThreshold || !isAuthError(err) {
+		return "", false
+	}
+	for p, f := range h.failures {
+		if p != phase && f > 0 {
+			return "", false
+		}
+	}
+
+	action, ok := missingAction(err)
+	if ok {
+		h.hinted[phase] = true
+	}
+
+	return action, ok
+}
+
+// recordPhase updates the health of phase and its telemetry. If only phase
+// keeps failing due to missing permissions the likely missing IAM action is
+// logged once.
+func (b *BaseCollector) recordPhase(phase string, err error) {
+	healthy := 1.0
+	if err != nil {
+		healthy = 0
+	}
+	b.Telemetry().PhaseHealthy.WithLabelValues(phase).Set(healthy)
+
+	if action, ok := b.phases.record(phase, err); ok {
+		b.logger().Errorw("collector phase keeps failing due to missing permissions, check the IAM policy",
+			"id", b.ID(), "name", b.config.Name, "type", b.config.Type,
+			"phase", phase, "action", action, "error", err)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+var errAccessDenied = awserr.New("AccessDeniedException", "not authorized to perform: cloudwatch:GetMetricData", nil)
+
+func TestPhaseHealthRecord(t *testing.T) {
+	denied := &MethodError{Method: MethodGetMetricData, Err: errAccessDenied}
+	other := &MethodError{Method: MethodGetMetricData, Err: errScripted}
+
+	type step struct {
+		phase  string
+		err    error
+		action string
+	}
+	cases := []struct {
+		steps   []step
+		message string
+	}{
+		{
+			steps: []step{
+				{PhaseQuery, denied, ""},
+				{PhaseQuery, denied, ""},
+				{PhaseQuery, denied, "cloudwatch:GetMetricData"},
+				{PhaseQuery, denied, ""},
+			},
+			message: "Persistent auth failures should be hinted at once",
+		},
+		{
+			steps: []step{
+				{PhaseQuery, denied, ""},
+				{PhaseQuery, denied, ""},
+				{PhaseQuery, denied, "cloudwatch:GetMetricData"},
+				{PhaseQuery, nil, ""},
+				{PhaseQuery, denied, ""},
+				{PhaseQuery, denied, ""},
+				{PhaseQuery, denied, "cloudwatch:GetMetricData"},
+			},
+			message: "Hints should be repeated after the phase recovered",
+		},
+		{
+			steps: []step{
+				{PhaseQuery, other, ""},
+				{PhaseQuery, other, ""},
+				{PhaseQuery, other, ""},
+			},
+			message: "Other errors should not be hinted at",
+		},
+		{
+			steps: []step{
+				{PhaseStore, errScripted, ""},
+				{PhaseQuery, denied, ""},
+				{PhaseQuery, denied, ""},
+				{PhaseQuery, denied, ""},
+			},
+			message: "Auth failures should not be hinted at if other phases fail as well",
+		},
+		{
+			steps: []step{
+				{PhaseQuery, denied, ""},
+				{PhaseQuery, errAccessDenied, ""},
+				{PhaseQuery, errAccessDenied, ""},
+			},
+			message: "Auth failures of unknown methods should not be hinted at",
+		},
+	}
+
+	for _, c := range cases {
+		h := phaseHealth{}
+		for i, s := range c.steps {
+			action, ok := h.record(s.phase, s.err)
+			assert.Equal(t, s.action, action, "%s: step %d", c.message, i)
+			assert.Equal(t, s.action != "", ok, "%s: step %d", c.message, i)
+		}
+	}
+}
+
+func TestPhaseHealthQueryAuthFailure(t *testing.T) {
+	client := &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{
+			{{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff")}},
+		},
+		Errors: map[string]error{MethodGetMetricData: errAccessDenied},
+	}
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:        "ebs",
+		MetricStats: []MetricStat{{MetricName: "VolumeReadBytes", Stat: "Sum"}},
+	}))
+	b._client = client
+	b.store = NewStore(0)
+	phases := b.Telemetry().PhaseHealthy
+
+	for i := 0; i < phaseFailureThreshold; i++ {
+		assert.Nil(t, b.collect(context.Background(), nil, defaultMetricDimension(b.dimension, b.resourcePrefix)))
+	}
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(phases.WithLabelValues(PhaseDiscovery)), "Discovery should be healthy")
+	assert.Equal(t, 0.0, testutil.ToFloat64(phases.WithLabelValues(PhaseQuery)), "Query should be unhealthy")
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(phases.WithLabelValues(PhaseStore)) == 1
+	}, time.Second, time.Millisecond, "Store should be healthy")
+
+	b.phases.Lock()
+	assert.True(t, b.phases.hinted[PhaseQuery], "Missing permission should be hinted at")
+	b.phases.Unlock()
+
+	client.Lock()
+	client.Errors = nil
+	client.Unlock()
+	assert.Nil(t, b.collect(context.Background(), nil, defaultMetricDimension(b.dimension, b.resourcePrefix)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(phases.WithLabelValues(PhaseQuery)), "Query should recover")
+}
+
+func TestPhaseHealthDiscoveryFailure(t *testing.T) {
+	client := &FakeClient{Errors: map[string]error{MethodGetResources: errAccessDenied}}
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"}))
+	b._client = client
+	b.store = NewStore(0)
+
+	assert.NotNil(t, b.collect(context.Background(), nil, defaultMetricDimension(b.dimension, b.resourcePrefix)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(b.Telemetry().PhaseHealthy.WithLabelValues(PhaseDiscovery)), "Discovery should be unhealthy")
+	assert.Equal(t, 1, len(client.Calls()), "Query should not run after discovery failed")
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// UnixSocketPrefix is the prefix of listen addresses of Unix domain sockets,
+// e.g. unix:///run/promwatch.sock.
+const UnixSocketPrefix = "unix://"
+
+var (
+	ErrUnixSocketUnsupported = errors.New("Unix socket listen addresses are not supported on this platform")
+	ErrConfigNotReadable     = errors.New("Config file not readable")
+)
+
+// validListen returns an error if the listen address is a Unix socket on a
+// platform not supporting them.
+func validListen(addr string) error {
+	if strings.HasPrefix(addr, UnixSocketPrefix) && !unixSocketSupported {
+		return fmt.Errorf("%w: %s", ErrUnixSocketUnsupported, addr)
+	}
+
+	return nil
+}
+
+// listen returns a listener for the listen address, a TCP address or a Unix
+// socket path prefixed by UnixSocketPrefix. A stale socket file left behind by
+// a previous run is removed.
+func listen(addr string) (net.Listener, error) {
+	if err := validListen(addr); err != nil {
+		return nil, err
+	}
+
+	path, ok := strings.CutPrefix(addr, UnixSocketPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	path = filepath.Clean(filepath.FromSlash(path))
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// platformCapabilities are the platform dependent features available in the
+// running binary.
+type platformCapabilities struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+	// ReloadSignal is true if the config is reloaded on SIGHUP, the reload
+	// endpoint is available on all platforms.
+	ReloadSignal bool `json:"reload_signal"`
+	UnixSocket   bool `json:"unix_socket"`
+}
+
+func capabilities() platformCapabilities {
+	return platformCapabilities{
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		ReloadSignal: len(reloadSignals) > 0,
+		UnixSocket:   unixSocketSupported,
+	}
+}
+
+// versionHandler serves the build information and platform capabilities as
+// JSON.
+func versionHandler() http.Handler {
+	type version struct {
+		Version   string               `json:"version"`
+		GitHash   string               `json:"githash"`
+		Date      string               `json:"date"`
+		GoVersion string               `json:"go_version"`
+		Platform  platformCapabilities `json:"platform"`
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(version{
+			Version:   Version,
+			GitHash:   GitHash,
+			Date:      Date,
+			GoVersion: runtime.Version(),
+			Platform:  capabilities(),
+		})
+	})
+}
+
+// reloader reloads the config file on request of the reload endpoint or a
+// reload signal. Only the log level is applied at runtime, other changes like
+// the collectors require a restart.
+type reloader struct {
+	sync.Mutex
+
+	configFile string
+}
+
+// reload reads and validates the config file and applies the log level.
+func (r *reloader) reload() error {
+	r.Lock()
+	defer r.Unlock()
+
+	// loadConfig falls back to the defaults for missing files, which must
+	// not reset a running instance.
+	if _, err := os.Stat(r.configFile); err != nil {
+		return fmt.Errorf("%w: %s", ErrConfigNotReadable, err)
+	}
+	conf, err := loadConfig(r.configFile)
+	if err != nil {
+		return err
+	}
+
+	Level.SetLevel(Levels.Get(conf.LogLevel))
+	// Collectors added or removed only take effect on restart, so ready
+	// falls behind total until then.
+	collectorsTotal.Set(float64(len(conf.Collectors)))
+	Logger.Infow("config reloaded, changes other than the log level require a restart", "config", r.configFile, "log_level", conf.LogLevel)
+
+	return nil
+}
+
+// ServeHTTP reloads the config on POST requests to /-/reload.
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.reload(); err != nil {
+		Logger.Errorw("config reload failed", "config", r.configFile, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// watchSignals reloads the config on every reload signal until stop is closed.
+// It returns right away on platforms without reload signals.
+func (r *reloader) watchSignals(stop <-chan struct{}) {
+	if len(reloadSignals) == 0 {
+		return
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, reloadSignals...)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-c:
+				if err := r.reload(); err != nil {
+					Logger.Errorw("config reload failed", "config", r.configFile, "error", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestVersionHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	versionHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", http.NoBody))
+
+	var got struct {
+		Version  string               `json:"version"`
+		Platform platformCapabilities `json:"platform"`
+	}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, Version, got.Version)
+	assert.Equal(t, runtime.GOOS, got.Platform.OS)
+	assert.Equal(t, len(reloadSignals) > 0, got.Platform.ReloadSignal)
+	assert.Equal(t, unixSocketSupported, got.Platform.UnixSocket)
+}
+
+func TestReloadHandler(t *testing.T) {
+	defer Level.SetLevel(Level.Level())
+
+	configFile := filepath.Join(t.TempDir(), "promwatch.yaml")
+	r := &reloader{configFile: configFile}
+	post := func() int {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/-/reload", http.NoBody))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusInternalServerError, post(), "Missing config files should fail the reload")
+
+	assert.Nil(t, os.WriteFile(configFile, []byte("log_level: debug\ncollectors: [{type: ebs}, {type: sqs}]\n"), 0o600))
+	assert.Equal(t, http.StatusOK, post())
+	assert.Equal(t, zapcore.DebugLevel, Level.Level(), "Reloading should apply the log level")
+	assert.Equal(t, float64(2), testutil.ToFloat64(collectorsTotal), "Reloading should update the number of configured collectors")
+
+	assert.Nil(t, os.WriteFile(configFile, []byte("log_level: error\ncollectors: [{type: unknown}]\n"), 0o600))
+	assert.Equal(t, http.StatusInternalServerError, post(), "Invalid configs should fail the reload")
+	assert.Equal(t, zapcore.DebugLevel, Level.Level(), "Invalid configs should not be applied")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/-/reload", http.NoBody))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,21 @@
+// Copyright 2021 CrowdStrike, Inc.
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// reloadSignals are the signals reloading the config, see reloader.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
+
+// unixSocketSupported is true if the listen address may be a Unix socket.
+const unixSocketSupported = true
+
+// replaceFile atomically replaces dst with src.
+func replaceFile(src, dst string) error {
+	return os.Rename(src, dst)
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 CrowdStrike, Inc.
+
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "promwatch.sock")
+
+	for i := 0; i < 2; i++ {
+		l, err := listen(UnixSocketPrefix + path)
+		assert.Nil(t, err, "Stale socket files should be replaced")
+		// Leave the socket file behind like a killed process.
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		s := &http.Server{
+			Handler:           versionHandler(),
+			ReadHeaderTimeout: time.Second,
+		}
+		go func() { _ = s.Serve(l) }()
+
+		c := &http.Client{Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) { return net.Dial("unix", path) },
+		}}
+		res, err := c.Get("http://promwatch/version")
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		res.Body.Close()
+		c.CloseIdleConnections()
+
+		assert.Nil(t, s.Close())
+	}
+}
+
+func TestReloadSignal(t *testing.T) {
+	defer Level.SetLevel(Level.Level())
+
+	configFile := filepath.Join(t.TempDir(), "promwatch.yaml")
+	assert.Nil(t, os.WriteFile(configFile, []byte("log_level: warn\n"), 0o600))
+	stop := make(chan struct{})
+	defer close(stop)
+	(&reloader{configFile: configFile}).watchSignals(stop)
+
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.Eventually(t, func() bool {
+		return Level.Level() == zapcore.WarnLevel
+	}, time.Second, 10*time.Millisecond, "SIGHUP should reload the config")
+}
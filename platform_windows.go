@@ -0,0 +1,36 @@
+// Copyright 2021 CrowdStrike, Inc.
+
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// reloadSignals is empty as there is no SIGHUP on Windows, the config is only
+// reloaded through the reload endpoint.
+var reloadSignals []os.Signal
+
+// unixSocketSupported is false as Unix sockets are not supported as listen
+// address on Windows.
+const unixSocketSupported = false
+
+// replaceFileAttempts is the number of attempts to replace a file, see
+// replaceFile.
+const replaceFileAttempts = 5
+
+// replaceFile replaces dst with src. Renaming onto a file fails on Windows
+// while another process, e.g. a textfile collector, has it open, so the rename
+// is retried shortly.
+func replaceFile(src, dst string) (err error) {
+	for i := 0; i < replaceFileAttempts; i++ {
+		if err = os.Rename(src, dst); err == nil {
+			return nil
+		}
+		time.Sleep(time.Duration(i+1) * 10 * time.Millisecond)
+	}
+
+	return err
+}
@@ -0,0 +1,40 @@
+// Copyright 2021 CrowdStrike, Inc.
+
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestWindowsCapabilities(t *testing.T) {
+	assert.Empty(t, reloadSignals, "Windows has no reload signal")
+	assert.False(t, capabilities().UnixSocket)
+}
+
+func TestListenUnixSocketUnsupported(t *testing.T) {
+	_, err := listen(`unix://C:\promwatch.sock`)
+	assert.ErrorIs(t, err, ErrUnixSocketUnsupported)
+
+	conf := PromWatchConfig{}
+	err = yaml.Unmarshal([]byte(`listen: unix://C:\promwatch.sock`), &conf)
+	assert.ErrorIs(t, err, ErrUnixSocketUnsupported, "Unix socket addresses should fail the config validation")
+}
+
+func TestReplaceFile(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	assert.Nil(t, os.WriteFile(src, []byte("new"), 0o600))
+	assert.Nil(t, os.WriteFile(dst, []byte("old"), 0o600))
+
+	assert.Nil(t, replaceFile(src, dst))
+	got, err := os.ReadFile(dst)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(got))
+}
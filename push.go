@@ -0,0 +1,175 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+var ErrInvalidRemoteWrite = errors.New("Invalid remote write configuration")
+
+// TenantHeader is the header carrying the tenant of push requests to
+// multi-tenant receivers like Mimir.
+const TenantHeader = "X-Scope-OrgID"
+
+// pusher is the Pusher shared by all collectors. It is nil in case no push URL
+// is configured.
+var pusher *Pusher
+
+// PushTimeout is the timeout of a single push request.
+const PushTimeout = 5 * time.Second
+
+// PushQueueSize is the number of commits queued for pushing, samples of further
+// commits are dropped until the queue drains.
+const PushQueueSize = 64
+
+// Pusher sends samples as snappy compressed Prometheus remote write requests
+// to a receiver, e.g. the receive endpoint of a local agent. Requests are not
+// retried, retries are left to the receiver.
+type Pusher struct {
+	url    string
+	conf   RemoteWriteConfig
+	client *http.Client
+	queue  chan []Sample
+}
+
+// RemoteWriteConfig holds the tenant and credentials sent along with push
+// requests, e.g. to Grafana Cloud or Mimir. Either basic auth or a bearer token
+// can be configured. The password and token are either set directly or read
+// from a file when the configuration is loaded.
+type RemoteWriteConfig struct {
+	// TenantID is sent as TenantHeader if set.
+	TenantID        string          `yaml:"tenant_id"`
+	BasicAuth       BasicAuthConfig `yaml:"basic_auth"`
+	BearerToken     string          `yaml:"bearer_token"`
+	BearerTokenFile string          `yaml:"bearer_token_file"`
+}
+
+// enabled returns true if any option is configured.
+func (c RemoteWriteConfig) enabled() bool {
+	return c.TenantID != "" || c.BasicAuth != (BasicAuthConfig{}) || c.BearerToken != "" || c.BearerTokenFile != ""
+}
+
+// resolve returns the configuration with the password and bearer token read
+// from their files, if set. It returns an error if both basic auth and a
+// bearer token are configured, or both the bearer token and its file.
+func (c RemoteWriteConfig) resolve() (RemoteWriteConfig, error) {
+	basicAuth, err := c.BasicAuth.resolve()
+	if err != nil {
+		return c, fmt.Errorf("%w: %w", ErrInvalidRemoteWrite, err)
+	}
+	c.BasicAuth = basicAuth
+
+	if c.BearerToken != "" && c.BearerTokenFile != "" {
+		return c, fmt.Errorf("%w: either bearer_token or bearer_token_file can be set", ErrInvalidRemoteWrite)
+	}
+	if c.BearerTokenFile != "" {
+		content, err := os.ReadFile(c.BearerTokenFile)
+		if err != nil {
+			return c, fmt.Errorf("%w: %s", ErrInvalidRemoteWrite, err)
+		}
+		c.BearerToken = strings.TrimRight(string(content), "\r\n")
+		if c.BearerToken == "" {
+			return c, fmt.Errorf("%w: empty bearer token file: %s", ErrInvalidRemoteWrite, c.BearerTokenFile)
+		}
+	}
+	if c.BasicAuth.enabled() && c.BearerToken != "" {
+		return c, fmt.Errorf("%w: either basic_auth or a bearer token can be set", ErrInvalidRemoteWrite)
+	}
+
+	return c, nil
+}
+
+// apply sets the tenant and authorization headers of the configuration on
+// req.
+func (c RemoteWriteConfig) apply(req *http.Request) {
+	if c.TenantID != "" {
+		req.Header.Set(TenantHeader, c.TenantID)
+	}
+	if c.BasicAuth.enabled() {
+		req.SetBasicAuth(c.BasicAuth.Username, c.BasicAuth.Password)
+	}
+	if c.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	}
+}
+
+// NewPusher returns a Pusher sending samples to url with the tenant and
+// credentials of conf.
+func NewPusher(url string, conf RemoteWriteConfig) *Pusher {
+	return &Pusher{
+		url:    url,
+		conf:   conf,
+		client: &http.Client{Timeout: PushTimeout},
+		queue:  make(chan []Sample, PushQueueSize),
+	}
+}
+
+// Enqueue queues samples to be pushed by Run without blocking, so collectors
+// are not held up by a slow receiver. The samples are dropped and counted if
+// the queue is full.
+func (p *Pusher) Enqueue(samples []Sample) {
+	select {
+	case p.queue <- samples:
+	default:
+		Logger.Warnw("push queue full, dropping samples", "url", p.url, "samples", len(samples))
+		pushCount.WithLabelValues("dropped").Inc()
+	}
+}
+
+// Run pushes the queued samples one request at a time until stop is closed.
+func (p *Pusher) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case samples := <-p.queue:
+			_ = p.Push(samples)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Push sends samples in a single write request. The outcome is counted and
+// errors are logged and returned.
+func (p *Pusher) Push(samples []Sample) error {
+	err := p.push(samples)
+	if err != nil {
+		Logger.Warnw("pushing samples failed", "url", p.url, "error", err)
+		pushCount.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	pushCount.WithLabelValues("success").Inc()
+	return nil
+}
+
+func (p *Pusher) push(samples []Sample) error {
+	body := snappy.Encode(nil, encodeWriteRequest(samples))
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	p.conf.apply(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Push to %s failed with status %s", p.url, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+	"gopkg.in/yaml.v2"
+)
+
+// decodedSeries is a time series decoded from a remote write request.
+type decodedSeries struct {
+	labels  map[string]string
+	samples [][2]float64
+}
+
+// decodeWriteRequest decodes a WriteRequest protobuf message, failing the
+// test on malformed input.
+func decodeWriteRequest(t *testing.T, b []byte) []decodedSeries {
+	res := []decodedSeries{}
+	forEachField(t, b, func(num protowire.Number, v []byte, _ uint64) {
+		assert.Equal(t, protowire.Number(writeRequestTimeseries), num)
+		ts := decodedSeries{labels: map[string]string{}}
+		forEachField(t, v, func(num protowire.Number, v []byte, _ uint64) {
+			switch num {
+			case timeSeriesLabels:
+				var name, value string
+				forEachField(t, v, func(num protowire.Number, v []byte, _ uint64) {
+					if num == labelName {
+						name = string(v)
+					} else {
+						value = string(v)
+					}
+				})
+				ts.labels[name] = value
+			case timeSeriesSamples:
+				var sample [2]float64
+				forEachField(t, v, func(num protowire.Number, _ []byte, n uint64) {
+					if num == sampleValue {
+						sample[0] = math.Float64frombits(n)
+					} else {
+						sample[1] = float64(n)
+					}
+				})
+				ts.samples = append(ts.samples, sample)
+			}
+		})
+		res = append(res, ts)
+	})
+
+	return res
+}
+
+func forEachField(t *testing.T, b []byte, f func(protowire.Number, []byte, uint64)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		assert.GreaterOrEqual(t, n, 0)
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			assert.GreaterOrEqual(t, n, 0)
+			f(num, v, 0)
+			b = b[n:]
+		case protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			assert.GreaterOrEqual(t, n, 0)
+			f(num, nil, v)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			assert.GreaterOrEqual(t, n, 0)
+			f(num, nil, v)
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+	}
+}
+
+func TestPusher(t *testing.T) {
+	var got []decodedSeries
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(r.Body)
+		decoded, err := snappy.Decode(nil, body)
+		assert.Nil(t, err)
+		got = decodeWriteRequest(t, decoded)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	labels := []Label{{Name: "volume_id", Value: "vol-1"}, {Name: "arn", Value: "arn:1"}}
+	samples := []Sample{
+		{Name: "promwatch_aws_ebs_volume_read_bytes_sum", Labels: labels, Value: 2.5, Timestamp: 120000},
+		{Name: "promwatch_aws_ebs_volume_read_bytes_sum", Labels: labels, Value: 1.5, Timestamp: 60000},
+		{Name: "promwatch_aws_ebs_volume_write_bytes_sum", Labels: labels, Value: 3, Timestamp: 60000},
+	}
+
+	before := testutil.ToFloat64(pushCount.WithLabelValues("success"))
+	assert.Nil(t, NewPusher(srv.URL, RemoteWriteConfig{}).Push(samples))
+	assert.Equal(t, before+1, testutil.ToFloat64(pushCount.WithLabelValues("success")))
+
+	assert.Equal(t, []decodedSeries{
+		{
+			labels: map[string]string{
+				"__name__":  "promwatch_aws_ebs_volume_read_bytes_sum",
+				"arn":       "arn:1",
+				"volume_id": "vol-1",
+			},
+			samples: [][2]float64{{1.5, 60000}, {2.5, 120000}},
+		},
+		{
+			labels: map[string]string{
+				"__name__":  "promwatch_aws_ebs_volume_write_bytes_sum",
+				"arn":       "arn:1",
+				"volume_id": "vol-1",
+			},
+			samples: [][2]float64{{3, 60000}},
+		},
+	}, got)
+}
+
+func TestPusherFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	before := testutil.ToFloat64(pushCount.WithLabelValues("failure"))
+	assert.NotNil(t, NewPusher(srv.URL, RemoteWriteConfig{}).Push([]Sample{{Name: "test", Value: 1}}))
+	assert.Equal(t, before+1, testutil.ToFloat64(pushCount.WithLabelValues("failure")))
+}
+
+func TestPusherQueue(t *testing.T) {
+	received := make(chan struct{}, PushQueueSize)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+		received <- struct{}{}
+	}))
+	defer srv.Close()
+
+	p := NewPusher(srv.URL, RemoteWriteConfig{})
+	before := testutil.ToFloat64(pushCount.WithLabelValues("dropped"))
+	for i := 0; i < PushQueueSize+1; i++ {
+		p.Enqueue([]Sample{{Name: "test", Value: float64(i)}})
+	}
+	assert.Equal(t, before+1, testutil.ToFloat64(pushCount.WithLabelValues("dropped")), "Samples should be dropped if the queue is full")
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		p.Run(stop)
+		close(done)
+	}()
+	for i := 0; i < PushQueueSize; i++ {
+		<-received
+	}
+	close(stop)
+	<-done
+	assert.Empty(t, p.queue, "All queued samples should be pushed")
+}
+
+func TestPusherRemoteWriteHeaders(t *testing.T) {
+	cases := []struct {
+		conf     RemoteWriteConfig
+		tenant   string
+		auth     string
+		expected string
+		message  string
+	}{
+		{
+			conf:    RemoteWriteConfig{},
+			message: "No tenant or authorization should be sent without configuration",
+		},
+		{
+			conf:     RemoteWriteConfig{TenantID: "team-a", BasicAuth: BasicAuthConfig{Username: "123456", Password: "secret"}},
+			tenant:   "team-a",
+			expected: "Basic MTIzNDU2OnNlY3JldA==",
+			message:  "Tenant and basic auth should be set",
+		},
+		{
+			conf:     RemoteWriteConfig{BearerToken: "token"},
+			expected: "Bearer token",
+			message:  "Bearer tokens should be set",
+		},
+	}
+
+	for _, c := range cases {
+		var tenant, auth string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant, auth = r.Header.Get(TenantHeader), r.Header.Get("Authorization")
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		assert.Nil(t, NewPusher(srv.URL, c.conf).Push([]Sample{{Name: "test", Value: 1}}), c.message)
+		assert.Equal(t, c.tenant, tenant, c.message)
+		assert.Equal(t, c.expected, auth, c.message)
+		srv.Close()
+	}
+}
+
+func TestConfigRemoteWrite(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("from-file\n"), 0o600))
+
+	var got PromWatchConfig
+	assert.Nil(t, yaml.Unmarshal([]byte("push_url: http://mimir/api/v1/push\nremote_write: {tenant_id: team-a, bearer_token_file: "+tokenFile+"}"), &got))
+	assert.Equal(t, RemoteWriteConfig{TenantID: "team-a", BearerToken: "from-file", BearerTokenFile: tokenFile}, got.RemoteWrite,
+		"Bearer tokens should be read from the file without trailing newline")
+
+	cases := map[string]string{
+		"Remote write without push URL should fail":      "remote_write: {tenant_id: team-a}",
+		"Basic auth and bearer token should fail":        "push_url: http://mimir\nremote_write: {bearer_token: token, basic_auth: {username: a, password: b}}",
+		"Bearer token and bearer token file should fail": "push_url: http://mimir\nremote_write: {bearer_token: token, bearer_token_file: " + tokenFile + "}",
+		"Missing bearer token files should fail":         "push_url: http://mimir\nremote_write: {bearer_token_file: " + tokenFile + ".missing}",
+		"Invalid basic auth should fail":                 "push_url: http://mimir\nremote_write: {basic_auth: {username: a}}",
+	}
+	for message, config := range cases {
+		assert.ErrorIs(t, yaml.Unmarshal([]byte(config), &PromWatchConfig{}), ErrInvalidRemoteWrite, message)
+	}
+}
+
+func TestEncodeWriteRequestLabelOrder(t *testing.T) {
+	req := encodeWriteRequest([]Sample{
+		{Name: "test", Labels: []Label{{Name: "b", Value: "2"}, {Name: "a", Value: "1"}}, Value: 1, Timestamp: 1},
+	})
+
+	names := []string{}
+	forEachField(t, req, func(_ protowire.Number, ts []byte, _ uint64) {
+		forEachField(t, ts, func(num protowire.Number, v []byte, _ uint64) {
+			if num != timeSeriesLabels {
+				return
+			}
+			forEachField(t, v, func(num protowire.Number, v []byte, _ uint64) {
+				if num == labelName {
+					names = append(names, string(v))
+				}
+			})
+		})
+	})
+
+	assert.Equal(t, []string{"__name__", "a", "b"}, names, "Labels should be sorted by name")
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Store backends selectable with store_backend.
+const (
+	StoreBackendMemory = "memory"
+	StoreBackendRedis  = "redis"
+)
+
+// DefaultRedisKeyPrefix is the prefix of the keys stores are written to.
+const DefaultRedisKeyPrefix = "promwatch:"
+
+// RedisTimeout limits the duration of every Redis command.
+const RedisTimeout = 5 * time.Second
+
+var ErrUnknownStoreBackend = errors.New("Unknown store backend in configuration")
+
+// Fields of the Redis hash a RedisStore is written to.
+const (
+	redisFieldContent    = "content"
+	redisFieldGeneration = "generation"
+)
+
+// RedisConfig configures the connection to Redis for the redis store backend.
+type RedisConfig struct {
+	Address   string `yaml:"address"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+	DB        int    `yaml:"db"`
+	KeyPrefix string `yaml:"key_prefix"`
+}
+
+// RedisBackend creates stores sharing committed metrics between PromWatch
+// replicas through Redis.
+type RedisBackend struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// redisBackend is used for the stores of all collectors if set, see
+// BaseCollector.newStore.
+var redisBackend *RedisBackend
+
+// NewRedisBackend returns a RedisBackend connecting to Redis as configured.
+func NewRedisBackend(c RedisConfig) *RedisBackend {
+	return &RedisBackend{
+		client: redis.NewClient(&redis.Options{
+			Addr:         c.Address,
+			Username:     c.Username,
+			Password:     c.Password,
+			DB:           c.DB,
+			DialTimeout:  RedisTimeout,
+			ReadTimeout:  RedisTimeout,
+			WriteTimeout: RedisTimeout,
+		}),
+		prefix: c.KeyPrefix,
+	}
+}
+
+// Store returns a store written to the Redis key with the given name.
+func (r *RedisBackend) Store(name string) Store {
+	return &RedisStore{
+		client:   r.client,
+		key:      r.prefix + name,
+		internal: &bytes.Buffer{},
+	}
+}
+
+// RedisStore is a Store keeping committed content in a Redis hash, so all
+// replicas using the same key serve the same content. Added content is
+// buffered in memory until committed.
+type RedisStore struct {
+	sync.Mutex
+
+	client   redis.UniversalClient
+	key      string
+	internal *bytes.Buffer
+	err      error
+}
+
+// Add appends a string to the uncommitted content.
+func (s *RedisStore) Add(str string) {
+	s.Lock()
+	defer s.Unlock()
+	s.internal.WriteString(str)
+}
+
+// Commit replaces the content in Redis with the uncommitted content and
+// increases the generation atomically. The uncommitted content is discarded
+// even if writing to Redis fails, the previous content is served until the
+// next successful commit in that case.
+func (s *RedisStore) Commit() {
+	s.Lock()
+	defer s.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+	defer cancel()
+	_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HSet(ctx, s.key, redisFieldContent, s.internal.String())
+		p.HIncrBy(ctx, s.key, redisFieldGeneration, 1)
+		return nil
+	})
+	if err != nil {
+		Logger.Errorw("committing to redis failed", "key", s.key, "error", err)
+	}
+	s.err = err
+	s.internal.Reset()
+}
+
+// Err returns the error of the last commit.
+func (s *RedisStore) Err() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
+
+// String returns the committed content. Nothing is returned if Redis can not
+// be reached.
+func (s *RedisStore) String() string {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+	defer cancel()
+
+	str, err := s.client.HGet(ctx, s.key, redisFieldContent).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		Logger.Errorw("reading from redis failed", "key", s.key, "error", err)
+	}
+
+	return str
+}
+
+// Generation returns the number of commits to the key by all replicas.
+func (s *RedisStore) Generation() uint64 {
+	ctx, cancel := context.WithTimeout(context.Background(), RedisTimeout)
+	defer cancel()
+
+	str, err := s.client.HGet(ctx, s.key, redisFieldGeneration).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			Logger.Errorw("reading from redis failed", "key", s.key, "error", err)
+		}
+		return 0
+	}
+
+	g, _ := strconv.ParseUint(str, 10, 64)
+
+	return g
+}
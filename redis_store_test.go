@@ -0,0 +1,79 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedisBackend(t *testing.T) (*RedisBackend, *miniredis.Miniredis) {
+	m := miniredis.RunT(t)
+	r := NewRedisBackend(RedisConfig{Address: m.Addr(), KeyPrefix: DefaultRedisKeyPrefix})
+	t.Cleanup(func() { _ = r.client.Close() })
+
+	return r, m
+}
+
+func TestRedisStore(t *testing.T) {
+	r, m := newTestRedisBackend(t)
+	s := r.Store("ebs:volumes:us-east-1")
+
+	assert.Equal(t, "", s.String(), "Empty store should return empty string")
+	assert.Equal(t, uint64(0), s.Generation(), "Empty store should be at generation 0")
+
+	s.Add("first")
+	assert.Equal(t, "", s.String(), "Uncommitted content should not be served")
+	s.Commit()
+	assert.Equal(t, "first", s.String(), "Committed content should be served")
+	assert.Equal(t, uint64(1), s.Generation(), "Commit should increase the generation")
+	assert.Equal(t, "first", m.HGet("promwatch:ebs:volumes:us-east-1", redisFieldContent), "Content should be written to the prefixed key")
+
+	s.Add("second")
+	s.Commit()
+	assert.Equal(t, "second", s.String(), "Commit should replace the content")
+	assert.Equal(t, uint64(2), s.Generation())
+}
+
+func TestRedisStoreShared(t *testing.T) {
+	r, _ := newTestRedisBackend(t)
+	first := r.Store("ebs:volumes:us-east-1")
+	second := r.Store("ebs:volumes:us-east-1")
+	other := r.Store("ebs:volumes:eu-west-1")
+
+	first.Add("shared")
+	first.Commit()
+	assert.Equal(t, "shared", second.String(), "Stores with the same key should share content")
+	assert.Equal(t, first.Generation(), second.Generation(), "Stores with the same key should share the generation")
+	assert.Equal(t, "", other.String(), "Stores with other keys should not share content")
+}
+
+func TestRedisStoreUnavailable(t *testing.T) {
+	r, m := newTestRedisBackend(t)
+	s := r.Store("ebs:volumes:us-east-1")
+	s.Add("first")
+	s.Commit()
+
+	m.SetError("LOADING Redis is loading the dataset in memory")
+	s.Add("second")
+	assert.NotPanics(t, s.Commit, "Failing commits should not panic")
+	assert.Equal(t, "", s.String(), "Unavailable Redis should serve no content")
+	assert.Equal(t, uint64(0), s.Generation())
+
+	m.SetError("")
+	assert.Equal(t, "first", s.String(), "Failed commits should keep the previous content")
+}
+
+func TestBaseCollectorRedisStore(t *testing.T) {
+	r, m := newTestRedisBackend(t)
+	redisBackend = r
+	defer func() { redisBackend = nil }()
+
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs", Name: "volumes", Region: "us-east-1"}))
+	s := b.newStore()
+	s.Add("content")
+	s.Commit()
+
+	assert.True(t, m.Exists("promwatch:ebs:volumes:us-east-1"), "Collector stores should use the redis backend if configured")
+}
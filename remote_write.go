@@ -0,0 +1,113 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the Prometheus remote write protobuf messages, see
+// https://github.com/prometheus/prometheus/blob/main/prompb/types.proto
+const (
+	writeRequestTimeseries = 1
+	timeSeriesLabels       = 1
+	timeSeriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+// series is a time series with all its labels including the metric name.
+type series struct {
+	labels  []Label
+	samples []Sample
+}
+
+// groupSeries groups samples into series identified by their metric name and
+// labels. Labels of each series are sorted by name and samples by timestamp as
+// required by the remote write protocol. The series are sorted by their labels
+// to produce deterministic output.
+func groupSeries(samples []Sample) []*series {
+	index := map[string]*series{}
+	for _, s := range samples {
+		labels := append([]Label{{Name: "__name__", Value: s.Name}}, s.Labels...)
+		sort.SliceStable(labels, func(i, j int) bool {
+			return labels[i].Name < labels[j].Name
+		})
+
+		key := labelsKey(labels)
+		ts, ok := index[key]
+		if !ok {
+			ts = &series{labels: labels}
+			index[key] = ts
+		}
+		ts.samples = append(ts.samples, s)
+	}
+
+	keys := make([]string, 0, len(index))
+	for k := range index {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := make([]*series, 0, len(keys))
+	for _, k := range keys {
+		ts := index[k]
+		sort.SliceStable(ts.samples, func(i, j int) bool {
+			return ts.samples[i].Timestamp < ts.samples[j].Timestamp
+		})
+		res = append(res, ts)
+	}
+
+	return res
+}
+
+func labelsKey(labels []Label) string {
+	b := strings.Builder{}
+	for _, l := range labels {
+		b.WriteString(l.Name)
+		b.WriteByte(0xff)
+		b.WriteString(l.Value)
+		b.WriteByte(0xff)
+	}
+
+	return b.String()
+}
+
+// encodeWriteRequest encodes samples as Prometheus remote write WriteRequest
+// protobuf message. The result is not compressed.
+func encodeWriteRequest(samples []Sample) []byte {
+	var req []byte
+	for _, ts := range groupSeries(samples) {
+		var msg []byte
+		for _, l := range ts.labels {
+			var label []byte
+			label = protowire.AppendTag(label, labelName, protowire.BytesType)
+			label = protowire.AppendString(label, l.Name)
+			label = protowire.AppendTag(label, labelValue, protowire.BytesType)
+			label = protowire.AppendString(label, l.Value)
+
+			msg = protowire.AppendTag(msg, timeSeriesLabels, protowire.BytesType)
+			msg = protowire.AppendBytes(msg, label)
+		}
+		for _, s := range ts.samples {
+			var sample []byte
+			sample = protowire.AppendTag(sample, sampleValue, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(s.Value))
+			sample = protowire.AppendTag(sample, sampleTimestamp, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(s.Timestamp))
+
+			msg = protowire.AppendTag(msg, timeSeriesSamples, protowire.BytesType)
+			msg = protowire.AppendBytes(msg, sample)
+		}
+
+		req = protowire.AppendTag(req, writeRequestTimeseries, protowire.BytesType)
+		req = protowire.AppendBytes(req, msg)
+	}
+
+	return req
+}
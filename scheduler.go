@@ -0,0 +1,175 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// chunkScheduler is the ChunkScheduler shared by all collectors. It is nil in
+// case no CloudWatch rate limit is configured.
+var chunkScheduler *ChunkScheduler
+
+// ChunkScheduler limits the rate of GetMetricData requests shared by all
+// collectors. Every collector has its own queue of waiting requests and the
+// queues are drained round-robin, so a collector with a large backlog can not
+// starve collectors with few requests queued behind it.
+type ChunkScheduler struct {
+	sync.Mutex
+
+	interval time.Duration
+	queues   map[CollectorID]*chunkQueue
+	// ring holds the collectors with waiting requests in the order they
+	// are served.
+	ring []CollectorID
+
+	pending chan struct{}
+	stop    chan struct{}
+}
+
+// chunkQueue holds the requests of a single collector waiting to be
+// dispatched.
+type chunkQueue struct {
+	waiting []chan struct{}
+	tele    *CollectorTelemetry
+}
+
+// NewChunkScheduler creates a ChunkScheduler dispatching at most rate requests
+// per second and starts dispatching.
+func NewChunkScheduler(rate float64) *ChunkScheduler {
+	s := &ChunkScheduler{
+		interval: time.Duration(float64(time.Second) / rate),
+		queues:   map[CollectorID]*chunkQueue{},
+		pending:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	go s.dispatch()
+
+	return s
+}
+
+// Wait blocks until the scheduler dispatches the next request of the
+// collector with the given ID or ctx is done, in which case the request is
+// dropped from the queue and the error of ctx is returned. The time spent
+// waiting and the queue depth are recorded in tele.
+func (s *ChunkScheduler) Wait(ctx context.Context, id CollectorID, tele *CollectorTelemetry) error {
+	start := time.Now()
+	ready := make(chan struct{})
+
+	s.Lock()
+	q, ok := s.queues[id]
+	if !ok {
+		q = &chunkQueue{tele: tele}
+		s.queues[id] = q
+		s.ring = append(s.ring, id)
+	}
+	q.waiting = append(q.waiting, ready)
+	tele.SchedulerQueueDepth.Set(float64(len(q.waiting)))
+	s.Unlock()
+
+	select {
+	case s.pending <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-ready:
+	case <-ctx.Done():
+		s.cancel(id, ready)
+		return ctx.Err()
+	}
+	tele.SchedulerWaitSeconds.Set(time.Since(start).Seconds())
+
+	return nil
+}
+
+// cancel removes the waiting request ready of the collector with the given ID
+// from its queue unless it was dispatched already.
+func (s *ChunkScheduler) cancel(id CollectorID, ready chan struct{}) {
+	s.Lock()
+	defer s.Unlock()
+
+	q, ok := s.queues[id]
+	if !ok {
+		return
+	}
+	for i, w := range q.waiting {
+		if w == ready {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			break
+		}
+	}
+	q.tele.SchedulerQueueDepth.Set(float64(len(q.waiting)))
+	if len(q.waiting) > 0 {
+		return
+	}
+
+	delete(s.queues, id)
+	for i, r := range s.ring {
+		if r == id {
+			s.ring = append(s.ring[:i], s.ring[i+1:]...)
+			break
+		}
+	}
+}
+
+// Stop stops dispatching. Requests still waiting will not be dispatched.
+func (s *ChunkScheduler) Stop() {
+	close(s.stop)
+}
+
+func (s *ChunkScheduler) dispatch() {
+	var last time.Time
+	for {
+		s.Lock()
+		empty := len(s.ring) == 0
+		s.Unlock()
+
+		if empty {
+			select {
+			case <-s.stop:
+				return
+			case <-s.pending:
+			}
+			continue
+		}
+
+		if wait := time.Until(last.Add(s.interval)); wait > 0 {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		s.releaseNext()
+		last = time.Now()
+	}
+}
+
+// releaseNext dispatches the oldest request of the collector next in line and
+// moves the collector to the end of the line if it has more requests waiting.
+func (s *ChunkScheduler) releaseNext() {
+	s.Lock()
+	defer s.Unlock()
+
+	// The ring is empty if the waiting requests were cancelled since
+	// dispatch checked it.
+	if len(s.ring) == 0 {
+		return
+	}
+	id := s.ring[0]
+	s.ring = s.ring[1:]
+
+	q := s.queues[id]
+	close(q.waiting[0])
+	q.waiting = q.waiting[1:]
+	q.tele.SchedulerQueueDepth.Set(float64(len(q.waiting)))
+
+	if len(q.waiting) > 0 {
+		s.ring = append(s.ring, id)
+	} else {
+		delete(s.queues, id)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func schedulerTelemetry(name string) *CollectorTelemetry {
+	return newTelemetryVecs(DefaultTelemetryLabels).collectorTelemetry(prometheus.Labels{LabelCollectorName: name})
+}
+
+func TestChunkSchedulerFairness(t *testing.T) {
+	s := NewChunkScheduler(1000)
+	defer s.Stop()
+
+	large := schedulerTelemetry("large")
+	small := schedulerTelemetry("small")
+
+	var largeDone int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = s.Wait(context.Background(), "large", large)
+			atomic.AddInt64(&largeDone, 1)
+		}()
+	}
+
+	// make sure the large backlog is queued before the small collector
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(large.SchedulerQueueDepth)+float64(atomic.LoadInt64(&largeDone)) == 200
+	}, time.Second, time.Millisecond)
+
+	before := atomic.LoadInt64(&largeDone)
+	smallWg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		smallWg.Add(1)
+		go func() {
+			defer smallWg.Done()
+			_ = s.Wait(context.Background(), "small", small)
+		}()
+	}
+	smallWg.Wait()
+	after := atomic.LoadInt64(&largeDone)
+
+	// Round-robin draining allows at most one large chunk per small chunk
+	// plus the chunks dispatched while the small collector was enqueueing.
+	assert.LessOrEqual(t, after-before, int64(4), "Small collector should not wait for the large backlog")
+	assert.Greater(t, testutil.ToFloat64(large.SchedulerQueueDepth), 150.0, "Large backlog should still be queued")
+	assert.Equal(t, 0.0, testutil.ToFloat64(small.SchedulerQueueDepth))
+
+	wg.Wait()
+	assert.Equal(t, 0.0, testutil.ToFloat64(large.SchedulerQueueDepth))
+	assert.Greater(t, testutil.ToFloat64(large.SchedulerWaitSeconds), 0.0)
+}
+
+func TestChunkSchedulerRate(t *testing.T) {
+	s := NewChunkScheduler(100)
+	defer s.Stop()
+	tele := schedulerTelemetry("rate")
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		_ = s.Wait(context.Background(), "rate", tele)
+	}
+
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond, "Requests should be dispatched at the configured rate")
+}
+
+func TestChunkSchedulerWaitCancelled(t *testing.T) {
+	// A rate this low dispatches the first request only and keeps the
+	// second waiting.
+	s := NewChunkScheduler(0.001)
+	defer s.Stop()
+	tele := schedulerTelemetry("cancelled")
+
+	assert.Nil(t, s.Wait(context.Background(), "cancelled", tele))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Wait(ctx, "cancelled", tele)
+	}()
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(tele.SchedulerQueueDepth) == 1
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("Wait should return once the context is done")
+	}
+	assert.Equal(t, 0.0, testutil.ToFloat64(tele.SchedulerQueueDepth), "Cancelled requests should leave the queue")
+	s.Lock()
+	assert.Empty(t, s.ring)
+	assert.Empty(t, s.queues)
+	s.Unlock()
+}
+
+func TestGetMetricDataScheduled(t *testing.T) {
+	s := NewChunkScheduler(1000)
+	defer s.Stop()
+
+	client := &FakeClient{MetricDataResultPages: [][]*cloudwatch.MetricDataResult{
+		{{Id: aws.String("id_a")}, {Id: aws.String("id_b")}},
+	}}
+	b := stripInterface(CollectorFromConfig(CollectorConfig{Type: "ebs"}))
+	b.scheduler = s
+
+	res, err := b.getMetricData(context.Background(), client, []*cloudwatch.GetMetricDataInput{
+		{MetricDataQueries: []*cloudwatch.MetricDataQuery{{Id: aws.String("id_a")}}},
+		{MetricDataQueries: []*cloudwatch.MetricDataQuery{{Id: aws.String("id_b")}}},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(*res))
+	assert.Equal(t, 2, len(client.Calls()), "Every chunk should be requested on its own")
+}
@@ -0,0 +1,182 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+)
+
+// SeriesResource describes the AWS resource series were collected from. It is
+// shared by all series of the resource.
+type SeriesResource struct {
+	ARN          string            `json:"arn"`
+	Dimension    string            `json:"dimension"`
+	ResourceType string            `json:"resource_type"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
+// seriesEntry maps a single series, identified by metric name and label
+// fingerprint, to its resource.
+type seriesEntry struct {
+	metric      string
+	fingerprint uint64
+	resource    *SeriesResource
+}
+
+// MarshalJSON flattens the entry with its resource.
+func (e seriesEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Metric      string `json:"metric"`
+		Fingerprint string `json:"fingerprint"`
+		*SeriesResource
+	}{e.metric, fmt.Sprintf("%016x", e.fingerprint), e.resource})
+}
+
+// SeriesMap holds the mapping of the series of the latest commit of a
+// collector to the resources they were collected from. Series are identified
+// by fingerprints instead of their labels to bound memory usage.
+type SeriesMap struct {
+	sync.Mutex
+
+	entries []seriesEntry
+	// rendered caches the JSON encoded entries until the next commit.
+	rendered []byte
+}
+
+// NewSeriesMap returns an empty SeriesMap.
+func NewSeriesMap() *SeriesMap {
+	return &SeriesMap{entries: []seriesEntry{}}
+}
+
+// set replaces the entries of the SeriesMap.
+func (m *SeriesMap) set(entries []seriesEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].metric != entries[j].metric {
+			return entries[i].metric < entries[j].metric
+		}
+		return entries[i].fingerprint < entries[j].fingerprint
+	})
+
+	m.Lock()
+	defer m.Unlock()
+	m.entries = entries
+	m.rendered = nil
+}
+
+// JSON returns the JSON encoded entries.
+func (m *SeriesMap) JSON() ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.rendered == nil {
+		b, err := json.Marshal(m.entries)
+		if err != nil {
+			return nil, err
+		}
+		m.rendered = b
+	}
+
+	return m.rendered, nil
+}
+
+// fingerprint returns the FNV-1a hash of the labels sorted by name with every
+// name and value followed by a 0xff byte. The metric name is not part of the
+// fingerprint.
+func fingerprint(labels []Label) uint64 {
+	sorted := append([]Label{}, labels...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	h := fnv.New64a()
+	for _, l := range sorted {
+		_, _ = h.Write([]byte(l.Name))
+		_, _ = h.Write([]byte{0xff})
+		_, _ = h.Write([]byte(l.Value))
+		_, _ = h.Write([]byte{0xff})
+	}
+
+	return h.Sum64()
+}
+
+// newSeriesResource describes resource r for the series map. The tags are
+// limited to the merge tags as only those end up as labels.
+func newSeriesResource(r *tagging.ResourceTagMapping, typ, dimension string, mergeTags []string) *SeriesResource {
+	res := &SeriesResource{
+		ARN:          aws.StringValue(r.ResourceARN),
+		Dimension:    dimension,
+		ResourceType: typ,
+	}
+
+	merge := map[string]struct{}{}
+	for _, t := range mergeTags {
+		merge[t] = struct{}{}
+	}
+	for _, t := range r.Tags {
+		if _, ok := merge[aws.StringValue(t.Key)]; !ok {
+			continue
+		}
+		if res.Tags == nil {
+			res.Tags = map[string]string{}
+		}
+		res.Tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+
+	return res
+}
+
+// queryDimension returns the value of the dimension with the given name of the
+// query. Expressions have no dimensions.
+func queryDimension(query *cloudwatch.MetricDataQuery, name string) string {
+	if query.MetricStat == nil {
+		return ""
+	}
+	for _, d := range query.MetricStat.Metric.Dimensions {
+		if aws.StringValue(d.Name) == name {
+			return aws.StringValue(d.Value)
+		}
+	}
+
+	return ""
+}
+
+// seriesMapHandler serves the series maps of the procs as JSON object keyed by
+// collector ID. The collector query parameter limits the response to the
+// collectors with the given IDs.
+func seriesMapHandler(procs []*CollectorProc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter := map[CollectorID]struct{}{}
+		for _, id := range r.URL.Query()["collector"] {
+			filter[CollectorID(id)] = struct{}{}
+		}
+
+		maps := map[CollectorID]json.RawMessage{}
+		for _, p := range procs {
+			if p.SeriesMap == nil {
+				continue
+			}
+			if _, ok := filter[p.ID]; len(filter) > 0 && !ok {
+				continue
+			}
+
+			b, err := p.SeriesMap.JSON()
+			if err != nil {
+				Logger.Error(err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			maps[p.ID] = b
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(maps)
+	})
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+)
+
+type seriesMapJSON struct {
+	Metric       string            `json:"metric"`
+	Fingerprint  string            `json:"fingerprint"`
+	ARN          string            `json:"arn"`
+	Dimension    string            `json:"dimension"`
+	ResourceType string            `json:"resource_type"`
+	Tags         map[string]string `json:"tags"`
+}
+
+func TestSeriesMap(t *testing.T) {
+	resource := &tagging.ResourceTagMapping{
+		ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff"),
+		Tags: []*tagging.Tag{
+			{Key: aws.String("team"), Value: aws.String("metrics")},
+			{Key: aws.String("secret"), Value: aws.String("not merged")},
+		},
+	}
+	ts := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	client := &FakeClient{
+		ResourceTagMappingPages: [][]*tagging.ResourceTagMapping{{resource}},
+		MetricDataResultPages: [][]*cloudwatch.MetricDataResult{{
+			{
+				Id:         aws.String(fmt.Sprintf("id_%s_0", id(resource))),
+				Values:     []*float64{aws.Float64(1), aws.Float64(2)},
+				Timestamps: []*time.Time{aws.Time(ts), aws.Time(ts.Add(time.Minute))},
+			},
+			{
+				Id:         aws.String(fmt.Sprintf("id_%s_1", id(resource))),
+				Values:     []*float64{},
+				Timestamps: []*time.Time{},
+			},
+		}},
+	}
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:      "ebs",
+		MergeTags: []string{"team"},
+		MetricStats: []MetricStat{
+			{MetricName: "VolumeReadBytes", Stat: "Sum"},
+			{MetricName: "VolumeWriteBytes", Stat: "Sum"},
+		},
+	}))
+	b._client = client
+	b.store = NewStore(0)
+	b.seriesMap = NewSeriesMap()
+
+	collect := func() []seriesMapJSON {
+		generation := b.store.Generation()
+		assert.Nil(t, b.collect(context.Background(), nil, defaultMetricDimension(b.dimension, b.resourcePrefix)))
+		assert.Eventually(t, func() bool { return b.store.Generation() > generation }, time.Second, time.Millisecond)
+
+		raw, err := b.seriesMap.JSON()
+		assert.Nil(t, err)
+		res := []seriesMapJSON{}
+		assert.Nil(t, json.Unmarshal(raw, &res))
+
+		return res
+	}
+
+	first := collect()
+	assert.Equal(t, 1, len(first), "Only series with results should be mapped")
+	assert.Equal(t, "promwatch_aws_ebs_volume_read_bytes_sum", first[0].Metric)
+	assert.Equal(t, "arn:aws:ec2:us-east-1:000000000000:volume/vol-fffffffffffffffff", first[0].ARN)
+	assert.Equal(t, "vol-fffffffffffffffff", first[0].Dimension)
+	assert.Equal(t, "ebs", first[0].ResourceType)
+	assert.Equal(t, map[string]string{"team": "metrics"}, first[0].Tags, "Only merge tags should be part of the mapping")
+
+	// The fingerprint has to match the labels of the stored series.
+	parser := expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(strings.NewReader(b.store.String()))
+	assert.Nil(t, err)
+	metric := families[first[0].Metric].GetMetric()[0]
+	labels := []Label{}
+	for _, l := range metric.GetLabel() {
+		labels = append(labels, Label{Name: l.GetName(), Value: l.GetValue()})
+	}
+	assert.Equal(t, fmt.Sprintf("%016x", fingerprint(labels)), first[0].Fingerprint, "Fingerprint should match the series labels")
+
+	assert.Equal(t, first, collect(), "Fingerprints should be stable across runs")
+}
+
+func TestFingerprint(t *testing.T) {
+	a := []Label{{Name: "arn", Value: "a"}, {Name: "volume_id", Value: "v"}}
+	b := []Label{{Name: "volume_id", Value: "v"}, {Name: "arn", Value: "a"}}
+	assert.Equal(t, fingerprint(a), fingerprint(b), "Fingerprint should not depend on label order")
+	assert.NotEqual(t, fingerprint(a), fingerprint([]Label{{Name: "arn", Value: "av"}, {Name: "volume_id", Value: ""}}),
+		"Fingerprint should separate names and values")
+}
+
+func TestSeriesMapHandler(t *testing.T) {
+	first, second := NewSeriesMap(), NewSeriesMap()
+	resource := &SeriesResource{ARN: "arn", Dimension: "dim", ResourceType: "ebs"}
+	first.set([]seriesEntry{{metric: "first", fingerprint: 1, resource: resource}})
+	second.set([]seriesEntry{{metric: "second", fingerprint: 2, resource: resource}})
+	procs := []*CollectorProc{
+		{ID: "first", SeriesMap: first},
+		{ID: "second", SeriesMap: second},
+		{ID: "metric-stream"},
+	}
+
+	cases := []struct {
+		query    string
+		expected []CollectorID
+		message  string
+	}{
+		{"", []CollectorID{"first", "second"}, "All collectors with series maps should be served"},
+		{"?collector=second", []CollectorID{"second"}, "Collectors should be filtered"},
+		{"?collector=first&collector=second", []CollectorID{"first", "second"}, "Multiple collectors should be filtered"},
+		{"?collector=unknown", []CollectorID{}, "Unknown collectors should be empty"},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		seriesMapHandler(procs).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/series-map"+c.query, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, c.message)
+
+		res := map[CollectorID][]seriesMapJSON{}
+		assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &res), c.message)
+		ids := []CollectorID{}
+		for _, id := range []CollectorID{"first", "second"} {
+			if _, ok := res[id]; ok {
+				ids = append(ids, id)
+			}
+		}
+		assert.Equal(t, c.expected, ids, c.message)
+	}
+
+	rec := httptest.NewRecorder()
+	seriesMapHandler(procs).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/series-map?collector=first", nil))
+	assert.JSONEq(t, `{"first":[{"metric":"first","fingerprint":"0000000000000001","arn":"arn","dimension":"dim","resource_type":"ebs"}]}`, rec.Body.String())
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// StaleNaN is the NaN value Prometheus uses as staleness marker to end a series
+// immediately instead of after the lookback delta.
+var StaleNaN = math.Float64frombits(0x7ff0000000000002)
+
+// staleSeries tracks the series of the last commit to emit stale markers for
+// series missing from the next one, see CollectorConfig.StaleMarkers. The lock
+// is held while tracking as storeResults runs asynchronously.
+type staleSeries struct {
+	sync.Mutex
+
+	last map[string]Sample
+}
+
+// seriesKey returns the key of the series of a sample with the formatted
+// labels.
+func seriesKey(name, formatted string) string {
+	return name + "{" + formatted + "}"
+}
+
+// markers records current as the series of the last commit and returns a stale
+// marker at timestamp for every series of the previous commit missing from
+// current, ordered by series. Markers are returned once, as the series they
+// were returned for are not part of the last commit anymore.
+func (s *staleSeries) markers(current map[string]Sample, timestamp int64) []Sample {
+	s.Lock()
+	defer s.Unlock()
+
+	keys := []string{}
+	for k := range s.last {
+		if _, ok := current[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	markers := make([]Sample, 0, len(keys))
+	for _, k := range keys {
+		m := s.last[k]
+		m.Value, m.Timestamp = StaleNaN, timestamp
+		markers = append(markers, m)
+	}
+	s.last = current
+
+	return markers
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaleSeriesMarkers(t *testing.T) {
+	s := &staleSeries{}
+	a := Sample{Name: "a", Labels: []Label{{"volume_id", "vol-a"}}}
+	b := Sample{Name: "b", Labels: []Label{{"volume_id", "vol-b"}}}
+
+	assert.Empty(t, s.markers(map[string]Sample{"a": a, "b": b}, 1000), "The first commit should have no stale markers")
+
+	markers := s.markers(map[string]Sample{"a": a}, 2000)
+	assert.Len(t, markers, 1)
+	assert.Equal(t, "b", markers[0].Name)
+	assert.Equal(t, b.Labels, markers[0].Labels)
+	assert.Equal(t, int64(2000), markers[0].Timestamp)
+	assert.Equal(t, math.Float64bits(StaleNaN), math.Float64bits(markers[0].Value), "Markers should carry the staleness NaN")
+
+	assert.Empty(t, s.markers(map[string]Sample{"a": a}, 3000), "Stale markers should be emitted once")
+	assert.Empty(t, s.markers(map[string]Sample{"a": a, "b": b}, 4000), "Returning series should not be marked")
+}
+
+func TestStoreResultsStaleMarkers(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:         "ebs",
+		StaleMarkers: true,
+		MetricStats:  []MetricStat{{MetricName: "VolumeReadBytes", Stat: "Sum"}},
+	}))
+	b.store = NewStore(0)
+	b.pusher = NewPusher("http://127.0.0.1", RemoteWriteConfig{})
+	b.withTime(&testTime{now: &now})
+
+	commit := func(volumes ...string) ([]string, []Sample) {
+		resources := []*tagging.ResourceTagMapping{}
+		for _, v := range volumes {
+			resources = append(resources, &tagging.ResourceTagMapping{ResourceARN: aws.String("arn:aws:ec2:us-east-1:000000000000:volume/" + v)})
+		}
+		index := NewResourceIndexFromTagMapping(&resources, id)
+		b.makeQueries(index, b.namespace, defaultMetricDimension(b.dimension, b.resourcePrefix))
+		results := []*cloudwatch.MetricDataResult{}
+		for _, queries := range index.Queries {
+			results = append(results, &cloudwatch.MetricDataResult{
+				Id:         queries[0].Id,
+				Values:     []*float64{aws.Float64(1)},
+				Timestamps: []*time.Time{aws.Time(now.Add(-5 * time.Minute))},
+			})
+		}
+		index.AddResults(&results)
+		b.storeResults(index)
+		now = now.Add(time.Minute)
+
+		return strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n"), <-b.pusher.queue
+	}
+
+	lines, pushed := commit("vol-a", "vol-b")
+	assert.Len(t, lines, 2)
+	assert.Len(t, pushed, 2)
+
+	lines, pushed = commit("vol-a")
+	assert.Len(t, lines, 1, "Stale markers should not be stored")
+	assert.NotContains(t, lines[0], "vol-b")
+	assert.NotContains(t, lines[0], "NaN")
+	assert.Len(t, pushed, 2)
+	stale := 0
+	for _, s := range pushed {
+		if labelsToString(s.Labels) == labelsToString([]Label{{"arn", "arn:aws:ec2:us-east-1:000000000000:volume/vol-b"}, {"volume_id", "vol-b"}}) {
+			stale++
+			assert.Equal(t, math.Float64bits(StaleNaN), math.Float64bits(s.Value), "Vanished series should be pushed with a stale marker")
+			assert.Equal(t, int64(1609459260000), s.Timestamp, "Stale markers should be at the commit time")
+		}
+	}
+	assert.Equal(t, 1, stale, "Vanished series should get exactly one stale marker")
+
+	_, pushed = commit("vol-a")
+	assert.Len(t, pushed, 1, "Stale markers should be pushed once")
+}
+
+func TestStoreResultsStaleMarkersWithoutPush(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:         "ebs",
+		StaleMarkers: true,
+		MetricStats:  []MetricStat{{MetricName: "VolumeReadBytes", Stat: "Sum"}},
+	}))
+	b.store = NewStore(0)
+
+	b.storeResults(syntheticIndex(b, 2, 1))
+	b.storeResults(syntheticIndex(b, 1, 1))
+	assert.NotContains(t, b.store.String(), "NaN", "Stale markers should never be stored")
+}
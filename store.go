@@ -11,20 +11,37 @@ type Store interface {
 	Add(str string)
 	Commit()
 	String() string
+	// Generation returns a number that changes with every commit. It allows
+	// consumers to cheaply detect whether the store content may have changed.
+	Generation() uint64
 }
 
-func NewStore() Store {
-	return &naiveStore{
+// failingStore is implemented by stores that can fail to commit. Err returns
+// the error of the last commit.
+type failingStore interface {
+	Err() error
+}
+
+func NewStore(hintBytes int) Store {
+	s := &naiveStore{
 		internal: &bytes.Buffer{},
 		view:     &bytes.Buffer{},
 	}
+	// Both buffers are grown as they are swapped on every commit.
+	if hintBytes > 0 {
+		s.internal.Grow(hintBytes)
+		s.view.Grow(hintBytes)
+	}
+
+	return s
 }
 
 type naiveStore struct {
 	sync.Mutex
 
-	internal *bytes.Buffer
-	view     *bytes.Buffer
+	internal   *bytes.Buffer
+	view       *bytes.Buffer
+	generation uint64
 }
 
 // Add appends a string to the store.
@@ -48,4 +65,12 @@ func (s *naiveStore) Commit() {
 	defer s.Unlock()
 	s.internal, s.view = s.view, s.internal
 	s.internal.Reset()
+	s.generation++
+}
+
+// Generation returns the number of commits since the store was created.
+func (s *naiveStore) Generation() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.generation
 }
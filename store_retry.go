@@ -0,0 +1,141 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// pendingCommit holds the content of a failed commit to retry it with the next
+// one. It holds a single commit at most to bound memory usage. The lock is held
+// for the whole commit as storeResults runs asynchronously.
+type pendingCommit struct {
+	sync.Mutex
+
+	content []byte
+}
+
+// commit stores content in the store of the collector with the families
+// declared, see declareFamilies. The content of the previous commit is merged
+// in if that commit failed, so a single failed commit loses no samples. If the retry fails as well, the samples of the
+// previous commit are dropped and counted, and content becomes the pending
+// commit in its place.
+func (b *BaseCollector) commit(content []byte) error {
+	b.pending.Lock()
+	defer b.pending.Unlock()
+
+	merged, retried := content, 0
+	if b.pending.content != nil {
+		merged, retried = mergeSamples(b.pending.content, content)
+		b.pending.content = nil
+	}
+
+	b.store.Add(string(declareFamilies(merged)))
+	b.store.Commit()
+	var err error
+	if s, ok := b.store.(failingStore); ok {
+		err = s.Err()
+	}
+
+	if err != nil {
+		if retried > 0 {
+			b.logger().Warnw("dropping samples of commit failed twice", "id", b.ID(), "name", b.config.Name, "samples", retried)
+			b.Telemetry().StoreDroppedSamplesCount.Add(float64(retried))
+		}
+		b.pending.content = content
+	}
+
+	return err
+}
+
+// mergeSample is a line of the exposition format split into the series and
+// the timestamp.
+type mergeSample struct {
+	timestamp int64
+	line      []byte
+}
+
+// splitSample splits a line as written by appendSample into the series, i.e.
+// the metric name and labels, and the timestamp. Label values may contain
+// spaces, so the line is split at the last two spaces.
+func splitSample(line []byte) (string, int64) {
+	i := bytes.LastIndexByte(line, ' ')
+	if i < 0 {
+		return string(line), 0
+	}
+	j := bytes.LastIndexByte(line[:i], ' ')
+	if j < 0 {
+		return string(line), 0
+	}
+	ts, err := strconv.ParseInt(string(line[i+1:]), 10, 64)
+	if err != nil {
+		return string(line), 0
+	}
+
+	return string(line[:j]), ts
+}
+
+// mergeSamples merges the samples of older into newer. Samples of older are
+// dropped if newer has a sample of the same series and timestamp, so series
+// stay free of duplicates and newer values win. The samples of every series
+// are ordered by timestamp, series keep the order they first appear in. It
+// returns the merged samples and the number of samples kept from older.
+func mergeSamples(older, newer []byte) ([]byte, int) {
+	type key struct {
+		series    string
+		timestamp int64
+	}
+
+	series := []string{}
+	samples := map[string][]mergeSample{}
+	add := func(s string, ts int64, line []byte) {
+		if _, ok := samples[s]; !ok {
+			series = append(series, s)
+		}
+		samples[s] = append(samples[s], mergeSample{timestamp: ts, line: line})
+	}
+
+	newerLines := bytes.SplitAfter(newer, []byte("\n"))
+	superseded := map[key]struct{}{}
+	for _, line := range newerLines {
+		if len(line) == 0 {
+			continue
+		}
+		s, ts := splitSample(bytes.TrimSuffix(line, []byte("\n")))
+		superseded[key{s, ts}] = struct{}{}
+	}
+
+	kept := 0
+	for _, line := range bytes.SplitAfter(older, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		s, ts := splitSample(bytes.TrimSuffix(line, []byte("\n")))
+		if _, ok := superseded[key{s, ts}]; ok {
+			continue
+		}
+		add(s, ts, line)
+		kept++
+	}
+	for _, line := range newerLines {
+		if len(line) == 0 {
+			continue
+		}
+		s, ts := splitSample(bytes.TrimSuffix(line, []byte("\n")))
+		add(s, ts, line)
+	}
+
+	merged := make([]byte, 0, len(older)+len(newer))
+	for _, s := range series {
+		sort.SliceStable(samples[s], func(i, j int) bool {
+			return samples[s][i].timestamp < samples[s][j].timestamp
+		})
+		for _, sample := range samples[s] {
+			merged = append(merged, sample.line...)
+		}
+	}
+
+	return merged, kept
+}
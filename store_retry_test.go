@@ -0,0 +1,101 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyStore is a Store failing the commits scripted in fail. Content of
+// failed commits is discarded like the RedisStore does.
+type flakyStore struct {
+	fail    []bool
+	commits int
+	err     error
+	buf     string
+	view    string
+}
+
+func (s *flakyStore) Add(str string) {
+	s.buf += str
+}
+
+func (s *flakyStore) Commit() {
+	fail := s.commits < len(s.fail) && s.fail[s.commits]
+	s.commits++
+	s.err = nil
+	if fail {
+		s.err = errors.New("store unavailable")
+	} else {
+		s.view = s.buf
+	}
+	s.buf = ""
+}
+
+func (s *flakyStore) Err() error         { return s.err }
+func (s *flakyStore) String() string     { return s.view }
+func (s *flakyStore) Generation() uint64 { return uint64(s.commits) }
+
+type line struct {
+	name  string
+	value float64
+	ts    int64
+}
+
+// samples formats lines like storeResults does. The label value contains a
+// space to make sure lines are split correctly.
+func samples(lines ...line) []byte {
+	buf := []byte{}
+	for _, l := range lines {
+		buf = appendSample(buf, l.name, `volume_id="vol 1"`, l.value, l.ts)
+	}
+	return buf
+}
+
+func TestCommitRetry(t *testing.T) {
+	store := &flakyStore{fail: []bool{true, false, true, true, false}}
+	b := &BaseCollector{store: store}
+	b.telemetry = newTelemetryVecs(DefaultTelemetryLabels).collectorTelemetry(prometheus.Labels{})
+
+	assert.NotNil(t, b.commit(samples(line{"a", 1, 1000}, line{"b", 1, 1000})))
+	assert.Equal(t, "", store.String())
+
+	assert.Nil(t, b.commit(samples(line{"a", 2, 2000}, line{"b", 2, 2000})))
+	assert.Equal(t, string(declareFamilies(samples(
+		line{"a", 1, 1000}, line{"a", 2, 2000},
+		line{"b", 1, 1000}, line{"b", 2, 2000},
+	))), store.String(), "Samples of a single failed commit should be retried in timestamp order")
+	assert.Equal(t, 0.0, testutil.ToFloat64(b.telemetry.StoreDroppedSamplesCount))
+
+	assert.NotNil(t, b.commit(samples(line{"a", 3, 3000}, line{"b", 3, 3000})))
+	assert.NotNil(t, b.commit(samples(line{"a", 4, 4000})))
+	assert.Equal(t, 2.0, testutil.ToFloat64(b.telemetry.StoreDroppedSamplesCount), "Samples of a commit failed twice should be dropped and counted")
+
+	assert.Nil(t, b.commit(samples(line{"a", 5, 5000})))
+	assert.Equal(t, string(declareFamilies(samples(line{"a", 4, 4000}, line{"a", 5, 5000}))), store.String(),
+		"Only the last failed commit should be retried")
+
+	assert.Nil(t, b.commit(samples(line{"a", 6, 6000})))
+	assert.Equal(t, "# TYPE a gauge\n"+string(samples(line{"a", 6, 6000})), store.String(), "Successful commits should not be retried")
+}
+
+func TestMergeSamples(t *testing.T) {
+	older := samples(line{"a", 1, 1000}, line{"a", 2, 3000}, line{"b", 1, 1000})
+	newer := samples(line{"a", 9, 2000}, line{"a", 3, 3000}, line{"c", 1, 3000})
+
+	merged, kept := mergeSamples(older, newer)
+	assert.Equal(t, string(samples(
+		line{"a", 1, 1000}, line{"a", 9, 2000}, line{"a", 3, 3000},
+		line{"b", 1, 1000},
+		line{"c", 1, 3000},
+	)), string(merged), "Samples should be ordered by timestamp and newer values should win")
+	assert.Equal(t, 2, kept, "Superseded samples should not be counted as kept")
+
+	merged, kept = mergeSamples(nil, newer)
+	assert.Equal(t, string(newer), string(merged))
+	assert.Equal(t, 0, kept)
+}
@@ -2,13 +2,28 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// storeSamples returns the content of s without the TYPE lines declaring the
+// families, see declareFamilies.
+func storeSamples(s Store) string {
+	b := strings.Builder{}
+	for _, l := range strings.SplitAfter(s.String(), "\n") {
+		if !strings.HasPrefix(l, typePrefix) {
+			b.WriteString(l)
+		}
+	}
+
+	return b.String()
+}
+
 func TestNaiveStore(t *testing.T) {
-	s := NewStore()
+	s := NewStore(0)
 	t1 := "This is a test"
 	t2 := "More of everything!"
 
@@ -27,6 +42,38 @@ func TestNaiveStore(t *testing.T) {
 	s.Commit()
 	assert.Equal(t, expected, s.String(), "Store should contain both added values after commit")
 
+	assert.Equal(t, uint64(2), s.Generation(), "Generation should count commits")
+
 	n := s.(*naiveStore)
 	assert.Equal(t, "", n.internal.String(), "Internal buffer should be empty after commit")
 }
+
+func TestNaiveStoreHint(t *testing.T) {
+	hint := 1 << 16
+	n := NewStore(hint).(*naiveStore)
+	assert.GreaterOrEqual(t, n.internal.Cap(), hint, "Buffers should be pre-grown by the hint")
+	assert.GreaterOrEqual(t, n.view.Cap(), hint)
+
+	n.Add("a")
+	n.Commit()
+	assert.GreaterOrEqual(t, n.internal.Cap(), hint, "Buffers should keep their capacity across commits")
+	assert.GreaterOrEqual(t, n.view.Cap(), hint)
+}
+
+func BenchmarkNaiveStoreAdd(b *testing.B) {
+	line := `promwatch_aws_ebs_volume_read_bytes_sum{volume_id="vol-fffffffffffffffff"} 1.000000 1609459200000` + "\n"
+	lines := 10000
+
+	for _, hint := range []int{0, lines * len(line)} {
+		b.Run(fmt.Sprintf("hint=%d", hint), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s := NewStore(hint)
+				for j := 0; j < lines; j++ {
+					s.Add(line)
+				}
+				s.Commit()
+			}
+		})
+	}
+}
@@ -4,7 +4,10 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var registry = prometheus.NewRegistry()
@@ -15,13 +18,92 @@ var (
 		Name: "promwatch_build_info",
 		Help: "PromWatch build information.",
 	}, []string{"version", "githash", "date"})
+
+	// Responses to conditional metrics requests that were answered with 304
+	// Not Modified.
+	notModifiedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "promwatch_http_not_modified_total",
+		Help: "Total number of metrics requests answered with 304 Not Modified.",
+	})
+
+	// Push requests of collector samples by result.
+	pushCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "promwatch_push_requests_total",
+		Help: "Total number of push requests of collector samples by result, dropped if the queue is full.",
+	}, []string{"result"})
+
+	// Whether this replica is the leader polling AWS.
+	leaderState = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promwatch_leader",
+		Help: "Whether this replica is the leader polling AWS, always 1 without leader election.",
+	})
+
+	// Collectors defined in the configuration and running collectors that
+	// are ready, see startCollectors.
+	collectorsTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promwatch_collectors_total",
+		Help: "Number of collectors defined in the configuration.",
+	})
+	collectorsReady = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "promwatch_collectors_ready",
+		Help: "Number of running collectors that committed the results of a successful collection.",
+	}, func() float64 { return float64(runningProcs.ready()) })
+
+	// Set when any telemetry metric could not be registered and is replaced
+	// by a no-op metric.
+	telemetryDegraded = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promwatch_telemetry_degraded",
+		Help: "Whether any PromWatch telemetry metric failed to register and is not exposed.",
+	})
+)
+
+// DatapointsPerSeriesBuckets are the buckets of the datapoints per series
+// histogram. The 0 bucket counts series CloudWatch returned no datapoints for.
+var DatapointsPerSeriesBuckets = []float64{0, 1, 2, 3, 5, 10, 20, 60}
+
+// Label names that can be attached to collector telemetry.
+const (
+	LabelCollectorID   = "collector_id"
+	LabelCollectorName = "collector_name"
+	LabelCollectorType = "collector_type"
 )
 
-// InitializeTelemetry registers the global Prometheus metric collectors.
-func InitializeTelemetry() {
+// Labels of collector telemetry about individual metrics and collection
+// phases.
+const (
+	LabelMetric = "metric"
+	LabelPhase  = "phase"
+	LabelRule   = "rule"
+)
+
+// DefaultTelemetryLabels are the labels attached to collector telemetry when
+// not configured otherwise.
+var DefaultTelemetryLabels = []string{LabelCollectorID, LabelCollectorName, LabelCollectorType}
+
+// collectorVecs holds the metric vectors shared by all collectors. It is
+// replaced by InitializeTelemetry and only initialized lazily with the default
+// labels in case collector telemetry is used before, e.g. in tests.
+var collectorVecs *telemetryVecs
+
+// InitializeTelemetry registers the global Prometheus metric collectors. The
+// labels determine which of the collector labels get attached to collector
+// telemetry.
+func InitializeTelemetry(labels []string) {
+	// Registered first so registration failures of any other metric are
+	// visible.
+	_ = registerTelemetry(registry, telemetryDegraded)
 	// Build info can be registered and set right away, it will not change
-	registry.MustRegister(buildInfo)
+	_ = registerTelemetry(registry, buildInfo)
 	buildInfo.WithLabelValues(Version, GitHash, Date).Set(1)
+	_ = registerTelemetry(registry, notModifiedCount)
+	_ = registerTelemetry(registry, pushCount)
+	_ = registerTelemetry(registry, leaderState)
+	leaderState.Set(boolFloat(isLeader()))
+	_ = registerTelemetry(registry, collectorsTotal)
+	_ = registerTelemetry(registry, collectorsReady)
+
+	collectorVecs = newTelemetryVecs(labels)
+	collectorVecs.register(registry)
 }
 
 // CollectorTelemetry holds the Prometheus metric collectors for each PromWatch
@@ -33,67 +115,436 @@ type CollectorTelemetry struct {
 	GetMetricDataCount                    prometheus.Counter
 	DescribeAutoScalingGroupsCount        prometheus.Counter
 	DescribeElasticacheCacheClustersCount prometheus.Counter
+	SelectResourceConfigCount             prometheus.Counter
+	DescribeRegionsCount                  prometheus.Counter
+	ListAccountAliasesCount               prometheus.Counter
+	DescribeDBInstancesCount              prometheus.Counter
+	ListNodesCount                        prometheus.Counter
+	GetCallerIdentityCount                prometheus.Counter
+	CredentialRefreshCount                prometheus.Counter
 	RunDuration                           prometheus.Gauge
 	MatchingResources                     prometheus.Gauge
+	GraceResources                        prometheus.Gauge
+	SchedulerQueueDepth                   prometheus.Gauge
+	SchedulerWaitSeconds                  prometheus.Gauge
+	EstimatedSeries                       prometheus.Gauge
+	StoreDroppedSamplesCount              prometheus.Counter
+	FilteredDimensionsCount               prometheus.Counter
+	OrphanResultsCount                    prometheus.Counter
+	IntervalOverrunsCount                 prometheus.Counter
+	OverrideActive                        prometheus.Gauge
+	PanicsCount                           prometheus.Counter
+	HistoryBytes                          prometheus.Gauge
+	DemotedResources                      prometheus.Gauge
+	ProbationSavedQueries                 prometheus.Gauge
+	DatapointsPerSeries                   prometheus.Observer
+	OutOfBoundsCount                      counterVec
+	ClassificationHitsCount               counterVec
+	FamilyCollisionsCount                 counterVec
+	PhaseHealthy                          gaugeVec
+}
+
+// counterVec is a counter vector with all but the last labels curried, see
+// telemetryVecs.counterVec.
+type counterVec interface {
+	WithLabelValues(lvs ...string) prometheus.Counter
 }
 
-// NewCollectorTelemetry creates and registers Prometheus metric collectors that
-// get used to record per collector metrics.
+// gaugeVec is a gauge vector with all but the last labels curried, see
+// telemetryVecs.gaugeVec.
+type gaugeVec interface {
+	WithLabelValues(lvs ...string) prometheus.Gauge
+}
+
+// NewCollectorTelemetry returns the Prometheus metric collectors that get used
+// to record per collector metrics. Labels not configured as telemetry labels
+// are dropped.
 func NewCollectorTelemetry(labels prometheus.Labels) *CollectorTelemetry {
-	tele := &CollectorTelemetry{
-		ErrorCount: prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        "promwatch_collector_errors_total",
-			Help:        "Total count of errors in metrics collectors",
-			ConstLabels: labels,
-		}),
-		RunCount: prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        "promwatch_collector_runs_total",
-			Help:        "Total count of collector runs.",
-			ConstLabels: labels,
-		}),
-		RunDuration: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        "promwatch_collector_run_duration_seconds",
-			Help:        "Total count of collector runs.",
-			ConstLabels: labels,
-		}),
-		MatchingResources: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name:        "promwatch_collector_matching_resources",
-			Help:        "Number of resources matching the collector's tag filters.",
-			ConstLabels: labels,
-		}),
+	if collectorVecs == nil {
+		collectorVecs = newTelemetryVecs(DefaultTelemetryLabels)
+	}
+
+	return collectorVecs.collectorTelemetry(labels)
+}
+
+// telemetryVecs holds one metric vector per collector metric family. Sharing
+// the vectors between collectors keeps the number of registered collectors
+// independent of the number of PromWatch collectors.
+type telemetryVecs struct {
+	labels []string
+	// failed holds the vectors that could not be registered. Collectors get
+	// no-op metrics in their place.
+	failed map[prometheus.Collector]struct{}
+
+	errorCount                            *prometheus.CounterVec
+	runCount                              *prometheus.CounterVec
+	getResourcesCount                     *prometheus.CounterVec
+	getMetricDataCount                    *prometheus.CounterVec
+	describeAutoScalingGroupsCount        *prometheus.CounterVec
+	describeElasticacheCacheClustersCount *prometheus.CounterVec
+	selectResourceConfigCount             *prometheus.CounterVec
+	describeRegionsCount                  *prometheus.CounterVec
+	listAccountAliasesCount               *prometheus.CounterVec
+	describeDBInstancesCount              *prometheus.CounterVec
+	listNodesCount                        *prometheus.CounterVec
+	getCallerIdentityCount                *prometheus.CounterVec
+	credentialRefreshCount                *prometheus.CounterVec
+	runDuration                           *prometheus.GaugeVec
+	matchingResources                     *prometheus.GaugeVec
+	graceResources                        *prometheus.GaugeVec
+	schedulerQueueDepth                   *prometheus.GaugeVec
+	schedulerWaitSeconds                  *prometheus.GaugeVec
+	estimatedSeries                       *prometheus.GaugeVec
+	storeDroppedSamplesCount              *prometheus.CounterVec
+	filteredDimensionsCount               *prometheus.CounterVec
+	orphanResultsCount                    *prometheus.CounterVec
+	intervalOverrunsCount                 *prometheus.CounterVec
+	overrideActive                        *prometheus.GaugeVec
+	panicsCount                           *prometheus.CounterVec
+	historyBytes                          *prometheus.GaugeVec
+	demotedResources                      *prometheus.GaugeVec
+	probationSavedQueries                 *prometheus.GaugeVec
+	datapointsPerSeries                   *prometheus.HistogramVec
+	outOfBoundsCount                      *prometheus.CounterVec
+	classificationHitsCount               *prometheus.CounterVec
+	familyCollisionsCount                 *prometheus.CounterVec
+	phaseHealthy                          *prometheus.GaugeVec
+}
+
+func newTelemetryVecs(labels []string) *telemetryVecs {
+	return &telemetryVecs{
+		labels: labels,
+		failed: map[prometheus.Collector]struct{}{},
+		errorCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_errors_total",
+			Help: "Total count of errors in metrics collectors",
+		}, labels),
+		runCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_runs_total",
+			Help: "Total count of collector runs.",
+		}, labels),
+		runDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promwatch_collector_run_duration_seconds",
+			Help: "Total count of collector runs.",
+		}, labels),
+		matchingResources: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promwatch_collector_matching_resources",
+			Help: "Number of resources matching the collector's tag filters.",
+		}, labels),
+		graceResources: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promwatch_collector_grace_resources",
+			Help: "Number of resources missing from discovery that are kept during the resource grace period.",
+		}, labels),
+		estimatedSeries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promwatch_estimated_series",
+			Help: "Estimated number of series exported by the collector, matching resources times metric stats.",
+		}, labels),
+		schedulerQueueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promwatch_collector_scheduler_queue_depth",
+			Help: "Number of GetMetricData requests waiting to be dispatched by the rate limiting scheduler.",
+		}, labels),
+		schedulerWaitSeconds: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promwatch_collector_scheduler_wait_seconds",
+			Help: "Time the last GetMetricData request spent waiting to be dispatched by the rate limiting scheduler.",
+		}, labels),
+		credentialRefreshCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_credential_refresh_total",
+			Help: "Total number of forced AWS credential refreshes due to expired credentials.",
+		}, labels),
+		filteredDimensionsCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_filtered_dimensions_total",
+			Help: "Total count of dimension combinations not queried as they did not pass the dimension filters.",
+		}, labels),
+		orphanResultsCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_orphan_results_total",
+			Help: "Total number of query results that belonged to no resource of the collection.",
+		}, labels),
+		storeDroppedSamplesCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_store_dropped_samples_total",
+			Help: "Total number of samples dropped as their commit to the store failed twice.",
+		}, labels),
+		intervalOverrunsCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_interval_overruns_total",
+			Help: "Total number of collections that took longer than the collector interval.",
+		}, labels),
+		overrideActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promwatch_collector_override_active",
+			Help: "Whether a runtime override of the collection parameters is active.",
+		}, labels),
+		panicsCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_panics_total",
+			Help: "Total number of recovered panics of the collector.",
+		}, labels),
+		historyBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promwatch_collector_history_bytes",
+			Help: "Estimated memory used by the commits retained in the history of the collector.",
+		}, labels),
+		demotedResources: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promwatch_collector_demoted_resources",
+			Help: "Number of resources demoted by the negative cache as their queries returned no datapoints.",
+		}, labels),
+		probationSavedQueries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promwatch_collector_probation_saved_queries",
+			Help: "Number of queries saved in the last run by skipping resources demoted by the negative cache.",
+		}, labels),
+		datapointsPerSeries: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "promwatch_collector_datapoints_per_series",
+			Help:    "Number of datapoints returned per series by each collection, low counts indicate a wrong period or offset.",
+			Buckets: DatapointsPerSeriesBuckets,
+		}, labels),
+		outOfBoundsCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_out_of_bounds_values_total",
+			Help: "Total number of values outside the bounds of their metric stat by metric.",
+		}, append(append([]string{}, labels...), LabelMetric)),
+		classificationHitsCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_classification_hits_total",
+			Help: "Total number of resources classified by classification rule value.",
+		}, append(append([]string{}, labels...), LabelRule)),
+		familyCollisionsCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_family_collisions_total",
+			Help: "Total number of committed metric families colliding with PromWatch telemetry by metric.",
+		}, append(append([]string{}, labels...), LabelMetric)),
+		phaseHealthy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "promwatch_collector_phase_healthy",
+			Help: "Whether the last run of a collection phase succeeded by phase, one of discovery, query, and store.",
+		}, append(append([]string{}, labels...), LabelPhase)),
 		// Counters for AWS API requests. The metric names are following the
 		// schema
 		// promwatch_<service_sdk_name>_<request_method_name>_requests_total
-		GetResourcesCount: prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        "promwatch_collector_rescourcegroupstaggingapi_getresources_requests_total",
-			Help:        "Total number of resource requests issued against the AWS Resource Groups Tagging API.",
-			ConstLabels: labels,
-		}),
-		GetMetricDataCount: prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        "promwatch_collector_cloudwatch_getmetricdata_requests_total",
-			Help:        "Total number of requests issued against the AWS CloudWatch GetMetricData endpoint.",
-			ConstLabels: labels,
-		}),
-		DescribeAutoScalingGroupsCount: prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        "promwatch_collector_autoscaling_describeautoscalinggroups_requests_total",
-			Help:        "Total number of requests issued against the AWS EC2 autoscaling endpoint.",
-			ConstLabels: labels,
-		}),
-		DescribeElasticacheCacheClustersCount: prometheus.NewCounter(prometheus.CounterOpts{
-			Name:        "promwatch_collector_elasticache_describecacheclusters_requests_total",
-			Help:        "Total number of requests issued against the AWS Elasticache endpoint.",
-			ConstLabels: labels,
-		}),
+		getResourcesCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_rescourcegroupstaggingapi_getresources_requests_total",
+			Help: "Total number of resource requests issued against the AWS Resource Groups Tagging API.",
+		}, labels),
+		getMetricDataCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_cloudwatch_getmetricdata_requests_total",
+			Help: "Total number of requests issued against the AWS CloudWatch GetMetricData endpoint.",
+		}, labels),
+		describeAutoScalingGroupsCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_autoscaling_describeautoscalinggroups_requests_total",
+			Help: "Total number of requests issued against the AWS EC2 autoscaling endpoint.",
+		}, labels),
+		describeElasticacheCacheClustersCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_elasticache_describecacheclusters_requests_total",
+			Help: "Total number of requests issued against the AWS Elasticache endpoint.",
+		}, labels),
+		selectResourceConfigCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_configservice_selectresourceconfig_requests_total",
+			Help: "Total number of requests issued against the AWS Config advanced query endpoint.",
+		}, labels),
+		describeRegionsCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_ec2_describeregions_requests_total",
+			Help: "Total number of requests issued against the AWS EC2 DescribeRegions endpoint.",
+		}, labels),
+		listAccountAliasesCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_iam_listaccountaliases_requests_total",
+			Help: "Total number of requests issued against the AWS IAM ListAccountAliases endpoint.",
+		}, labels),
+		describeDBInstancesCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_rds_describedbinstances_requests_total",
+			Help: "Total number of requests issued against the AWS RDS DescribeDBInstances endpoint.",
+		}, labels),
+		listNodesCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_kafka_listnodes_requests_total",
+			Help: "Total number of requests issued against the AWS MSK ListNodes endpoint.",
+		}, labels),
+		getCallerIdentityCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "promwatch_collector_sts_getcalleridentity_requests_total",
+			Help: "Total number of requests issued against the AWS STS GetCallerIdentity endpoint.",
+		}, labels),
 	}
+}
+
+// register registers all metric vectors with reg. Vectors failing to register
+// are recorded so collectors get no-op metrics in their place.
+func (v *telemetryVecs) register(reg prometheus.Registerer) {
+	for _, c := range []prometheus.Collector{
+		v.errorCount,
+		v.runCount,
+		v.runDuration,
+		v.matchingResources,
+		v.graceResources,
+		v.estimatedSeries,
+		v.schedulerQueueDepth,
+		v.schedulerWaitSeconds,
+		v.getMetricDataCount,
+		v.getResourcesCount,
+		v.describeAutoScalingGroupsCount,
+		v.describeElasticacheCacheClustersCount,
+		v.selectResourceConfigCount,
+		v.describeRegionsCount,
+		v.listAccountAliasesCount,
+		v.describeDBInstancesCount,
+		v.listNodesCount,
+		v.getCallerIdentityCount,
+		v.credentialRefreshCount,
+		v.storeDroppedSamplesCount,
+		v.filteredDimensionsCount,
+		v.orphanResultsCount,
+		v.intervalOverrunsCount,
+		v.overrideActive,
+		v.panicsCount,
+		v.historyBytes,
+		v.demotedResources,
+		v.probationSavedQueries,
+		v.datapointsPerSeries,
+		v.outOfBoundsCount,
+		v.classificationHitsCount,
+		v.familyCollisionsCount,
+		v.phaseHealthy,
+	} {
+		if err := registerTelemetry(reg, c); err != nil {
+			v.failed[c] = struct{}{}
+		}
+	}
+}
 
-	registry.MustRegister(tele.ErrorCount)
-	registry.MustRegister(tele.RunCount)
-	registry.MustRegister(tele.RunDuration)
-	registry.MustRegister(tele.MatchingResources)
-	registry.MustRegister(tele.GetMetricDataCount)
-	registry.MustRegister(tele.GetResourcesCount)
-	registry.MustRegister(tele.DescribeAutoScalingGroupsCount)
-	registry.MustRegister(tele.DescribeElasticacheCacheClustersCount)
+// collectorTelemetry curries the metric vectors with the labels that are
+// configured as telemetry labels.
+func (v *telemetryVecs) collectorTelemetry(labels prometheus.Labels) *CollectorTelemetry {
+	l := prometheus.Labels{}
+	for _, name := range v.labels {
+		l[name] = labels[name]
+	}
 
-	return tele
+	return &CollectorTelemetry{
+		ErrorCount:                            v.counter(v.errorCount, l),
+		RunCount:                              v.counter(v.runCount, l),
+		RunDuration:                           v.gauge(v.runDuration, l),
+		MatchingResources:                     v.gauge(v.matchingResources, l),
+		GraceResources:                        v.gauge(v.graceResources, l),
+		EstimatedSeries:                       v.gauge(v.estimatedSeries, l),
+		SchedulerQueueDepth:                   v.gauge(v.schedulerQueueDepth, l),
+		SchedulerWaitSeconds:                  v.gauge(v.schedulerWaitSeconds, l),
+		GetResourcesCount:                     v.counter(v.getResourcesCount, l),
+		GetMetricDataCount:                    v.counter(v.getMetricDataCount, l),
+		DescribeAutoScalingGroupsCount:        v.counter(v.describeAutoScalingGroupsCount, l),
+		DescribeElasticacheCacheClustersCount: v.counter(v.describeElasticacheCacheClustersCount, l),
+		SelectResourceConfigCount:             v.counter(v.selectResourceConfigCount, l),
+		DescribeRegionsCount:                  v.counter(v.describeRegionsCount, l),
+		ListAccountAliasesCount:               v.counter(v.listAccountAliasesCount, l),
+		DescribeDBInstancesCount:              v.counter(v.describeDBInstancesCount, l),
+		ListNodesCount:                        v.counter(v.listNodesCount, l),
+		GetCallerIdentityCount:                v.counter(v.getCallerIdentityCount, l),
+		CredentialRefreshCount:                v.counter(v.credentialRefreshCount, l),
+		StoreDroppedSamplesCount:              v.counter(v.storeDroppedSamplesCount, l),
+		FilteredDimensionsCount:               v.counter(v.filteredDimensionsCount, l),
+		OrphanResultsCount:                    v.counter(v.orphanResultsCount, l),
+		IntervalOverrunsCount:                 v.counter(v.intervalOverrunsCount, l),
+		OverrideActive:                        v.gauge(v.overrideActive, l),
+		PanicsCount:                           v.counter(v.panicsCount, l),
+		HistoryBytes:                          v.gauge(v.historyBytes, l),
+		DemotedResources:                      v.gauge(v.demotedResources, l),
+		ProbationSavedQueries:                 v.gauge(v.probationSavedQueries, l),
+		DatapointsPerSeries:                   v.observer(v.datapointsPerSeries, l),
+		OutOfBoundsCount:                      v.counterVec(v.outOfBoundsCount, l),
+		ClassificationHitsCount:               v.counterVec(v.classificationHitsCount, l),
+		FamilyCollisionsCount:                 v.counterVec(v.familyCollisionsCount, l),
+		PhaseHealthy:                          v.gaugeVec(v.phaseHealthy, l),
+	}
 }
+
+// counter returns the counter of vec with labels l, or a no-op counter if vec
+// failed to register.
+func (v *telemetryVecs) counter(vec *prometheus.CounterVec, l prometheus.Labels) prometheus.Counter {
+	if _, ok := v.failed[vec]; ok {
+		return noopCounter{}
+	}
+
+	return vec.With(l)
+}
+
+// counterVec returns vec curried with labels l, or a no-op counter vector if
+// vec failed to register.
+func (v *telemetryVecs) counterVec(vec *prometheus.CounterVec, l prometheus.Labels) counterVec {
+	if _, ok := v.failed[vec]; ok {
+		return noopCounterVec{}
+	}
+
+	return vec.MustCurryWith(l)
+}
+
+// gaugeVec returns vec curried with labels l, or a no-op gauge vector if vec
+// failed to register.
+func (v *telemetryVecs) gaugeVec(vec *prometheus.GaugeVec, l prometheus.Labels) gaugeVec {
+	if _, ok := v.failed[vec]; ok {
+		return noopGaugeVec{}
+	}
+
+	return vec.MustCurryWith(l)
+}
+
+// gauge returns the gauge of vec with labels l, or a no-op gauge if vec failed
+// to register.
+func (v *telemetryVecs) gauge(vec *prometheus.GaugeVec, l prometheus.Labels) prometheus.Gauge {
+	if _, ok := v.failed[vec]; ok {
+		return noopGauge{}
+	}
+
+	return vec.With(l)
+}
+
+// observer returns the histogram of vec with labels l, or a no-op observer if
+// vec failed to register.
+func (v *telemetryVecs) observer(vec *prometheus.HistogramVec, l prometheus.Labels) prometheus.Observer {
+	if _, ok := v.failed[vec]; ok {
+		return noopObserver{}
+	}
+
+	return vec.With(l)
+}
+
+// registerTelemetry registers c with reg. Instead of panicking on failure, the
+// error is logged and the telemetry is flagged as degraded.
+func registerTelemetry(reg prometheus.Registerer, c prometheus.Collector) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Registering telemetry panicked: %v", r)
+		}
+		if err != nil {
+			Logger.Errorw("registering telemetry failed, metric will not be exposed", "error", err)
+			telemetryDegraded.Set(1)
+		}
+	}()
+
+	return reg.Register(c)
+}
+
+// noopCounter is a prometheus.Counter discarding all updates. It replaces
+// counters that failed to register.
+type noopCounter struct{}
+
+func (noopCounter) Desc() *prometheus.Desc           { return prometheus.NewInvalidDesc(nil) }
+func (noopCounter) Write(*dto.Metric) error          { return nil }
+func (noopCounter) Describe(chan<- *prometheus.Desc) {}
+func (noopCounter) Collect(chan<- prometheus.Metric) {}
+func (noopCounter) Inc()                             {}
+func (noopCounter) Add(float64)                      {}
+
+// noopCounterVec hands out no-op counters. It replaces counter vectors that
+// failed to register.
+type noopCounterVec struct{}
+
+func (noopCounterVec) WithLabelValues(...string) prometheus.Counter { return noopCounter{} }
+
+// noopGaugeVec hands out no-op gauges. It replaces gauge vectors that failed
+// to register.
+type noopGaugeVec struct{}
+
+func (noopGaugeVec) WithLabelValues(...string) prometheus.Gauge { return noopGauge{} }
+
+// noopGauge is a prometheus.Gauge discarding all updates. It replaces gauges
+// that failed to register.
+type noopGauge struct {
+	noopCounter
+}
+
+func (noopGauge) Set(float64)       {}
+func (noopGauge) Dec()              {}
+func (noopGauge) Sub(float64)       {}
+func (noopGauge) SetToCurrentTime() {}
+
+// noopObserver is a prometheus.Observer discarding all observations. It
+// replaces histograms that failed to register.
+type noopObserver struct{}
+
+func (noopObserver) Observe(float64) {}
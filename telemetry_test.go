@@ -0,0 +1,120 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectorTelemetryLabels(t *testing.T) {
+	collectorLabels := prometheus.Labels{
+		LabelCollectorID:   "8c3b0a4e-0000-0000-0000-000000000000",
+		LabelCollectorName: "volumes",
+		LabelCollectorType: "ebs",
+	}
+
+	cases := []struct {
+		labels   []string
+		expected map[string]string
+		message  string
+	}{
+		{
+			labels:   DefaultTelemetryLabels,
+			expected: collectorLabels,
+			message:  "Default labels should attach all collector labels",
+		},
+		{
+			labels: []string{LabelCollectorName, LabelCollectorType},
+			expected: map[string]string{
+				LabelCollectorName: "volumes",
+				LabelCollectorType: "ebs",
+			},
+			message: "Only configured labels should be attached",
+		},
+		{
+			labels:   []string{},
+			expected: map[string]string{},
+			message:  "No labels should be attached if none are configured",
+		},
+	}
+
+	for _, c := range cases {
+		reg := prometheus.NewRegistry()
+		vecs := newTelemetryVecs(c.labels)
+		vecs.register(reg)
+		vecs.collectorTelemetry(collectorLabels).RunCount.Inc()
+
+		families, err := reg.Gather()
+		assert.Nil(t, err, c.message)
+		for _, mf := range families {
+			if mf.GetName() != "promwatch_collector_runs_total" {
+				continue
+			}
+			got := map[string]string{}
+			for _, l := range mf.GetMetric()[0].GetLabel() {
+				got[l.GetName()] = l.GetValue()
+			}
+			assert.Equal(t, c.expected, got, c.message)
+		}
+	}
+}
+
+func TestCollectorTelemetryAttribution(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	vecs := newTelemetryVecs([]string{LabelCollectorName, LabelCollectorType})
+	vecs.register(reg)
+
+	first := vecs.collectorTelemetry(prometheus.Labels{LabelCollectorName: "first", LabelCollectorType: "ebs"})
+	second := vecs.collectorTelemetry(prometheus.Labels{LabelCollectorName: "second", LabelCollectorType: "ebs"})
+
+	first.ErrorCount.Inc()
+	first.ErrorCount.Inc()
+	second.ErrorCount.Inc()
+	second.MatchingResources.Set(42)
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(first.ErrorCount))
+	assert.Equal(t, 1.0, testutil.ToFloat64(second.ErrorCount))
+	assert.Equal(t, 0.0, testutil.ToFloat64(first.MatchingResources))
+	assert.Equal(t, 42.0, testutil.ToFloat64(second.MatchingResources))
+	assert.Equal(t, 2, testutil.CollectAndCount(vecs.errorCount), "Each collector should have its own series")
+}
+
+func TestCollectorTelemetryDegraded(t *testing.T) {
+	defer telemetryDegraded.Set(0)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(telemetryDegraded)
+	// Conflicts with promwatch_collector_runs_total of the telemetry vectors
+	reg.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promwatch_collector_runs_total",
+		Help: "Conflicting metric.",
+	}))
+
+	vecs := newTelemetryVecs(DefaultTelemetryLabels)
+	assert.NotPanics(t, func() { vecs.register(reg) }, "Failed registrations should not panic")
+
+	telemetry := vecs.collectorTelemetry(prometheus.Labels{})
+	assert.NotPanics(t, func() {
+		telemetry.RunCount.Inc()
+		telemetry.ErrorCount.Inc()
+	}, "Metrics failing to register should be safe to use")
+	assert.Equal(t, noopCounter{}, telemetry.RunCount, "Metrics failing to register should be replaced")
+	assert.Equal(t, 1.0, testutil.ToFloat64(telemetry.ErrorCount), "Registered metrics should still be recorded")
+	assert.Equal(t, 1.0, testutil.ToFloat64(telemetryDegraded), "Telemetry should be flagged as degraded")
+
+	store := NewStore(0)
+	store.Add("promwatch_aws_ebs_volume_idle_time_sum{volume_id=\"vol-1\"} 1.000000 1611929698000\n")
+	store.Commit()
+	procs := []*CollectorProc{{ID: "ebs", Store: store}}
+
+	rec := httptest.NewRecorder()
+	metricsHandler(procs, reg).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	assert.Contains(t, string(body), `promwatch_aws_ebs_volume_idle_time_sum{volume_id="vol-1"}`, "Data metrics should still be served")
+	assert.Contains(t, string(body), "promwatch_telemetry_degraded 1", "The degraded flag should be served")
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/configservice"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/kafka"
+	"github.com/aws/aws-sdk-go/service/rds"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// FakeCall records a call to the FakeClient.
+type FakeCall struct {
+	Method string
+	Input  interface{}
+}
+
+// FakeClient implements the Client interface with scripted responses for
+// testing. Every call of a method delivers the scripted pages of that method
+// one by one, incrementing the request counter for each page like the
+// AWSClient does. If an error is scripted for a method it is returned after
+// all pages were delivered alongside the partial results.
+//
+// GetMetricData delivers for each input only the results whose IDs are part
+// of the input's queries, the same way CloudWatch would. GetResources delivers
+// at most the pages of the page limit of the context, see withMaxPages.
+// DescribeRegions and GetCallerIdentity are not paged and return nothing in
+// case of an error.
+type FakeClient struct {
+	sync.Mutex
+
+	AutoScalingGroupPages   [][]*autoscaling.Group
+	CacheClusterPages       [][]*elasticache.CacheCluster
+	ResourceTagMappingPages [][]*tagging.ResourceTagMapping
+	MetricDataResultPages   [][]*cloudwatch.MetricDataResult
+	ConfigResultPages       [][]*string
+	AccountAliasPages       [][]*string
+	DBInstancePages         [][]*rds.DBInstance
+	NodeInfoPages           [][]*kafka.NodeInfo
+	// Regions is the single page of regions returned by DescribeRegions.
+	Regions []*ec2.Region
+	// Identity is returned by GetCallerIdentity.
+	Identity *sts.GetCallerIdentityOutput
+
+	// Errors maps method names to the error returned by that method.
+	Errors map[string]error
+	// Delay is the duration every call blocks before responding to
+	// simulate a slow API. The delay ignores the context, like a client
+	// not respecting cancellation.
+	Delay time.Duration
+
+	calls []FakeCall
+}
+
+// Calls returns all calls recorded by the FakeClient in order.
+func (f *FakeClient) Calls() []FakeCall {
+	f.Lock()
+	defer f.Unlock()
+
+	return append([]FakeCall{}, f.calls...)
+}
+
+func (f *FakeClient) record(ctx context.Context, method string, input interface{}) error {
+	f.Lock()
+	f.calls = append(f.calls, FakeCall{Method: method, Input: input})
+	err, delay := f.Errors[method], f.Delay
+	f.Unlock()
+
+	time.Sleep(delay)
+
+	if err != nil {
+		return &MethodError{Method: method, Err: err}
+	}
+
+	return nil
+}
+
+func (f *FakeClient) DescribeAutoScalingGroups(ctx context.Context, input *autoscaling.DescribeAutoScalingGroupsInput, tele *CollectorTelemetry) (*[]*autoscaling.Group, error) {
+	err := f.record(ctx, MethodDescribeAutoScalingGroups, input)
+	res := []*autoscaling.Group{}
+	for _, page := range f.AutoScalingGroupPages {
+		tele.DescribeAutoScalingGroupsCount.Inc()
+		res = append(res, page...)
+	}
+
+	return &res, err
+}
+
+func (f *FakeClient) DescribeCacheClusters(ctx context.Context, input *elasticache.DescribeCacheClustersInput, tele *CollectorTelemetry) (*[]*elasticache.CacheCluster, error) {
+	err := f.record(ctx, MethodDescribeCacheClusters, input)
+	res := []*elasticache.CacheCluster{}
+	for _, page := range f.CacheClusterPages {
+		tele.DescribeElasticacheCacheClustersCount.Inc()
+		res = append(res, page...)
+	}
+
+	return &res, err
+}
+
+func (f *FakeClient) GetResources(ctx context.Context, input *tagging.GetResourcesInput, tele *CollectorTelemetry) (*[]*tagging.ResourceTagMapping, error) {
+	err := f.record(ctx, MethodGetResources, input)
+	res := []*tagging.ResourceTagMapping{}
+	for i, page := range f.ResourceTagMappingPages {
+		if max := maxPages(ctx); max > 0 && i >= max {
+			break
+		}
+		tele.GetResourcesCount.Inc()
+		res = append(res, page...)
+	}
+
+	return &res, err
+}
+
+func (f *FakeClient) GetMetricData(ctx context.Context, in []*cloudwatch.GetMetricDataInput, tele *CollectorTelemetry) (*[]*cloudwatch.MetricDataResult, error) {
+	err := f.record(ctx, MethodGetMetricData, in)
+	res := []*cloudwatch.MetricDataResult{}
+	for _, input := range in {
+		ids := map[string]struct{}{}
+		for _, q := range input.MetricDataQueries {
+			ids[aws.StringValue(q.Id)] = struct{}{}
+		}
+
+		for _, page := range f.MetricDataResultPages {
+			tele.GetMetricDataCount.Inc()
+			for _, r := range page {
+				if _, ok := ids[aws.StringValue(r.Id)]; ok {
+					res = append(res, r)
+				}
+			}
+		}
+	}
+
+	return &res, err
+}
+
+func (f *FakeClient) ListConfigResources(ctx context.Context, input *configservice.SelectResourceConfigInput, tele *CollectorTelemetry) (*[]*string, error) {
+	err := f.record(ctx, MethodListConfigResources, input)
+	res := []*string{}
+	for _, page := range f.ConfigResultPages {
+		tele.SelectResourceConfigCount.Inc()
+		res = append(res, page...)
+	}
+
+	return &res, err
+}
+
+func (f *FakeClient) DescribeRegions(ctx context.Context, input *ec2.DescribeRegionsInput, tele *CollectorTelemetry) (*[]*ec2.Region, error) {
+	res := []*ec2.Region{}
+	if err := f.record(ctx, MethodDescribeRegions, input); err != nil {
+		return &res, err
+	}
+	tele.DescribeRegionsCount.Inc()
+	res = append(res, f.Regions...)
+
+	return &res, nil
+}
+
+func (f *FakeClient) ListAccountAliases(ctx context.Context, input *iam.ListAccountAliasesInput, tele *CollectorTelemetry) (*[]*string, error) {
+	err := f.record(ctx, MethodListAccountAliases, input)
+	res := []*string{}
+	for _, page := range f.AccountAliasPages {
+		tele.ListAccountAliasesCount.Inc()
+		res = append(res, page...)
+	}
+
+	return &res, err
+}
+
+func (f *FakeClient) DescribeDBInstances(ctx context.Context, input *rds.DescribeDBInstancesInput, tele *CollectorTelemetry) (*[]*rds.DBInstance, error) {
+	err := f.record(ctx, MethodDescribeDBInstances, input)
+	res := []*rds.DBInstance{}
+	for _, page := range f.DBInstancePages {
+		tele.DescribeDBInstancesCount.Inc()
+		res = append(res, page...)
+	}
+
+	return &res, err
+}
+
+func (f *FakeClient) ListNodes(ctx context.Context, input *kafka.ListNodesInput, tele *CollectorTelemetry) (*[]*kafka.NodeInfo, error) {
+	err := f.record(ctx, MethodListNodes, input)
+	res := []*kafka.NodeInfo{}
+	for _, page := range f.NodeInfoPages {
+		tele.ListNodesCount.Inc()
+		res = append(res, page...)
+	}
+
+	return &res, err
+}
+
+func (f *FakeClient) GetCallerIdentity(ctx context.Context, input *sts.GetCallerIdentityInput, tele *CollectorTelemetry) (*sts.GetCallerIdentityOutput, error) {
+	res := &sts.GetCallerIdentityOutput{}
+	if err := f.record(ctx, MethodGetCallerIdentity, input); err != nil {
+		return res, err
+	}
+	tele.GetCallerIdentityCount.Inc()
+	if f.Identity != nil {
+		res = f.Identity
+	}
+
+	return res, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// DefaultTextfileInterval is the default number of seconds between writes of
+// the textfile output.
+const DefaultTextfileInterval = 60
+
+// TextfileWriter periodically writes the metrics of all collector stores and
+// the PromWatch telemetry to a file to be picked up by the textfile collector
+// of the node_exporter.
+type TextfileWriter struct {
+	path     string
+	procs    []*CollectorProc
+	gatherer prometheus.Gatherer
+}
+
+// NewTextfileWriter returns a TextfileWriter writing to path.
+func NewTextfileWriter(path string, procs []*CollectorProc, gatherer prometheus.Gatherer) *TextfileWriter {
+	return &TextfileWriter{
+		path:     path,
+		procs:    procs,
+		gatherer: gatherer,
+	}
+}
+
+// Run writes the textfile every interval until stop is closed.
+func (w *TextfileWriter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Write(); err != nil {
+			Logger.Errorw("writing textfile failed", "path", w.path, "error", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Write atomically replaces the textfile with the current metrics. The content
+// is written to a temporary file in the same directory first which is then
+// renamed, so readers never see a partially written file.
+func (w *TextfileWriter) Write() error {
+	content, err := w.render()
+	if err != nil {
+		return err
+	}
+
+	// The temporary file does not end in .prom so it is ignored by the
+	// textfile collector until renamed.
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), "."+filepath.Base(w.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return replaceFile(tmp.Name(), w.path)
+}
+
+// render produces the textfile content. The textfile collector neither
+// supports timestamps nor multiple samples of the same series, so only the
+// latest sample of every series is kept and timestamps are dropped. Like on
+// /metrics, collectors exposed on their named path only are left out and
+// collectors exposed through the registry are gathered with the telemetry.
+func (w *TextfileWriter) render() ([]byte, error) {
+	buf := bytes.Buffer{}
+	declared := map[string]struct{}{}
+	for _, c := range w.procs {
+		if !c.inDefault() || c.inRegistry() {
+			continue
+		}
+		writeDeclared(&buf, c.Store.String(), declared)
+	}
+
+	parser := expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("Can not parse collector metrics: %w", err)
+	}
+
+	telemetry, err := w.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	for _, mf := range telemetry {
+		families[mf.GetName()] = mf
+	}
+
+	names := make([]string, 0, len(families))
+	for n := range families {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	out := bytes.Buffer{}
+	for _, n := range names {
+		mf := families[n]
+		mf.Metric = latestMetrics(mf.Metric)
+		if _, err := expfmt.MetricFamilyToText(&out, mf); err != nil {
+			return nil, err
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+// latestMetrics returns the metric with the latest timestamp of every label set
+// with the timestamp removed, ordered by labels.
+func latestMetrics(metrics []*dto.Metric) []*dto.Metric {
+	latest := map[string]*dto.Metric{}
+	keys := []string{}
+	for _, m := range metrics {
+		b := strings.Builder{}
+		for _, l := range m.GetLabel() {
+			fmt.Fprintf(&b, "%s\xff%s\xff", l.GetName(), l.GetValue())
+		}
+		key := b.String()
+
+		prev, ok := latest[key]
+		if !ok {
+			keys = append(keys, key)
+		}
+		if !ok || m.GetTimestampMs() >= prev.GetTimestampMs() {
+			latest[key] = m
+		}
+	}
+	sort.Strings(keys)
+
+	res := make([]*dto.Metric, 0, len(keys))
+	for _, k := range keys {
+		m := latest[k]
+		m.TimestampMs = nil
+		res = append(res, m)
+	}
+
+	return res
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTextfileWrite(t *testing.T) {
+	store := NewStore(0)
+	store.Add("promwatch_aws_ebs_volume_read_bytes_sum{arn=\"a\",volume_id=\"vol-a\"} 1.000000 1611929640000\n")
+	store.Add("promwatch_aws_ebs_volume_read_bytes_sum{arn=\"a\",volume_id=\"vol-a\"} 3.000000 1611929700000\n")
+	store.Add("promwatch_aws_ebs_volume_read_bytes_sum{arn=\"b\",volume_id=\"vol-b\"} 2.000000 1611929700000\n")
+	store.Commit()
+
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "promwatch_test_total", Help: "Test counter."})
+	reg.MustRegister(counter)
+	counter.Add(5)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "promwatch.prom")
+	assert.Nil(t, os.WriteFile(path, []byte("stale content\n"), 0o644))
+
+	w := NewTextfileWriter(path, []*CollectorProc{{ID: "test", Store: store}}, reg)
+	assert.Nil(t, w.Write())
+
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, `# TYPE promwatch_aws_ebs_volume_read_bytes_sum untyped
+promwatch_aws_ebs_volume_read_bytes_sum{arn="a",volume_id="vol-a"} 3
+promwatch_aws_ebs_volume_read_bytes_sum{arn="b",volume_id="vol-b"} 2
+# HELP promwatch_test_total Test counter.
+# TYPE promwatch_test_total counter
+promwatch_test_total 5
+`, string(content), "Only the latest sample of every series should be written without timestamps")
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0o644), info.Mode().Perm(), "Textfile should be readable by the textfile collector")
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries), "Temporary files should not be left behind")
+}
+
+func TestTextfileWriteFailure(t *testing.T) {
+	store := NewStore(0)
+	store.Add("invalid{\n")
+	store.Commit()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "promwatch.prom")
+	assert.Nil(t, os.WriteFile(path, []byte("previous\n"), 0o644))
+
+	w := NewTextfileWriter(path, []*CollectorProc{{ID: "test", Store: store}}, prometheus.NewRegistry())
+	assert.NotNil(t, w.Write())
+
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "previous\n", string(content), "A failed write should leave the previous file untouched")
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries), "Temporary files should not be left behind")
+}
@@ -0,0 +1,26 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidTLS = errors.New("Invalid TLS configuration")
+
+// validTLS returns an error unless both or none of the certificate and key
+// file are set and they hold a valid key pair.
+func validTLS(certFile, keyFile string) error {
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("%w: tls_cert_file and tls_key_file have to be set together", ErrInvalidTLS)
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidTLS, err)
+	}
+
+	return nil
+}
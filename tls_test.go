@@ -0,0 +1,61 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+// writeKeyPair writes a self-signed certificate and its key to dir and returns
+// their paths.
+func writeKeyPair(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0o600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600))
+
+	return certFile, keyFile
+}
+
+func TestConfigTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeKeyPair(t, dir)
+
+	var got PromWatchConfig
+	assert.Nil(t, yaml.Unmarshal([]byte("tls_cert_file: "+certFile+"\ntls_key_file: "+keyFile), &got))
+	assert.Equal(t, certFile, got.TLSCertFile)
+	assert.Equal(t, keyFile, got.TLSKeyFile)
+
+	cases := map[string]string{
+		"Missing key files should fail":        "tls_cert_file: " + certFile + "\ntls_key_file: " + filepath.Join(dir, "missing.pem"),
+		"Certificates without key should fail": "tls_cert_file: " + certFile,
+		"Mismatching key pairs should fail":    "tls_cert_file: " + certFile + "\ntls_key_file: " + certFile,
+	}
+	for message, config := range cases {
+		assert.ErrorIs(t, yaml.Unmarshal([]byte(config), &PromWatchConfig{}), ErrInvalidTLS, message)
+	}
+}
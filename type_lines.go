@@ -0,0 +1,83 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// typePrefix starts the TYPE line declaring a metric family in the text format.
+const typePrefix = "# TYPE "
+
+// sampleName returns the metric name of a line as written by appendSample.
+func sampleName(line []byte) []byte {
+	if i := bytes.IndexAny(line, "{ "); i >= 0 {
+		return line[:i]
+	}
+
+	return line
+}
+
+// declareFamilies returns content with a TYPE line declaring every family as
+// gauge before its first sample. Strict parsers and linters reject families
+// without TYPE line. Every family is declared once as a second TYPE line for the
+// same name fails the whole scrape.
+func declareFamilies(content []byte) []byte {
+	declared := map[string]struct{}{}
+	out := make([]byte, 0, len(content)+len(content)/8)
+	for len(content) > 0 {
+		line := content
+		if i := bytes.IndexByte(content, '\n'); i >= 0 {
+			line = content[:i+1]
+		}
+		content = content[len(line):]
+
+		if line[0] != '#' {
+			name := sampleName(line)
+			if _, ok := declared[string(name)]; !ok {
+				declared[string(name)] = struct{}{}
+				out = append(out, typePrefix...)
+				out = append(out, name...)
+				out = append(out, " gauge\n"...)
+			}
+		}
+		out = append(out, line...)
+	}
+
+	return out
+}
+
+// writeDeclared writes content to w leaving out the TYPE lines of families in
+// declared and adds the families content declares to declared. It joins the
+// content of multiple stores, e.g. of collectors of the same type in different
+// regions, without declaring a family twice. The samples of a family are not
+// necessarily grouped then, which the text format parsers of Prometheus accept.
+func writeDeclared(w io.Writer, content string, declared map[string]struct{}) {
+	written := 0
+	for off := 0; ; {
+		i := strings.Index(content[off:], typePrefix)
+		if i < 0 {
+			break
+		}
+		i += off
+		end := len(content)
+		if j := strings.IndexByte(content[i:], '\n'); j >= 0 {
+			end = i + j + 1
+		}
+		off = end
+		// Label values have their newlines escaped, so a TYPE line can
+		// only be found at the start of a line.
+		if i > 0 && content[i-1] != '\n' {
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimSuffix(content[i+len(typePrefix):end], "\n"), " ")
+		if _, ok := declared[name]; !ok {
+			declared[name] = struct{}{}
+			continue
+		}
+		_, _ = io.WriteString(w, content[written:i])
+		written = end
+	}
+	_, _ = io.WriteString(w, content[written:])
+}
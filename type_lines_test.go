@@ -0,0 +1,86 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeclareFamilies(t *testing.T) {
+	content := "a{x=\"1\"} 1.000000 1000\nb 2.000000 1000\na{x=\"2\"} 3.000000 1000\n"
+	assert.Equal(t,
+		"# TYPE a gauge\na{x=\"1\"} 1.000000 1000\n# TYPE b gauge\nb 2.000000 1000\na{x=\"2\"} 3.000000 1000\n",
+		string(declareFamilies([]byte(content))), "Every family should be declared once before its first sample")
+	assert.Empty(t, declareFamilies(nil))
+}
+
+func TestWriteDeclared(t *testing.T) {
+	declared := map[string]struct{}{}
+	b := strings.Builder{}
+	writeDeclared(&b, "# TYPE a gauge\na{x=\"1\"} 1\n# TYPE b gauge\nb{x=\"# TYPE a gauge\"} 1\n", declared)
+	writeDeclared(&b, "# TYPE a gauge\na{x=\"2\"} 2\n# TYPE c gauge\nc 3\n", declared)
+	assert.Equal(t,
+		"# TYPE a gauge\na{x=\"1\"} 1\n# TYPE b gauge\nb{x=\"# TYPE a gauge\"} 1\na{x=\"2\"} 2\n# TYPE c gauge\nc 3\n",
+		b.String(), "Families should only be declared by the first content declaring them")
+}
+
+func TestStoreResultsTypeLines(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	procs := map[CollectorID]*CollectorProc{}
+	for _, region := range []string{"us-east-1", "us-west-2"} {
+		b := stripInterface(CollectorFromConfig(CollectorConfig{
+			Type:   "ebs",
+			Region: region,
+			MetricStats: []MetricStat{
+				{MetricName: "VolumeReadBytes", Stat: "Sum"},
+				{MetricName: "VolumeWriteBytes", Stat: "Sum"},
+			},
+		}))
+		b.store = NewStore(0)
+		resources := []*tagging.ResourceTagMapping{
+			{ResourceARN: aws.String("arn:aws:ec2:" + region + ":000000000000:volume/vol-a")},
+			{ResourceARN: aws.String("arn:aws:ec2:" + region + ":000000000000:volume/vol-b")},
+		}
+		index := NewResourceIndexFromTagMapping(&resources, id)
+		b.makeQueries(index, b.namespace, b.metricDimensions())
+		results := []*cloudwatch.MetricDataResult{}
+		for _, queries := range index.Queries {
+			for _, q := range queries {
+				results = append(results, &cloudwatch.MetricDataResult{
+					Id:         q.Id,
+					Values:     []*float64{aws.Float64(1)},
+					Timestamps: []*time.Time{aws.Time(now)},
+				})
+			}
+		}
+		index.AddResults(&results)
+		b.storeResults(index)
+		procs[b.ID()] = &CollectorProc{ID: b.ID(), Store: b.store}
+	}
+
+	rec := serve(metricsHandler(sortedProcs(procs), prometheus.NewRegistry()), "", false)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Equal(t, 1, strings.Count(body, "# TYPE promwatch_aws_ebs_volume_read_bytes_sum gauge\n"),
+		"Families of several collectors should be declared once per scrape")
+
+	parser := expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(strings.NewReader(body))
+	assert.Nil(t, err)
+	for _, name := range []string{"promwatch_aws_ebs_volume_read_bytes_sum", "promwatch_aws_ebs_volume_write_bytes_sum"} {
+		if assert.Contains(t, families, name) {
+			assert.Equal(t, dto.MetricType_GAUGE, families[name].GetType())
+			assert.Len(t, families[name].Metric, 4)
+		}
+	}
+}
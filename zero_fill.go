@@ -0,0 +1,95 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// MaxZeroFillPoints is the maximum number of timestamps zero filled per query,
+// only the latest are filled for windows with more periods.
+const MaxZeroFillPoints = 1440
+
+// queryWindow is the time window a query was requested for.
+type queryWindow struct {
+	start time.Time
+	end   time.Time
+}
+
+// setZeroFillWindows records the windows of the zero filled queries of index
+// as requested by in.
+func (i *ResourceIndex) setZeroFillWindows(in []*cloudwatch.GetMetricDataInput) {
+	for _, input := range in {
+		for _, q := range input.MetricDataQueries {
+			if _, ok := i.ZeroFill[*q.Id]; ok {
+				i.ZeroFill[*q.Id] = queryWindow{
+					start: aws.TimeValue(input.StartTime),
+					end:   aws.TimeValue(input.EndTime),
+				}
+			}
+		}
+	}
+}
+
+// timestamps returns the timestamps CloudWatch returns datapoints at for the
+// window in milliseconds, ascending. Like CloudWatch does for start times less
+// than 15 days ago, the start is rounded down to the whole minute and
+// datapoints are every period from there until before the end.
+func (w queryWindow) timestamps(period time.Duration) []int64 {
+	if period <= 0 {
+		return nil
+	}
+
+	start := w.start.Truncate(time.Minute)
+	n := int(w.end.Sub(start) / period)
+	if w.end.Sub(start)%period != 0 {
+		n++
+	}
+	skip := 0
+	if n > MaxZeroFillPoints {
+		skip = n - MaxZeroFillPoints
+	}
+
+	ts := make([]int64, 0, n-skip)
+	for k := skip; k < n; k++ {
+		ts = append(ts, start.Add(time.Duration(k)*period).UnixMilli())
+	}
+
+	return ts
+}
+
+// zeroFill returns a copy of res with a zero value at every timestamp of the
+// window res has no value for, ordered by timestamp ascending. res may be nil
+// for queries without result.
+func (w queryWindow) zeroFill(query *cloudwatch.MetricDataQuery, res *cloudwatch.MetricDataResult) *cloudwatch.MetricDataResult {
+	filled := &cloudwatch.MetricDataResult{Id: query.Id}
+	values, timestamps := []*float64{}, []*time.Time{}
+	if res != nil {
+		values, timestamps = res.Values, res.Timestamps
+	}
+
+	seen := make(map[int64]struct{}, len(timestamps))
+	for _, t := range timestamps {
+		seen[t.UnixMilli()] = struct{}{}
+	}
+
+	period := time.Duration(aws.Int64Value(query.MetricStat.Period)) * time.Second
+	i := 0
+	for _, ts := range w.timestamps(period) {
+		// Values are ascending as requested with TimestampAscending.
+		for ; i < len(timestamps) && timestamps[i].UnixMilli() < ts; i++ {
+			filled.Values = append(filled.Values, values[i])
+			filled.Timestamps = append(filled.Timestamps, timestamps[i])
+		}
+		if _, ok := seen[ts]; !ok {
+			filled.Values = append(filled.Values, aws.Float64(0))
+			filled.Timestamps = append(filled.Timestamps, aws.Time(time.UnixMilli(ts).UTC()))
+		}
+	}
+	filled.Values = append(filled.Values, values[i:]...)
+	filled.Timestamps = append(filled.Timestamps, timestamps[i:]...)
+
+	return filled
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 CrowdStrike, Inc.
+package main
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	tagging "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryWindowTimestamps(t *testing.T) {
+	start := time.Date(2021, 1, 1, 10, 0, 30, 0, time.UTC)
+	w := queryWindow{start: start, end: start.Add(15 * time.Minute)}
+
+	got := []string{}
+	for _, ts := range w.timestamps(5 * time.Minute) {
+		got = append(got, time.UnixMilli(ts).UTC().Format("15:04:05"))
+	}
+	assert.Equal(t, []string{"10:00:00", "10:05:00", "10:10:00", "10:15:00"}, got,
+		"Timestamps should start at the start rounded down to the minute and step by period until before the end")
+
+	aligned := queryWindow{start: start.Truncate(time.Hour), end: start.Truncate(time.Hour).Add(2 * time.Hour)}
+	assert.Len(t, aligned.timestamps(time.Hour), 2, "Aligned windows should have one timestamp per period")
+
+	long := queryWindow{start: start, end: start.Add(48 * time.Hour)}
+	ts := long.timestamps(time.Minute)
+	assert.Len(t, ts, MaxZeroFillPoints, "Timestamps should be capped")
+	assert.Equal(t, start.Truncate(time.Minute).Add(48*time.Hour).UnixMilli(), ts[len(ts)-1], "The latest timestamps should be kept")
+
+	assert.Empty(t, w.timestamps(0))
+}
+
+func TestZeroFill(t *testing.T) {
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	w := queryWindow{start: start, end: start.Add(15 * time.Minute)}
+	query := &cloudwatch.MetricDataQuery{
+		Id:         aws.String("id_a_0"),
+		MetricStat: &cloudwatch.MetricStat{Period: aws.Int64(300)},
+	}
+	format := func(res *cloudwatch.MetricDataResult) []string {
+		got := []string{}
+		for i, v := range res.Values {
+			got = append(got, res.Timestamps[i].Format("15:04")+"="+strconv.FormatFloat(*v, 'f', -1, 64))
+		}
+		return got
+	}
+
+	assert.Equal(t, []string{"10:00=0", "10:05=0", "10:10=0"}, format(w.zeroFill(query, nil)),
+		"Queries without result should be zero filled across the window")
+
+	partial := &cloudwatch.MetricDataResult{
+		Id:         query.Id,
+		Values:     []*float64{aws.Float64(3)},
+		Timestamps: []*time.Time{aws.Time(start.Add(5 * time.Minute))},
+	}
+	assert.Equal(t, []string{"10:00=0", "10:05=3", "10:10=0"}, format(w.zeroFill(query, partial)),
+		"Gaps should be filled in timestamp order")
+	assert.Len(t, partial.Values, 1, "Results should not be modified")
+
+	full := &cloudwatch.MetricDataResult{
+		Id:         query.Id,
+		Values:     []*float64{aws.Float64(1), aws.Float64(2), aws.Float64(3)},
+		Timestamps: []*time.Time{aws.Time(start), aws.Time(start.Add(5 * time.Minute)), aws.Time(start.Add(10 * time.Minute))},
+	}
+	assert.Equal(t, []string{"10:00=1", "10:05=2", "10:10=3"}, format(w.zeroFill(query, full)),
+		"Complete results should be unchanged")
+}
+
+func TestStoreResultsZeroFill(t *testing.T) {
+	now := time.Date(2021, 1, 1, 10, 20, 0, 0, time.UTC)
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:     "sqs",
+		Offset:   300,
+		Interval: 900,
+		Period:   300,
+		MetricStats: []MetricStat{
+			{MetricName: "NumberOfMessagesSent", Stat: "Sum", ZeroFill: true},
+			{MetricName: "ApproximateAgeOfOldestMessage", Stat: "Maximum"},
+		},
+	}))
+	b.store = NewStore(0)
+	b.withTime(&testTime{now: &now})
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:sqs:us-east-1:000000000000:busy")},
+		{ResourceARN: aws.String("arn:aws:sqs:us-east-1:000000000000:idle")},
+	}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+	dim := defaultMetricDimension(b.dimension, b.resourcePrefix)
+	index.setZeroFillWindows(b.getMetricDataInput(index, dim))
+
+	results := []*cloudwatch.MetricDataResult{}
+	for _, queries := range index.Queries {
+		for _, q := range queries {
+			if aws.StringValue(q.MetricStat.Metric.Dimensions[0].Value) != "busy" {
+				continue
+			}
+			results = append(results, &cloudwatch.MetricDataResult{
+				Id:         q.Id,
+				Values:     []*float64{aws.Float64(7)},
+				Timestamps: []*time.Time{aws.Time(time.Date(2021, 1, 1, 10, 5, 0, 0, time.UTC))},
+			})
+		}
+	}
+	index.AddResults(&results)
+	b.storeResults(index)
+
+	lines := strings.Split(strings.TrimSuffix(storeSamples(b.store), "\n"), "\n")
+	sort.Strings(lines)
+	assert.Equal(t, []string{
+		`promwatch_aws_sqs_approximate_age_of_oldest_message_maximum{arn="arn:aws:sqs:us-east-1:000000000000:busy",queue_name="busy"} 7.000000 1609495500000`,
+		`promwatch_aws_sqs_number_of_messages_sent_sum{arn="arn:aws:sqs:us-east-1:000000000000:busy",queue_name="busy"} 0.000000 1609495200000`,
+		`promwatch_aws_sqs_number_of_messages_sent_sum{arn="arn:aws:sqs:us-east-1:000000000000:busy",queue_name="busy"} 0.000000 1609495800000`,
+		`promwatch_aws_sqs_number_of_messages_sent_sum{arn="arn:aws:sqs:us-east-1:000000000000:busy",queue_name="busy"} 7.000000 1609495500000`,
+		`promwatch_aws_sqs_number_of_messages_sent_sum{arn="arn:aws:sqs:us-east-1:000000000000:idle",queue_name="idle"} 0.000000 1609495200000`,
+		`promwatch_aws_sqs_number_of_messages_sent_sum{arn="arn:aws:sqs:us-east-1:000000000000:idle",queue_name="idle"} 0.000000 1609495500000`,
+		`promwatch_aws_sqs_number_of_messages_sent_sum{arn="arn:aws:sqs:us-east-1:000000000000:idle",queue_name="idle"} 0.000000 1609495800000`,
+	}, lines, "Zero filled stats should have a value at every period of the window, other stats only their datapoints")
+}
+
+func TestZeroFillQueryFailure(t *testing.T) {
+	b := stripInterface(CollectorFromConfig(CollectorConfig{
+		Type:        "sqs",
+		Interval:    900,
+		Period:      300,
+		MetricStats: []MetricStat{{MetricName: "NumberOfMessagesSent", Stat: "Sum", ZeroFill: true}},
+	}))
+	b._client = &FakeClient{Errors: map[string]error{MethodGetMetricData: errAccessDenied}}
+	b.store = NewStore(0)
+	resources := []*tagging.ResourceTagMapping{
+		{ResourceARN: aws.String("arn:aws:sqs:us-east-1:000000000000:idle")},
+	}
+	index := NewResourceIndexFromTagMapping(&resources, id)
+
+	b.getMetrics(context.Background(), index, defaultMetricDimension(b.dimension, b.resourcePrefix))
+	assert.Empty(t, index.ZeroFill, "Results missing due to failed queries should not be zero filled")
+}